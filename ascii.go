@@ -0,0 +1,680 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ASCII码帧与二进制帧的转换. 两种格式的字段顺序相同, 只是编码不同:
+// 数值以大端十六进制字符表示, 软元件为2字符名称加6字符编号, 位单位的数据每点1字符.
+// 请求体的结构由指令决定, 响应体的结构还需要对应的请求.
+
+var errShortFrame = errors.New("short frame")
+
+// fieldReader 按字段读取请求体或响应体.
+type fieldReader interface {
+	u8() int
+	u16() int
+	u32() uint32
+	device() (DeviceInfo, uint32)
+	bits(n int) []bool
+	raw(n int) []byte
+	rest() []byte
+	err() error
+}
+
+// fieldWriter 按字段写入请求体或响应体.
+type fieldWriter interface {
+	u8(v int)
+	u16(v int)
+	u32(v uint32)
+	device(info DeviceInfo, no uint32)
+	bits(v []bool)
+	raw(v []byte)
+	bytes() []byte
+}
+
+type binReader struct {
+	b []byte
+	e error
+}
+
+func (r *binReader) next(n int) []byte {
+	if r.e == nil && len(r.b) < n {
+		r.e = errShortFrame
+	}
+
+	if r.e != nil {
+		return make([]byte, n)
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b
+}
+
+func (r *binReader) u8() int {
+	return int(r.next(1)[0])
+}
+
+func (r *binReader) u16() int {
+	return int(binary.LittleEndian.Uint16(r.next(2)))
+}
+
+func (r *binReader) u32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *binReader) device() (DeviceInfo, uint32) {
+	b := r.next(4)
+
+	info, ok := LookupDeviceCode(b[3])
+	if !ok && r.e == nil {
+		r.e = fmt.Errorf("unknown device code %#02x", b[3])
+	}
+
+	return info, uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// bits 每字节2点, 高4位为前一点.
+func (r *binReader) bits(n int) []bool {
+	b := r.next((n + 1) / 2)
+	re := make([]bool, n)
+
+	for i := range re {
+		if i%2 == 0 {
+			re[i] = b[i/2]&0xF0 != 0
+		} else {
+			re[i] = b[i/2]&0x0F != 0
+		}
+	}
+
+	return re
+}
+
+func (r *binReader) raw(n int) []byte {
+	return r.next(n)
+}
+
+func (r *binReader) rest() []byte {
+	b := r.b
+	r.b = nil
+
+	return b
+}
+
+func (r *binReader) err() error {
+	return r.e
+}
+
+type binWriter struct {
+	b []byte
+}
+
+func (w *binWriter) u8(v int) {
+	w.b = append(w.b, byte(v))
+}
+
+func (w *binWriter) u16(v int) {
+	w.b = append(w.b, byte(v), byte(v>>8))
+}
+
+func (w *binWriter) u32(v uint32) {
+	w.b = append(w.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (w *binWriter) device(info DeviceInfo, no uint32) {
+	w.b = append(w.b, byte(no), byte(no>>8), byte(no>>16), info.Code)
+}
+
+func (w *binWriter) bits(v []bool) {
+	b := make([]byte, (len(v)+1)/2)
+
+	for i, on := range v {
+		switch {
+		case !on:
+		case i%2 == 0:
+			b[i/2] |= 0x10
+		default:
+			b[i/2] |= 0x01
+		}
+	}
+
+	w.b = append(w.b, b...)
+}
+
+func (w *binWriter) raw(v []byte) {
+	w.b = append(w.b, v...)
+}
+
+func (w *binWriter) bytes() []byte {
+	return w.b
+}
+
+// asciiNames 与软元件名称不同的ASCII码软元件名称.
+var asciiNames = map[string]string{"STS": "SS", "STC": "SC", "STN": "SN"}
+
+// asciiDeviceName 返回软元件的2字符ASCII码名称.
+func asciiDeviceName(info DeviceInfo) string {
+	if name, ok := asciiNames[info.Name]; ok {
+		return name
+	}
+
+	if len(info.Name) == 1 {
+		return info.Name + "*"
+	}
+
+	return info.Name
+}
+
+func lookupASCIIDevice(name string) (DeviceInfo, bool) {
+	name = strings.TrimSuffix(strings.ToUpper(name), "*")
+
+	for full, short := range asciiNames {
+		if name == short {
+			return LookupDevice(full)
+		}
+	}
+
+	return LookupDevice(name)
+}
+
+type asciiReader struct {
+	b []byte
+	e error
+}
+
+func (r *asciiReader) next(n int) string {
+	if r.e == nil && len(r.b) < n {
+		r.e = errShortFrame
+	}
+
+	if r.e != nil {
+		return strings.Repeat("0", n)
+	}
+
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+
+	return s
+}
+
+func (r *asciiReader) hex(n int) uint64 {
+	s := r.next(n)
+
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil && r.e == nil {
+		r.e = fmt.Errorf("invalid hex field %q", s)
+	}
+
+	return v
+}
+
+func (r *asciiReader) u8() int {
+	return int(r.hex(2))
+}
+
+func (r *asciiReader) u16() int {
+	return int(r.hex(4))
+}
+
+func (r *asciiReader) u32() uint32 {
+	return uint32(r.hex(8))
+}
+
+func (r *asciiReader) device() (DeviceInfo, uint32) {
+	name := r.next(2)
+
+	info, ok := lookupASCIIDevice(name)
+	if !ok {
+		if r.e == nil {
+			r.e = fmt.Errorf("unknown device %q", name)
+		}
+
+		return info, 0
+	}
+
+	s := r.next(6)
+
+	no, err := strconv.ParseUint(s, info.Base, 32)
+	if err != nil && r.e == nil {
+		r.e = fmt.Errorf("invalid device number %q", s)
+	}
+
+	return info, uint32(no)
+}
+
+func (r *asciiReader) bits(n int) []bool {
+	s := r.next(n)
+	re := make([]bool, n)
+
+	for i := range re {
+		re[i] = s[i] != '0'
+	}
+
+	return re
+}
+
+func (r *asciiReader) raw(n int) []byte {
+	return []byte(r.next(n))
+}
+
+func (r *asciiReader) rest() []byte {
+	b := r.b
+	r.b = nil
+
+	return b
+}
+
+func (r *asciiReader) err() error {
+	return r.e
+}
+
+type asciiWriter struct {
+	b []byte
+}
+
+func (w *asciiWriter) hex(v uint64, n int) {
+	s := strings.ToUpper(strconv.FormatUint(v, 16))
+	w.b = append(w.b, strings.Repeat("0", n-len(s))+s...)
+}
+
+func (w *asciiWriter) u8(v int) {
+	w.hex(uint64(v), 2)
+}
+
+func (w *asciiWriter) u16(v int) {
+	w.hex(uint64(v), 4)
+}
+
+func (w *asciiWriter) u32(v uint32) {
+	w.hex(uint64(v), 8)
+}
+
+func (w *asciiWriter) device(info DeviceInfo, no uint32) {
+	s := strings.ToUpper(strconv.FormatUint(uint64(no), info.Base))
+	w.b = append(w.b, asciiDeviceName(info)+strings.Repeat("0", 6-len(s))+s...)
+}
+
+func (w *asciiWriter) bits(v []bool) {
+	for _, on := range v {
+		if on {
+			w.b = append(w.b, '1')
+		} else {
+			w.b = append(w.b, '0')
+		}
+	}
+}
+
+func (w *asciiWriter) raw(v []byte) {
+	w.b = append(w.b, v...)
+}
+
+func (w *asciiWriter) bytes() []byte {
+	return w.b
+}
+
+// pipe 从r读取字段并原样写入w.
+type pipe struct {
+	r fieldReader
+	w fieldWriter
+}
+
+func (p pipe) u8() int {
+	v := p.r.u8()
+	p.w.u8(v)
+
+	return v
+}
+
+func (p pipe) u16() int {
+	v := p.r.u16()
+	p.w.u16(v)
+
+	return v
+}
+
+func (p pipe) u32() {
+	p.w.u32(p.r.u32())
+}
+
+func (p pipe) device() DeviceInfo {
+	info, no := p.r.device()
+	p.w.device(info, no)
+
+	return info
+}
+
+func (p pipe) bits(n int) {
+	p.w.bits(p.r.bits(n))
+}
+
+func (p pipe) raw(n int) {
+	p.w.raw(p.r.raw(n))
+}
+
+// words 复制n个字.
+func (p pipe) words(n int) {
+	for i := 0; i < n && p.r.err() == nil; i++ {
+		p.u16()
+	}
+}
+
+// request 按指令复制请求体. 不认识的指令按字节复制.
+func (p pipe) request(cmd, sub uint16) {
+	switch cmd {
+	case 0x0401:
+		p.device()
+		p.u16()
+	case 0x1401:
+		p.device()
+		n := p.u16()
+
+		if sub&0x01 == 1 {
+			p.bits(n)
+		} else {
+			p.words(n)
+		}
+	case 0x0403:
+		w, d := p.u8(), p.u8()
+
+		for i := 0; i < w+d; i++ {
+			p.device()
+		}
+	case 0x1402:
+		if sub&0x01 == 1 {
+			for i, n := 0, p.u8(); i < n && p.r.err() == nil; i++ {
+				p.device()
+				p.u8()
+			}
+
+			return
+		}
+
+		w, d := p.u8(), p.u8()
+
+		for i := 0; i < w && p.r.err() == nil; i++ {
+			p.device()
+			p.u16()
+		}
+
+		for i := 0; i < d && p.r.err() == nil; i++ {
+			p.device()
+			p.u32()
+		}
+	case 0x0406, 0x1406:
+		w, b := p.u8(), p.u8()
+		counts := make([]int, 0, w+b)
+
+		for i := 0; i < w+b && p.r.err() == nil; i++ {
+			p.device()
+			counts = append(counts, p.u16())
+
+			if cmd == 0x1406 {
+				p.words(counts[i])
+			}
+		}
+	case 0x0619:
+		p.raw(p.u16())
+	case 0x1001:
+		p.u16()
+		p.u8()
+		p.u8()
+	case 0x1002, 0x1003, 0x1005, 0x1006:
+		p.u16()
+	default:
+		for p.r.err() == nil {
+			b := p.r.rest()
+			if len(b) == 0 {
+				return
+			}
+
+			p.w.raw(b)
+		}
+	}
+}
+
+// response 按请求复制响应数据, req为二进制请求体.
+func (p pipe) response(cmd, sub uint16, req []byte) {
+	r := &binReader{b: req}
+
+	switch cmd {
+	case 0x0401:
+		r.device()
+		n := r.u16()
+
+		if sub&0x01 == 1 {
+			p.bits(n)
+		} else {
+			p.words(n)
+		}
+	case 0x0403:
+		w, d := r.u8(), r.u8()
+		p.words(w)
+
+		for i := 0; i < d; i++ {
+			p.u32()
+		}
+	case 0x0406:
+		w, b := r.u8(), r.u8()
+		total := 0
+
+		for i := 0; i < w+b; i++ {
+			r.device()
+			total += r.u16()
+		}
+
+		p.words(total)
+	case 0x0101:
+		p.raw(16)
+		p.u16()
+	case 0x0619:
+		p.raw(p.u16())
+	default:
+		p.w.raw(p.r.rest())
+	}
+}
+
+// frameHeader 帧头部中的数值字段.
+type frameHeader struct {
+	frame    Frame
+	response bool
+	serial   uint16
+	network  int
+	pc       int
+	io       int
+	station  int
+	length   int
+	code     int // 请求为监视定时器, 响应为结束代码
+}
+
+// readHeader 读取帧头部至监视定时器或结束代码为止.
+func readHeader(r fieldReader) (frameHeader, error) {
+	var h frameHeader
+
+	sub := r.u16()
+
+	switch sub {
+	case 0x5000, 0x0050:
+	case 0x5400, 0x0054:
+		h.frame = Frame4E
+	case 0xD000, 0x00D0:
+		h.response = true
+	case 0xD400, 0x00D4:
+		h.frame, h.response = Frame4E, true
+	default:
+		if r.err() != nil {
+			return h, r.err()
+		}
+
+		return h, fmt.Errorf("unknown subheader %04x", sub)
+	}
+
+	if h.frame == Frame4E {
+		h.serial = uint16(r.u16())
+		r.u16()
+	}
+
+	h.network, h.pc, h.io, h.station = r.u8(), r.u8(), r.u16(), r.u8()
+	h.length = r.u16()
+	h.code = r.u16()
+
+	return h, r.err()
+}
+
+func writeHeader(w fieldWriter, h frameHeader, ascii bool) {
+	sub := 0x50
+	if h.response {
+		sub = 0xD0
+	}
+
+	if h.frame == Frame4E {
+		sub |= 0x04
+	}
+
+	// 二进制副帧头按字节顺序为50 00, ASCII码为"5000"
+	if ascii {
+		w.u16(sub << 8)
+	} else {
+		w.u16(sub)
+	}
+
+	if h.frame == Frame4E {
+		w.u16(int(h.serial))
+		w.u16(0)
+	}
+
+	w.u8(h.network)
+	w.u8(h.pc)
+	w.u16(h.io)
+	w.u8(h.station)
+	w.u16(h.length)
+	w.u16(h.code)
+}
+
+// isASCIIFrame 判断帧是否为ASCII码格式.
+func isASCIIFrame(b []byte) bool {
+	return len(b) >= 4 && (string(b[:2]) == "50" || string(b[:2]) == "54" || string(b[:2]) == "D0" || string(b[:2]) == "D4")
+}
+
+func newFieldReader(b []byte, ascii bool) fieldReader {
+	if ascii {
+		return &asciiReader{b: b}
+	}
+
+	return &binReader{b: b}
+}
+
+func newFieldWriter(ascii bool) fieldWriter {
+	if ascii {
+		return &asciiWriter{}
+	}
+
+	return &binWriter{}
+}
+
+// TranscodeRequest 在二进制与ASCII码之间转换请求帧, toASCII为转换方向.
+// 用于在服务器或代理中以二进制格式处理ASCII码请求.
+func TranscodeRequest(b []byte, toASCII bool) ([]byte, error) {
+	return transcodeRequest(b, toASCII)
+}
+
+// TranscodeResponse 在二进制与ASCII码之间转换响应帧, req为对应的二进制请求帧.
+func TranscodeResponse(b []byte, req []byte, toASCII bool) ([]byte, error) {
+	return transcodeResponse(b, req, toASCII)
+}
+
+// transcodeRequest 在二进制与ASCII码之间转换请求帧, toASCII为转换方向.
+func transcodeRequest(b []byte, toASCII bool) ([]byte, error) {
+	r := newFieldReader(b, !toASCII)
+
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.response {
+		return nil, errors.New("not a request frame")
+	}
+
+	cmd, sub := r.u16(), r.u16()
+
+	body := newFieldWriter(toASCII)
+	pipe{r: r, w: body}.request(uint16(cmd), uint16(sub))
+
+	if r.err() != nil {
+		return nil, fmt.Errorf("request %04x/%04x: %w", cmd, sub, r.err())
+	}
+
+	h.length = fieldWidth(toASCII, 6) + len(body.bytes())
+
+	w := newFieldWriter(toASCII)
+	writeHeader(w, h, toASCII)
+	w.u16(cmd)
+	w.u16(sub)
+	w.raw(body.bytes())
+
+	return w.bytes(), nil
+}
+
+// fieldWidth 返回n字节数值字段的编码长度.
+func fieldWidth(ascii bool, n int) int {
+	if ascii {
+		return n * 2
+	}
+
+	return n
+}
+
+// transcodeResponse 在二进制与ASCII码之间转换响应帧, req为对应的二进制请求帧.
+func transcodeResponse(b []byte, req []byte, toASCII bool) ([]byte, error) {
+	r := newFieldReader(b, !toASCII)
+
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !h.response {
+		return nil, errors.New("not a response frame")
+	}
+
+	body := newFieldWriter(toASCII)
+	p := pipe{r: r, w: body}
+
+	if h.code != 0 {
+		// 错误信息: 访问路径 + 指令 + 子指令
+		p.u8()
+		p.u8()
+		p.u16()
+		p.u8()
+		p.u16()
+		p.u16()
+	} else {
+		rr := &binReader{b: req}
+
+		rh, err := readHeader(rr)
+		if err != nil || rh.response {
+			return nil, fmt.Errorf("invalid request for response: %v", err)
+		}
+
+		cmd, sub := rr.u16(), rr.u16()
+		p.response(uint16(cmd), uint16(sub), rr.rest())
+	}
+
+	if r.err() != nil {
+		return nil, r.err()
+	}
+
+	h.length = len(body.bytes()) + fieldWidth(toASCII, 2)
+
+	w := newFieldWriter(toASCII)
+	writeHeader(w, h, toASCII)
+	w.raw(body.bytes())
+
+	return w.bytes(), nil
+}
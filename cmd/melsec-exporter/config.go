@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/internal/plcconf"
+	"gopkg.in/yaml.v3"
+)
+
+// config 导出器的配置文件.
+//
+//	listen: ":9716"
+//	targets:
+//	  - name: line1
+//	    addr: 192.168.0.10:5007
+//	    frame: 4E
+//	    labels: {site: plant1}
+//	    tags_file: line1-tags.yaml
+//	    tags:
+//	      - name: speed
+//	        address: D100
+//	        type: int16
+//	        scale: 0.1
+//	        labels: {unit: rpm}
+type config struct {
+	Listen  string         `yaml:"listen"`
+	Targets []targetConfig `yaml:"targets"`
+}
+
+// targetConfig 一台PLC的连接参数与标签.
+type targetConfig struct {
+	Name        string `yaml:"name"`
+	plcconf.PLC `yaml:",inline"`
+	Labels      map[string]string `yaml:"labels"`
+	// TagsFile 标签数据库文件(YAML、CSV或GX Works导出), 与Tags合并
+	TagsFile string      `yaml:"tags_file"`
+	Tags     []tagConfig `yaml:"tags"`
+
+	skipped error // 标签文件中跳过的标签
+}
+
+// tagConfig 标签定义, 另外可以指定指标名与标签.
+type tagConfig struct {
+	melsec.Tag `yaml:",inline"`
+	// Metric 指标名, 默认为melsec_tag_value. melsec_前缀保留给导出器自身的指标
+	Metric string            `yaml:"metric"`
+	Help   string            `yaml:"help"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+const defaultMetric = "melsec_tag_value"
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// reservedLabels 由导出器设置的标签.
+var reservedLabels = map[string]bool{"target": true, "tag": true, "address": true, "index": true}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i := range c.Targets {
+		c.Targets[i].TagsFile = plcconf.Resolve(path, c.Targets[i].TagsFile)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &c, nil
+}
+
+func (c *config) validate() error {
+	if len(c.Targets) == 0 {
+		return errors.New("no targets")
+	}
+
+	names := make(map[string]bool, len(c.Targets))
+
+	for _, t := range c.Targets {
+		if t.Name == "" || t.Addr == "" {
+			return errors.New("target needs name and addr")
+		}
+
+		if names[t.Name] {
+			return fmt.Errorf("duplicate target %q", t.Name)
+		}
+
+		names[t.Name] = true
+
+		if err := checkLabels(t.Labels); err != nil {
+			return fmt.Errorf("target %s: %w", t.Name, err)
+		}
+
+		for _, tag := range t.Tags {
+			if tag.Metric != "" && (!metricName.MatchString(tag.Metric) || strings.HasPrefix(tag.Metric, "melsec_")) {
+				return fmt.Errorf("tag %s: invalid metric name %q", tag.Name, tag.Metric)
+			}
+
+			if err := checkLabels(tag.Labels); err != nil {
+				return fmt.Errorf("tag %s: %w", tag.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func checkLabels(labels map[string]string) error {
+	for name := range labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+
+		if reservedLabels[name] {
+			return fmt.Errorf("label %q is set by the exporter", name)
+		}
+	}
+
+	return nil
+}
+
+// loadTags 读取标签文件并合并配置中的标签, 返回标签数据库与各标签的指标定义.
+func (t *targetConfig) loadTags() (*melsec.TagDB, map[string]tagConfig, error) {
+	db := melsec.NewTagDB(nil)
+
+	if t.TagsFile != "" {
+		if err := plcconf.LoadTags(db, t.TagsFile); errors.Is(err, melsec.ErrTagsSkipped) {
+			t.skipped = err
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	defs := make(map[string]tagConfig, len(t.Tags))
+
+	for _, tag := range t.Tags {
+		if err := db.Add(tag.Tag); err != nil {
+			return nil, nil, err
+		}
+
+		defs[tag.Name] = tag
+	}
+
+	for _, tag := range db.Tags() {
+		if tag.Type == melsec.TypeString {
+			return nil, nil, fmt.Errorf("tag %s: string tags cannot be exported", tag.Name)
+		}
+	}
+
+	if len(db.Tags()) == 0 {
+		return nil, nil, fmt.Errorf("target %s: no tags", t.Name)
+	}
+
+	return db, defs, nil
+}
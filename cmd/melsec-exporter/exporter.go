@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// target 一台PLC, 在多次采集之间保持同一个连接.
+type target struct {
+	name   string
+	host   string
+	port   string
+	labels map[string]string
+	ops    []melsec.PlcOption
+	tags   []*melsec.Tag
+	defs   map[string]tagConfig
+	plan   *melsec.ReadPlan
+	// skipped 标签文件中跳过的标签
+	skipped error
+
+	// mu 保证同一时间只有一次采集使用连接
+	mu     sync.Mutex
+	conn   *melsec.PlcConn
+	broken bool
+}
+
+func newTarget(c targetConfig, ops ...melsec.PlcOption) (*target, error) {
+	host, port, err := c.SplitAddr()
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", c.Name, err)
+	}
+
+	ops, err = c.Options(ops...)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", c.Name, err)
+	}
+
+	db, defs, err := c.loadTags()
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := db.Plan()
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %w", c.Name, err)
+	}
+
+	return &target{
+		name:    c.Name,
+		host:    host,
+		port:    port,
+		labels:  c.Labels,
+		ops:     ops,
+		tags:    db.Tags(),
+		defs:    defs,
+		plan:    plan,
+		skipped: c.skipped,
+	}, nil
+}
+
+// connect 首次采集时建立连接, 上次采集失败时重新连接.
+func (t *target) connect() error {
+	if t.conn == nil {
+		conn, err := melsec.NewConn(t.host, t.port, t.ops...)
+		if err != nil {
+			return err
+		}
+
+		t.conn = conn
+
+		return nil
+	}
+
+	if t.broken {
+		if err := t.conn.Reconnect(); err != nil {
+			return err
+		}
+
+		t.broken = false
+	}
+
+	return nil
+}
+
+// scrape 按读取计划读取全部标签.
+func (t *target) scrape() (map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.connect(); err != nil {
+		return nil, err
+	}
+
+	result, err := t.plan.Read(t.conn)
+	if err != nil {
+		// 通信失败时下次采集重新连接, 结束代码异常时连接仍然可用
+		var ne net.Error
+		if errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			t.broken = true
+		}
+
+		return nil, err
+	}
+
+	return melsec.DecodeTags(t.tags, result)
+}
+
+func (t *target) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		_ = t.conn.Close()
+	}
+}
+
+// exporter 每次请求/metrics时并发采集全部目标.
+type exporter struct {
+	targets []*target
+	stats   *melsec.Stats
+	logger  *log.Logger
+}
+
+func newExporter(c *config, logger *log.Logger) (*exporter, error) {
+	e := &exporter{stats: melsec.NewStats(), logger: logger}
+
+	for _, tc := range c.Targets {
+		t, err := newTarget(tc, melsec.SetMetrics(e.stats))
+		if err != nil {
+			e.close()
+
+			return nil, err
+		}
+
+		e.targets = append(e.targets, t)
+	}
+
+	return e, nil
+}
+
+func (e *exporter) close() {
+	for _, t := range e.targets {
+		t.close()
+	}
+}
+
+// sample 一个样本.
+type sample struct {
+	labels string
+	value  float64
+}
+
+// family 同名的全部样本.
+type family struct {
+	help    string
+	samples []sample
+}
+
+type scrapeResult struct {
+	values   map[string]interface{}
+	err      error
+	duration time.Duration
+}
+
+func (e *exporter) collect() []scrapeResult {
+	results := make([]scrapeResult, len(e.targets))
+
+	var wg sync.WaitGroup
+
+	for i, t := range e.targets {
+		wg.Add(1)
+
+		go func(i int, t *target) {
+			defer wg.Done()
+
+			start := time.Now()
+			values, err := t.scrape()
+			results[i] = scrapeResult{values: values, err: err, duration: time.Since(start)}
+
+			if err != nil && e.logger != nil {
+				e.logger.Printf("scrape %s: %v", t.name, err)
+			}
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// write 采集全部目标并以Prometheus文本格式输出.
+func (e *exporter) write(w io.Writer) error {
+	results := e.collect()
+	families := map[string]*family{
+		"melsec_scrape_success":          {help: "Whether the last scrape of the target succeeded."},
+		"melsec_scrape_duration_seconds": {help: "Duration of the last scrape of the target."},
+	}
+
+	add := func(name, help, labels string, value float64) {
+		f, ok := families[name]
+		if !ok {
+			f = &family{help: help}
+			families[name] = f
+		}
+
+		f.samples = append(f.samples, sample{labels: labels, value: value})
+	}
+
+	for i, t := range e.targets {
+		r := results[i]
+		base := formatLabels(map[string]string{"target": t.name}, t.labels)
+
+		success := 0.0
+		if r.err == nil {
+			success = 1
+		}
+
+		add("melsec_scrape_success", "", base, success)
+		add("melsec_scrape_duration_seconds", "", base, r.duration.Seconds())
+
+		if r.err != nil {
+			continue
+		}
+
+		for _, tag := range t.tags {
+			def := t.defs[tag.Name]
+
+			name := def.Metric
+			if name == "" {
+				name = defaultMetric
+			}
+
+			// 同名指标的说明取第一个标签的
+			help := "PLC tag value."
+			if name != defaultMetric {
+				if help = def.Help; help == "" {
+					help = tag.Comment
+				}
+			}
+
+			fixed := map[string]string{"target": t.name, "tag": tag.Name, "address": tag.Address}
+			values := toFloats(r.values[tag.Name])
+
+			for j, v := range values {
+				if len(values) > 1 {
+					fixed["index"] = strconv.Itoa(j)
+				}
+
+				add(name, help, formatLabels(fixed, def.Labels, t.labels), v)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	b := bufio.NewWriter(w)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, escapeHelp(f.help), name)
+
+		for _, s := range f.samples {
+			fmt.Fprintf(b, "%s{%s} %s\n", name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+
+	if err := b.Flush(); err != nil {
+		return err
+	}
+
+	return e.stats.WritePrometheus(w)
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	if err := e.write(w); err != nil && e.logger != nil {
+		e.logger.Printf("write metrics: %v", err)
+	}
+}
+
+// toFloats 将工程值转换为样本值, bool为0或1.
+func toFloats(v interface{}) []float64 {
+	rv := reflect.ValueOf(v)
+
+	if rv.Kind() == reflect.Slice {
+		re := make([]float64, 0, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			re = append(re, toFloats(rv.Index(i).Interface())...)
+		}
+
+		return re
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			return []float64{1}
+		}
+
+		return []float64{0}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return []float64{float64(rv.Int())}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return []float64{float64(rv.Uint())}
+	case reflect.Float32, reflect.Float64:
+		return []float64{rv.Float()}
+	}
+
+	return nil
+}
+
+// formatLabels 按名称排序输出标签, 同名标签以前面的为准.
+func formatLabels(sets ...map[string]string) string {
+	merged := make(map[string]string)
+
+	for _, set := range sets {
+		for k, v := range set {
+			if _, ok := merged[k]; !ok {
+				merged[k] = v
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + `="` + labelEscaper.Replace(merged[k]) + `"`
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dualm/melsec/mock"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "exporter.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func scrape(t *testing.T, e *exporter) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	return rec.Body.String()
+}
+
+func TestExporter(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	down := mock.NewServer()
+	down.Close()
+
+	_ = s.Memory.SetWords("D100", 125)
+	_ = s.Memory.SetWords("D200", 0, 0x3FC0, 0, 0xC000)
+	_ = s.Memory.SetBits("M0", true)
+
+	path := writeConfig(t, fmt.Sprintf(`
+targets:
+  - name: line1
+    addr: %s
+    frame: 4E
+    labels: {site: plant1}
+    tags_file: tags.yaml
+    tags:
+      - name: speed
+        address: D100
+        type: int16
+        scale: 0.1
+        labels: {unit: rpm, site: override}
+      - name: temps
+        address: D200
+        type: float32
+        length: 2
+        metric: line_temperature_celsius
+        help: Oven temperatures.
+  - name: line2
+    addr: %s
+    timeout: 1s
+    tags:
+      - name: run
+        address: M0
+`, s.Addr(), down.Addr()))
+
+	tags := "tags:\n  - name: running\n    address: M0\n"
+	if err := os.WriteFile(filepath.Join(filepath.Dir(path), "tags.yaml"), []byte(tags), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := newExporter(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.close()
+
+	out := scrape(t, e)
+
+	for _, want := range []string{
+		`melsec_scrape_success{site="plant1",target="line1"} 1`,
+		`melsec_scrape_success{target="line2"} 0`,
+		`melsec_tag_value{address="D100",site="override",tag="speed",target="line1",unit="rpm"} 12.5`,
+		`melsec_tag_value{address="M0",site="plant1",tag="running",target="line1"} 1`,
+		"# HELP line_temperature_celsius Oven temperatures.\n# TYPE line_temperature_celsius gauge\n",
+		`line_temperature_celsius{address="D200",index="0",site="plant1",tag="temps",target="line1"} 1.5`,
+		`line_temperature_celsius{address="D200",index="1",site="plant1",tag="temps",target="line1"} -2`,
+		`melsec_requests_total{plc="` + s.Addr() + `"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+
+	if strings.Count(out, "# TYPE melsec_tag_value ") != 1 {
+		t.Errorf("metric family must be written once:\n%s", out)
+	}
+
+	// 通信失败的抓取报告失败, 下一次抓取重新连接同一个PlcConn
+	_ = s.AddFault(mock.Fault{Close: true, Count: 1})
+
+	if out = scrape(t, e); !strings.Contains(out, `melsec_scrape_success{site="plant1",target="line1"} 0`) {
+		t.Errorf("want failed scrape:\n%s", out)
+	}
+
+	_ = s.Memory.SetWords("D100", 130)
+
+	out = scrape(t, e)
+
+	for _, want := range []string{
+		`melsec_scrape_success{site="plant1",target="line1"} 1`,
+		`tag="speed",target="line1",unit="rpm"} 13`,
+		`melsec_reconnects_total{plc="` + s.Addr() + `"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		"targets: []",
+		"targets:\n  - name: a\n",
+		"targets:\n  - {name: a, addr: 'h:1'}\n  - {name: a, addr: 'h:2'}\n",
+		"targets:\n  - {name: a, addr: 'h:1', labels: {target: x}}\n",
+		"targets:\n  - {name: a, addr: 'h:1', labels: {0bad: x}}\n",
+		"targets:\n  - name: a\n    addr: h:1\n    tags:\n      - {name: t, address: D0, metric: melsec_x}\n",
+	} {
+		if _, err := loadConfig(writeConfig(t, config)); err == nil {
+			t.Errorf("want error for %q", config)
+		}
+	}
+
+	for _, config := range []string{
+		"targets:\n  - {name: a, addr: 'h:1', frame: 5E, tags: [{name: t, address: D0}]}\n",
+		"targets:\n  - {name: a, addr: 'h:1'}\n",
+		"targets:\n  - {name: a, addr: 'h:1', tags: [{name: t, address: D0, type: string, length: 4}]}\n",
+	} {
+		c, err := loadConfig(writeConfig(t, config))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newExporter(c, nil); err == nil {
+			t.Errorf("want error for %q", config)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// melsec-exporter 读取配置中的PLC标签, 以Prometheus指标的形式在/metrics输出.
+//
+//	melsec-exporter -config exporter.yaml
+//
+// 每次抓取时并发读取全部目标, 同一目标的标签按读取计划合并为尽量少的请求,
+// 连接在多次抓取之间保持, 通信失败后的下一次抓取重新连接.
+// 除标签值外还输出各目标的melsec_scrape_success、melsec_scrape_duration_seconds以及通信统计.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultListen = ":9716"
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("melsec-exporter", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-exporter.yaml", "配置文件")
+	listen := fs.String("listen", "", "监听地址, 默认取自配置文件或"+defaultListen)
+	verbose := fs.Bool("v", false, "输出抓取失败的日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger := log.New(stderr, "", log.LstdFlags)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Print(err)
+
+		return 1
+	}
+
+	if *listen == "" {
+		*listen = c.Listen
+	}
+
+	if *listen == "" {
+		*listen = defaultListen
+	}
+
+	var scrapeLogger *log.Logger
+	if *verbose {
+		scrapeLogger = logger
+	}
+
+	e, err := newExporter(c, scrapeLogger)
+	if err != nil {
+		logger.Print(err)
+
+		return 1
+	}
+	defer e.close()
+
+	for _, t := range e.targets {
+		if t.skipped != nil {
+			logger.Printf("target %s: %v", t.name, t.skipped)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		fmt.Fprintln(w, `<html><body><h1>MELSEC exporter</h1><a href="/metrics">Metrics</a></body></html>`)
+	})
+
+	srv := &http.Server{Addr: *listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = srv.Shutdown(shutdown)
+	}()
+
+	logger.Printf("listening on %s, %d target(s)", *listen, len(e.targets))
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Print(err)
+
+		return 1
+	}
+
+	return 0
+}
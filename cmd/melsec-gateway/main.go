@@ -0,0 +1,205 @@
+// melsec-gateway 以HTTP/REST与WebSocket提供PLC访问.
+//
+//	melsec-gateway -config gateway.yaml
+//
+// 配置文件:
+//
+//	listen: :8080
+//	timeout: 3s
+//	allowed_origins: [http://dashboard.local]
+//	plcs:
+//	  - name: line1
+//	    addr: 192.168.0.10:5007
+//	    frame: 4E
+//	    tags_file: line1-tags.yaml
+//	tokens:
+//	  - name: dashboard
+//	    token: 2b7e151628aed2a6
+//	    read: ["*"]
+//	  - name: mes
+//	    token: abf7158809cf4f3c
+//	    write: [line1]
+//
+// 请求示例:
+//
+//	curl -H "Authorization: Bearer 2b7e151628aed2a6" "http://localhost:8080/plcs/line1/devices/D100?count=10"
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/gateway"
+	"github.com/dualm/melsec/internal/plcconf"
+	"gopkg.in/yaml.v3"
+)
+
+type plcConfig struct {
+	Name        string `yaml:"name"`
+	plcconf.PLC `yaml:",inline"`
+	TagsFile    string `yaml:"tags_file"`
+}
+
+type config struct {
+	Listen         string          `yaml:"listen"`
+	Timeout        time.Duration   `yaml:"timeout"`
+	MaxCount       int             `yaml:"max_count"`
+	AllowedOrigins []string        `yaml:"allowed_origins"`
+	PLCs           []plcConfig     `yaml:"plcs"`
+	Tokens         []gateway.Token `yaml:"tokens"`
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if len(c.PLCs) == 0 {
+		return nil, fmt.Errorf("%s: no plcs", path)
+	}
+
+	return &c, nil
+}
+
+// newServer 连接配置中的PLC并创建网关, 返回的函数关闭所有连接.
+func newServer(path string, c *config, logger melsec.Logger) (*gateway.Server, func(), error) {
+	var conns []*melsec.PlcConn
+
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+
+	gc := gateway.Config{
+		Tokens:         c.Tokens,
+		Timeout:        c.Timeout,
+		MaxCount:       c.MaxCount,
+		AllowedOrigins: c.AllowedOrigins,
+		Logger:         logger,
+	}
+
+	for i := range c.PLCs {
+		pc := &c.PLCs[i]
+
+		conn, err := pc.Dial(melsec.SetLogger(logger))
+		if err != nil {
+			closeAll()
+
+			return nil, nil, fmt.Errorf("plc %s: %w", pc.Name, err)
+		}
+
+		conns = append(conns, conn)
+
+		p := gateway.PLC{Name: pc.Name, Conn: conn}
+
+		if pc.TagsFile != "" {
+			p.Tags = melsec.NewTagDB(conn)
+			if err := plcconf.LoadTags(p.Tags, plcconf.Resolve(path, pc.TagsFile)); errors.Is(err, melsec.ErrTagsSkipped) {
+				logger.Warn("tags skipped", "plc", pc.Name, "err", err)
+			} else if err != nil {
+				closeAll()
+
+				return nil, nil, fmt.Errorf("plc %s: %w", pc.Name, err)
+			}
+		}
+
+		gc.PLCs = append(gc.PLCs, p)
+	}
+
+	s, err := gateway.New(gc)
+	if err != nil {
+		closeAll()
+
+		return nil, nil, err
+	}
+
+	return s, closeAll, nil
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("melsec-gateway", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-gateway.yaml", "配置文件")
+	listen := fs.String("listen", "", "监听地址, 覆盖配置文件")
+	verbose := fs.Bool("v", false, "输出通信日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	level := melsec.LevelInfo
+	if *verbose {
+		level = melsec.LevelDebug
+	}
+
+	logger := melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), level)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Error("load config", "err", err)
+
+		return 1
+	}
+
+	if *listen != "" {
+		c.Listen = *listen
+	}
+
+	if c.Listen == "" {
+		c.Listen = ":8080"
+	}
+
+	s, closeAll, err := newServer(*path, c, logger)
+	if err != nil {
+		logger.Error("create gateway", "err", err)
+
+		return 1
+	}
+	defer closeAll()
+
+	srv := &http.Server{Addr: c.Listen, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = srv.Shutdown(shutdown)
+	}()
+
+	logger.Info("listening", "addr", c.Listen, "plcs", len(c.PLCs))
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("serve", "err", err)
+
+		return 1
+	}
+
+	return 0
+}
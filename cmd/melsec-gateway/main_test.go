@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+)
+
+func TestServer(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	_ = s.Memory.SetWords("D10", 3)
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`plcs:
+  - name: line1
+    addr: %s
+    timeout: 1s
+    tags_file: tags.csv
+tokens:
+  - name: dashboard
+    token: secret
+    read: ["*"]
+`, s.Addr())
+
+	if err := os.WriteFile(filepath.Join(dir, "gateway.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tags.csv"), []byte("name,address,type\nlevel,D10,int16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "gateway.yaml")
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, closeAll, err := newServer(path, c, melsec.NewStdLogger(nil, melsec.LevelError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAll()
+
+	hs := httptest.NewServer(g)
+	defer hs.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, hs.URL+"/plcs/line1/tags/level", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), `"value":3`) {
+		t.Errorf("unexpected response %d %s", resp.StatusCode, b)
+	}
+
+	stderr := bytes.Buffer{}
+	if code := run(context.Background(), []string{"-config", filepath.Join(dir, "nosuch.yaml")}, &stderr); code != 1 {
+		t.Errorf("want exit 1, got %d", code)
+	}
+}
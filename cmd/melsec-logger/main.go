@@ -0,0 +1,160 @@
+// melsec-logger 按周期读取标签, 将样本写入CSV文件或InfluxDB.
+//
+//	melsec-logger -config logger.yaml
+//
+// 配置文件, 相对路径以配置文件所在目录为基准:
+//
+//	plc:
+//	  addr: 192.168.0.10:5007
+//	  frame: 4E
+//	interval: 1s
+//	mode: change
+//	buffer: 10000
+//	tags_file: line1-tags.csv
+//	tags:
+//	  - name: speed
+//	    address: D100
+//	    type: int16
+//	    scale: 0.1
+//	output:
+//	  format: csv
+//	  dir: data
+//	  prefix: line1
+//	  rotate: 24h
+//	  max_size: 104857600
+//
+// 写入InfluxDB:
+//
+//	output:
+//	  format: influx
+//	  url: http://127.0.0.1:8086/api/v2/write?org=plant&bucket=plc
+//	  token: xxxx
+//	  labels:
+//	    line: line1
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/datalog"
+	"github.com/dualm/melsec/internal/plcconf"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	PLC            plcconf.PLC `yaml:"plc"`
+	TagsFile       string      `yaml:"tags_file"`
+	datalog.Config `yaml:",inline"`
+
+	skipped error // 标签文件中跳过的标签
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if c.TagsFile != "" {
+		db := melsec.NewTagDB(nil)
+		if err := plcconf.LoadTags(db, plcconf.Resolve(path, c.TagsFile)); errors.Is(err, melsec.ErrTagsSkipped) {
+			c.skipped = err
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range db.Tags() {
+			c.Tags = append(c.Tags, *tag)
+		}
+	}
+
+	c.Output.Dir = plcconf.Resolve(path, c.Output.Dir)
+
+	if c.Timeout == 0 {
+		c.Timeout = c.PLC.TimeoutOrDefault()
+	}
+
+	return &c, nil
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("melsec-logger", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-logger.yaml", "配置文件")
+	verbose := fs.Bool("v", false, "输出通信日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	level := melsec.LevelInfo
+	if *verbose {
+		level = melsec.LevelDebug
+	}
+
+	logger := melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), level)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Error("load config", "err", err)
+
+		return 1
+	}
+
+	if c.skipped != nil {
+		logger.Warn("tags skipped", "err", c.skipped)
+	}
+
+	c.Logger = logger
+
+	conn, err := c.PLC.Dial(melsec.SetLogger(logger))
+	if err != nil {
+		logger.Error("connect plc", "addr", c.PLC.Addr, "err", err)
+
+		return 1
+	}
+	defer conn.Close()
+
+	l, err := datalog.New(conn, c.Config)
+	if err != nil {
+		logger.Error("create logger", "err", err)
+
+		return 1
+	}
+
+	logger.Info("logging", "plc", c.PLC.Addr, "tags", len(c.Tags), "mode", c.Mode, "format", c.Output.Format)
+
+	if err := l.Run(ctx); err != nil {
+		logger.Error("logger stopped", "err", err)
+
+		return 1
+	}
+
+	if n := l.Dropped(); n > 0 {
+		logger.Warn("records dropped", "records", n)
+	}
+
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec/mock"
+)
+
+func TestRun(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	_ = s.Memory.SetWords("D10", 3)
+
+	dir := t.TempDir()
+	config := fmt.Sprintf("plc:\n  addr: %s\n  timeout: 1s\ninterval: 10ms\nmode: change\ntags_file: tags.csv\noutput:\n  dir: data\n  prefix: line1\n", s.Addr())
+
+	if err := os.WriteFile(filepath.Join(dir, "logger.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tags.csv"), []byte("name,address,type\nlevel,D10,int16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(filepath.Join(dir, "logger.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Tags) != 1 || c.Tags[0].Name != "level" || c.Timeout != time.Second || c.Output.Dir != filepath.Join(dir, "data") {
+		t.Errorf("unexpected config %+v", c.Config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	stderr := bytes.Buffer{}
+
+	go func() {
+		done <- run(ctx, []string{"-config", filepath.Join(dir, "logger.yaml")}, &stderr)
+	}()
+
+	var content string
+
+	for deadline := time.Now().Add(5 * time.Second); !strings.HasSuffix(content, ",3\n"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for record: %q %s", content, stderr.String())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		matches, _ := filepath.Glob(filepath.Join(dir, "data", "line1-*.csv"))
+		if len(matches) == 1 {
+			b, _ := os.ReadFile(matches[0])
+			content = string(b)
+		}
+	}
+
+	cancel()
+
+	if code := <-done; code != 0 {
+		t.Errorf("exit %d: %s", code, stderr.String())
+	}
+
+	if !strings.HasPrefix(content, "\ufefftime,level\n") {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if code := run(context.Background(), []string{"-config", filepath.Join(dir, "nosuch.yaml")}, &stderr); code != 1 {
+		t.Errorf("want exit 1, got %d", code)
+	}
+}
@@ -0,0 +1,157 @@
+// melsec-modbus 以Modbus TCP服务器的形式提供PLC访问.
+//
+//	melsec-modbus -config modbus.yaml
+//
+// 配置文件:
+//
+//	listen: :502
+//	unit_id: 1
+//	plc:
+//	  addr: 192.168.0.10:5007
+//	  frame: 4E
+//	mappings:
+//	  - table: holding_registers
+//	    start: 0
+//	    count: 1000
+//	    device: D1000
+//	  - table: input_registers
+//	    start: 0
+//	    count: 100
+//	    device: W0
+//	  - table: coils
+//	    start: 0
+//	    count: 512
+//	    device: M0
+//	  - table: discrete_inputs
+//	    start: 0
+//	    count: 256
+//	    device: X0
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/internal/plcconf"
+	"github.com/dualm/melsec/modbus"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	Listen        string      `yaml:"listen"`
+	PLC           plcconf.PLC `yaml:"plc"`
+	modbus.Config `yaml:",inline"`
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr, nil))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if c.Listen == "" {
+		c.Listen = ":502"
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = c.PLC.TimeoutOrDefault()
+	}
+
+	return &c, nil
+}
+
+// run 运行服务器直到ctx结束. ready不为nil时在开始监听后收到监听地址.
+func run(ctx context.Context, args []string, stderr io.Writer, ready chan<- string) int {
+	fs := flag.NewFlagSet("melsec-modbus", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-modbus.yaml", "配置文件")
+	listen := fs.String("listen", "", "监听地址, 覆盖配置文件")
+	verbose := fs.Bool("v", false, "输出通信日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	level := melsec.LevelInfo
+	if *verbose {
+		level = melsec.LevelDebug
+	}
+
+	logger := melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), level)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Error("load config", "err", err)
+
+		return 1
+	}
+
+	if *listen != "" {
+		c.Listen = *listen
+	}
+
+	c.Logger = logger
+
+	conn, err := c.PLC.Dial(melsec.SetLogger(logger))
+	if err != nil {
+		logger.Error("connect plc", "addr", c.PLC.Addr, "err", err)
+
+		return 1
+	}
+	defer conn.Close()
+
+	s, err := modbus.New(conn, c.Config)
+	if err != nil {
+		logger.Error("create server", "err", err)
+
+		return 1
+	}
+
+	l, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		logger.Error("listen", "err", err)
+
+		return 1
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		_ = s.Close()
+	}()
+
+	logger.Info("listening", "addr", l.Addr().String(), "mappings", len(c.Mappings))
+
+	if ready != nil {
+		ready <- l.Addr().String()
+	}
+
+	if err := s.Serve(l); err != nil {
+		logger.Error("serve", "err", err)
+
+		return 1
+	}
+
+	return 0
+}
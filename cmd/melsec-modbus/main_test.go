@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec/mock"
+)
+
+func TestRun(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	_ = s.Memory.SetWords("D1000", 42)
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`listen: 127.0.0.1:0
+plc:
+  addr: %s
+  timeout: 1s
+mappings:
+  - table: holding_registers
+    count: 10
+    device: D1000
+`, s.Addr())
+
+	if err := os.WriteFile(filepath.Join(dir, "modbus.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan string, 1)
+	done := make(chan int)
+	stderr := bytes.Buffer{}
+
+	go func() {
+		done <- run(ctx, []string{"-config", filepath.Join(dir, "modbus.yaml")}, &stderr, ready)
+	}()
+
+	var addr string
+
+	select {
+	case addr = <-ready:
+	case code := <-done:
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{0, 1, 0, 0, 0, 6, 1, 0x03, 0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 11)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(resp, []byte{0, 1, 0, 0, 0, 5, 1, 0x03, 2, 0, 42}) {
+		t.Errorf("unexpected response % x", resp)
+	}
+
+	cancel()
+
+	if code := <-done; code != 0 {
+		t.Errorf("exit %d: %s", code, stderr.String())
+	}
+
+	if code := run(context.Background(), []string{"-config", filepath.Join(dir, "nosuch.yaml")}, &stderr, nil); code != 1 {
+		t.Errorf("want exit 1, got %d", code)
+	}
+}
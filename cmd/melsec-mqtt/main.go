@@ -0,0 +1,138 @@
+// melsec-mqtt 按配置在PLC与MQTT broker之间转发标签.
+//
+//	melsec-mqtt -config mqtt.yaml
+//
+// 配置文件:
+//
+//	plc:
+//	  addr: 192.168.0.10:5007
+//	  frame: 4E
+//	broker: tcp://127.0.0.1:1883
+//	topic: plant/line1
+//	qos: 1
+//	retain: true
+//	interval: 500ms
+//	tags_file: line1-tags.yaml
+//	tags:
+//	  - address: D100
+//	    type: int16
+//	writable: [D5000-D5999]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/internal/plcconf"
+	"github.com/dualm/melsec/mqttbridge"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	PLC               plcconf.PLC `yaml:"plc"`
+	TagsFile          string      `yaml:"tags_file"`
+	mqttbridge.Config `yaml:",inline"`
+
+	skipped error // 标签文件中跳过的标签
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if c.TagsFile != "" {
+		db := melsec.NewTagDB(nil)
+		if err := plcconf.LoadTags(db, plcconf.Resolve(path, c.TagsFile)); errors.Is(err, melsec.ErrTagsSkipped) {
+			c.skipped = err
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, tag := range db.Tags() {
+			c.Tags = append(c.Tags, *tag)
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = c.PLC.TimeoutOrDefault()
+	}
+
+	return &c, nil
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("melsec-mqtt", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-mqtt.yaml", "配置文件")
+	verbose := fs.Bool("v", false, "输出通信日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	level := melsec.LevelInfo
+	if *verbose {
+		level = melsec.LevelDebug
+	}
+
+	logger := melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), level)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Error("load config", "err", err)
+
+		return 1
+	}
+
+	if c.skipped != nil {
+		logger.Warn("tags skipped", "err", c.skipped)
+	}
+
+	c.Logger = logger
+
+	conn, err := c.PLC.Dial(melsec.SetLogger(logger))
+	if err != nil {
+		logger.Error("connect plc", "addr", c.PLC.Addr, "err", err)
+
+		return 1
+	}
+	defer conn.Close()
+
+	b, err := mqttbridge.New(conn, c.Config)
+	if err != nil {
+		logger.Error("create bridge", "err", err)
+
+		return 1
+	}
+
+	if err := b.Run(ctx); err != nil {
+		logger.Error("bridge stopped", "err", err)
+
+		return 1
+	}
+
+	return 0
+}
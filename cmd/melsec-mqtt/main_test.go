@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec/mock"
+	"github.com/dualm/melsec/mqttbridge/mqtttest"
+)
+
+// lockedBuffer 可被MQTT客户端的goroutine同时写入的日志.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestRun(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	_ = s.Memory.SetWords("D10", 3)
+
+	dir := t.TempDir()
+	config := fmt.Sprintf("plc:\n  addr: %s\n  timeout: 1s\nbroker: %s\ntopic: line1\ninterval: 10ms\ntags_file: tags.csv\n", s.Addr(), broker.URL())
+
+	if err := os.WriteFile(filepath.Join(dir, "mqtt.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tags.csv"), []byte("name,address,type\nlevel,D10,int16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadConfig(filepath.Join(dir, "mqtt.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Tags) != 1 || c.Tags[0].Name != "level" || c.Timeout != time.Second {
+		t.Errorf("unexpected config %+v", c.Config)
+	}
+
+	ch := broker.Watch("line1/level")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	stderr := &lockedBuffer{}
+
+	go func() {
+		done <- run(ctx, []string{"-config", filepath.Join(dir, "mqtt.yaml")}, stderr)
+	}()
+
+	select {
+	case m := <-ch:
+		if !bytes.Contains(m.Payload, []byte(`"value":3`)) {
+			t.Errorf("unexpected payload %s", m.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for value")
+	}
+
+	cancel()
+
+	if code := <-done; code != 0 {
+		t.Errorf("exit %d: %s", code, stderr.String())
+	}
+
+	if code := run(context.Background(), []string{"-config", filepath.Join(dir, "nosuch.yaml")}, stderr); code != 1 {
+		t.Errorf("want exit 1, got %d", code)
+	}
+}
@@ -0,0 +1,157 @@
+// melsec-proxy 转发HMI、上位机与PLC之间的MC协议请求, 记录每个请求并按规则限制访问.
+//
+//	melsec-proxy -config proxy.yaml
+//
+// 配置文件:
+//
+//	listen: :5007
+//	plc:
+//	  addr: 192.168.0.10:5007
+//	  frame: 4E
+//	deny_by_default: false
+//	rules:
+//	  - name: recipe hmi
+//	    action: allow
+//	    clients: [192.168.0.20]
+//	    commands: [write]
+//	    devices: [D5000-D5999]
+//	  - name: recipe hmi status
+//	    action: allow
+//	    clients: [192.168.0.20]
+//	    commands: [cpu_model]
+//	  - name: recipe hmi read only
+//	    action: deny
+//	    clients: [192.168.0.20]
+//	    commands: [write]
+//	  - name: no remote stop
+//	    action: deny
+//	    commands: [remote_stop, remote_reset]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/internal/plcconf"
+	"github.com/dualm/melsec/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	Listen       string      `yaml:"listen"`
+	PLC          plcconf.PLC `yaml:"plc"`
+	proxy.Config `yaml:",inline"`
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	os.Exit(run(ctx, os.Args[1:], os.Stderr, nil))
+}
+
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if c.Listen == "" {
+		c.Listen = ":5007"
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = c.PLC.TimeoutOrDefault()
+	}
+
+	return &c, nil
+}
+
+// run 运行代理直到ctx结束. ready不为nil时在开始监听后收到监听地址.
+func run(ctx context.Context, args []string, stderr io.Writer, ready chan<- string) int {
+	fs := flag.NewFlagSet("melsec-proxy", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	path := fs.String("config", "melsec-proxy.yaml", "配置文件")
+	listen := fs.String("listen", "", "监听地址, 覆盖配置文件")
+	verbose := fs.Bool("v", false, "输出与PLC的通信日志")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	level := melsec.LevelInfo
+	if *verbose {
+		level = melsec.LevelDebug
+	}
+
+	logger := melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), level)
+
+	c, err := loadConfig(*path)
+	if err != nil {
+		logger.Error("load config", "err", err)
+
+		return 1
+	}
+
+	if *listen != "" {
+		c.Listen = *listen
+	}
+
+	c.Logger = logger
+
+	conn, err := c.PLC.Dial(melsec.SetLogger(logger))
+	if err != nil {
+		logger.Error("connect plc", "addr", c.PLC.Addr, "err", err)
+
+		return 1
+	}
+	defer conn.Close()
+
+	p, err := proxy.New(conn, c.Config)
+	if err != nil {
+		logger.Error("create proxy", "err", err)
+
+		return 1
+	}
+
+	l, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		logger.Error("listen", "err", err)
+
+		return 1
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		_ = p.Close()
+	}()
+
+	logger.Info("listening", "addr", l.Addr().String(), "plc", c.PLC.Addr, "rules", len(c.Rules))
+
+	if ready != nil {
+		ready <- l.Addr().String()
+	}
+
+	if err := p.Serve(l); err != nil {
+		logger.Error("serve", "err", err)
+
+		return 1
+	}
+
+	return 0
+}
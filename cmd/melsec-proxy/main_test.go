@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+)
+
+func TestRun(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	_ = s.Memory.SetWords("D100", 42)
+
+	dir := t.TempDir()
+	config := fmt.Sprintf(`listen: 127.0.0.1:0
+plc:
+  addr: %s
+  timeout: 1s
+rules:
+  - name: read only
+    action: deny
+    commands: [write]
+`, s.Addr())
+
+	if err := os.WriteFile(filepath.Join(dir, "proxy.yaml"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan string, 1)
+	done := make(chan int)
+	stderr := bytes.Buffer{}
+
+	go func() {
+		done <- run(ctx, []string{"-config", filepath.Join(dir, "proxy.yaml")}, &stderr, ready)
+	}()
+
+	var addr string
+
+	select {
+	case addr = <-ready:
+	case code := <-done:
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	conn, err := melsec.NewConn(host, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	dev, _ := melsec.NewDevice("D100", 1, conn)
+	if err := dev.Read(); err != nil || !bytes.Equal(dev.GetValue(), []byte{42, 0}) {
+		t.Errorf("unexpected D100 % x %v", dev.GetValue(), err)
+	}
+
+	dev.SetValue([]byte{43, 0})
+
+	var ee *melsec.EndCodeError
+	if err := dev.Write(); !errors.As(err, &ee) || ee.Code != 0xC05B {
+		t.Errorf("want end code C05B, got %v", err)
+	}
+
+	cancel()
+
+	if code := <-done; code != 0 {
+		t.Errorf("exit %d: %s", code, stderr.String())
+	}
+
+	if !strings.Contains(stderr.String(), "rule=read only") {
+		t.Errorf("denied request not logged:\n%s", stderr.String())
+	}
+
+	if code := run(context.Background(), []string{"-config", filepath.Join(dir, "nosuch.yaml")}, &stderr, nil); code != 1 {
+		t.Errorf("want exit 1, got %d", code)
+	}
+}
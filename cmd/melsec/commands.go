@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// entry 一个软元件点的值.
+type entry struct {
+	Address string      `json:"address"`
+	Value   interface{} `json:"value"`
+}
+
+func typeFlag(fs *flag.FlagSet) *string {
+	return fs.String("type", "", "数据类型 bool|int16|uint16|int32|uint32|float32|float64|string, 默认位软元件为bool, 字软元件为int16")
+}
+
+// resolveType 解析-type, 为空时位软元件按位读写, 字软元件为int16.
+func resolveType(name string, info melsec.DeviceInfo) (melsec.DataType, error) {
+	if name == "" {
+		if info.Bit {
+			return melsec.TypeBool, nil
+		}
+
+		return melsec.TypeInt16, nil
+	}
+
+	return melsec.ParseDataType(name)
+}
+
+func parseCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%w: invalid count %q", errUsage, s)
+	}
+
+	return n, nil
+}
+
+// reader 读取从一个软元件开始的连续数据. 位软元件的bool按位展开, 其余类型按字解码.
+type reader struct {
+	info  melsec.DeviceInfo
+	no    uint64
+	count int
+	typ   melsec.DataType
+	dev   *melsec.Device
+}
+
+func newReader(conn *melsec.PlcConn, address string, count int, typeName string) (*reader, error) {
+	info, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := resolveType(typeName, info)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{info: info, no: no, count: count, typ: t}
+
+	words := t.Words(count)
+	if r.bits() {
+		words = (count + 15) / 16
+	}
+
+	if r.dev, err = melsec.NewDevice(address, words, conn); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *reader) bits() bool {
+	return r.info.Bit && r.typ == melsec.TypeBool
+}
+
+func (r *reader) read(e *env) ([]entry, error) {
+	if err := r.dev.Read(); err != nil {
+		return nil, err
+	}
+
+	b := r.dev.GetValue()
+
+	if r.bits() {
+		entries := make([]entry, r.count)
+
+		for i := range entries {
+			word := binary.LittleEndian.Uint16(b[i/16*2:])
+			entries[i] = entry{melsec.FormatAddress(r.info, r.no+uint64(i)), word>>(i%16)&1 == 1}
+		}
+
+		return entries, nil
+	}
+
+	if r.typ == melsec.TypeString {
+		v, err := melsec.DecodeValue(r.typ, b, r.count)
+		if err != nil {
+			return nil, err
+		}
+
+		return []entry{{melsec.FormatAddress(r.info, r.no), v}}, nil
+	}
+
+	// 位软元件按字读取时每个字为16点
+	step := r.typ.Words(1)
+	if r.info.Bit {
+		step *= 16
+	}
+
+	size := r.typ.Words(1) * 2
+	entries := make([]entry, r.count)
+
+	for i := range entries {
+		v, err := melsec.DecodeValue(r.typ, b[i*size:], 1)
+		if err != nil {
+			return nil, err
+		}
+
+		entries[i] = entry{melsec.FormatAddress(r.info, r.no+uint64(i*step)), v}
+	}
+
+	return entries, nil
+}
+
+func printTable(w io.Writer, entries []entry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "ADDRESS\tVALUE")
+
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%v\n", e.Address, e.Value)
+	}
+
+	return tw.Flush()
+}
+
+func readCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	typ := typeFlag(fs)
+
+	return func(_ context.Context, e *env, args []string) error {
+		if len(args) == 0 || len(args) > 2 {
+			return fmt.Errorf("%w: need ADDR [COUNT]", errUsage)
+		}
+
+		count := 1
+
+		if len(args) == 2 {
+			var err error
+
+			if count, err = parseCount(args[1]); err != nil {
+				return err
+			}
+		}
+
+		r, err := newReader(e.conn, args[0], count, *typ)
+		if err != nil {
+			return err
+		}
+
+		entries, err := r.read(e)
+		if err != nil {
+			return err
+		}
+
+		if e.json {
+			return e.printJSON(entries)
+		}
+
+		return printTable(e.stdout, entries)
+	}
+}
+
+// parseBit 解析位的值, 接受1/0、true/false及on/off.
+func parseBit(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid bit value %q", s)
+	}
+
+	return on, nil
+}
+
+// parseValue 整数按Go语法解析(可带0x前缀), 其余交由EncodeValue解析.
+func parseValue(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return i
+	}
+
+	if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return u
+	}
+
+	return s
+}
+
+// writeValues 写入从address开始的连续数据. 位软元件的bool按位写入, 其余类型按字编码.
+func writeValues(e *env, address string, values []string, typeName string) error {
+	info, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+
+	t, err := resolveType(typeName, info)
+	if err != nil {
+		return err
+	}
+
+	if info.Bit && t == melsec.TypeBool {
+		addresses := make([]string, len(values))
+		bits := make([]bool, len(values))
+
+		for i, v := range values {
+			if bits[i], err = parseBit(v); err != nil {
+				return err
+			}
+
+			addresses[i] = melsec.FormatAddress(info, no+uint64(i))
+		}
+
+		return e.conn.WriteBits(addresses, bits)
+	}
+
+	var b []byte
+
+	if t == melsec.TypeString {
+		s := strings.Join(values, " ")
+		b, err = melsec.EncodeValue(t, s, len(s))
+	} else {
+		vs := make([]interface{}, len(values))
+		for i, v := range values {
+			vs[i] = parseValue(v)
+		}
+
+		b, err = melsec.EncodeValue(t, vs, len(vs))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dev, err := melsec.NewDevice(address, len(b)/2, e.conn)
+	if err != nil {
+		return err
+	}
+
+	dev.SetValue(b)
+
+	return dev.Write()
+}
+
+func writeCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	typ := typeFlag(fs)
+
+	return func(_ context.Context, e *env, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("%w: need ADDR VALUE...", errUsage)
+		}
+
+		if err := writeValues(e, args[0], args[1:], *typ); err != nil {
+			return err
+		}
+
+		if e.json {
+			return e.printJSON(map[string]interface{}{"address": args[0], "count": len(args) - 1})
+		}
+
+		fmt.Fprintf(e.stdout, "wrote %d value(s) to %s\n", len(args)-1, args[0])
+
+		return nil
+	}
+}
+
+// sample monitor的一次采样.
+type sample struct {
+	Time   time.Time `json:"time"`
+	Values []entry   `json:"values,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func monitorCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	typ := typeFlag(fs)
+	interval := fs.Duration("interval", time.Second, "采样周期")
+	count := fs.Int("count", 0, "采样次数, 0为直到中断")
+
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("%w: need ADDR[,ADDR...]", errUsage)
+		}
+
+		if *interval <= 0 {
+			return fmt.Errorf("%w: interval must be positive", errUsage)
+		}
+
+		var readers []*reader
+
+		for _, address := range strings.Split(strings.Join(args, ","), ",") {
+			if address = strings.TrimSpace(address); address == "" {
+				continue
+			}
+
+			r, err := newReader(e.conn, address, 1, *typ)
+			if err != nil {
+				return err
+			}
+
+			readers = append(readers, r)
+		}
+
+		changed := make(map[string]time.Time)
+		last := make(map[string]interface{})
+
+		ticker := time.NewTicker(*interval)
+		defer ticker.Stop()
+
+		for n := 0; *count == 0 || n < *count; n++ {
+			if n > 0 {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-ticker.C:
+				}
+			}
+
+			s := sample{Time: time.Now()}
+
+			for _, r := range readers {
+				entries, err := r.read(e)
+				if err != nil {
+					s.Error = err.Error()
+
+					break
+				}
+
+				s.Values = append(s.Values, entries...)
+			}
+
+			for _, v := range s.Values {
+				if old, ok := last[v.Address]; !ok || old != v.Value {
+					last[v.Address], changed[v.Address] = v.Value, s.Time
+				}
+			}
+
+			if err := e.printSample(s, changed, *interval); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// printSample 终端中刷新整个表格, 否则每次采样输出一行.
+func (e *env) printSample(s sample, changed map[string]time.Time, interval time.Duration) error {
+	if e.json {
+		return e.printJSON(s)
+	}
+
+	if !e.tty {
+		b := strings.Builder{}
+		b.WriteString(s.Time.Format("15:04:05.000"))
+
+		for _, v := range s.Values {
+			fmt.Fprintf(&b, " %s=%v", v.Address, v.Value)
+		}
+
+		if s.Error != "" {
+			b.WriteString(" error=" + strconv.Quote(s.Error))
+		}
+
+		_, err := fmt.Fprintln(e.stdout, b.String())
+
+		return err
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "%s  every %s  (Ctrl+C to quit)\n\n", s.Time.Format("2006-01-02 15:04:05"), interval)
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDRESS\tVALUE\tCHANGED")
+
+	for _, v := range s.Values {
+		fmt.Fprintf(tw, "%s\t%v\t%s\n", v.Address, v.Value, changed[v.Address].Format("15:04:05.000"))
+	}
+
+	_ = tw.Flush()
+
+	if s.Error != "" {
+		fmt.Fprintf(&buf, "\nerror: %s\n", s.Error)
+	}
+
+	_, err := e.stdout.Write(buf.Bytes())
+
+	return err
+}
+
+func infoCommand(*flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(_ context.Context, e *env, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("%w: info takes no arguments", errUsage)
+		}
+
+		s, err := e.conn.GetCPUInfo()
+		if err != nil {
+			return err
+		}
+
+		// 型号名16字符, 之后为2字节的型号代码
+		model, code := s, ""
+		if len(s) >= 18 {
+			model = strings.TrimSpace(s[:16])
+			code = fmt.Sprintf("%04X", binary.LittleEndian.Uint16([]byte(s[16:18])))
+		}
+
+		if e.json {
+			return e.printJSON(map[string]string{"model": model, "code": code})
+		}
+
+		fmt.Fprintf(e.stdout, "model: %s\ncode:  %s\n", model, code)
+
+		return nil
+	}
+}
+
+func loopbackCommand(*flag.FlagSet) func(context.Context, *env, []string) error {
+	return func(_ context.Context, e *env, args []string) error {
+		if len(args) > 1 {
+			return fmt.Errorf("%w: need at most one DATA", errUsage)
+		}
+
+		data := "0123456789ABCDEF"
+		if len(args) == 1 {
+			data = args[0]
+		}
+
+		start := time.Now()
+
+		echo, err := e.conn.Loopback([]byte(data))
+		if err != nil {
+			return err
+		}
+
+		latency := time.Since(start)
+
+		if string(echo) != data {
+			return fmt.Errorf("echo mismatch: sent %q, got %q", data, echo)
+		}
+
+		if e.json {
+			return e.printJSON(map[string]interface{}{"data": data, "echo": string(echo), "latency_ms": latency.Seconds() * 1000})
+		}
+
+		fmt.Fprintf(e.stdout, "echo %s in %s\n", echo, latency)
+
+		return nil
+	}
+}
+
+func dumpCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	typ := typeFlag(fs)
+	format := fs.String("format", "csv", "输出格式 csv|json|table")
+
+	return func(_ context.Context, e *env, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("%w: need ADDR COUNT", errUsage)
+		}
+
+		count, err := parseCount(args[1])
+		if err != nil {
+			return err
+		}
+
+		if e.json {
+			*format = "json"
+		}
+
+		if *format != "csv" && *format != "json" && *format != "table" {
+			return fmt.Errorf("%w: unknown format %q", errUsage, *format)
+		}
+
+		r, err := newReader(e.conn, args[0], count, *typ)
+		if err != nil {
+			return err
+		}
+
+		entries, err := r.read(e)
+		if err != nil {
+			return err
+		}
+
+		switch *format {
+		case "json":
+			return e.printJSON(entries)
+		case "table":
+			return printTable(e.stdout, entries)
+		}
+
+		w := csv.NewWriter(e.stdout)
+		_ = w.Write([]string{"address", "value"})
+
+		for _, v := range entries {
+			_ = w.Write([]string{v.Address, fmt.Sprint(v.Value)})
+		}
+
+		w.Flush()
+
+		return w.Error()
+	}
+}
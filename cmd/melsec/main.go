@@ -0,0 +1,289 @@
+// melsec 通过MC协议读写三菱PLC软元件的命令行工具.
+//
+//	melsec read D100 10 -type int16
+//	melsec write M20 1
+//	melsec monitor D100,D200 -interval 500ms
+//	melsec info
+//	melsec loopback
+//	melsec dump D0 1000 -format csv
+//	melsec shell -plcs plcs.yaml
+//
+// 连接参数可以放在子命令的任意位置, 默认连接地址取自环境变量MELSEC_ADDR.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dualm/melsec"
+	"golang.org/x/term"
+)
+
+const defaultAddr = "127.0.0.1:5007"
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	// setup 注册子命令的选项, 返回解析完成后执行的函数.
+	setup func(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error
+	// offline 为true时不预先建立连接, 由子命令自行连接.
+	offline bool
+}
+
+var commands = []command{
+	{"read", "read ADDR [COUNT] [-type T]", "读取软元件", readCommand, false},
+	{"write", "write ADDR VALUE... [-type T]", "写入软元件", writeCommand, false},
+	{"monitor", "monitor ADDR[,ADDR...] [-interval D] [-type T]", "周期读取并显示软元件", monitorCommand, false},
+	{"info", "info", "读取CPU型号", infoCommand, false},
+	{"loopback", "loopback [DATA]", "折返测试", loopbackCommand, false},
+	{"dump", "dump ADDR COUNT [-format csv|json|table] [-type T]", "导出连续的软元件", dumpCommand, false},
+	{"shell", "shell [-plcs FILE]", "交互式调试", shellCommand, true},
+}
+
+// env 子命令的运行环境.
+type env struct {
+	conn   *melsec.PlcConn
+	flags  connFlags
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	json   bool
+	tty    bool
+}
+
+func (e *env) printJSON(v interface{}) error {
+	enc := json.NewEncoder(e.stdout)
+
+	return enc.Encode(v)
+}
+
+// connFlags 所有子命令共用的连接参数.
+type connFlags struct {
+	Addr    string        `yaml:"addr"`
+	Frame   string        `yaml:"frame"`
+	ASCII   bool          `yaml:"ascii"`
+	Network uint          `yaml:"network"`
+	PC      uint          `yaml:"pc"`
+	IO      uint          `yaml:"io"`
+	Station uint          `yaml:"station"`
+	Timer   uint          `yaml:"timer"`
+	Timeout time.Duration `yaml:"-"`
+	JSON    bool          `yaml:"-"`
+	Verbose bool          `yaml:"-"`
+}
+
+func (c *connFlags) register(fs *flag.FlagSet) {
+	addr := os.Getenv("MELSEC_ADDR")
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	fs.StringVar(&c.Addr, "addr", addr, "PLC地址 host:port, 默认取自MELSEC_ADDR")
+	fs.StringVar(&c.Frame, "frame", "3E", "报文格式 3E|4E")
+	fs.BoolVar(&c.ASCII, "ascii", false, "使用ASCII码通信")
+	fs.UintVar(&c.Network, "network", 0, "网络编号")
+	fs.UintVar(&c.PC, "pc", 0xFF, "PC编号")
+	fs.UintVar(&c.IO, "io", 0x3FF, "请求目标模块IO编号")
+	fs.UintVar(&c.Station, "station", 0, "请求目标模块站号")
+	fs.UintVar(&c.Timer, "timer", 4, "CPU监视定时器, 单位250ms")
+	fs.DurationVar(&c.Timeout, "timeout", 5*time.Second, "每次通信的超时时间")
+	fs.BoolVar(&c.JSON, "json", false, "以JSON格式输出")
+	fs.BoolVar(&c.Verbose, "v", false, "在标准错误输出通信日志")
+}
+
+func (c *connFlags) options(stderr io.Writer) ([]melsec.PlcOption, error) {
+	ops := []melsec.PlcOption{
+		melsec.SetASCII(c.ASCII),
+		melsec.SetNetCode(c.Network),
+		melsec.SetPLCCode(c.PC),
+		melsec.SetModuleIoNo(c.IO),
+		melsec.SetModuleStationNo(c.Station),
+		melsec.SetCPUTimer(c.Timer),
+		melsec.SetTimeout(c.Timeout),
+	}
+
+	switch strings.ToUpper(c.Frame) {
+	case "3E":
+		ops = append(ops, melsec.SetFrame(melsec.Frame3E))
+	case "4E":
+		ops = append(ops, melsec.SetFrame(melsec.Frame4E))
+	default:
+		return nil, fmt.Errorf("unknown frame %q", c.Frame)
+	}
+
+	if c.Verbose {
+		ops = append(ops, melsec.SetLogger(melsec.NewStdLogger(log.New(stderr, "", log.LstdFlags), melsec.LevelDebug)))
+	}
+
+	return ops, nil
+}
+
+func (c *connFlags) dial(stderr io.Writer) (*melsec.PlcConn, error) {
+	ops, err := c.options(stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return melsec.NewConn(host, port, ops...)
+}
+
+// errUsage 参数错误, 退出码为2.
+var errUsage = errors.New("usage error")
+
+// parseArgs 解析参数, 允许选项出现在位置参数之间. 数值(包括负数)总是位置参数, "--"之后不再解析选项.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for len(args) > 0 {
+		arg := args[0]
+
+		if arg == "--" {
+			return append(positional, args[1:]...), nil
+		}
+
+		if _, err := strconv.ParseFloat(arg, 64); err == nil || !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			args = args[1:]
+
+			continue
+		}
+
+		// 选项与其值(不使用=时)一起解析
+		n := 1
+
+		name := strings.TrimLeft(arg, "-")
+		if f := fs.Lookup(name); f != nil && !strings.Contains(name, "=") {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				n = 2
+			}
+		}
+
+		if n > len(args) {
+			n = len(args)
+		}
+
+		if err := fs.Parse(args[:n]); err != nil {
+			return nil, err
+		}
+
+		args = args[n:]
+	}
+
+	return positional, nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: melsec <command> [arguments] [flags]")
+	fmt.Fprintln(w)
+
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-52s %s\n", c.usage, c.summary)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run 'melsec <command> -h' for flags")
+}
+
+// run 执行命令行, 返回退出码.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, tty bool) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "help" {
+		usage(stderr)
+
+		return 2
+	}
+
+	var cmd *command
+
+	for i := range commands {
+		if commands[i].name == args[0] {
+			cmd = &commands[i]
+		}
+	}
+
+	if cmd == nil {
+		fmt.Fprintf(stderr, "melsec: unknown command %q\n", args[0])
+		usage(stderr)
+
+		return 2
+	}
+
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: melsec %s\n\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+
+	c := connFlags{}
+	c.register(fs)
+	exec := cmd.setup(fs)
+
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+
+		return 2
+	}
+
+	e := &env{flags: c, stdin: stdin, stdout: stdout, stderr: stderr, json: c.JSON, tty: tty}
+
+	if !cmd.offline {
+		conn, err := c.dial(stderr)
+		if err != nil {
+			fmt.Fprintf(stderr, "melsec: %v\n", err)
+
+			return 1
+		}
+
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		e.conn = conn
+	}
+
+	if err := exec(ctx, e, positional); err != nil {
+		fmt.Fprintf(stderr, "melsec %s: %v\n", cmd.name, err)
+
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+
+			return 2
+		}
+
+		return 1
+	}
+
+	return 0
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tty := term.IsTerminal(int(os.Stdout.Fd()))
+
+	code := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr, tty)
+
+	stop()
+	os.Exit(code)
+}
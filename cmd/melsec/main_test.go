@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dualm/melsec/mock"
+)
+
+func runCLI(t *testing.T, s *mock.Server, args ...string) (string, string, int) {
+	t.Helper()
+
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	args = append(args, "-addr", s.Addr())
+	code := run(context.Background(), args, nil, &stdout, &stderr, false)
+
+	return stdout.String(), stderr.String(), code
+}
+
+func TestReadWrite(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	if _, stderr, code := runCLI(t, s, "write", "D100", "1", "-2", "0x10", "-frame", "4E"); code != 0 {
+		t.Fatalf("write: %d %s", code, stderr)
+	}
+
+	if words, _ := s.Memory.Words("D100", 3); !reflect.DeepEqual(words, []uint16{1, 0xFFFE, 0x10}) {
+		t.Errorf("unexpected D100 %v", words)
+	}
+
+	stdout, stderr, code := runCLI(t, s, "read", "D100", "3", "-json")
+	if code != 0 {
+		t.Fatalf("read: %d %s", code, stderr)
+	}
+
+	var entries []entry
+	if err := json.Unmarshal([]byte(stdout), &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 || entries[1].Address != "D101" || entries[1].Value != float64(-2) {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	if _, _, code := runCLI(t, s, "write", "D200", "1.5", "-type", "float32"); code != 0 {
+		t.Fatal("float write failed")
+	}
+
+	stdout, _, _ = runCLI(t, s, "read", "-type", "float32", "D200")
+	if !strings.Contains(stdout, "D200     1.5") {
+		t.Errorf("unexpected table %q", stdout)
+	}
+}
+
+func TestBits(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	if _, stderr, code := runCLI(t, s, "write", "M20", "1", "off", "on"); code != 0 {
+		t.Fatalf("write: %d %s", code, stderr)
+	}
+
+	if bits, _ := s.Memory.Bits("M20", 3); !reflect.DeepEqual(bits, []bool{true, false, true}) {
+		t.Errorf("unexpected M20 %v", bits)
+	}
+
+	stdout, _, _ := runCLI(t, s, "dump", "M19", "4")
+	if stdout != "address,value\nM19,false\nM20,true\nM21,false\nM22,true\n" {
+		t.Errorf("unexpected dump %q", stdout)
+	}
+
+	// X按十六进制编号, 按字读取时每个值16点
+	_ = s.Memory.SetWords("X10", 0x1234, 0x5678)
+
+	stdout, _, _ = runCLI(t, s, "dump", "X10", "2", "-type", "uint16", "-format", "json")
+	if strings.TrimSpace(stdout) != `[{"address":"X10","value":4660},{"address":"X20","value":22136}]` {
+		t.Errorf("unexpected dump %q", stdout)
+	}
+}
+
+func TestInfoLoopbackMonitor(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	stdout, _, code := runCLI(t, s, "info", "-json")
+	if code != 0 || strings.TrimSpace(stdout) != `{"code":"0366","model":"Q03UDVCPU"}` {
+		t.Errorf("unexpected info %d %q", code, stdout)
+	}
+
+	stdout, _, code = runCLI(t, s, "loopback", "ABCD")
+	if code != 0 || !strings.HasPrefix(stdout, "echo ABCD in ") {
+		t.Errorf("unexpected loopback %d %q", code, stdout)
+	}
+
+	_ = s.Memory.SetWords("D10", 7)
+	_ = s.Memory.SetBits("Y0", true)
+
+	stdout, stderr, code := runCLI(t, s, "monitor", "D10,Y0", "-interval", "10ms", "-count", "2")
+	if code != 0 {
+		t.Fatalf("monitor: %d %s", code, stderr)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], " D10=7 Y0=true") {
+		t.Errorf("unexpected monitor output %q", stdout)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	for _, args := range [][]string{
+		{"frobnicate"},
+		{"read"},
+		{"dump", "D0", "0"},
+		{"read", "D0", "-nosuch"},
+	} {
+		if _, _, code := runCLI(t, s, args...); code != 2 {
+			t.Errorf("%v: want exit code 2, got %d", args, code)
+		}
+	}
+
+	if _, stderr, code := runCLI(t, s, "read", "D0", "-frame", "5E"); code != 1 || !strings.Contains(stderr, "unknown frame") {
+		t.Errorf("unexpected result %d %q", code, stderr)
+	}
+
+	// 结束代码异常时退出码为1
+	_ = s.AddFault(mock.Fault{Device: "D0", EndCode: mock.EndCodeDeviceRange})
+
+	if _, stderr, code := runCLI(t, s, "read", "D0"); code != 1 || stderr == "" {
+		t.Errorf("unexpected result %d %q", code, stderr)
+	}
+}
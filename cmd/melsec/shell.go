@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dualm/melsec"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+const shellHelp = `commands:
+  read ADDR[:TYPE] [COUNT]      读取软元件, 如 read D100:float32 2
+  write ADDR[:TYPE] VALUE...    写入软元件, 如 write M20 1 0 1
+  watch [ADDR[:TYPE]...]        加入监视列表并原地刷新, 按任意键停止
+  unwatch [ADDR...]             移出监视列表, 不指定时清空
+  plcs                          列出PLC
+  use NAME                      切换PLC
+  info                          读取CPU型号
+  loopback [DATA]               折返测试
+  decode FRAME [RESPONSE]       解码十六进制或ASCII码帧
+  history                       显示历史命令
+  exit                          退出
+types: bool int16 uint16 int32 uint32 float32 float64 string`
+
+var shellCommands = []string{"read", "write", "watch", "unwatch", "plcs", "use", "info", "loopback", "decode", "history", "help", "exit", "quit"}
+
+var typeNames = []string{"bool", "int16", "uint16", "int32", "uint32", "float32", "float64", "string"}
+
+// plcEntry -plcs文件中的一个PLC, 未填写的连接参数取自命令行.
+type plcEntry struct {
+	Name      string `yaml:"name"`
+	connFlags `yaml:",inline"`
+}
+
+// loadPLCs 读取PLC列表文件:
+//
+//	plcs:
+//	  - name: line1
+//	    addr: 192.168.0.10:5007
+//	    frame: 4E
+func loadPLCs(path string, base connFlags) ([]plcEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		PLCs []yaml.Node `yaml:"plcs"`
+	}
+
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	entries := make([]plcEntry, 0, len(doc.PLCs))
+	seen := make(map[string]bool)
+
+	for _, node := range doc.PLCs {
+		p := plcEntry{connFlags: base}
+
+		if err := node.Decode(&p); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if p.Name == "" || seen[p.Name] {
+			return nil, fmt.Errorf("%s:%d: missing or duplicate plc name %q", path, node.Line, p.Name)
+		}
+
+		seen[p.Name] = true
+		entries = append(entries, p)
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s: no plcs", path)
+	}
+
+	return entries, nil
+}
+
+type watchItem struct {
+	spec string
+	r    *reader
+}
+
+// shell 交互式调试环境, 按名称切换多个PLC.
+type shell struct {
+	env      *env
+	plcs     []plcEntry
+	conns    map[string]*melsec.PlcConn
+	current  int
+	watches  []watchItem
+	history  []string
+	interval time.Duration
+
+	// keys 终端中watch等待按键的输入, 非终端时为nil, watch只输出一次
+	keys io.Reader
+	// candidates 显示多个补全候选
+	candidates func([]string)
+}
+
+func shellCommand(fs *flag.FlagSet) func(context.Context, *env, []string) error {
+	plcs := fs.String("plcs", "", "PLC列表文件(YAML), 未指定时只有由连接参数定义的default")
+	interval := fs.Duration("interval", 500*time.Millisecond, "watch的刷新周期")
+
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("%w: shell takes no arguments", errUsage)
+		}
+
+		s := &shell{
+			env:      e,
+			plcs:     []plcEntry{{Name: "default", connFlags: e.flags}},
+			conns:    make(map[string]*melsec.PlcConn),
+			interval: *interval,
+		}
+
+		if *plcs != "" {
+			entries, err := loadPLCs(*plcs, e.flags)
+			if err != nil {
+				return err
+			}
+
+			s.plcs = entries
+		}
+
+		defer s.close()
+
+		return s.run(ctx)
+	}
+}
+
+func (s *shell) close() {
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *shell) prompt() string {
+	return "melsec(" + s.plcs[s.current].Name + ")> "
+}
+
+func (s *shell) run(ctx context.Context) error {
+	readLine := func() (string, error) {
+		return "", io.EOF
+	}
+
+	f, ok := s.env.stdin.(*os.File)
+	if ok && term.IsTerminal(int(f.Fd())) {
+		fd := int(f.Fd())
+
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			_ = term.Restore(fd, state)
+		}()
+
+		t := term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{f, s.env.stdout}, s.prompt())
+
+		if w, h, err := term.GetSize(fd); err == nil {
+			_ = t.SetSize(w, h)
+		}
+
+		t.AutoCompleteCallback = s.complete
+		s.candidates = func(c []string) {
+			fmt.Fprintln(t, strings.Join(c, "  "))
+		}
+		s.keys = f
+		s.env.stdout = t
+
+		readLine = func() (string, error) {
+			t.SetPrompt(s.prompt())
+
+			return t.ReadLine()
+		}
+
+		fmt.Fprintln(t, "type 'help' for commands, Tab completes devices")
+	} else if s.env.stdin != nil {
+		sc := bufio.NewScanner(s.env.stdin)
+
+		readLine = func() (string, error) {
+			if !sc.Scan() {
+				if sc.Err() != nil {
+					return "", sc.Err()
+				}
+
+				return "", io.EOF
+			}
+
+			return sc.Text(), nil
+		}
+	}
+
+	for ctx.Err() == nil {
+		line, err := readLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		s.history = append(s.history, line)
+
+		if s.exec(ctx, line) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// conn 返回当前PLC的连接, 尚未连接时建立连接.
+func (s *shell) conn() (*melsec.PlcConn, error) {
+	p := s.plcs[s.current]
+
+	if conn, ok := s.conns[p.Name]; ok {
+		return conn, nil
+	}
+
+	conn, err := p.dial(s.env.stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.conns[p.Name] = conn
+
+	return conn, nil
+}
+
+// drop 通信失败时关闭当前连接, 下一个命令重新连接.
+func (s *shell) drop(err error) {
+	var ne net.Error
+	if !errors.As(err, &ne) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return
+	}
+
+	name := s.plcs[s.current].Name
+
+	if conn, ok := s.conns[name]; ok {
+		_ = conn.Close()
+		delete(s.conns, name)
+	}
+
+	for i := range s.watches {
+		s.watches[i].r = nil
+	}
+}
+
+// splitSpec 拆分ADDR[:TYPE].
+func splitSpec(spec string) (string, string) {
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		return spec[:i], spec[i+1:]
+	}
+
+	return spec, ""
+}
+
+// exec 执行一行命令, 返回是否退出.
+func (s *shell) exec(ctx context.Context, line string) bool {
+	fields := strings.Fields(line)
+	out := s.env.stdout
+
+	var err error
+
+	switch fields[0] {
+	case "exit", "quit":
+		return true
+	case "help":
+		fmt.Fprintln(out, shellHelp)
+	case "history":
+		for i, h := range s.history {
+			fmt.Fprintf(out, "%4d  %s\n", i+1, h)
+		}
+	case "plcs":
+		s.listPLCs()
+	case "use":
+		err = s.use(fields[1:])
+	case "decode":
+		err = s.decode(fields[1:])
+	case "unwatch":
+		s.unwatch(fields[1:])
+	case "read", "write", "watch", "info", "loopback":
+		err = s.online(ctx, fields)
+	default:
+		err = fmt.Errorf("unknown command %q, type 'help'", fields[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "error: %v\n", err)
+	}
+
+	return false
+}
+
+func (s *shell) listPLCs() {
+	tw := tabwriter.NewWriter(s.env.stdout, 0, 0, 2, ' ', 0)
+
+	for i, p := range s.plcs {
+		mark := " "
+		if i == s.current {
+			mark = "*"
+		}
+
+		state := ""
+		if _, ok := s.conns[p.Name]; ok {
+			state = "connected"
+		}
+
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\n", mark, p.Name, p.Addr, strings.ToUpper(p.Frame), state)
+	}
+
+	_ = tw.Flush()
+}
+
+func (s *shell) use(args []string) error {
+	if len(args) != 1 {
+		return errors.New("need NAME")
+	}
+
+	for i, p := range s.plcs {
+		if p.Name == args[0] {
+			s.current = i
+
+			for j := range s.watches {
+				s.watches[j].r = nil
+			}
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown plc %q", args[0])
+}
+
+// online 执行需要连接的命令.
+func (s *shell) online(ctx context.Context, fields []string) error {
+	conn, err := s.conn()
+	if err != nil {
+		return err
+	}
+
+	s.env.conn = conn
+
+	err = s.dispatch(ctx, fields[0], fields[1:])
+	if err != nil {
+		s.drop(err)
+	}
+
+	return err
+}
+
+func (s *shell) dispatch(ctx context.Context, cmd string, args []string) error {
+	e := s.env
+
+	switch cmd {
+	case "read":
+		if len(args) == 0 || len(args) > 2 {
+			return errors.New("need ADDR[:TYPE] [COUNT]")
+		}
+
+		count := 1
+
+		if len(args) == 2 {
+			var err error
+
+			if count, err = parseCount(args[1]); err != nil {
+				return err
+			}
+		}
+
+		address, typ := splitSpec(args[0])
+
+		r, err := newReader(e.conn, address, count, typ)
+		if err != nil {
+			return err
+		}
+
+		entries, err := r.read(e)
+		if err != nil {
+			return err
+		}
+
+		return printTable(e.stdout, entries)
+	case "write":
+		if len(args) < 2 {
+			return errors.New("need ADDR[:TYPE] VALUE...")
+		}
+
+		address, typ := splitSpec(args[0])
+
+		if err := writeValues(e, address, args[1:], typ); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(e.stdout, "wrote %d value(s) to %s\n", len(args)-1, address)
+	case "watch":
+		for _, spec := range args {
+			if err := s.addWatch(spec); err != nil {
+				return err
+			}
+		}
+
+		return s.watch(ctx)
+	case "info", "loopback":
+		var (
+			exec func(context.Context, *env, []string) error
+			fs   = flag.NewFlagSet(cmd, flag.ContinueOnError)
+		)
+
+		if cmd == "info" {
+			exec = infoCommand(fs)
+		} else {
+			exec = loopbackCommand(fs)
+		}
+
+		return exec(ctx, e, args)
+	}
+
+	return nil
+}
+
+func (s *shell) addWatch(spec string) error {
+	address, typ := splitSpec(spec)
+
+	if _, err := newReader(s.env.conn, address, 1, typ); err != nil {
+		return err
+	}
+
+	for _, w := range s.watches {
+		if w.spec == spec {
+			return nil
+		}
+	}
+
+	s.watches = append(s.watches, watchItem{spec: spec})
+
+	return nil
+}
+
+func (s *shell) unwatch(specs []string) {
+	if len(specs) == 0 {
+		s.watches = nil
+
+		return
+	}
+
+	kept := s.watches[:0]
+
+	for _, w := range s.watches {
+		keep := true
+
+		for _, spec := range specs {
+			if address, _ := splitSpec(w.spec); w.spec == spec || address == spec {
+				keep = false
+			}
+		}
+
+		if keep {
+			kept = append(kept, w)
+		}
+	}
+
+	s.watches = kept
+}
+
+// renderWatch 返回监视列表的表格.
+func (s *shell) renderWatch() []byte {
+	buf := bytes.Buffer{}
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "%s\t%s\n", s.plcs[s.current].Name, time.Now().Format("15:04:05.000"))
+
+	for i := range s.watches {
+		w := &s.watches[i]
+
+		var (
+			entries []entry
+			err     error
+		)
+
+		if w.r == nil {
+			address, typ := splitSpec(w.spec)
+			w.r, err = newReader(s.env.conn, address, 1, typ)
+		}
+
+		if err == nil {
+			entries, err = w.r.read(s.env)
+		}
+
+		if err != nil {
+			s.drop(err)
+			fmt.Fprintf(tw, "%s\terror: %v\n", w.spec, err)
+
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s\t%v\n", w.spec, entries[0].Value)
+	}
+
+	_ = tw.Flush()
+
+	return buf.Bytes()
+}
+
+// watch 刷新监视列表. 终端中原地刷新直到按键, 否则输出一次.
+func (s *shell) watch(ctx context.Context) error {
+	if len(s.watches) == 0 {
+		return errors.New("watch list is empty")
+	}
+
+	out := s.env.stdout
+
+	if s.keys == nil {
+		_, err := out.Write(s.renderWatch())
+
+		return err
+	}
+
+	fmt.Fprintf(out, "refresh every %s, press any key to stop\n", s.interval)
+
+	stop := make(chan struct{})
+
+	go func() {
+		b := make([]byte, 1)
+		_, _ = s.keys.Read(b)
+		close(stop)
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	lines := 0
+
+	for {
+		if lines > 0 {
+			fmt.Fprintf(out, "\x1b[%dA\x1b[J", lines)
+		}
+
+		b := s.renderWatch()
+		lines = bytes.Count(b, []byte("\n"))
+
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// frameLengthOK 判断帧头部的数据长度与帧的实际长度是否一致.
+func frameLengthOK(b []byte, ascii bool) bool {
+	width := 1
+	if ascii {
+		width = 2
+	}
+
+	if len(b) < width {
+		return false
+	}
+
+	sub := fmt.Sprintf("%02X", b[0])
+	if ascii {
+		sub = string(b[:2])
+	}
+
+	// 数据长度之前: 副帧头2, 访问路径5, 4E另有序列号与空白4
+	offset := 7 * width
+
+	switch sub {
+	case "50", "D0":
+	case "54", "D4":
+		offset += 4 * width
+	default:
+		return false
+	}
+
+	if len(b) < offset+2*width {
+		return false
+	}
+
+	var length uint64
+
+	if ascii {
+		v, err := strconv.ParseUint(string(b[offset:offset+4]), 16, 16)
+		if err != nil {
+			return false
+		}
+
+		length = v
+	} else {
+		length = uint64(b[offset]) | uint64(b[offset+1])<<8
+	}
+
+	return int(length) == len(b)-offset-2*width
+}
+
+// parseFrame 解析粘贴的帧. 十六进制文本的长度与二进制帧不符而与ASCII码帧相符时按ASCII码帧解码.
+func parseFrame(s string) ([]byte, error) {
+	text := strings.NewReplacer(" ", "", ":", "", "-", "").Replace(s)
+
+	b, hexErr := hex.DecodeString(text)
+	if hexErr == nil && frameLengthOK(b, false) {
+		return b, nil
+	}
+
+	if frameLengthOK([]byte(text), true) {
+		return []byte(text), nil
+	}
+
+	if hexErr != nil {
+		return nil, fmt.Errorf("frame is neither hex nor ASCII: %w", hexErr)
+	}
+
+	return b, nil
+}
+
+// decode 解码请求帧, 同时给出响应帧时按请求解释响应数据.
+func (s *shell) decode(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("need FRAME [RESPONSE]")
+	}
+
+	frames := make([][]byte, len(args))
+
+	for i, arg := range args {
+		b, err := parseFrame(arg)
+		if err != nil {
+			return err
+		}
+
+		frames[i] = b
+	}
+
+	out := s.env.stdout
+
+	if len(frames) == 1 {
+		f, err := melsec.DecodeFrame(frames[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out, f)
+
+		return nil
+	}
+
+	req, resp, err := melsec.DecodeExchange(frames[0], frames[1])
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, req)
+	fmt.Fprintln(out, resp)
+
+	return nil
+}
+
+// complete 补全命令、软元件名称、数据类型与PLC名称.
+func (s *shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	head := line[:pos]
+	start := strings.LastIndexAny(head, " ") + 1
+	word := head[start:]
+	typed := word
+	fields := strings.Fields(head[:start])
+
+	var (
+		candidates []string
+		prefix     string
+		space      = true
+	)
+
+	switch {
+	case len(fields) == 0:
+		candidates = shellCommands
+	case fields[0] == "use":
+		for _, p := range s.plcs {
+			candidates = append(candidates, p.Name)
+		}
+	case fields[0] == "unwatch":
+		for _, w := range s.watches {
+			candidates = append(candidates, w.spec)
+		}
+	case fields[0] == "read" || fields[0] == "write" || fields[0] == "watch":
+		if len(fields) > 1 && fields[0] != "watch" {
+			return "", 0, false
+		}
+
+		if i := strings.IndexByte(word, ':'); i >= 0 {
+			prefix, word = word[:i+1], word[i+1:]
+			candidates = typeNames
+		} else {
+			word = strings.ToUpper(word)
+			space = false
+
+			for _, d := range melsec.Devices() {
+				candidates = append(candidates, d.Name)
+			}
+		}
+	}
+
+	var matches []string
+
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	sort.Strings(matches)
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(matches) == 1 && space {
+		common += " "
+	}
+
+	if prefix+common == typed && len(matches) > 1 {
+		if s.candidates != nil {
+			s.candidates(matches)
+		}
+
+		return "", 0, false
+	}
+
+	completed := line[:start] + prefix + common
+
+	return completed + line[pos:], len(completed), true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dualm/melsec/mock"
+)
+
+func TestShellScript(t *testing.T) {
+	line1, line2 := mock.NewServer(), mock.NewServer()
+	defer line1.Close()
+	defer line2.Close()
+
+	_ = line2.Memory.SetWords("D100", 42)
+
+	path := filepath.Join(t.TempDir(), "plcs.yaml")
+	config := fmt.Sprintf("plcs:\n  - name: line1\n    addr: %s\n    frame: 4E\n  - name: line2\n    addr: %s\n", line1.Addr(), line2.Addr())
+
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	script := strings.Join([]string{
+		"write D100:int32 70000",
+		"read D100:int32",
+		"write M0 1 0 1",
+		"read M0 3",
+		"watch D100:uint16 M2",
+		"unwatch M2",
+		"watch",
+		"use line2",
+		"plcs",
+		"read D100",
+		"decode 500000FFFF03000C00100001040000640000A80300",
+		"decode 500000FF03FF000018001004010000D*0001000003",
+		"frobnicate",
+		"history",
+		"exit",
+		"read D0",
+	}, "\n")
+
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+
+	code := run(context.Background(), []string{"shell", "-plcs", path}, strings.NewReader(script), &stdout, &stderr, false)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+
+	out := stdout.String()
+
+	for _, want := range []string{
+		"wrote 1 value(s) to D100",
+		"D100     70000",
+		"M2       true",
+		"D100:uint16  4464\nM2           true\n",
+		"* line2",
+		"D100     42",
+		"3E binary request net=00 pc=FF io=03FF st=00 timer=4s 0401/0000 batch read (word units) D100:3w",
+		"3E ASCII request",
+		`error: unknown command "frobnicate"`,
+		"  14  history",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("want %q in output:\n%s", want, out)
+		}
+	}
+
+	// unwatch之后的watch只有D100
+	if i := strings.LastIndex(out, "D100:uint16"); strings.Contains(out[i:], "M2  ") {
+		t.Errorf("M2 should be unwatched:\n%s", out)
+	}
+
+	// exit之后的命令不执行
+	if line2.Requests() != 1 {
+		t.Errorf("want 1 request to line2, got %d", line2.Requests())
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	s := &shell{plcs: []plcEntry{{Name: "line1"}, {Name: "line2"}}}
+
+	var shown []string
+	s.candidates = func(c []string) {
+		shown = c
+	}
+
+	tests := []struct {
+		line string
+		want string
+		ok   bool
+	}{
+		{"re", "read ", true},
+		{"read d1", "read D1", false},
+		{"read z", "read Z", true},
+		{"read D100:fl", "read D100:float", true},
+		{"read D100:float6", "read D100:float64 ", true},
+		{"use l", "use line", true},
+		{"read D100 1", "", false},
+	}
+
+	for _, tt := range tests {
+		got, pos, ok := s.complete(tt.line, len(tt.line), '\t')
+		if ok != tt.ok || ok && (got != tt.want || pos != len(tt.want)) {
+			t.Errorf("%q: want %q %v, got %q %d %v", tt.line, tt.want, tt.ok, got, pos, ok)
+		}
+	}
+
+	if _, _, ok := s.complete("use line", 8, '\t'); ok || len(shown) != 2 {
+		t.Errorf("want candidates shown, got %v", shown)
+	}
+
+	if _, _, ok := s.complete("re", 2, 'a'); ok {
+		t.Error("only Tab completes")
+	}
+}
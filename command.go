@@ -9,10 +9,14 @@ var (
 
 	CommandMultiWriteWordBinary McMessage = []byte{0x01, 0x14, 0x00, 0x00}
 
-	// CommandRandomRead_Word_Binary McMessage = []byte{0x01, 0x04, 0x00, 0x00}
+	CommandRandomReadWordBinary McMessage = []byte{0x03, 0x04, 0x00, 0x00}
 
 	CommandMultiBlockReadBinary  McMessage = []byte{0x06, 0x04, 0x00, 0x00}
 	CommandMultiBlockWriteBinary McMessage = []byte{0x06, 0x14, 0x00, 0x00}
 
+	CommandRandomWriteBitBinary McMessage = []byte{0x02, 0x14, 0x01, 0x00}
+
+	CommandLoopbackTest McMessage = []byte{0x19, 0x06, 0x00, 0x00}
+
 	CodeOK = []byte{0x00, 0x00}
 )
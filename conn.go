@@ -2,89 +2,299 @@ package melsec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"reflect"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	FirstResponseLength     = 11 // 副帧头=2, 访问路径=7, 数据长度=2
+	FirstResponseLength4E   = 15 // 副帧头=2, 序列号=4, 访问路径=7, 数据长度=2
 	ResponseErrorCodeIndex  = 9
 	ResponseErrorCodeLength = 2
 )
 
+// ErrSerialMismatch 4E帧响应的序列号与请求不一致.
+var ErrSerialMismatch = errors.New("response serial number mismatch")
+
 func NewConn(addr, port string, ops ...PlcOption) (*PlcConn, error) {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr+":"+port)
+	option := newPlcOption(nil)
+
+	for _, o := range ops {
+		if o == nil {
+			continue
+		}
+
+		if err := o(option); err != nil {
+			return nil, err
+		}
+	}
+
+	address := net.JoinHostPort(addr, port)
+
+	conn, err := dial(address, option.dialTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	return &PlcConn{
+		Conn:    conn,
+		option:  option,
+		address: address,
+		timeout: option.timeout,
+	}, nil
+}
+
+func dial(address string, timeout time.Duration) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", address, timeout)
 	if err != nil {
 		return nil, err
 	}
 
+	conn := c.(*net.TCPConn)
+
 	if err = conn.SetKeepAlive(true); err != nil {
+		_ = conn.Close()
+
 		return nil, err
 	}
 
-	return &PlcConn{
-		conn,
-		newPlcOption(ops),
-	}, nil
+	return conn, nil
 }
 
+// PlcConn 与PLC的连接, 可被多个goroutine共享, 请求按顺序逐个发送.
+// 请求的超时以SetTimeout设置, 不要在共享的连接上调用SetDeadline等net.Conn的方法.
 type PlcConn struct {
 	// conn   net.Conn
 	net.Conn
-	option *plcOptions
+	option   *plcOptions
+	mu       sync.Mutex
+	serial   uint16
+	recorder *Recorder
+	address  string
+	timeout  time.Duration // 每次请求的超时时间, 由mu保护
+	deadline bool          // 连接上是否有上一次请求设置的期限, 由mu保护
 }
 
-func (plc *PlcConn) SendCmd(msg McMessage, retSize int, debug bool) ([]byte, error) {
-	_, err := plc.Write(msg)
-	if err != nil {
-		return nil, err
+// Reconnect 关闭当前连接并重新连接NewConn时的地址, 进行中的请求完成后执行.
+// 已创建的Device等可以继续使用.
+func (plc *PlcConn) Reconnect() error {
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+
+	if plc.address == "" {
+		return errors.New("reconnect: connection was not created by NewConn")
 	}
 
-	buff := make([]byte, FirstResponseLength)
+	_ = plc.Conn.Close()
+
+	conn, err := dial(plc.address, plc.option.dialTimeout)
+
+	if m := plc.option.metrics; m != nil {
+		m.Reconnected(plc.address, err)
+	}
 
-	_, err = io.ReadFull(plc, buff)
 	if err != nil {
-		return nil, fmt.Errorf("got % x, %w", buff, err)
+		return err
+	}
+
+	plc.Conn = conn
+	plc.deadline = false
+
+	return nil
+}
+
+// SetTimeout 设置之后每次请求的超时时间, 0为不限制. 对共享连接的所有使用者生效.
+func (plc *PlcConn) SetTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("negative timeout %v", d)
 	}
 
-	if debug {
-		log.Printf("first response: % x", buff)
+	plc.mu.Lock()
+	plc.timeout = d
+	plc.mu.Unlock()
+
+	return nil
+}
+
+// SendCmd 发送请求并读取完整的响应, 返回响应数据的前retSize个字节, retSize小于0时返回全部响应数据.
+// 响应按数据长度读取, 出错时也不会在连接中残留未读的数据.
+func (plc *PlcConn) SendCmd(msg McMessage, retSize int) ([]byte, error) {
+	m := plc.option.metrics
+	if m == nil {
+		return plc.send(msg, retSize, &RequestStats{})
 	}
 
-	// 返回错误代码
-	if errorCode := buff[ResponseErrorCodeIndex : ResponseErrorCodeIndex+ResponseErrorCodeLength]; !reflect.DeepEqual(errorCode, CodeOK) {
-		buff = make([]byte, ResponseErrorCodeLength)
+	st := RequestStats{PLC: plc.address}
+	st.Command, st.SubCommand = requestCommand(msg, plc.option.frame)
 
-		_, err = io.ReadFull(plc, buff)
-		if err != nil {
+	m.RequestStarted(st.PLC)
+
+	b, err := plc.send(msg, retSize, &st)
+	st.Err = err
+
+	m.RequestDone(st)
+
+	return b, err
+}
+
+// send 执行一次请求, 统计结果写入st.
+func (plc *PlcConn) send(msg McMessage, retSize int, st *RequestStats) ([]byte, error) {
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+
+	var serial uint16
+
+	if plc.option.frame == Frame4E {
+		plc.serial++
+		serial = plc.serial
+
+		msg = append(McMessage{}, msg...)
+		binary.LittleEndian.PutUint16(msg[2:], serial)
+	}
+
+	wire := msg
+
+	if plc.option.ascii {
+		var err error
+
+		if wire, err = transcodeRequest(msg, true); err != nil {
 			return nil, err
 		}
+	}
+
+	start := time.Now()
+
+	// 超时为0时清除上一次请求留下的期限
+	if d := plc.timeout; d > 0 || plc.deadline {
+		deadline := time.Time{}
+		if d > 0 {
+			deadline = start.Add(d)
+		}
+
+		if err := plc.Conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+
+		plc.deadline = d > 0
+	}
+
+	resp, sent, err := plc.exchange(wire)
+
+	latency := time.Since(start)
+	st.Latency, st.Sent, st.Received = latency, sent, len(resp)
+
+	if plc.recorder != nil {
+		plc.recorder.record(start, wire, resp, err)
+	}
+
+	if err == nil && plc.option.ascii {
+		resp, err = transcodeResponse(resp, msg, false)
+	}
+
+	logger := plc.option.logger
+	_, quiet := logger.(nopLogger)
+
+	if err != nil {
+		if !quiet {
+			logger.Error("mc exchange failed", append(plc.exchangeAttrs(msg, resp), "latency", latency, "error", err)...)
+		}
+
+		return nil, err
+	}
+
+	headerLength := plc.option.headerLength()
+	buff, data := resp[:headerLength], resp[headerLength:]
+
+	if plc.option.frame == Frame4E {
+		if got := binary.LittleEndian.Uint16(buff[2:]); got != serial {
+			return nil, fmt.Errorf("%w: want %d, got %d", ErrSerialMismatch, serial, got)
+		}
+	}
 
-		log.Printf("errorcode: % x", buff)
+	// 返回错误代码
+	if errorCode := buff[headerLength-ResponseErrorCodeLength:]; !reflect.DeepEqual(errorCode, CodeOK) {
+		code := binary.LittleEndian.Uint16(errorCode)
+		st.EndCode = code
+
+		if !quiet {
+			logger.Warn("mc end code", append(plc.exchangeAttrs(msg, resp), "latency", latency,
+				"end_code", fmt.Sprintf("%04X", code), "reason", ExplainEndCode(code))...)
+		}
 
 		return nil, ErrorSelect(errorCode)
 	}
 
+	if !quiet {
+		logger.Debug("mc exchange", append(plc.exchangeAttrs(msg, resp), "latency", latency)...)
+	}
+
+	if retSize < 0 {
+		return data, nil
+	}
+
 	if retSize == 0 {
 		return nil, nil
 	}
 
-	buff = make([]byte, retSize)
+	if len(data) < retSize {
+		return nil, fmt.Errorf("short response: want %d bytes, got %d", retSize, len(data))
+	}
+
+	return data[:retSize], nil
+}
 
-	_, err = io.ReadFull(plc, buff)
+// exchange 发送请求并读取完整的响应帧, 出错时返回已经收到的部分. sent为实际发送的字节数.
+func (plc *PlcConn) exchange(msg McMessage) ([]byte, int, error) {
+	sent, err := plc.Write(msg)
 	if err != nil {
-		return nil, err
+		return nil, sent, err
+	}
+
+	ascii := plc.option.ascii
+	headerLength := fieldWidth(ascii, plc.option.headerLength())
+	buff := make([]byte, headerLength)
+
+	n, err := io.ReadFull(plc, buff)
+	if err != nil {
+		return buff[:n], sent, fmt.Errorf("got % x, %w", buff, err)
+	}
+
+	// 数据长度包含结束代码
+	codeLength := fieldWidth(ascii, ResponseErrorCodeLength)
+	lengthField := buff[headerLength-2*codeLength : headerLength-codeLength]
+
+	var length int
+
+	if ascii {
+		v, err := strconv.ParseUint(string(lengthField), 16, 16)
+		if err != nil {
+			return buff, sent, fmt.Errorf("invalid response length %q", lengthField)
+		}
+
+		length = int(v)
+	} else {
+		length = int(binary.LittleEndian.Uint16(lengthField))
+	}
+
+	if length < codeLength {
+		return buff, sent, fmt.Errorf("invalid response length %d", length)
+	}
+
+	data := make([]byte, length-codeLength)
+
+	n, err = io.ReadFull(plc, data)
+	if err != nil {
+		return append(buff, data[:n]...), sent, err
 	}
 
-	return buff, nil
+	return append(buff, data...), sent, nil
 }
 
 func (plc *PlcConn) GetCPUInfo() (string, error) {
@@ -93,7 +303,7 @@ func (plc *PlcConn) GetCPUInfo() (string, error) {
 		return "", err
 	}
 
-	_b, err := plc.SendCmd(cmd, 18, false)
+	_b, err := plc.SendCmd(cmd, 18)
 	if err != nil {
 		return "", err
 	}
@@ -104,3 +314,63 @@ func (plc *PlcConn) GetCPUInfo() (string, error) {
 func getCPUInfo() McMessage {
 	return []byte{0x01, 0x01, 0x00, 0x00}
 }
+
+// WriteBits 以位为单位随机写入多个位软元件, 不影响同一字内的其他位.
+func (plc *PlcConn) WriteBits(devices []string, values []bool) error {
+	cmd, err := plc.option.generateMessageRandomBits(devices, values)
+	if err != nil {
+		return err
+	}
+
+	_, err = plc.SendCmd(cmd, 0)
+
+	return err
+}
+
+// ReadRandom 随机读取多个字及双字软元件, 返回值依次为各字(2字节)与各双字(4字节)的数据.
+func (plc *PlcConn) ReadRandom(words, dwords []string) ([]byte, error) {
+	cmd, err := plc.option.generateMessageRandomRead(words, dwords)
+	if err != nil {
+		return nil, err
+	}
+
+	return plc.SendCmd(cmd, len(words)*2+len(dwords)*4)
+}
+
+// Loopback 执行折返测试, PLC原样返回data. data为1-960字节的0-9、A-F字符.
+func (plc *PlcConn) Loopback(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data) > 960 {
+		return nil, fmt.Errorf("loopback data length %d out of range 1-960", len(data))
+	}
+
+	body := append(McMessage{}, CommandLoopbackTest...)
+	body = append(body, byte(len(data)), byte(len(data)>>8))
+	body = append(body, data...)
+
+	cmd, err := plc.option.makeRequest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := plc.SendCmd(cmd, len(data)+2)
+	if err != nil {
+		return nil, err
+	}
+
+	return b[2:], nil
+}
+
+// Forward 以连接的帧格式、访问路径与监视定时器发送一个请求, cmd为二进制格式的指令、子指令与请求数据,
+// 返回全部响应数据. PLC以非0结束代码响应时返回*EndCodeError. 用于转发其他客户端的请求.
+func (plc *PlcConn) Forward(cmd []byte) ([]byte, error) {
+	if len(cmd) < 4 {
+		return nil, fmt.Errorf("forward: command too short: % x", cmd)
+	}
+
+	msg, err := plc.option.makeRequest(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return plc.SendCmd(msg, -1)
+}
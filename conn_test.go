@@ -0,0 +1,512 @@
+package melsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePLC 只支持字软元件的批量与多块批量读写及随机位写入, 用于测试请求的拆分与合并.
+type fakePLC struct {
+	mu       sync.Mutex
+	mem      map[byte][]byte  // 软元件代码 -> 每个编号2字节
+	requests [][]byte         // 收到的请求数据(监视定时器之后)
+	failAt   int              // 第failAt个请求(从1开始)返回错误代码, 0为不失败
+	after    func(cmd uint16) // 每个请求处理之后调用, 可模拟PLC程序改写软元件
+}
+
+func newFakePLC(t *testing.T, ops ...PlcOption) (*fakePLC, *PlcConn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	plc := &fakePLC{mem: make(map[byte][]byte)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go plc.serve(conn)
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+
+	conn, err := NewConn(addr.IP.String(), strconv.Itoa(addr.Port), ops...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return plc, conn
+}
+
+func (plc *fakePLC) words(code byte, no, count int) []byte {
+	need := (no + count) * 2
+	if len(plc.mem[code]) < need {
+		plc.mem[code] = append(plc.mem[code], make([]byte, need-len(plc.mem[code]))...)
+	}
+
+	return plc.mem[code][no*2 : need]
+}
+
+func (plc *fakePLC) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	for {
+		req, ascii, err := readFakeRequest(conn)
+		if err != nil {
+			return
+		}
+
+		resp, code := plc.handle(req[11:])
+
+		b := bytes.Buffer{}
+		b.Write([]byte{0xD0, 0x00})
+		b.Write(req[2:7])
+		_ = binary.Write(&b, binary.LittleEndian, uint16(len(resp)+2))
+		_ = binary.Write(&b, binary.LittleEndian, code)
+		b.Write(resp)
+
+		out := b.Bytes()
+
+		if ascii {
+			if out, err = transcodeResponse(out, req, true); err != nil {
+				return
+			}
+		}
+
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// readFakeRequest 读取一个3E请求帧, ASCII码的请求转换为二进制返回.
+func readFakeRequest(conn net.Conn) ([]byte, bool, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return nil, false, err
+	}
+
+	if ascii := header[0] == '5'; ascii {
+		header = append(header, make([]byte, 9)...)
+		if _, err := io.ReadFull(conn, header[1:]); err != nil {
+			return nil, false, err
+		}
+
+		length, err := strconv.ParseUint(string(header[14:]), 16, 16)
+		if err != nil {
+			return nil, false, err
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil, false, err
+		}
+
+		req, err := transcodeRequest(append(header, data...), false)
+
+		return req, true, err
+	}
+
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return nil, false, err
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint16(header[7:]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, false, err
+	}
+
+	return append(header, data...), false, nil
+}
+
+func (plc *fakePLC) handle(req []byte) ([]byte, uint16) {
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+
+	plc.requests = append(plc.requests, req)
+	if plc.failAt == len(plc.requests) {
+		return []byte{0, 0, 0, 0, 0, 0, 0, 0, 0}, 0xC051
+	}
+
+	device := func(b []byte) (byte, int) {
+		return b[3], int(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16)
+	}
+
+	cmd, body := binary.LittleEndian.Uint16(req), req[4:]
+
+	if plc.after != nil {
+		defer plc.after(cmd)
+	}
+
+	switch cmd {
+	case 0x0401, 0x1401:
+		code, no := device(body)
+		count := int(binary.LittleEndian.Uint16(body[4:]))
+
+		if cmd == 0x1401 {
+			copy(plc.words(code, no, count), body[6:])
+
+			return nil, 0
+		}
+
+		return append([]byte{}, plc.words(code, no, count)...), 0
+	case 0x0406, 0x1406:
+		blocks := int(body[0]) + int(body[1])
+		body = body[2:]
+		resp := make([]byte, 0)
+
+		for i := 0; i < blocks; i++ {
+			code, no := device(body)
+			count := int(binary.LittleEndian.Uint16(body[4:]))
+			body = body[6:]
+
+			if cmd == 0x1406 {
+				copy(plc.words(code, no, count), body[:count*2])
+				body = body[count*2:]
+
+				continue
+			}
+
+			resp = append(resp, plc.words(code, no, count)...)
+		}
+
+		return resp, 0
+	case 0x1402:
+		// 位软元件按起始编号存放, 第0位为该编号本身
+		for i := 0; i < int(body[0]); i++ {
+			code, no := device(body[1+i*5:])
+			w := plc.words(code, no, 1)
+			w[0] = w[0]&^1 | body[5+i*5]
+		}
+
+		return nil, 0
+	}
+
+	return nil, 0xC059
+}
+
+func TestDeviceSplit(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	dev, err := NewDevice("D0", 2000, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dev.Atomic() {
+		t.Error("want non-atomic device")
+	}
+
+	value := make([]byte, 4000)
+	for i := range value {
+		value[i] = byte(i)
+	}
+
+	dev.SetValue(value)
+
+	if err := dev.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dev.GetValue(), value) {
+		t.Fatal("read back mismatch")
+	}
+
+	// 960 + 960 + 80, 写和读各3个请求
+	if len(plc.requests) != 6 {
+		t.Fatalf("want 6 requests, got %d", len(plc.requests))
+	}
+
+	if count := binary.LittleEndian.Uint16(plc.requests[5][8:]); count != 80 {
+		t.Errorf("want last chunk of 80 words, got %d", count)
+	}
+}
+
+func TestDevicePartialWrite(t *testing.T) {
+	plc, conn := newFakePLC(t)
+	plc.failAt = 2
+
+	dev, err := NewDevice("D0", 1000, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.SetValue(make([]byte, 2000))
+
+	err = dev.Write()
+
+	var partial *PartialWriteError
+	if !errors.As(err, &partial) || !errors.Is(err, ErrNonAtomicWrite) || partial.Written != 1 || partial.Total != 2 {
+		t.Fatalf("want partial write of 1/2, got %v", err)
+	}
+}
+
+func TestMultiDeviceSplit(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	dev, err := NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([][]byte, 0)
+
+	for i := 0; i < 130; i++ {
+		dev.AddBlock("D"+strconv.Itoa(i*10), 2)
+		values = append(values, []byte{byte(i), 0, 0, byte(i)})
+	}
+
+	dev.AddBlock("R0", 1500)
+	values = append(values, bytes.Repeat([]byte{0xAB}, 3000))
+
+	if dev.Atomic() {
+		t.Error("want non-atomic multi device")
+	}
+
+	dev.SetValue(values)
+
+	if err := dev.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := len(plc.requests)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range dev.GetValue() {
+		if !bytes.Equal(v, values[i]) {
+			t.Fatalf("block %d: read back mismatch", i)
+		}
+	}
+
+	for _, req := range plc.requests[writes:] {
+		if blocks := int(req[4]) + int(req[5]); blocks > MaxBlocks {
+			t.Errorf("request with %d blocks", blocks)
+		}
+	}
+
+	if reads := len(plc.requests) - writes; reads != writes || reads < 3 {
+		t.Errorf("want the same number (>=3) of read and write requests, got %d and %d", reads, writes)
+	}
+}
+
+func TestGenerateCmdMultiLimits(t *testing.T) {
+	names := make([]string, 121)
+	counts := make([]int, 121)
+
+	for i := range names {
+		names[i], counts[i] = "D"+strconv.Itoa(i), 1
+	}
+
+	if _, err := generateCmdMulti(names, counts, nil); err == nil {
+		t.Error("want error for 121 blocks")
+	}
+
+	if _, err := generateCmdMulti([]string{"D0", "D1000"}, []int{500, 500}, nil); err == nil {
+		t.Error("want error for 1000 points")
+	}
+}
+
+func TestASCIIFrames(t *testing.T) {
+	plc, conn := newFakePLC(t, SetASCII(true))
+
+	rec := bytes.Buffer{}
+	conn.Record(NewRecorder(&rec))
+
+	dev, err := NewDevice("D100", 3, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.SetValue([]byte{1, 0, 0x34, 0x12, 3, 0})
+
+	if err := dev.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dev.GetValue(), []byte{1, 0, 0x34, 0x12, 3, 0}) {
+		t.Errorf("unexpected read % x", dev.GetValue())
+	}
+
+	if err := conn.WriteBits([]string{"D7"}, []bool{true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := plc.words(0xA8, 7, 1); w[0] != 1 {
+		t.Errorf("want D7 bit 0 set, got % x", w)
+	}
+
+	// 结束代码异常的响应也能正确读取, 连接之后仍可使用
+	plc.failAt = 4
+
+	if err := dev.Read(); err == nil {
+		t.Fatal("want end code error")
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 记录的是线路上的ASCII码帧
+	if !strings.Contains(rec.String(), `"request":"35303030`) {
+		t.Errorf("want ASCII frames recorded, got %s", rec.String())
+	}
+}
+
+func TestForward(t *testing.T) {
+	for _, ascii := range []bool{false, true} {
+		plc, conn := newFakePLC(t, SetASCII(ascii))
+		copy(plc.words(0xA8, 100, 2), []byte{0x34, 0x12, 0x78, 0x56})
+
+		// 批量读取D100起2字
+		b, err := conn.Forward([]byte{0x01, 0x04, 0x00, 0x00, 100, 0, 0, 0xA8, 2, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, []byte{0x34, 0x12, 0x78, 0x56}) {
+			t.Errorf("ascii=%v: unexpected response % x", ascii, b)
+		}
+
+		plc.failAt = 2
+		_, err = conn.Forward([]byte{0x01, 0x04, 0x00, 0x00, 100, 0, 0, 0xA8, 2, 0})
+
+		var ee *EndCodeError
+		if !errors.As(err, &ee) || ee.Code != 0xC051 {
+			t.Errorf("ascii=%v: want end code C051, got %v", ascii, err)
+		}
+	}
+
+	_, conn := newFakePLC(t)
+
+	if _, err := conn.Forward([]byte{0x01}); err == nil {
+		t.Error("want error for short command")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	plc, conn := newFakePLC(t, SetTimeout(time.Second))
+
+	dev, err := NewDevice("D0", 1, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	// PLC响应慢于超时时间
+	plc.mu.Lock()
+	plc.after = func(uint16) { time.Sleep(200 * time.Millisecond) }
+	plc.mu.Unlock()
+
+	if err := conn.SetTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	var ne net.Error
+	if err := dev.Read(); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("want timeout, got %v", err)
+	}
+
+	plc.mu.Lock()
+	plc.after = nil
+	plc.mu.Unlock()
+
+	if err := conn.SetTimeout(-1); err == nil {
+		t.Error("want error for negative timeout")
+	}
+
+	// 请求、设置超时与重新连接可以并发执行
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 100)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			dev, _ := NewDevice("D0", 1, conn)
+
+			for j := 0; j < 20; j++ {
+				if err := dev.Read(); err != nil {
+					errs <- err
+
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		_ = conn.SetTimeout(time.Duration(i+1) * time.Second)
+
+		if err := conn.Reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// 取消超时后, 上一次请求设置的期限不再生效
+	if err := conn.SetTimeout(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SetTimeout(0); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if err := dev.Read(); err != nil {
+		t.Errorf("read after clearing timeout: %v", err)
+	}
+}
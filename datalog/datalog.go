@@ -0,0 +1,422 @@
+// Package datalog 按周期读取标签, 将带时间戳的样本写入按时间与大小轮换的CSV文件,
+// 或以InfluxDB行协议写入文件或HTTP接口, 供质量追溯等离线分析使用.
+//
+// 标签以MultiDevice读取. ModeInterval每个周期写入全部标签; ModeChange只写入值变化的标签,
+// 没有变化的周期不写入. PLC通信失败的周期不产生样本, 下一周期之前重新连接.
+// 输出失败(磁盘已满、HTTP服务不可用等)时样本保留在内存缓冲区中并在之后重试,
+// 缓冲区满时丢弃最旧的样本.
+package datalog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// Mode 写入方式.
+type Mode string
+
+const (
+	ModeInterval Mode = "interval"
+	ModeChange   Mode = "change"
+)
+
+const (
+	// batchSize 每次写入输出的最大样本数
+	batchSize = 1000
+	// retryInterval 输出失败后没有新样本时的重试间隔
+	retryInterval = 5 * time.Second
+)
+
+// Config 数据记录的配置.
+type Config struct {
+	// Interval 读取周期, 默认1s
+	Interval time.Duration `yaml:"interval"`
+	// Mode 写入方式, 默认ModeInterval
+	Mode Mode `yaml:"mode"`
+	// Timeout 非0时设置为conn每次请求的超时时间, 为0时使用conn已有的设置. 同时作为HTTP写入的超时时间, 默认5s
+	Timeout time.Duration `yaml:"timeout"`
+	// Buffer 输出失败时在内存中保留的最大样本数, 默认10000
+	Buffer int          `yaml:"buffer"`
+	Tags   []melsec.Tag `yaml:"tags"`
+	Output Output       `yaml:"output"`
+	// Sink 不为nil时代替Output
+	Sink   Sink          `yaml:"-"`
+	Logger melsec.Logger `yaml:"-"`
+}
+
+// Record 一次读取的样本, Values以标签名为键, 只包含读取成功(ModeChange时为值变化)的标签.
+type Record struct {
+	Time   time.Time
+	Values map[string]interface{}
+}
+
+// Sink 样本的输出. Write返回错误时样本保留在缓冲区中, 之后重新写入;
+// 错误包含ErrRejected时样本被丢弃.
+type Sink interface {
+	Write(records []Record) error
+	Close() error
+}
+
+// ErrRejected 输出拒绝了样本(如HTTP 400), 重试不会成功.
+var ErrRejected = errors.New("records rejected")
+
+// Logger 数据记录器.
+type Logger struct {
+	conn   *melsec.PlcConn
+	config Config
+	tags   []*melsec.Tag
+	dev    *melsec.MultiDevice
+	sink   Sink
+	logger melsec.Logger
+
+	// 只在读取的goroutine中访问
+	readAt time.Time
+	last   map[string]string
+
+	// 只在写入的goroutine中访问
+	failing bool
+
+	mu       sync.Mutex
+	buffer   []Record
+	inflight int // 正在写入输出的样本数
+	dropped  uint64
+	overflow bool
+	wake     chan struct{}
+}
+
+// New 创建以conn读取标签的记录器, 标签与输出在此检查. 文件在第一次写入时创建.
+func New(conn *melsec.PlcConn, c Config) (*Logger, error) {
+	switch c.Mode {
+	case "":
+		c.Mode = ModeInterval
+	case ModeInterval, ModeChange:
+	default:
+		return nil, fmt.Errorf("datalog: unknown mode %q", c.Mode)
+	}
+
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+
+	if conn == nil {
+		return nil, errors.New("datalog: nil plc connection")
+	}
+
+	if c.Timeout > 0 {
+		if err := conn.SetTimeout(c.Timeout); err != nil {
+			return nil, err
+		}
+	} else {
+		c.Timeout = 5 * time.Second
+	}
+
+	if c.Buffer <= 0 {
+		c.Buffer = 10000
+	}
+
+	l := &Logger{
+		conn:   conn,
+		config: c,
+		logger: c.Logger,
+		last:   make(map[string]string),
+		wake:   make(chan struct{}, 1),
+	}
+
+	if l.logger == nil {
+		l.logger = nopLogger{}
+	}
+
+	db := melsec.NewTagDB(nil)
+
+	for _, tag := range c.Tags {
+		if tag.Name == "" {
+			tag.Name = tag.Address
+		}
+
+		if _, ok := db.Lookup(tag.Name); ok {
+			return nil, fmt.Errorf("datalog: duplicate tag %s", tag.Name)
+		}
+
+		if err := db.Add(tag); err != nil {
+			return nil, fmt.Errorf("datalog: %w", err)
+		}
+	}
+
+	l.tags = db.Tags()
+	if len(l.tags) == 0 {
+		return nil, errors.New("datalog: no tags")
+	}
+
+	dev, err := melsec.NewMultiDevice(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range l.tags {
+		dev.AddBlock(tag.Address, tag.Words())
+	}
+
+	l.dev = dev
+
+	l.sink = c.Sink
+	if l.sink == nil {
+		if l.sink, err = c.Output.open(l.tags, c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+// Pending 返回缓冲区中尚未写入的样本数.
+func (l *Logger) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.buffer) + l.inflight
+}
+
+// Dropped 返回因缓冲区已满或被输出拒绝而丢弃的样本数.
+func (l *Logger) Dropped() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.dropped
+}
+
+// Run 周期读取并写入样本, 直到ctx结束. 结束前写入缓冲区中的样本并关闭输出.
+func (l *Logger) Run(ctx context.Context) error {
+	poller := melsec.NewPoller()
+
+	err := poller.Add(melsec.PollGroup{
+		Name:     "datalog",
+		Interval: l.config.Interval,
+		Devices:  []melsec.Reader{readerFunc(l.read)},
+		OnCycle:  l.sample,
+	})
+	if err != nil {
+		return err
+	}
+
+	stop, done := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		l.writeLoop(stop)
+	}()
+
+	if err = poller.Run(ctx); ctx.Err() != nil {
+		err = nil
+	}
+
+	close(stop)
+	<-done
+
+	if cerr := l.sink.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+type readerFunc func() error
+
+func (f readerFunc) Read() error {
+	return f()
+}
+
+func (l *Logger) read() error {
+	l.readAt = time.Now()
+
+	return l.dev.Read()
+}
+
+// sample 每次读取后生成样本, 通信失败时重新连接PLC.
+func (l *Logger) sample(err error) {
+	if err != nil {
+		l.logger.Warn("plc read failed", "err", err)
+
+		if brokenConn(err) {
+			if err := l.conn.Reconnect(); err != nil {
+				l.logger.Error("plc reconnect failed", "err", err)
+			}
+		}
+	}
+
+	values := make(map[string]interface{}, len(l.tags))
+
+	for i, tag := range l.tags {
+		block := l.dev.Block(i)
+		if block.Err != nil || len(block.Value) < tag.Words()*2 {
+			continue
+		}
+
+		v, err := tag.Decode(block.Value)
+		if err != nil {
+			continue
+		}
+
+		if l.config.Mode == ModeChange {
+			// 以文本比较, NaN也能判断为未变化
+			text := fmt.Sprint(v)
+			if last, ok := l.last[tag.Name]; ok && last == text {
+				continue
+			}
+
+			l.last[tag.Name] = text
+		}
+
+		values[tag.Name] = v
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	l.add(Record{Time: l.readAt, Values: values})
+}
+
+// add 将样本加入缓冲区并唤醒写入.
+func (l *Logger) add(r Record) {
+	l.mu.Lock()
+	l.buffer = append(l.buffer, r)
+	warn := l.trim()
+	l.mu.Unlock()
+
+	if warn {
+		l.warnFull()
+	}
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// trim 缓冲区超过上限时丢弃最旧的样本, 每次输出中断只在第一次丢弃时返回true. 调用时持有mu.
+func (l *Logger) trim() bool {
+	over := len(l.buffer) - l.config.Buffer
+	if over <= 0 {
+		return false
+	}
+
+	l.buffer = l.buffer[over:]
+	l.dropped += uint64(over)
+
+	warn := !l.overflow
+	l.overflow = true
+
+	return warn
+}
+
+func (l *Logger) warnFull() {
+	l.logger.Warn("datalog buffer full, dropping oldest records", "buffer", l.config.Buffer)
+}
+
+// writeLoop 有新样本时写入输出, 输出失败时定期重试. stop关闭后最后写入一次.
+func (l *Logger) writeLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.wake:
+		case <-ticker.C:
+		case <-stop:
+			l.flush()
+
+			if n := l.Pending(); n > 0 {
+				l.logger.Error("datalog stopped with unwritten records", "records", n)
+			}
+
+			return
+		}
+
+		l.flush()
+	}
+}
+
+// flush 分批写入缓冲区中的样本, 直到缓冲区为空或输出失败.
+func (l *Logger) flush() {
+	for {
+		l.mu.Lock()
+
+		n := len(l.buffer)
+		if n > batchSize {
+			n = batchSize
+		}
+
+		batch := l.buffer[:n:n]
+		l.buffer = l.buffer[n:]
+		l.inflight = n
+
+		l.mu.Unlock()
+
+		if n == 0 {
+			return
+		}
+
+		err := l.sink.Write(batch)
+
+		l.mu.Lock()
+		l.inflight = 0
+
+		var full bool
+
+		switch {
+		case err == nil:
+			l.overflow = false
+		case errors.Is(err, ErrRejected):
+			l.dropped += uint64(n)
+		default:
+			// 放回缓冲区的开头, 期间新增的样本在其后
+			l.buffer = append(batch, l.buffer...)
+			full = l.trim()
+		}
+
+		pending := len(l.buffer)
+		l.mu.Unlock()
+
+		if full {
+			l.warnFull()
+		}
+
+		switch {
+		case err == nil:
+			if l.failing {
+				l.failing = false
+				l.logger.Info("datalog output recovered", "pending", pending)
+			}
+		case errors.Is(err, ErrRejected):
+			l.logger.Error("datalog records rejected", "records", n, "err", err)
+		default:
+			if !l.failing {
+				l.failing = true
+				l.logger.Warn("datalog output failed, buffering", "pending", pending, "err", err)
+			}
+
+			return
+		}
+	}
+}
+
+func brokenConn(err error) bool {
+	var ne net.Error
+
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
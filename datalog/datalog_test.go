@@ -0,0 +1,370 @@
+package datalog
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+)
+
+var testTags = []melsec.Tag{
+	{Name: "speed", Address: "D100", Type: melsec.TypeInt16, Scale: 0.1},
+	{Name: "run", Address: "M0"},
+	{Name: "pos", Address: "D200", Type: melsec.TypeInt32, Length: 2},
+	{Name: "lot no", Address: "D300", Type: melsec.TypeString, Length: 4},
+}
+
+func tags(t *testing.T) []*melsec.Tag {
+	t.Helper()
+
+	db := melsec.NewTagDB(nil)
+	if err := db.Add(testTags...); err != nil {
+		t.Fatal(err)
+	}
+
+	return db.Tags()
+}
+
+func TestEncode(t *testing.T) {
+	cs := newColumns(tags(t))
+	at := time.Date(2024, 1, 2, 15, 4, 5, 6000000, time.Local)
+	r := Record{Time: at, Values: map[string]interface{}{
+		"speed":  12.5,
+		"run":    true,
+		"pos":    []int32{-1, 2},
+		"lot no": `A,"1"`,
+	}}
+
+	if got := string(cs.csv(r)); got != "2024-01-02 15:04:05.006,12.5,1,-1,2,\"A,\"\"1\"\"\"\n" {
+		t.Errorf("unexpected csv %q", got)
+	}
+
+	if got := strings.Join(cs.names(), ","); got != "speed,run,pos[0],pos[1],lot no" {
+		t.Errorf("unexpected columns %q", got)
+	}
+
+	// 只包含部分标签的样本
+	if got := string(cs.csv(Record{Time: at, Values: map[string]interface{}{"run": false}})); got != "2024-01-02 15:04:05.006,,0,,,\n" {
+		t.Errorf("unexpected csv %q", got)
+	}
+
+	enc := newLineEncoder("plc data", map[string]string{"line": "L 1", "area": "a=b"}, cs)
+
+	want := `plc\ data,area=a\=b,line=L\ 1 speed=12.5,run=true,pos[0]=-1i,pos[1]=2i,lot\ no="A,\"1\"" ` + strconv.FormatInt(at.UnixNano(), 10) + "\n"
+	if got := string(enc.encode(r)); got != want {
+		t.Errorf("unexpected line %q", got)
+	}
+
+	if got := enc.encode(Record{Time: at, Values: map[string]interface{}{"speed": math.NaN()}}); got != nil {
+		t.Errorf("want no line for NaN, got %q", got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+
+	open := func() *rotatingFile {
+		return &rotatingFile{dir: dir, prefix: "line1", ext: ".csv", rotate: 24 * time.Hour, maxSize: 30, header: []byte("time,a\n")}
+	}
+
+	write := func(f *rotatingFile, at time.Time, line string) {
+		t.Helper()
+
+		if err := f.write(at, []byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := open()
+	write(f, day.Add(time.Hour), "01,1\n")
+	write(f, day.Add(2*time.Hour), "02,2\n")
+	write(f, day.Add(25*time.Hour), "25,3\n")
+
+	if err := f.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新启动后追加到当前周期的文件, 超过大小时使用下一个序号
+	f = open()
+	write(f, day.Add(26*time.Hour), "26,4444444444\n")
+	write(f, day.Add(27*time.Hour), "27,5555555555\n")
+
+	if err := f.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 列不同时不追加到已有文件
+	f = open()
+	f.header = []byte("time,a,b\n")
+	write(f, day.Add(28*time.Hour), "28,6,6\n")
+
+	if err := f.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"line1-20240102-000000.csv":   "time,a\n01,1\n02,2\n",
+		"line1-20240103-000000.csv":   "time,a\n25,3\n26,4444444444\n",
+		"line1-20240103-000000-1.csv": "time,a\n27,5555555555\n",
+		"line1-20240103-000000-2.csv": "time,a,b\n28,6,6\n",
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(want) {
+		t.Errorf("unexpected files %v", entries)
+	}
+
+	for name, content := range want {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(b) != content {
+			t.Errorf("%s: unexpected content %q %v", name, b, err)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies []string
+		status = http.StatusInternalServerError
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink, err := Output{Format: FormatInflux, URL: srv.URL + "/write?db=plc", Token: "secret"}.open(tags(t), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	records := []Record{{Time: time.Unix(1, 0), Values: map[string]interface{}{"run": true}}}
+
+	if err := sink.Write(records); err == nil || errors.Is(err, ErrRejected) {
+		t.Errorf("want retryable error, got %v", err)
+	}
+
+	mu.Lock()
+	status = http.StatusBadRequest
+	mu.Unlock()
+
+	if err := sink.Write(records); !errors.Is(err, ErrRejected) {
+		t.Errorf("want ErrRejected, got %v", err)
+	}
+
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+
+	if err := sink.Write(records); err != nil {
+		t.Error(err)
+	}
+
+	if len(bodies) != 3 || bodies[2] != "melsec run=true 1000000000\n" {
+		t.Errorf("unexpected bodies %q", bodies)
+	}
+
+	for _, o := range []Output{
+		{Format: "json"},
+		{Format: FormatCSV, URL: srv.URL},
+		{Format: FormatInflux, URL: "ftp://host/"},
+		{MaxSize: -1},
+	} {
+		if _, err := o.open(tags(t), time.Second); err == nil {
+			t.Errorf("want error for %+v", o)
+		}
+	}
+}
+
+// memorySink 在内存中保存样本, failing为true时写入失败.
+type memorySink struct {
+	mu      sync.Mutex
+	records []Record
+	failing bool
+	closed  bool
+}
+
+func (s *memorySink) Write(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failing {
+		return errors.New("disk full")
+	}
+
+	s.records = append(s.records, records...)
+
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memorySink) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func (s *memorySink) values(tag string) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	re := make([]interface{}, 0)
+
+	for _, r := range s.records {
+		if v, ok := r.Values[tag]; ok {
+			re = append(re, v)
+		}
+	}
+
+	return re
+}
+
+func start(t *testing.T, c Config) (*mock.Server, *Logger, func()) {
+	t.Helper()
+
+	plc := mock.NewServer()
+	t.Cleanup(plc.Close)
+
+	conn, err := melsec.NewConn(plc.Host(), plc.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	if c.Tags == nil {
+		c.Tags = testTags
+	}
+
+	l, err := New(conn, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() { done <- l.Run(ctx) }()
+
+	return plc, l, func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Errorf("run: %v", err)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestChangeMode(t *testing.T) {
+	sink := &memorySink{}
+	plc, l, stop := start(t, Config{Interval: 5 * time.Millisecond, Mode: ModeChange, Buffer: 3, Sink: sink})
+
+	waitFor(t, "first record", func() bool { return len(sink.values("speed")) == 1 })
+	_ = plc.Memory.SetWords("D100", 100)
+
+	waitFor(t, "speed 10", func() bool { return len(sink.values("speed")) == 2 })
+
+	if got := sink.values("speed"); !reflect.DeepEqual(got, []interface{}{0.0, 10.0}) {
+		t.Errorf("unexpected speed %v", got)
+	}
+
+	if got := sink.values("run"); !reflect.DeepEqual(got, []interface{}{false}) {
+		t.Errorf("unchanged tag written again: %v", got)
+	}
+
+	// 输出失败时缓冲, 超过上限时丢弃最旧的样本
+	sink.setFailing(true)
+
+	for i := 1; i <= 5; i++ {
+		_ = plc.Memory.SetWords("D100", uint16(100+i))
+		waitFor(t, "buffered record", func() bool { return l.Pending()+int(l.Dropped()) == i })
+	}
+
+	sink.setFailing(false)
+	_ = plc.Memory.SetWords("D100", 200)
+
+	waitFor(t, "flush", func() bool { return l.Pending() == 0 })
+	stop()
+
+	if got := sink.values("speed"); !reflect.DeepEqual(got, []interface{}{0.0, 10.0, 104 * 0.1, 105 * 0.1, 20.0}) {
+		t.Errorf("unexpected speed %v", got)
+	}
+
+	if l.Dropped() != 3 || !sink.closed {
+		t.Errorf("dropped %d, closed %v", l.Dropped(), sink.closed)
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	dir := t.TempDir()
+	plc, _, stop := start(t, Config{Interval: 5 * time.Millisecond, Output: Output{Dir: dir, Prefix: "line1"}})
+
+	_ = plc.Memory.SetWords("D200", 1, 0, 0xFFFF, 0xFFFF)
+	_ = plc.Memory.SetBits("M0", true)
+
+	var rows []string
+
+	waitFor(t, "rows", func() bool {
+		matches, _ := filepath.Glob(filepath.Join(dir, "line1-*.csv"))
+		if len(matches) != 1 {
+			return false
+		}
+
+		b, _ := os.ReadFile(matches[0])
+		rows = strings.Split(strings.TrimSpace(string(b)), "\n")
+
+		return len(rows) > 1 && strings.HasSuffix(rows[len(rows)-1], ",0,1,1,-1,")
+	})
+
+	stop()
+
+	if rows[0] != "\ufefftime,speed,run,pos[0],pos[1],lot no" {
+		t.Errorf("unexpected header %q", rows[0])
+	}
+}
@@ -0,0 +1,532 @@
+package datalog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// Format 输出格式.
+type Format string
+
+const (
+	FormatCSV    Format = "csv"
+	FormatInflux Format = "influx"
+)
+
+// Output 输出的配置. FormatCSV写入Dir中的文件; FormatInflux在URL不为空时以HTTP POST写入, 否则写入Dir中的文件.
+//
+// 文件名为<Prefix>-<周期开始时间>[-序号].csv或.lp, 周期按本地时间对齐, 例如Rotate为24h时每天0点开始新文件.
+// 重新启动后追加到当前周期的文件, 文件已满或CSV的列不同时使用下一个序号.
+type Output struct {
+	Format Format `yaml:"format"`
+	// Dir 文件的目录, 默认为当前目录
+	Dir string `yaml:"dir"`
+	// Prefix 文件名前缀, 默认为melsec
+	Prefix string `yaml:"prefix"`
+	// Rotate 文件的轮换周期, 默认24h
+	Rotate time.Duration `yaml:"rotate"`
+	// MaxSize 单个文件的最大字节数, 超过时在同一周期内使用下一个序号, 0为不限制
+	MaxSize int64 `yaml:"max_size"`
+	// URL InfluxDB的写入地址, 时间戳精度为ns, 例如
+	// http://127.0.0.1:8086/api/v2/write?org=plant&bucket=plc 或 http://127.0.0.1:8086/write?db=plc
+	URL string `yaml:"url"`
+	// Token 以"Authorization: Token <Token>"发送
+	Token string `yaml:"token"`
+	// Measurement 行协议的measurement, 默认melsec
+	Measurement string `yaml:"measurement"`
+	// Labels 行协议的tag set, 例如line: line1
+	Labels map[string]string `yaml:"labels"`
+}
+
+// open 按配置创建输出, tags决定CSV的列与行协议的字段.
+func (o Output) open(tags []*melsec.Tag, timeout time.Duration) (Sink, error) {
+	if o.Prefix == "" {
+		o.Prefix = "melsec"
+	}
+
+	if o.Rotate <= 0 {
+		o.Rotate = 24 * time.Hour
+	}
+
+	if o.Measurement == "" {
+		o.Measurement = "melsec"
+	}
+
+	if o.MaxSize < 0 {
+		return nil, fmt.Errorf("datalog: invalid max_size %d", o.MaxSize)
+	}
+
+	columns := newColumns(tags)
+
+	switch o.Format {
+	case "", FormatCSV:
+		if o.URL != "" {
+			return nil, errors.New("datalog: url requires influx format")
+		}
+
+		names := append([]string{"time"}, columns.names()...)
+		// UTF-8 BOM, Excel据此识别中文标签名
+		header := append([]byte("\ufeff"), csvLine(names)...)
+
+		return &fileSink{file: o.file(".csv", header), encode: columns.csv}, nil
+	case FormatInflux:
+		enc := newLineEncoder(o.Measurement, o.Labels, columns)
+
+		if o.URL == "" {
+			return &fileSink{file: o.file(".lp", nil), encode: enc.encode}, nil
+		}
+
+		u, err := url.Parse(o.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("datalog: invalid url %q", o.URL)
+		}
+
+		return &httpSink{url: o.URL, token: o.Token, encode: enc.encode, client: &http.Client{Timeout: timeout}}, nil
+	}
+
+	return nil, fmt.Errorf("datalog: unknown format %q", o.Format)
+}
+
+func (o Output) file(ext string, header []byte) *rotatingFile {
+	return &rotatingFile{dir: o.Dir, prefix: o.Prefix, ext: ext, rotate: o.Rotate, maxSize: o.MaxSize, header: header}
+}
+
+// column 一个输出列, 数组标签的每个元素为一列, 名称为name[i].
+type column struct {
+	name  string
+	tag   string
+	index int // 不是数组时为-1
+}
+
+type columns []column
+
+func newColumns(tags []*melsec.Tag) columns {
+	re := make(columns, 0, len(tags))
+
+	for _, tag := range tags {
+		if tag.Type == melsec.TypeString || tag.Length <= 1 {
+			re = append(re, column{name: tag.Name, tag: tag.Name, index: -1})
+
+			continue
+		}
+
+		for i := 0; i < tag.Length; i++ {
+			re = append(re, column{name: fmt.Sprintf("%s[%d]", tag.Name, i), tag: tag.Name, index: i})
+		}
+	}
+
+	return re
+}
+
+func (cs columns) names() []string {
+	re := make([]string, len(cs))
+	for i, c := range cs {
+		re[i] = c.name
+	}
+
+	return re
+}
+
+// value 返回列在样本中的值, 样本不包含该标签时返回nil.
+func (c column) value(r Record) interface{} {
+	v, ok := r.Values[c.tag]
+	if !ok || c.index < 0 {
+		return v
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice || c.index >= rv.Len() {
+		return nil
+	}
+
+	return rv.Index(c.index).Interface()
+}
+
+const csvTime = "2006-01-02 15:04:05.000"
+
+// csv 将样本编码为一行CSV, 时间为本地时间, bool为1或0, 样本中没有的标签为空.
+func (cs columns) csv(r Record) []byte {
+	row := make([]string, 1, len(cs)+1)
+	row[0] = r.Time.Format(csvTime)
+
+	for _, c := range cs {
+		row = append(row, csvValue(c.value(r)))
+	}
+
+	return csvLine(row)
+}
+
+func csvLine(row []string) []byte {
+	b := bytes.Buffer{}
+	w := csv.NewWriter(&b)
+	_ = w.Write(row)
+	w.Flush()
+
+	return b.Bytes()
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "1"
+		}
+
+		return "0"
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	return fmt.Sprint(v)
+}
+
+// lineEncoder 生成InfluxDB行协议: measurement,标签 字段=值,... 时间戳(ns).
+type lineEncoder struct {
+	prefix  string
+	columns columns
+	keys    []string
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+func newLineEncoder(measurement string, labels map[string]string, cs columns) *lineEncoder {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	prefix := measurementEscaper.Replace(measurement)
+	for _, k := range names {
+		prefix += "," + keyEscaper.Replace(k) + "=" + keyEscaper.Replace(labels[k])
+	}
+
+	keys := make([]string, len(cs))
+	for i, c := range cs {
+		keys[i] = keyEscaper.Replace(c.name)
+	}
+
+	return &lineEncoder{prefix: prefix, columns: cs, keys: keys}
+}
+
+// encode 将样本编码为一行, 没有可写入的字段时返回nil. NaN与无穷大不能以行协议表示, 被忽略.
+func (e *lineEncoder) encode(r Record) []byte {
+	b := bytes.Buffer{}
+	b.WriteString(e.prefix)
+
+	sep := byte(' ')
+
+	for i, c := range e.columns {
+		v, ok := lineValue(c.value(r))
+		if !ok {
+			continue
+		}
+
+		b.WriteByte(sep)
+		b.WriteString(e.keys[i])
+		b.WriteByte('=')
+		b.WriteString(v)
+
+		sep = ','
+	}
+
+	if sep == ' ' {
+		return nil
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(r.Time.UnixNano(), 10))
+	b.WriteByte('\n')
+
+	return b.Bytes()
+}
+
+func lineValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case bool:
+		return strconv.FormatBool(v), true
+	case float32:
+		return lineFloat(float64(v), 32)
+	case float64:
+		return lineFloat(v, 64)
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	case int16, uint16, int32, uint32:
+		return fmt.Sprintf("%di", v), true
+	}
+
+	return "", false
+}
+
+func lineFloat(f float64, bits int) (string, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, bits), true
+}
+
+// fileSink 写入轮换的文件. 写入失败时整批重试, 文件中可能出现重复的行.
+type fileSink struct {
+	file   *rotatingFile
+	encode func(Record) []byte
+}
+
+func (s *fileSink) Write(records []Record) error {
+	for _, r := range records {
+		line := s.encode(r)
+		if line == nil {
+			continue
+		}
+
+		if err := s.file.write(r.Time, line); err != nil {
+			// 下次写入时重新打开文件
+			s.file.abort()
+
+			return err
+		}
+	}
+
+	if err := s.file.flush(); err != nil {
+		s.file.abort()
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.close()
+}
+
+// rotatingFile 按周期与大小轮换的文件.
+type rotatingFile struct {
+	dir     string
+	prefix  string
+	ext     string
+	rotate  time.Duration
+	maxSize int64
+	// header 每个文件的开头, 追加到已有文件时检查是否一致
+	header []byte
+
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	end  time.Time
+}
+
+// periodStart 返回t所在周期的开始时间, 周期按本地时间对齐.
+func periodStart(t time.Time, rotate time.Duration) time.Time {
+	_, offset := t.Zone()
+	d := time.Duration(offset) * time.Second
+
+	return t.Add(d).Truncate(rotate).Add(-d)
+}
+
+func (r *rotatingFile) write(t time.Time, line []byte) error {
+	full := r.maxSize > 0 && r.size > int64(len(r.header)) && r.size+int64(len(line)) > r.maxSize
+
+	if r.f == nil || !t.Before(r.end) || full {
+		if err := r.open(t, int64(len(line))); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.w.Write(line)
+	r.size += int64(n)
+
+	return err
+}
+
+// open 关闭当前文件, 打开t所在周期中第一个可以追加n字节的文件.
+func (r *rotatingFile) open(t time.Time, n int64) error {
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	if r.dir != "" {
+		if err := os.MkdirAll(r.dir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	start := periodStart(t, r.rotate)
+	base := filepath.Join(r.dir, r.prefix+"-"+start.Format("20060102-150405"))
+
+	for seq := 0; seq < 1000; seq++ {
+		name := base + r.ext
+		if seq > 0 {
+			name = fmt.Sprintf("%s-%d%s", base, seq, r.ext)
+		}
+
+		f, size, err := r.append(name, n)
+		if err != nil {
+			return err
+		}
+
+		if f != nil {
+			r.f, r.w, r.size, r.end = f, bufio.NewWriter(f), size, start.Add(r.rotate)
+
+			return nil
+		}
+	}
+
+	return fmt.Errorf("datalog: too many files for %s", base)
+}
+
+// append 打开name用于追加n字节, 新文件写入header. 追加后超过MaxSize或开头与header不一致时返回nil.
+func (r *rotatingFile) append(name string, n int64) (*os.File, int64, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return nil, 0, err
+	}
+
+	if fi.Size() == 0 {
+		if _, err := f.Write(r.header); err != nil {
+			_ = f.Close()
+
+			return nil, 0, err
+		}
+
+		return f, int64(len(r.header)), nil
+	}
+
+	if r.maxSize > 0 && fi.Size()+n > r.maxSize {
+		_ = f.Close()
+
+		return nil, 0, nil
+	}
+
+	if len(r.header) != 0 {
+		head := make([]byte, len(r.header))
+		if _, err := f.ReadAt(head, 0); err != nil || !bytes.Equal(head, r.header) {
+			_ = f.Close()
+
+			return nil, 0, nil
+		}
+	}
+
+	return f, fi.Size(), nil
+}
+
+func (r *rotatingFile) flush() error {
+	if r.w == nil {
+		return nil
+	}
+
+	return r.w.Flush()
+}
+
+// abort 丢弃未写入的数据并关闭文件.
+func (r *rotatingFile) abort() {
+	if r.f != nil {
+		_ = r.f.Close()
+	}
+
+	r.f, r.w = nil, nil
+}
+
+func (r *rotatingFile) close() error {
+	if r.f == nil {
+		return nil
+	}
+
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+
+	r.f, r.w = nil, nil
+
+	return err
+}
+
+// httpSink 以HTTP POST写入InfluxDB, 每批样本为一个请求.
+type httpSink struct {
+	url    string
+	token  string
+	encode func(Record) []byte
+	client *http.Client
+}
+
+func (s *httpSink) Write(records []Record) error {
+	body := bytes.Buffer{}
+	for _, r := range records {
+		body.Write(s.encode(r))
+	}
+
+	if body.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusRequestEntityTooLarge,
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		// 数据本身有问题, 重试不会成功; 认证等其他错误在修正配置之前保留样本
+		return fmt.Errorf("%w: %s: %s", ErrRejected, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+
+	return nil
+}
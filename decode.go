@@ -0,0 +1,428 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// commandNames 指令及子指令的名称, 子指令为0xFFFF时表示任意子指令.
+var commandNames = map[[2]uint16]string{
+	{0x0401, 0x0000}: "batch read (word units)",
+	{0x0401, 0x0001}: "batch read (bit units)",
+	{0x1401, 0x0000}: "batch write (word units)",
+	{0x1401, 0x0001}: "batch write (bit units)",
+	{0x0403, 0x0000}: "random read (word units)",
+	{0x1402, 0x0000}: "random write (word units)",
+	{0x1402, 0x0001}: "random write (bit units)",
+	{0x0406, 0x0000}: "multiple block batch read",
+	{0x1406, 0x0000}: "multiple block batch write",
+	{0x0801, 0xFFFF}: "monitor device registration",
+	{0x0802, 0xFFFF}: "monitor",
+	{0x0101, 0x0000}: "read CPU model name",
+	{0x1001, 0x0000}: "remote RUN",
+	{0x1002, 0x0000}: "remote STOP",
+	{0x1003, 0x0000}: "remote PAUSE",
+	{0x1005, 0x0000}: "remote latch clear",
+	{0x1006, 0x0000}: "remote RESET",
+	{0x0619, 0x0000}: "loopback test",
+	{0x1630, 0xFFFF}: "remote password unlock",
+	{0x1631, 0xFFFF}: "remote password lock",
+}
+
+// CommandName 返回指令及子指令的名称, 未知时返回空字符串.
+func CommandName(cmd, sub uint16) string {
+	if name, ok := commandNames[[2]uint16{cmd, sub}]; ok {
+		return name
+	}
+
+	return commandNames[[2]uint16{cmd, 0xFFFF}]
+}
+
+// endCodes 常见结束代码的说明.
+var endCodes = map[uint16]string{
+	0x0000: "normal completion",
+	0xC050: "ASCII data that cannot be converted to binary received",
+	0xC051: "number of read/write points out of range (word units)",
+	0xC052: "number of read/write points out of range (bit units)",
+	0xC053: "number of random read/write points out of range",
+	0xC054: "number of blocks out of range",
+	0xC056: "device number out of range",
+	0xC058: "request data length does not match the number of points",
+	0xC059: "command or subcommand not supported",
+	0xC05B: "CPU module cannot read/write the specified device",
+	0xC05C: "error in request contents",
+	0xC05D: "monitor registration not performed",
+	0xC05F: "request cannot be executed on the target CPU module",
+	0xC060: "error in request contents (bit device value)",
+	0xC061: "request data length error",
+	0xC06F: "frame format (ASCII/binary) does not match the setting",
+	0xC070: "device memory extension cannot be specified for the target",
+	0xC0B5: "CPU module cannot handle the specified data",
+	0xC200: "remote password error",
+	0xC201: "port is locked by remote password",
+	0xC204: "request from a device other than the one that unlocked the password",
+	0xCEE0: "request content is abnormal (other station)",
+	0xCEE1: "request message size exceeds the limit",
+	0xCEE2: "response message size exceeds the limit",
+	0xC05E: "monitoring timer expired before the CPU responded",
+}
+
+// ExplainEndCode 返回结束代码的说明.
+func ExplainEndCode(code uint16) string {
+	if s, ok := endCodes[code]; ok {
+		return s
+	}
+
+	return "unknown end code"
+}
+
+// DecodedDevice 请求中的一段软元件. 位单位访问时Points为点数, 字单位时为字数.
+type DecodedDevice struct {
+	Address string
+	Points  int
+	Bit     bool  // 位单位访问
+	Dword   bool  // 随机读写的双字
+	Values  []int // 写入的值, 位单位为0/1
+}
+
+// DecodedFrame 一个已解码的请求帧或响应帧.
+type DecodedFrame struct {
+	Frame    Frame
+	ASCII    bool
+	Response bool
+	Serial   uint16
+	Network  uint8
+	PC       uint8
+	ModuleIO uint16
+	Station  uint8
+
+	// 请求
+	Timer      uint16
+	Command    uint16
+	SubCommand uint16
+	Devices    []DecodedDevice
+
+	// 响应. 错误响应的Command/SubCommand取自错误信息
+	EndCode uint16
+	Data    []byte // 二进制格式的响应数据
+	Words   []uint16
+}
+
+// DecodeFrame 解码3E/4E二进制或ASCII码格式的请求帧或响应帧.
+// 响应数据的含义需要对应的请求, 不需要时可使用DecodeExchange.
+func DecodeFrame(b []byte) (*DecodedFrame, error) {
+	ascii := isASCIIFrame(b)
+
+	if ascii {
+		r := &asciiReader{b: b}
+
+		h, err := readHeader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		// ASCII码请求可以完整转换, 响应只能解码头部与错误信息
+		if !h.response {
+			bin, err := transcodeRequest(b, false)
+			if err != nil {
+				return nil, err
+			}
+
+			f, err := decodeBinary(bin)
+			if f != nil {
+				f.ASCII = true
+			}
+
+			return f, err
+		}
+
+		f := headerFrame(h)
+		f.ASCII = true
+
+		if h.code != 0 {
+			f.Command, f.SubCommand = errorInfo(r)
+		}
+
+		f.Data = r.rest()
+
+		return f, r.err()
+	}
+
+	return decodeBinary(b)
+}
+
+// DecodeExchange 解码一对请求帧与响应帧, 按请求解释响应数据.
+func DecodeExchange(req, resp []byte) (*DecodedFrame, *DecodedFrame, error) {
+	request, err := DecodeFrame(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bin := req
+	if request.ASCII {
+		if bin, err = transcodeRequest(req, false); err != nil {
+			return request, nil, err
+		}
+	}
+
+	if isASCIIFrame(resp) {
+		if resp, err = transcodeResponse(resp, bin, false); err != nil {
+			return request, nil, err
+		}
+	}
+
+	response, err := decodeBinary(resp)
+	if err != nil {
+		return request, nil, err
+	}
+
+	response.ASCII = request.ASCII
+
+	if response.EndCode == 0 {
+		response.Command, response.SubCommand = request.Command, request.SubCommand
+
+		if request.Command == 0x0401 || request.Command == 0x0403 || request.Command == 0x0406 {
+			if request.SubCommand&0x01 == 0 {
+				response.Words = make([]uint16, len(response.Data)/2)
+				for i := range response.Words {
+					response.Words[i] = binary.LittleEndian.Uint16(response.Data[i*2:])
+				}
+			}
+		}
+	}
+
+	return request, response, nil
+}
+
+func headerFrame(h frameHeader) *DecodedFrame {
+	f := &DecodedFrame{
+		Frame:    h.frame,
+		Response: h.response,
+		Serial:   h.serial,
+		Network:  uint8(h.network),
+		PC:       uint8(h.pc),
+		ModuleIO: uint16(h.io),
+		Station:  uint8(h.station),
+	}
+
+	if h.response {
+		f.EndCode = uint16(h.code)
+	} else {
+		f.Timer = uint16(h.code)
+	}
+
+	return f
+}
+
+func errorInfo(r fieldReader) (uint16, uint16) {
+	r.u8()
+	r.u8()
+	r.u16()
+	r.u8()
+
+	return uint16(r.u16()), uint16(r.u16())
+}
+
+func decodeBinary(b []byte) (*DecodedFrame, error) {
+	r := &binReader{b: b}
+
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	f := headerFrame(h)
+
+	if h.response {
+		if h.code != 0 {
+			f.Command, f.SubCommand = errorInfo(r)
+		}
+
+		f.Data = r.rest()
+
+		return f, r.err()
+	}
+
+	f.Command, f.SubCommand = uint16(r.u16()), uint16(r.u16())
+	f.Devices = decodeDevices(f.Command, f.SubCommand, r)
+
+	if r.err() != nil {
+		return f, fmt.Errorf("request %04x/%04x: %w", f.Command, f.SubCommand, r.err())
+	}
+
+	return f, nil
+}
+
+// decodeDevices 解析请求访问的软元件.
+func decodeDevices(cmd, sub uint16, r *binReader) []DecodedDevice {
+	re := make([]DecodedDevice, 0)
+	bit := sub&0x01 == 1
+
+	device := func() DecodedDevice {
+		info, no := r.device()
+
+		return DecodedDevice{Address: FormatAddress(info, uint64(no))}
+	}
+
+	words := func(n int) []int {
+		v := make([]int, 0, n)
+		for i := 0; i < n && r.err() == nil; i++ {
+			v = append(v, r.u16())
+		}
+
+		return v
+	}
+
+	switch cmd {
+	case 0x0401, 0x1401:
+		d := device()
+		d.Points, d.Bit = r.u16(), bit
+
+		if cmd == 0x1401 {
+			if bit {
+				for _, on := range r.bits(d.Points) {
+					v := 0
+					if on {
+						v = 1
+					}
+
+					d.Values = append(d.Values, v)
+				}
+			} else {
+				d.Values = words(d.Points)
+			}
+		}
+
+		re = append(re, d)
+	case 0x0403:
+		w, dw := r.u8(), r.u8()
+
+		for i := 0; i < w+dw && r.err() == nil; i++ {
+			d := device()
+			d.Points, d.Dword = 1, i >= w
+			re = append(re, d)
+		}
+	case 0x1402:
+		if bit {
+			for i, n := 0, r.u8(); i < n && r.err() == nil; i++ {
+				d := device()
+				d.Points, d.Bit, d.Values = 1, true, []int{r.u8()}
+				re = append(re, d)
+			}
+
+			break
+		}
+
+		w, dw := r.u8(), r.u8()
+
+		for i := 0; i < w+dw && r.err() == nil; i++ {
+			d := device()
+			d.Points, d.Dword = 1, i >= w
+
+			if d.Dword {
+				d.Values = []int{int(r.u32())}
+			} else {
+				d.Values = []int{r.u16()}
+			}
+
+			re = append(re, d)
+		}
+	case 0x0406, 0x1406:
+		w, b := r.u8(), r.u8()
+
+		for i := 0; i < w+b && r.err() == nil; i++ {
+			d := device()
+			d.Points = r.u16()
+
+			if cmd == 0x1406 {
+				d.Values = words(d.Points)
+			}
+
+			re = append(re, d)
+		}
+	}
+
+	return re
+}
+
+// Name 返回指令名称.
+func (f *DecodedFrame) Name() string {
+	if name := CommandName(f.Command, f.SubCommand); name != "" {
+		return name
+	}
+
+	return "unknown command"
+}
+
+func (f *DecodedFrame) String() string {
+	b := strings.Builder{}
+
+	format := "binary"
+	if f.ASCII {
+		format = "ASCII"
+	}
+
+	kind := "request"
+	if f.Response {
+		kind = "response"
+	}
+
+	fmt.Fprintf(&b, "%s %s %s", f.Frame, format, kind)
+
+	if f.Frame == Frame4E {
+		fmt.Fprintf(&b, " serial=%d", f.Serial)
+	}
+
+	fmt.Fprintf(&b, " net=%02X pc=%02X io=%04X st=%02X", f.Network, f.PC, f.ModuleIO, f.Station)
+
+	if f.Response {
+		fmt.Fprintf(&b, " end=%04X %s", f.EndCode, ExplainEndCode(f.EndCode))
+
+		if f.EndCode != 0 {
+			fmt.Fprintf(&b, " (%04X/%04X %s)", f.Command, f.SubCommand, f.Name())
+
+			return b.String()
+		}
+
+		switch {
+		case f.Words != nil:
+			fmt.Fprintf(&b, " words=%04X", f.Words)
+		case len(f.Data) != 0:
+			fmt.Fprintf(&b, " data=% X", f.Data)
+		}
+
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, " timer=%s %04X/%04X %s", time.Duration(f.Timer)*250*time.Millisecond, f.Command, f.SubCommand, f.Name())
+
+	for _, d := range f.Devices {
+		b.WriteString(" " + d.String())
+	}
+
+	return b.String()
+}
+
+func (d DecodedDevice) String() string {
+	s := d.Address
+
+	switch {
+	case d.Dword:
+		s += ":dword"
+	case d.Points != 1 || !d.Bit:
+		unit := "w"
+		if d.Bit {
+			unit = "pt"
+		}
+
+		s += fmt.Sprintf(":%d%s", d.Points, unit)
+	}
+
+	if len(d.Values) != 0 {
+		s += fmt.Sprintf("=%X", d.Values)
+	}
+
+	return s
+}
@@ -0,0 +1,123 @@
+package melsec
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBinaryRequest(t *testing.T) {
+	opt := newPlcOption(nil)
+
+	msg, err := opt.generateMessage("D100", 2, []byte{1, 0, 0xFF, 0xFF})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := DecodeFrame(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Response || f.Command != 0x1401 || len(f.Devices) != 1 || !reflect.DeepEqual(f.Devices[0].Values, []int{1, 0xFFFF}) {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	want := "3E binary request net=00 pc=FF io=03FF st=00 timer=250ms 1401/0000 batch write (word units) D100:2w=[1 FFFF]"
+	if f.String() != want {
+		t.Errorf("want %s, got %s", want, f)
+	}
+
+	msg, _ = opt.generateMessageRandomBits([]string{"M3", "Y1F"}, []bool{true, false})
+	f, _ = DecodeFrame(msg)
+
+	if s := f.String(); !strings.HasSuffix(s, "random write (bit units) M3=[1] Y1F=[0]") {
+		t.Errorf("unexpected %s", s)
+	}
+}
+
+func TestDecodeASCII(t *testing.T) {
+	req := []byte("500000FF03FF000018001004010000D*0001000003")
+
+	f, err := DecodeFrame(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.ASCII || f.Timer != 0x10 || f.Command != 0x0401 || f.Devices[0].Address != "D100" || f.Devices[0].Points != 3 {
+		t.Fatalf("unexpected frame %+v", f)
+	}
+
+	bin, err := transcodeRequest(req, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0x50, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x0C, 0x00, 0x10, 0x00, 0x01, 0x04, 0x00, 0x00, 0x64, 0x00, 0x00, 0xA8, 0x03, 0x00}
+	if !bytes.Equal(bin, want) {
+		t.Fatalf("want % x, got % x", want, bin)
+	}
+
+	back, err := transcodeRequest(bin, true)
+	if err != nil || !bytes.Equal(back, req) {
+		t.Fatalf("want %s, got %s %v", req, back, err)
+	}
+
+	resp := []byte("D00000FF03FF0000100000000100020003")
+
+	_, r, err := DecodeExchange(req, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.ASCII || r.EndCode != 0 || !reflect.DeepEqual(r.Words, []uint16{1, 2, 3}) {
+		t.Fatalf("unexpected response %+v", r)
+	}
+
+	bresp, _ := transcodeResponse(resp, bin, false)
+	if back, _ := transcodeResponse(bresp, bin, true); !bytes.Equal(back, resp) {
+		t.Errorf("response round trip: want %s, got %s", resp, back)
+	}
+}
+
+func TestDecodeTranscodeRoundTrip(t *testing.T) {
+	opt := newPlcOption([]PlcOption{SetFrame(Frame4E)})
+
+	msgs := make([]McMessage, 0)
+
+	m, _ := opt.generateMessageRandomBits([]string{"M3", "X1F"}, []bool{true, false})
+	msgs = append(msgs, m)
+	m, _ = opt.generateMessageRandomRead([]string{"D0", "SM400"}, []string{"W1A"})
+	msgs = append(msgs, m)
+	m, _ = opt.generateMessageMulti([]string{"D0", "M16"}, []int{1, 2}, [][]byte{{1, 0}, {2, 0, 3, 0}})
+	msgs = append(msgs, m)
+	m, _ = opt.makeRequest([]byte{0x01, 0x14, 0x01, 0x00, 0x00, 0x00, 0x00, 0x9C, 0x03, 0x00, 0x10, 0x10})
+	msgs = append(msgs, m)
+
+	for _, msg := range msgs {
+		ascii, err := transcodeRequest(msg, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		back, err := transcodeRequest(ascii, false)
+		if err != nil || !bytes.Equal(back, msg) {
+			t.Errorf("round trip %s: want % x, got % x %v", ascii, msg, back, err)
+		}
+	}
+}
+
+func TestDecodeErrorResponse(t *testing.T) {
+	resp := []byte{0xD4, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x0B, 0x00, 0x59, 0xC0, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x01, 0x04, 0x00, 0x00}
+
+	f, err := DecodeFrame(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "4E binary response serial=7 net=00 pc=FF io=03FF st=00 end=C059 command or subcommand not supported (0401/0000 batch read (word units))"
+	if f.String() != want {
+		t.Errorf("want %s, got %s", want, f)
+	}
+}
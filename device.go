@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"log"
 	"reflect"
 )
 
@@ -15,10 +14,12 @@ type Device struct {
 	count       int
 	value       []byte
 	mValue      []byte
-	readMessage McMessage
+	chunks      []deviceChunk
+	readMessage []McMessage
 	Error       error
 	conn        *PlcConn
 	changed     bool
+	hub         changeHub
 }
 
 func NewDevice(name string, count int, plc *PlcConn) (*Device, error) {
@@ -35,7 +36,7 @@ func NewDevice(name string, count int, plc *PlcConn) (*Device, error) {
 		name:        name,
 		count:       count,
 		value:       make([]byte, 0, count*2),
-		readMessage: make([]byte, 0),
+		readMessage: make([]McMessage, 0),
 		Error:       nil,
 		conn:        plc,
 	}, nil
@@ -49,59 +50,110 @@ func (dev *Device) Changed() bool {
 	return dev.changed
 }
 
+// Atomic 返回写入是否能在一个请求内完成. 超过MaxBatchPoints个字的软元件被拆分为多个请求, 写入不是原子的.
+func (dev *Device) Atomic() bool {
+	return dev.count <= MaxBatchPoints
+}
+
+func (dev *Device) getChunks() ([]deviceChunk, error) {
+	if dev.chunks == nil {
+		chunks, err := splitDevice(0, dev.name, dev.count, MaxBatchPoints)
+		if err != nil {
+			return nil, err
+		}
+
+		dev.chunks = chunks
+	}
+
+	return dev.chunks, nil
+}
+
 // Write 执行写入操作, 写入内容为最近一次SetValue时传入的值.
-func (dev *Device) Write(debug bool) error {
+// 拆分为多个请求的写入中途失败时返回*PartialWriteError.
+func (dev *Device) Write() error {
 	if dev.mValue == nil {
 		return nil
 	}
 
-	message, err := dev.conn.option.generateMessage(dev.name, dev.count, dev.mValue)
+	chunks, err := dev.getChunks()
 	if err != nil {
 		return err
 	}
 
-	_, err = dev.conn.SendCmd(message, 0, debug)
-	if err != nil {
-		return err
+	for i, c := range chunks {
+		message, err := dev.conn.option.generateMessage(c.name, c.count, dev.mValue[c.offset*2:(c.offset+c.count)*2])
+		if err != nil {
+			return err
+		}
+
+		_, err = dev.conn.SendCmd(message, 0)
+		if err != nil {
+			if i > 0 {
+				return &PartialWriteError{Written: i, Total: len(chunks), Err: err}
+			}
+
+			return err
+		}
 	}
 
 	// 更新数据
-	copy(dev.value, dev.mValue)
+	dev.value = append(dev.value[:0], dev.mValue...)
 	dev.changed = true
 	dev.mValue = nil
+	dev.publish()
 
 	return nil
 }
 
-func (dev *Device) Read(debug bool) error {
+func (dev *Device) getReadMessage() ([]McMessage, error) {
 	if len(dev.readMessage) == 0 {
-		message, err := dev.conn.option.generateMessage(dev.name, dev.count, nil)
+		chunks, err := dev.getChunks()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		dev.readMessage = message
-	}
+		messages := make([]McMessage, len(chunks))
 
-	if debug {
-		log.Printf("sending: % x", dev.readMessage)
+		for i, c := range chunks {
+			message, err := dev.conn.option.generateMessage(c.name, c.count, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			messages[i] = message
+		}
+
+		dev.readMessage = messages
 	}
 
-	buff, err := dev.conn.SendCmd(dev.readMessage, dev.count*2, debug)
+	return dev.readMessage, nil
+}
+
+// Read 读取软元件, 超过MaxBatchPoints个字时拆分为多个请求并合并结果.
+func (dev *Device) Read() error {
+	messages, err := dev.getReadMessage()
 	if err != nil {
 		return err
 	}
 
+	buff := make([]byte, 0, dev.count*2)
+
+	for i, message := range messages {
+		b, err := dev.conn.SendCmd(message, dev.chunks[i].count*2)
+		if err != nil {
+			return err
+		}
+
+		buff = append(buff, b...)
+	}
+
 	if reflect.DeepEqual(dev.value, buff) {
 		return nil
 	}
 
 	dev.value = buff
 	dev.changed = true
-
-	if debug {
-		log.Printf("response: % x", buff)
-	}
+	dev.publish()
 
 	return nil
 }
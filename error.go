@@ -1,9 +1,9 @@
 package melsec
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"reflect"
 )
 
 var (
@@ -11,13 +11,28 @@ var (
 	errorUnknown = errors.New("未知错误")
 )
 
+// EndCodeError PLC以非0结束代码响应的请求.
+type EndCodeError struct {
+	Code uint16
+	err  error
+}
+
+func (e *EndCodeError) Error() string {
+	return fmt.Sprintf("%s, error code: %02x%02x", e.err, byte(e.Code), byte(e.Code>>8))
+}
+
+func (e *EndCodeError) Unwrap() error {
+	return e.err
+}
+
+// ErrorSelect 由响应中的结束代码(小端序)生成*EndCodeError.
 func ErrorSelect(errCode []byte) error {
 	err := errorUnknown
 
-	switch {
-	case reflect.DeepEqual(errCode, []byte{0x5E, 0xC0}):
+	code := binary.LittleEndian.Uint16(errCode)
+	if code == 0xC05E {
 		err = errorTimeout
 	}
 
-	return fmt.Errorf("%w, error code: %x", err, errCode)
+	return &EndCodeError{Code: code, err: err}
 }
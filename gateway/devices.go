@@ -0,0 +1,328 @@
+package gateway
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dualm/melsec"
+)
+
+// deviceRequest 经过检查的软元件地址与数据类型.
+type deviceRequest struct {
+	address string
+	info    melsec.DeviceInfo
+	no      uint64
+	typ     melsec.DataType
+}
+
+// bits 位软元件的bool按位读写, 其余按字.
+func (d *deviceRequest) bits() bool {
+	return d.info.Bit && d.typ == melsec.TypeBool
+}
+
+// parseDevice 由value.go的地址解析检查地址与类型, 类型默认为位软元件bool、字软元件int16.
+func parseDevice(address, typeName string) (*deviceRequest, error) {
+	address = strings.ToUpper(address)
+
+	info, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid address %q: %v", address, err)
+	}
+
+	d := &deviceRequest{address: address, info: info, no: no, typ: melsec.TypeInt16}
+	if info.Bit {
+		d.typ = melsec.TypeBool
+	}
+
+	if typeName != "" {
+		if d.typ, err = melsec.ParseDataType(typeName); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+
+	return d, nil
+}
+
+func (s *Server) parseCount(r *http.Request) (int, error) {
+	text := r.URL.Query().Get("count")
+	if text == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.Atoi(text)
+	if err != nil || n <= 0 || n > s.config.MaxCount {
+		return 0, errorf(http.StatusBadRequest, "count must be 1..%d", s.config.MaxCount)
+	}
+
+	return n, nil
+}
+
+type deviceValues struct {
+	PLC     string      `json:"plc"`
+	Address string      `json:"address"`
+	Type    string      `json:"type"`
+	Values  interface{} `json:"values,omitempty"`
+	Value   interface{} `json:"value,omitempty"` // 字符串
+}
+
+func (s *Server) readDevice(w http.ResponseWriter, r *http.Request, p *PLC, address string) error {
+	d, err := parseDevice(address, r.URL.Query().Get("type"))
+	if err != nil {
+		return err
+	}
+
+	count, err := s.parseCount(r)
+	if err != nil {
+		return err
+	}
+
+	words := d.typ.Words(count)
+	if d.bits() {
+		words = (count + 15) / 16
+	}
+
+	dev, err := melsec.NewDevice(d.address, words, p.Conn)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	if err := s.check(p, dev.Read()); err != nil {
+		return err
+	}
+
+	b := dev.GetValue()
+	re := deviceValues{PLC: p.Name, Address: d.address, Type: d.typ.String()}
+
+	switch {
+	case d.bits():
+		values := make([]bool, count)
+		for i := range values {
+			values[i] = binary.LittleEndian.Uint16(b[i/16*2:])>>(i%16)&1 == 1
+		}
+
+		re.Values = values
+	case d.typ == melsec.TypeString:
+		if re.Value, err = melsec.DecodeValue(d.typ, b, count); err != nil {
+			return err
+		}
+	default:
+		v, err := melsec.DecodeValue(d.typ, b, count)
+		if err != nil {
+			return err
+		}
+
+		if count == 1 {
+			v = []interface{}{v}
+		}
+
+		re.Values = v
+	}
+
+	writeJSON(w, http.StatusOK, re)
+
+	return nil
+}
+
+// toValues 将请求体的值展开为列表.
+func toValues(v interface{}) []interface{} {
+	if s, ok := v.([]interface{}); ok {
+		return s
+	}
+
+	return []interface{}{v}
+}
+
+func toBool(v interface{}) (bool, error) {
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case float64:
+		if v == 0 || v == 1 {
+			return v == 1, nil
+		}
+	case string:
+		switch strings.ToLower(v) {
+		case "on", "true", "1":
+			return true, nil
+		case "off", "false", "0":
+			return false, nil
+		}
+	}
+
+	return false, errorf(http.StatusBadRequest, "invalid bit value %v", v)
+}
+
+func (s *Server) writeDevice(w http.ResponseWriter, r *http.Request, p *PLC, address string) error {
+	d, err := parseDevice(address, r.URL.Query().Get("type"))
+	if err != nil {
+		return err
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		return err
+	}
+
+	values := toValues(body)
+	if len(values) > s.config.MaxCount {
+		return errorf(http.StatusBadRequest, "at most %d values", s.config.MaxCount)
+	}
+
+	if d.bits() {
+		if err := s.writeBits(p, d, values); err != nil {
+			return err
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "count": len(values)})
+
+		return nil
+	}
+
+	var b []byte
+
+	if d.typ == melsec.TypeString {
+		text, ok := body.(string)
+		if !ok {
+			return errorf(http.StatusBadRequest, "string value required")
+		}
+
+		b, err = melsec.EncodeValue(d.typ, text, len(text))
+	} else {
+		b, err = melsec.EncodeValue(d.typ, values, len(values))
+	}
+
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	dev, err := melsec.NewDevice(d.address, len(b)/2, p.Conn)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+
+	dev.SetValue(b)
+
+	if err := s.check(p, dev.Write()); err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "count": len(values)})
+
+	return nil
+}
+
+// writeBits 按位写入, 超过随机写入上限时拆分为多个请求.
+func (s *Server) writeBits(p *PLC, d *deviceRequest, values []interface{}) error {
+	addresses := make([]string, len(values))
+	bits := make([]bool, len(values))
+
+	for i, v := range values {
+		on, err := toBool(v)
+		if err != nil {
+			return err
+		}
+
+		addresses[i] = melsec.FormatAddress(d.info, d.no+uint64(i))
+		bits[i] = on
+	}
+
+	for len(addresses) > 0 {
+		n := len(addresses)
+		if n > melsec.MaxRandomBitPoints {
+			n = melsec.MaxRandomBitPoints
+		}
+
+		if err := s.check(p, p.Conn.WriteBits(addresses[:n], bits[:n])); err != nil {
+			return err
+		}
+
+		addresses, bits = addresses[n:], bits[n:]
+	}
+
+	return nil
+}
+
+func (s *Server) tagDB(p *PLC) (*melsec.TagDB, error) {
+	if p.Tags == nil {
+		return nil, errorf(http.StatusNotFound, "plc %s has no tags", p.Name)
+	}
+
+	return p.Tags, nil
+}
+
+func (s *Server) lookupTag(p *PLC, name string) (*melsec.TagDB, *melsec.Tag, error) {
+	db, err := s.tagDB(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tag, ok := db.Lookup(name)
+	if !ok {
+		return nil, nil, errorf(http.StatusNotFound, "%v: %s", melsec.ErrTagNotFound, name)
+	}
+
+	return db, tag, nil
+}
+
+func (s *Server) listTags(w http.ResponseWriter, p *PLC) error {
+	db, err := s.tagDB(p)
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, db.Tags())
+
+	return nil
+}
+
+func (s *Server) readTag(w http.ResponseWriter, p *PLC, name string) error {
+	db, tag, err := s.lookupTag(p, name)
+	if err != nil {
+		return err
+	}
+
+	v, err := db.Read(tag.Name)
+	if err := s.check(p, err); err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"plc": p.Name, "tag": tag.Name, "address": tag.Address, "value": v})
+
+	return nil
+}
+
+func (s *Server) writeTag(w http.ResponseWriter, r *http.Request, p *PLC, name string) error {
+	db, tag, err := s.lookupTag(p, name)
+	if err != nil {
+		return err
+	}
+
+	v, err := decodeBody(r)
+	if err != nil {
+		return err
+	}
+
+	// 先编码以区分请求错误与通信失败
+	if tag.IsBit() {
+		on, err := toBool(v)
+		if err != nil {
+			return err
+		}
+
+		v = on
+	} else {
+		if _, err := tag.Encode(v); err != nil {
+			return errorf(http.StatusBadRequest, "%v", err)
+		}
+	}
+
+	if err := s.check(p, db.Write(tag.Name, v)); err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true})
+
+	return nil
+}
@@ -0,0 +1,381 @@
+// Package gateway 以HTTP/REST与WebSocket提供PLC访问, 供其他语言的脚本与Web看板使用.
+//
+//	GET  /plcs                                     可访问的PLC
+//	GET  /plcs/{name}/devices/D100?count=10&type=int16
+//	PUT  /plcs/{name}/devices/D100?type=int16      请求体为[1,2,3]、{"values":[1,2,3]}或{"value":1}
+//	GET  /plcs/{name}/tags                         标签定义
+//	GET  /plcs/{name}/tags/{tag}
+//	PUT  /plcs/{name}/tags/{tag}                   请求体为值或{"value":...}
+//	GET  /plcs/{name}/ws?tags=Speed,D100:int16&interval=500ms&deadband=0.5
+//
+// 请求以Authorization: Bearer <token>认证, WebSocket也可以使用?token=.
+// 每个令牌分别列出可读与可写的PLC, 可写的PLC同时可读.
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/gorilla/websocket"
+)
+
+// PLC 网关提供访问的一台PLC.
+type PLC struct {
+	Name string
+	Conn *melsec.PlcConn
+	// Tags 可选的标签数据库, 标签可以按名称读写与订阅
+	Tags *melsec.TagDB
+}
+
+// Token 访问令牌及其权限, Read与Write为PLC名称, "*"表示全部.
+type Token struct {
+	Name  string   `yaml:"name"`
+	Token string   `yaml:"token"`
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+}
+
+// Config 网关的配置.
+type Config struct {
+	PLCs   []PLC
+	Tokens []Token
+	// Timeout 非0时设置为各PLC连接每次请求的超时时间, 为0时使用连接已有的设置.
+	// 同时作为WebSocket写入的超时时间, 默认5s
+	Timeout time.Duration
+	// MaxCount 一次读写的最大点数, 默认1024
+	MaxCount int
+	// MinInterval WebSocket读取周期的下限, 默认100ms
+	MinInterval time.Duration
+	// AllowedOrigins 允许连接WebSocket的跨域来源, 为空时只允许同源, "*"表示全部
+	AllowedOrigins []string
+	Logger         melsec.Logger
+}
+
+// Server 网关, 实现http.Handler.
+type Server struct {
+	config   Config
+	plcs     map[string]*PLC
+	names    []string
+	tokens   map[string]*Token
+	upgrader websocket.Upgrader
+	logger   melsec.Logger
+}
+
+// New 创建网关.
+func New(c Config) (*Server, error) {
+	if len(c.Tokens) == 0 {
+		return nil, errors.New("gateway: no tokens")
+	}
+
+	timeout := c.Timeout
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+
+	if c.MaxCount <= 0 {
+		c.MaxCount = 1024
+	}
+
+	if c.MinInterval <= 0 {
+		c.MinInterval = 100 * time.Millisecond
+	}
+
+	s := &Server{
+		config: c,
+		plcs:   make(map[string]*PLC, len(c.PLCs)),
+		tokens: make(map[string]*Token, len(c.Tokens)),
+		logger: c.Logger,
+	}
+
+	if s.logger == nil {
+		s.logger = nopLogger{}
+	}
+
+	for i := range c.PLCs {
+		p := &c.PLCs[i]
+		if p.Name == "" || strings.Contains(p.Name, "/") || p.Conn == nil {
+			return nil, fmt.Errorf("gateway: invalid plc %q", p.Name)
+		}
+
+		if _, ok := s.plcs[p.Name]; ok {
+			return nil, fmt.Errorf("gateway: duplicate plc %s", p.Name)
+		}
+
+		if timeout > 0 {
+			if err := p.Conn.SetTimeout(timeout); err != nil {
+				return nil, fmt.Errorf("gateway: plc %s: %w", p.Name, err)
+			}
+		}
+
+		s.plcs[p.Name] = p
+		s.names = append(s.names, p.Name)
+	}
+
+	sort.Strings(s.names)
+
+	for i := range c.Tokens {
+		t := &c.Tokens[i]
+		if t.Token == "" {
+			return nil, fmt.Errorf("gateway: empty token %q", t.Name)
+		}
+
+		if _, ok := s.tokens[t.Token]; ok {
+			return nil, fmt.Errorf("gateway: duplicate token %q", t.Name)
+		}
+
+		for _, name := range append(append([]string{}, t.Read...), t.Write...) {
+			if _, ok := s.plcs[name]; !ok && name != "*" {
+				return nil, fmt.Errorf("gateway: token %s: unknown plc %s", t.Name, name)
+			}
+		}
+
+		s.tokens[t.Token] = t
+	}
+
+	s.upgrader.CheckOrigin = s.checkOrigin
+
+	return s, nil
+}
+
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range s.config.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+
+	// 同源
+	return strings.EqualFold(origin, "http://"+r.Host) || strings.EqualFold(origin, "https://"+r.Host)
+}
+
+func contains(list []string, name string) bool {
+	for _, v := range list {
+		if v == "*" || v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Token) canRead(plc string) bool {
+	return contains(t.Read, plc) || contains(t.Write, plc)
+}
+
+func (t *Token) canWrite(plc string) bool {
+	return contains(t.Write, plc)
+}
+
+// httpError 带HTTP状态码的错误.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &httpError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError 输出错误, 未指定状态码的错误视为PLC通信失败.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadGateway
+
+	var he *httpError
+	if errors.As(err, &he) {
+		code = he.code
+	}
+
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// authenticate 返回请求的令牌.
+func (s *Server) authenticate(r *http.Request) (*Token, error) {
+	key := r.URL.Query().Get("token")
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			return nil, errorf(http.StatusUnauthorized, "unsupported authorization scheme")
+		}
+
+		key = strings.TrimSpace(auth[len(prefix):])
+	}
+
+	t, ok := s.tokens[key]
+	if key == "" || !ok {
+		return nil, errorf(http.StatusUnauthorized, "invalid token")
+	}
+
+	return t, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.serve(w, r); err != nil {
+		var he *httpError
+		if !errors.As(err, &he) || he.code >= 500 {
+			s.logger.Warn("gateway request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		}
+
+		writeError(w, err)
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) error {
+	token, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="melsec"`)
+
+		return err
+	}
+
+	parts := strings.SplitN(strings.Trim(r.URL.Path, "/"), "/", 4)
+	if parts[0] != "plcs" {
+		return errorf(http.StatusNotFound, "not found")
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			return errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		}
+
+		s.listPLCs(w, token)
+
+		return nil
+	}
+
+	p, ok := s.plcs[parts[1]]
+	if !ok || !token.canRead(p.Name) {
+		// 无权访问的PLC与不存在的PLC相同
+		return errorf(http.StatusNotFound, "unknown plc %s", parts[1])
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		return errorf(http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+
+	if r.Method == http.MethodPut && !token.canWrite(p.Name) {
+		return errorf(http.StatusForbidden, "token %s may not write to %s", token.Name, p.Name)
+	}
+
+	switch {
+	case len(parts) == 4 && parts[2] == "devices":
+		if r.Method == http.MethodPut {
+			return s.writeDevice(w, r, p, parts[3])
+		}
+
+		return s.readDevice(w, r, p, parts[3])
+	case len(parts) == 3 && parts[2] == "tags" && r.Method == http.MethodGet:
+		return s.listTags(w, p)
+	case len(parts) == 4 && parts[2] == "tags":
+		if r.Method == http.MethodPut {
+			return s.writeTag(w, r, p, parts[3])
+		}
+
+		return s.readTag(w, p, parts[3])
+	case len(parts) == 3 && parts[2] == "ws" && r.Method == http.MethodGet:
+		return s.stream(w, r, p)
+	}
+
+	return errorf(http.StatusNotFound, "not found")
+}
+
+type plcInfo struct {
+	Name     string `json:"name"`
+	Writable bool   `json:"writable"`
+	Tags     int    `json:"tags"`
+}
+
+func (s *Server) listPLCs(w http.ResponseWriter, token *Token) {
+	re := make([]plcInfo, 0, len(s.names))
+
+	for _, name := range s.names {
+		if !token.canRead(name) {
+			continue
+		}
+
+		info := plcInfo{Name: name, Writable: token.canWrite(name)}
+		if db := s.plcs[name].Tags; db != nil {
+			info.Tags = len(db.Tags())
+		}
+
+		re = append(re, info)
+	}
+
+	writeJSON(w, http.StatusOK, re)
+}
+
+// check 通信失败时重新连接, 下一个请求使用新的连接.
+func (s *Server) check(p *PLC, err error) error {
+	var ne net.Error
+	if err == nil || !errors.As(err, &ne) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	if rerr := p.Conn.Reconnect(); rerr != nil {
+		s.logger.Error("plc reconnect failed", "plc", p.Name, "err", rerr)
+	}
+
+	return err
+}
+
+// decodeBody 解析请求体, 接受值、{"value":...}或{"values":[...]}.
+func decodeBody(r *http.Request) (interface{}, error) {
+	var v interface{}
+
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	if err := dec.Decode(&v); err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid body: %v", err)
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		switch {
+		case m["values"] != nil:
+			v = m["values"]
+		case m["value"] != nil:
+			v = m["value"]
+		default:
+			return nil, errorf(http.StatusBadRequest, `body needs "value" or "values"`)
+		}
+	}
+
+	if v == nil {
+		return nil, errorf(http.StatusBadRequest, "null value")
+	}
+
+	return v, nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
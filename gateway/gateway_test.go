@@ -0,0 +1,209 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+	"github.com/gorilla/websocket"
+)
+
+func newGateway(t *testing.T) (*mock.Server, *httptest.Server) {
+	t.Helper()
+
+	s := mock.NewServer()
+	t.Cleanup(s.Close)
+
+	conn, err := melsec.NewConn(s.Host(), s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	db := melsec.NewTagDB(conn)
+	if err := db.Add(
+		melsec.Tag{Name: "Speed", Address: "D300", Type: melsec.TypeInt16, Scale: 0.1},
+		melsec.Tag{Name: "Run", Address: "M10"},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := New(Config{
+		PLCs: []PLC{{Name: "line1", Conn: conn, Tags: db}},
+		Tokens: []Token{
+			{Name: "dashboard", Token: "r", Read: []string{"*"}},
+			{Name: "mes", Token: "w", Write: []string{"line1"}},
+		},
+		MaxCount:    100,
+		MinInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs := httptest.NewServer(g)
+	t.Cleanup(hs.Close)
+
+	return s, hs
+}
+
+func request(t *testing.T, hs *httptest.Server, method, path, token, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, hs.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestREST(t *testing.T) {
+	s, hs := newGateway(t)
+
+	_ = s.Memory.SetWords("D100", 1, 0xFFFE, 3)
+	_ = s.AddFault(mock.Fault{Device: "D900", EndCode: mock.EndCodeDeviceRange})
+
+	tests := []struct {
+		method, path, token, body string
+		code                      int
+		want                      string
+	}{
+		{"GET", "/plcs", "", "", 401, "invalid token"},
+		{"GET", "/plcs", "nosuch", "", 401, "invalid token"},
+		{"GET", "/plcs", "r", "", 200, `[{"name":"line1","writable":false,"tags":2}]`},
+		{"GET", "/plcs/line1/devices/D100?count=3&type=int16", "r", "", 200, `{"plc":"line1","address":"D100","type":"int16","values":[1,-2,3]}`},
+		{"GET", "/plcs/line1/devices/d101?type=uint16", "r", "", 200, `"values":[65534]`},
+		{"PUT", "/plcs/line1/devices/D200", "r", "[1]", 403, "may not write"},
+		{"PUT", "/plcs/line1/devices/D200?type=int32", "w", `{"values":[70000,-1]}`, 200, `{"count":2,"ok":true}`},
+		{"GET", "/plcs/line1/devices/D200?type=int32&count=2", "w", "", 200, `"values":[70000,-1]`},
+		{"PUT", "/plcs/line1/devices/D200", "w", "[1.5]", 400, "not an integer"},
+		{"PUT", "/plcs/line1/devices/D200", "w", "[70000]", 400, "out of range"},
+		{"PUT", "/plcs/line1/devices/D200", "w", "{}", 400, "value"},
+		{"PUT", "/plcs/line1/devices/D200", "w", "[[1]]", 400, "unsupported value"},
+		{"PUT", "/plcs/line1/devices/D210?type=float32", "w", "[1]", 200, `{"count":1,"ok":true}`},
+		{"PUT", "/plcs/line1/devices/M0", "w", `[true, 0, "on"]`, 200, `"ok":true`},
+		{"GET", "/plcs/line1/devices/M0?count=3", "r", "", 200, `"values":[true,false,true]`},
+		{"PUT", "/plcs/line1/devices/M0", "w", `[2]`, 400, "invalid bit value"},
+		{"GET", "/plcs/line1/devices/Q100", "r", "", 400, "invalid address"},
+		{"GET", "/plcs/line1/devices/D0?count=0", "r", "", 400, "count must be"},
+		{"GET", "/plcs/line1/devices/D0?count=101", "r", "", 400, "count must be"},
+		{"GET", "/plcs/line1/devices/D0?type=int64", "r", "", 400, "int64"},
+		{"GET", "/plcs/line1/devices/D900", "r", "", 502, "error"},
+		{"GET", "/plcs/line2/devices/D0", "r", "", 404, "unknown plc"},
+		{"DELETE", "/plcs/line1/devices/D0", "w", "", 405, "not allowed"},
+		{"GET", "/other", "r", "", 404, "not found"},
+		{"PUT", "/plcs/line1/tags/Speed", "w", `{"value":12.5}`, 200, `{"ok":true}`},
+		{"GET", "/plcs/line1/tags/Speed", "r", "", 200, `{"address":"D300","plc":"line1","tag":"Speed","value":12.5}`},
+		{"PUT", "/plcs/line1/tags/Run", "w", `"on"`, 200, `{"ok":true}`},
+		{"GET", "/plcs/line1/tags/Run", "r", "", 200, `"value":true`},
+		{"GET", "/plcs/line1/tags/Nope", "r", "", 404, "tag not found"},
+		{"GET", "/plcs/line1/tags", "r", "", 200, `"name":"Speed","address":"D300","type":"int16"`},
+	}
+
+	for _, tt := range tests {
+		code, body := request(t, hs, tt.method, tt.path, tt.token, tt.body)
+		if code != tt.code || !strings.Contains(body, tt.want) {
+			t.Errorf("%s %s: want %d %q, got %d %q", tt.method, tt.path, tt.code, tt.want, code, body)
+		}
+	}
+
+	if words, _ := s.Memory.Words("D300", 1); words[0] != 125 {
+		t.Errorf("unexpected D300 %v", words)
+	}
+
+	if bits, _ := s.Memory.Bits("M10", 1); !bits[0] {
+		t.Error("M10 should be on")
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	s, hs := newGateway(t)
+
+	_ = s.Memory.SetWords("D300", 100)
+	_ = s.Memory.SetWords("D100", 7)
+
+	url := "ws" + strings.TrimPrefix(hs.URL, "http") + "/plcs/line1/ws?tags=Speed,D100:uint16&interval=10ms&token=r"
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	next := func() event {
+		t.Helper()
+
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var ev event
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatal(err)
+		}
+
+		return ev
+	}
+
+	first := map[string]interface{}{}
+	for i := 0; i < 2; i++ {
+		ev := next()
+		first[ev.Tag] = ev.Value
+
+		if ev.Old != nil {
+			t.Errorf("first event should have no old value: %+v", ev)
+		}
+	}
+
+	if !reflect.DeepEqual(first, map[string]interface{}{"Speed": float64(10), "D100:uint16": float64(7)}) {
+		t.Errorf("unexpected first values %v", first)
+	}
+
+	_ = s.Memory.SetWords("D100", 8)
+
+	if ev := next(); ev.Tag != "D100:uint16" || ev.Value != float64(8) || ev.Old != float64(7) || ev.Address != "D100" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	// 参数错误在升级前以HTTP状态返回
+	for _, q := range []string{"tags=Q0&token=r", "tags=D0&interval=x&token=r", "tags=D0"} {
+		_, resp, err := websocket.DefaultDialer.Dial(strings.Split(url, "?")[0]+"?"+q, nil)
+		if err == nil || resp == nil || resp.StatusCode < 400 {
+			t.Errorf("%s: want http error", q)
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	conn := &melsec.PlcConn{}
+
+	for _, c := range []Config{
+		{PLCs: []PLC{{Name: "a", Conn: conn}}},
+		{PLCs: []PLC{{Name: "a", Conn: conn}, {Name: "a", Conn: conn}}, Tokens: []Token{{Token: "t"}}},
+		{PLCs: []PLC{{Name: "a/b", Conn: conn}}, Tokens: []Token{{Token: "t"}}},
+		{PLCs: []PLC{{Name: "a", Conn: conn}}, Tokens: []Token{{Token: "t", Write: []string{"b"}}}},
+		{PLCs: []PLC{{Name: "a", Conn: conn}}, Tokens: []Token{{Token: "t"}, {Token: "t"}}},
+	} {
+		if _, err := New(c); err == nil {
+			t.Errorf("want error for %+v", c)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package gateway
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// event WebSocket推送的一个标签变化, 首次读取时Old为null.
+type event struct {
+	Tag     string      `json:"tag"`
+	Address string      `json:"address"`
+	Value   interface{} `json:"value"`
+	Old     interface{} `json:"old"`
+	Time    time.Time   `json:"time"`
+}
+
+// streamTags 解析tags参数, 每项为标签名或ADDR[:TYPE].
+func streamTags(p *PLC, spec string) ([]melsec.Tag, error) {
+	var tags []melsec.Tag
+
+	seen := make(map[string]bool)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" || seen[item] {
+			continue
+		}
+
+		seen[item] = true
+
+		if p.Tags != nil {
+			if tag, ok := p.Tags.Lookup(item); ok {
+				tags = append(tags, *tag)
+
+				continue
+			}
+		}
+
+		address, typeName := item, ""
+		if i := strings.Index(item, ":"); i >= 0 {
+			address, typeName = item[:i], item[i+1:]
+		}
+
+		d, err := parseDevice(address, typeName)
+		if err != nil {
+			return nil, err
+		}
+
+		if d.typ == melsec.TypeString {
+			return nil, errorf(http.StatusBadRequest, "string tags cannot be streamed")
+		}
+
+		tags = append(tags, melsec.Tag{Name: item, Address: d.address, Type: d.typ})
+	}
+
+	if len(tags) == 0 {
+		return nil, errorf(http.StatusBadRequest, "no tags")
+	}
+
+	if len(tags) > melsec.MaxBlocks {
+		return nil, errorf(http.StatusBadRequest, "at most %d tags", melsec.MaxBlocks)
+	}
+
+	return tags, nil
+}
+
+// stream 按周期读取订阅的标签, 以JSON推送变化. 每个连接独立读取.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, p *PLC) error {
+	query := r.URL.Query()
+
+	tags, err := streamTags(p, query.Get("tags"))
+	if err != nil {
+		return err
+	}
+
+	interval := time.Second
+
+	if text := query.Get("interval"); text != "" {
+		if interval, err = time.ParseDuration(text); err != nil {
+			return errorf(http.StatusBadRequest, "invalid interval %q", text)
+		}
+	}
+
+	if interval < s.config.MinInterval {
+		interval = s.config.MinInterval
+	}
+
+	var deadband float64
+
+	if text := query.Get("deadband"); text != "" {
+		if deadband, err = strconv.ParseFloat(text, 64); err != nil || deadband < 0 {
+			return errorf(http.StatusBadRequest, "invalid deadband %q", text)
+		}
+	}
+
+	dev, err := melsec.NewMultiDevice(p.Conn)
+	if err != nil {
+		return err
+	}
+
+	for i := range tags {
+		dev.AddBlock(tags[i].Address, tags[i].Words())
+	}
+
+	sub, err := dev.Subscribe(melsec.WithTags(tags...), melsec.WithDeadband(deadband))
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	defer sub.Close()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade已输出错误响应
+		return nil
+	}
+	defer conn.Close()
+
+	// 读取客户端的消息以处理关闭与ping, 内容被忽略
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(v interface{}) bool {
+		_ = conn.SetWriteDeadline(time.Now().Add(s.config.Timeout))
+
+		return conn.WriteJSON(v) == nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	read := func() bool {
+		if err := s.check(p, dev.Read()); err != nil {
+			return send(map[string]string{"error": err.Error()})
+		}
+
+		return true
+	}
+
+	if !read() {
+		return nil
+	}
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case ev := <-sub.C:
+			if !send(event{Tag: ev.Tag, Address: ev.Address, Value: ev.New, Old: ev.Old, Time: ev.Time}) {
+				return nil
+			}
+		case <-ticker.C:
+			if !read() {
+				return nil
+			}
+		}
+	}
+}
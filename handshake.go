@@ -0,0 +1,292 @@
+package melsec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrHandshakeTimeout 握手的某一步在超时时间内未完成.
+var ErrHandshakeTimeout = errors.New("handshake timeout")
+
+// HandshakeError PLC通过错误代码软元件返回的非0结果.
+type HandshakeError struct {
+	Code uint16
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("handshake error code 0x%04x", e.Code)
+}
+
+// HandshakeConfig 请求/应答位握手的软元件配置.
+// 由PC发起时Request为PC置位的请求位, Ack为PLC置位的应答位, Data为PC写入的数据;
+// 由PLC发起时Request为PLC置位的请求位, Ack为PC置位的应答位, Data为PC读取的数据.
+// ErrorCode可选, 为结果代码所在的字软元件, 0表示成功.
+type HandshakeConfig struct {
+	Data      string
+	DataCount int
+	Request   string
+	Ack       string
+	ErrorCode string
+	// Timeout 等待每一次位变化的超时时间, 默认5秒.
+	Timeout time.Duration
+	// PollInterval 读取位状态的间隔, 默认50毫秒.
+	PollInterval time.Duration
+}
+
+// Handshake 基于Device读写的请求/应答位握手. 同一个Handshake上的握手依次执行.
+type Handshake struct {
+	mu        sync.Mutex
+	conn      *PlcConn
+	cfg       HandshakeConfig
+	data      *Device
+	request   *Device
+	ack       *Device
+	errorCode *Device
+}
+
+func NewHandshake(plc *PlcConn, cfg HandshakeConfig) (*Handshake, error) {
+	if plc == nil {
+		return nil, errors.New("nil plc connection")
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 50 * time.Millisecond
+	}
+
+	h := &Handshake{conn: plc, cfg: cfg}
+
+	for _, a := range []string{cfg.Request, cfg.Ack} {
+		comp, _, err := parseComponent(a)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isBitComponent(comp) {
+			return nil, fmt.Errorf("握手信号%s不是位软元件", a)
+		}
+	}
+
+	var err error
+
+	if h.request, err = NewDevice(cfg.Request, 1, plc); err != nil {
+		return nil, err
+	}
+
+	if h.ack, err = NewDevice(cfg.Ack, 1, plc); err != nil {
+		return nil, err
+	}
+
+	if cfg.Data != "" {
+		if h.data, err = NewDevice(cfg.Data, cfg.DataCount, plc); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ErrorCode != "" {
+		if h.errorCode, err = NewDevice(cfg.ErrorCode, 1, plc); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// readBit 读取位软元件的状态.
+func readBit(dev *Device) (bool, error) {
+	if err := dev.Read(); err != nil {
+		return false, err
+	}
+
+	return len(dev.value) != 0 && dev.value[0]&1 == 1, nil
+}
+
+// waitBit 等待位软元件变为state, 超时返回ErrHandshakeTimeout.
+func (h *Handshake) waitBit(ctx context.Context, dev *Device, state bool) error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+
+	err := h.pollBit(ctx, dev, state)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: waiting for %s = %t", ErrHandshakeTimeout, dev.name, state)
+	}
+
+	return err
+}
+
+// pollBit 等待位软元件变为state, 只受ctx控制.
+func (h *Handshake) pollBit(ctx context.Context, dev *Device, state bool) error {
+	ticker := time.NewTicker(h.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		on, err := readBit(dev)
+		if err != nil {
+			return err
+		}
+
+		if on == state {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handshake) setBit(address string, state bool) error {
+	return h.conn.WriteBits([]string{address}, []bool{state})
+}
+
+// readCode 读取结果代码, 未配置时返回0.
+func (h *Handshake) readCode() (uint16, error) {
+	if h.errorCode == nil {
+		return 0, nil
+	}
+
+	if err := h.errorCode.Read(); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint16(h.errorCode.value), nil
+}
+
+// Execute 执行一次由PC发起的握手: 等待应答位复位, 写入数据, 置位请求位,
+// 等待应答位置位, 读取结果代码, 复位请求位, 等待应答位复位.
+// 任何一步失败或ctx取消时复位请求位; PLC返回非0结果代码时返回*HandshakeError.
+func (h *Handshake) Execute(ctx context.Context, data []byte) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.waitBit(ctx, h.ack, false); err != nil {
+		return err
+	}
+
+	if h.data != nil {
+		if len(data) > h.data.count*2 {
+			return fmt.Errorf("handshake data %d bytes, %s holds %d", len(data), h.cfg.Data, h.data.count*2)
+		}
+
+		h.data.SetValue(data)
+
+		if err := h.data.Write(); err != nil {
+			return err
+		}
+	}
+
+	if err := h.setBit(h.cfg.Request, true); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			// 清理失败不覆盖原始错误
+			_ = h.setBit(h.cfg.Request, false)
+		}
+	}()
+
+	if err := h.waitBit(ctx, h.ack, true); err != nil {
+		return err
+	}
+
+	code, err := h.readCode()
+	if err != nil {
+		return err
+	}
+
+	if err := h.setBit(h.cfg.Request, false); err != nil {
+		return err
+	}
+
+	if err := h.waitBit(ctx, h.ack, false); err != nil {
+		return err
+	}
+
+	if code != 0 {
+		return &HandshakeError{Code: code}
+	}
+
+	return nil
+}
+
+// EventHandler 处理PLC发起的事件, 返回值写入结果代码软元件.
+type EventHandler func(data []byte) uint16
+
+// Accept 等待并处理一次由PLC发起的握手: 等待请求位置位, 读取数据并调用handler,
+// 写入结果代码, 置位应答位, 等待请求位复位后复位应答位.
+// 等待请求位不受Timeout限制, 只受ctx控制. 失败时复位应答位.
+func (h *Handshake) Accept(ctx context.Context, handler EventHandler) (err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.pollBit(ctx, h.request, true); err != nil {
+		return err
+	}
+
+	var data []byte
+
+	if h.data != nil {
+		if err := h.data.Read(); err != nil {
+			return err
+		}
+
+		data = append([]byte{}, h.data.value...)
+	}
+
+	code := handler(data)
+
+	if h.errorCode != nil {
+		h.errorCode.SetValue([]byte{byte(code), byte(code >> 8)})
+
+		if err := h.errorCode.Write(); err != nil {
+			return err
+		}
+	}
+
+	if err := h.setBit(h.cfg.Ack, true); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = h.setBit(h.cfg.Ack, false)
+		}
+	}()
+
+	if err := h.waitBit(ctx, h.request, false); err != nil {
+		return err
+	}
+
+	return h.setBit(h.cfg.Ack, false)
+}
+
+// Listen 循环处理PLC发起的握手直到ctx结束或通信失败. 单次握手超时不会结束循环,
+// 此时等待PLC复位请求位后再接受下一次握手, 同一个请求不会被处理两次.
+func (h *Handshake) Listen(ctx context.Context, handler EventHandler) error {
+	for {
+		err := h.Accept(ctx, handler)
+
+		if err != nil && errors.Is(err, ErrHandshakeTimeout) && ctx.Err() == nil {
+			h.mu.Lock()
+			err = h.pollBit(ctx, h.request, false)
+			h.mu.Unlock()
+		}
+
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			return err
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package melsec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func fastHandshake(t *testing.T, conn *PlcConn) *Handshake {
+	t.Helper()
+
+	h, err := NewHandshake(conn, HandshakeConfig{
+		Data:         "D100",
+		DataCount:    2,
+		Request:      "M100",
+		Ack:          "M101",
+		ErrorCode:    "D200",
+		Timeout:      200 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func TestHandshakeExecute(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	// PLC程序: 请求置位时检查数据并应答, 请求复位时复位应答
+	plc.after = func(cmd uint16) {
+		if cmd != 0x1402 {
+			return
+		}
+
+		req := plc.words(0x90, 100, 1)[0] & 1
+		ack := plc.words(0x90, 101, 1)
+
+		if req == 1 {
+			code := uint16(0)
+			if binary.LittleEndian.Uint16(plc.words(0xA8, 100, 1)) == 0 {
+				code = 0x12
+			}
+
+			binary.LittleEndian.PutUint16(plc.words(0xA8, 200, 1), code)
+		}
+
+		ack[0] = req
+	}
+
+	h := fastHandshake(t, conn)
+
+	if err := h.Execute(context.Background(), []byte{5, 0, 6, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := plc.words(0xA8, 100, 2); d[0] != 5 || d[2] != 6 {
+		t.Errorf("unexpected data % x", d)
+	}
+
+	err := h.Execute(context.Background(), []byte{0, 0})
+
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || herr.Code != 0x12 {
+		t.Fatalf("want handshake error 0x12, got %v", err)
+	}
+
+	if plc.words(0x90, 100, 1)[0]&1 != 0 {
+		t.Error("request left on")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	plc, conn := newFakePLC(t)
+	h := fastHandshake(t, conn)
+
+	err := h.Execute(context.Background(), nil)
+	if !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("want timeout, got %v", err)
+	}
+
+	if plc.words(0x90, 100, 1)[0]&1 != 0 {
+		t.Error("request not reset after timeout")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := h.Execute(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("want canceled, got %v", err)
+	}
+
+	if plc.words(0x90, 100, 1)[0]&1 != 0 {
+		t.Error("request not reset after cancel")
+	}
+}
+
+func TestHandshakeAccept(t *testing.T) {
+	plc, conn := newFakePLC(t)
+	h := fastHandshake(t, conn)
+
+	// PLC发起: 写入数据并置位请求, 收到应答后复位请求
+	plc.mu.Lock()
+	copy(plc.words(0xA8, 100, 2), []byte{7, 0, 8, 0})
+	plc.words(0x90, 100, 1)[0] = 1
+	plc.after = func(cmd uint16) {
+		if cmd == 0x1402 && plc.words(0x90, 101, 1)[0]&1 == 1 {
+			plc.words(0x90, 100, 1)[0] = 0
+		}
+	}
+	plc.mu.Unlock()
+
+	var got []byte
+
+	err := h.Accept(context.Background(), func(data []byte) uint16 {
+		got = data
+
+		return 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 4 || got[0] != 7 || got[2] != 8 {
+		t.Errorf("unexpected event data % x", got)
+	}
+
+	if code := binary.LittleEndian.Uint16(plc.words(0xA8, 200, 1)); code != 3 {
+		t.Errorf("want result code 3, got %d", code)
+	}
+
+	if plc.words(0x90, 101, 1)[0]&1 != 0 {
+		t.Error("ack left on")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := h.Listen(ctx, func([]byte) uint16 { return 0 }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want listen to end with ctx, got %v", err)
+	}
+}
+
+func TestHandshakeListenTimeout(t *testing.T) {
+	plc, conn := newFakePLC(t)
+	h := fastHandshake(t, conn)
+
+	// PLC置位请求后超过Timeout才复位
+	plc.mu.Lock()
+	plc.words(0x90, 100, 1)[0] = 1
+	plc.mu.Unlock()
+
+	release := time.AfterFunc(500*time.Millisecond, func() {
+		plc.mu.Lock()
+		plc.words(0x90, 100, 1)[0] = 0
+		plc.mu.Unlock()
+	})
+	defer release.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 800*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+
+	err := h.Listen(ctx, func([]byte) uint16 {
+		calls++
+
+		return 0
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want listen to end with ctx, got %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("handler called %d times for one request", calls)
+	}
+
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+
+	if plc.words(0x90, 101, 1)[0]&1 != 0 {
+		t.Error("ack left on")
+	}
+}
@@ -0,0 +1,206 @@
+package melsec
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// HeartbeatMode PC侧心跳软元件的更新方式.
+type HeartbeatMode uint8
+
+const (
+	// HeartbeatIncrement 每个周期加1, 65535之后回到0.
+	HeartbeatIncrement HeartbeatMode = iota
+	// HeartbeatToggle 每个周期在0与1之间切换, 位软元件与字软元件均可.
+	HeartbeatToggle
+)
+
+// HeartbeatConfig 心跳配置. PLCAddress为空时不监视PLC侧心跳,
+// 此时连续StaleAfter时间写入失败即视为链路失效.
+type HeartbeatConfig struct {
+	Address    string
+	Mode       HeartbeatMode
+	Period     time.Duration
+	PLCAddress string
+	// StaleAfter PLC侧心跳保持不变多久后视为链路失效, 默认3个周期.
+	StaleAfter time.Duration
+	// OnStatus 链路在正常与失效之间切换时调用.
+	OnStatus func(HeartbeatStatus)
+}
+
+// HeartbeatStatus 心跳的当前状态. LastChange为最近一次观察到PLC侧心跳变化
+// (未配置PLCAddress时为最近一次写入成功)的时间.
+type HeartbeatStatus struct {
+	Stale      bool
+	Sent       uint16
+	PLCValue   uint16
+	LastChange time.Time
+	Errors     uint64
+	LastError  error
+}
+
+// Heartbeat 按固定周期更新PC侧心跳并监视PLC侧心跳.
+type Heartbeat struct {
+	cfg    HeartbeatConfig
+	conn   *PlcConn
+	bit    bool
+	out    *Device
+	in     *Device
+	mu     sync.Mutex
+	status HeartbeatStatus
+	seen   bool
+}
+
+// NewHeartbeat 创建心跳, 调用Run后开始运行.
+func (plc *PlcConn) NewHeartbeat(cfg HeartbeatConfig) (*Heartbeat, error) {
+	if cfg.Period <= 0 {
+		return nil, errors.New("heartbeat period must be positive")
+	}
+
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = 3 * cfg.Period
+	}
+
+	comp, _, err := parseComponent(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Heartbeat{cfg: cfg, conn: plc, bit: isBitComponent(comp)}
+
+	if h.bit && cfg.Mode != HeartbeatToggle {
+		return nil, errors.New("bit heartbeat device must use HeartbeatToggle")
+	}
+
+	if h.out, err = NewDevice(cfg.Address, 1, plc); err != nil {
+		return nil, err
+	}
+
+	if cfg.PLCAddress != "" {
+		if h.in, err = NewDevice(cfg.PLCAddress, 1, plc); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// Status 返回心跳的当前状态.
+func (h *Heartbeat) Status() HeartbeatStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.status
+}
+
+// Run 运行心跳直到ctx结束.
+func (h *Heartbeat) Run(ctx context.Context) error {
+	h.mu.Lock()
+	h.status.LastChange = time.Now()
+	h.mu.Unlock()
+
+	ticker := time.NewTicker(h.cfg.Period)
+	defer ticker.Stop()
+
+	for {
+		h.beat(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// next 返回下一次写入的值.
+func (h *Heartbeat) next(v uint16) uint16 {
+	if h.cfg.Mode == HeartbeatToggle {
+		return v ^ 1
+	}
+
+	return v + 1
+}
+
+func (h *Heartbeat) send(v uint16) error {
+	if h.bit {
+		return h.conn.WriteBits([]string{h.cfg.Address}, []bool{v&1 == 1})
+	}
+
+	h.out.SetValue([]byte{byte(v), byte(v >> 8)})
+
+	return h.out.Write()
+}
+
+func (h *Heartbeat) receive() (uint16, error) {
+	if err := h.in.Read(); err != nil {
+		return 0, err
+	}
+
+	v := binary.LittleEndian.Uint16(h.in.value)
+
+	comp, _, _ := parseComponent(h.cfg.PLCAddress)
+	if isBitComponent(comp) {
+		v &= 1
+	}
+
+	return v, nil
+}
+
+func (h *Heartbeat) beat(now time.Time) {
+	h.mu.Lock()
+	v := h.next(h.status.Sent)
+	h.mu.Unlock()
+
+	sendErr := h.send(v)
+
+	var (
+		plcValue uint16
+		readErr  error
+	)
+
+	if h.in != nil {
+		plcValue, readErr = h.receive()
+	}
+
+	h.mu.Lock()
+
+	s := &h.status
+
+	for _, err := range []error{sendErr, readErr} {
+		if err != nil {
+			s.Errors++
+			s.LastError = err
+		}
+	}
+
+	if sendErr == nil {
+		s.Sent = v
+
+		if h.in == nil {
+			s.LastChange = now
+		}
+	}
+
+	if h.in != nil && readErr == nil {
+		if h.seen && plcValue != s.PLCValue {
+			s.LastChange = now
+		}
+
+		s.PLCValue, h.seen = plcValue, true
+	}
+
+	stale := now.Sub(s.LastChange) >= h.cfg.StaleAfter
+	changed := stale != s.Stale
+	s.Stale = stale
+	status := *s
+
+	h.mu.Unlock()
+
+	if changed && h.cfg.OnStatus != nil {
+		h.cfg.OnStatus(status)
+	}
+}
@@ -0,0 +1,102 @@
+package melsec
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	// PLC程序在前几个周期递增D11, 之后停止
+	beats := 3
+	plc.after = func(cmd uint16) {
+		if cmd == 0x1401 && beats > 0 {
+			beats--
+			w := plc.words(0xA8, 11, 1)
+			binary.LittleEndian.PutUint16(w, binary.LittleEndian.Uint16(w)+1)
+		}
+	}
+
+	events := make(chan HeartbeatStatus, 4)
+
+	h, err := conn.NewHeartbeat(HeartbeatConfig{
+		Address:    "D10",
+		Period:     5 * time.Millisecond,
+		PLCAddress: "D11",
+		StaleAfter: 30 * time.Millisecond,
+		OnStatus: func(s HeartbeatStatus) {
+			events <- s
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- h.Run(ctx)
+	}()
+
+	select {
+	case s := <-events:
+		if !s.Stale || s.PLCValue != 3 {
+			t.Errorf("want stale at PLC value 3, got %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stale event")
+	}
+
+	// PLC恢复后链路恢复
+	plc.mu.Lock()
+	beats = 1000
+	plc.mu.Unlock()
+
+	select {
+	case s := <-events:
+		if s.Stale {
+			t.Errorf("want recovered, got %+v", s)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no recover event")
+	}
+
+	cancel()
+	<-done
+
+	plc.mu.Lock()
+	sent := binary.LittleEndian.Uint16(plc.words(0xA8, 10, 1))
+	plc.mu.Unlock()
+
+	if s := h.Status(); s.Sent != sent || sent < 4 || s.Errors != 0 {
+		t.Errorf("want increasing host heartbeat, plc has %d, status %+v", sent, s)
+	}
+}
+
+func TestHeartbeatToggleBit(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	if _, err := conn.NewHeartbeat(HeartbeatConfig{Address: "M0", Period: time.Millisecond}); err == nil {
+		t.Error("want error for incrementing bit device")
+	}
+
+	h, err := conn.NewHeartbeat(HeartbeatConfig{Address: "M0", Mode: HeartbeatToggle, Period: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	h.status.LastChange = now
+
+	for i := 0; i < 3; i++ {
+		h.beat(now)
+	}
+
+	if b := plc.words(0x90, 0, 1)[0]; b != 1 || h.Status().Sent != 1 || h.Status().Stale {
+		t.Errorf("want M0 on after 3 toggles, got %d %+v", b, h.Status())
+	}
+}
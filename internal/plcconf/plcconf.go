@@ -0,0 +1,138 @@
+// Package plcconf 各命令行工具共用的PLC连接与标签文件配置.
+package plcconf
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// DefaultTimeout 未指定Timeout时每次通信的超时时间.
+const DefaultTimeout = 5 * time.Second
+
+// PLC 一台PLC的连接参数, 访问路径未指定时使用本站的默认值.
+//
+//	addr: 192.168.0.10:5007
+//	frame: 4E
+//	timeout: 2s
+type PLC struct {
+	Addr    string        `yaml:"addr"`
+	Frame   string        `yaml:"frame"`
+	ASCII   bool          `yaml:"ascii"`
+	Network uint          `yaml:"network"`
+	PC      *uint         `yaml:"pc"`
+	IO      *uint         `yaml:"io"`
+	Station uint          `yaml:"station"`
+	Timer   *uint         `yaml:"timer"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// TimeoutOrDefault 每次通信(包括建立连接)的超时时间.
+func (p *PLC) TimeoutOrDefault() time.Duration {
+	if p.Timeout <= 0 {
+		return DefaultTimeout
+	}
+
+	return p.Timeout
+}
+
+// Options 返回连接参数对应的选项, 追加在ops之后.
+func (p *PLC) Options(ops ...melsec.PlcOption) ([]melsec.PlcOption, error) {
+	pc, io, timer := uint(0xFF), uint(0x3FF), uint(4)
+	if p.PC != nil {
+		pc = *p.PC
+	}
+
+	if p.IO != nil {
+		io = *p.IO
+	}
+
+	if p.Timer != nil {
+		timer = *p.Timer
+	}
+
+	ops = append(ops,
+		melsec.SetDialTimeout(p.TimeoutOrDefault()),
+		melsec.SetTimeout(p.TimeoutOrDefault()),
+		melsec.SetASCII(p.ASCII),
+		melsec.SetNetCode(p.Network),
+		melsec.SetPLCCode(pc),
+		melsec.SetModuleIoNo(io),
+		melsec.SetModuleStationNo(p.Station),
+		melsec.SetCPUTimer(timer),
+	)
+
+	switch strings.ToUpper(p.Frame) {
+	case "", "3E":
+		ops = append(ops, melsec.SetFrame(melsec.Frame3E))
+	case "4E":
+		ops = append(ops, melsec.SetFrame(melsec.Frame4E))
+	default:
+		return nil, fmt.Errorf("unknown frame %q", p.Frame)
+	}
+
+	return ops, nil
+}
+
+// SplitAddr 拆分Addr为NewConn使用的host与port.
+func (p *PLC) SplitAddr() (string, string, error) {
+	if p.Addr == "" {
+		return "", "", fmt.Errorf("empty plc address")
+	}
+
+	return net.SplitHostPort(p.Addr)
+}
+
+// Dial 建立连接.
+func (p *PLC) Dial(ops ...melsec.PlcOption) (*melsec.PlcConn, error) {
+	ops, err := p.Options(ops...)
+	if err != nil {
+		return nil, err
+	}
+
+	host, port, err := p.SplitAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	return melsec.NewConn(host, port, ops...)
+}
+
+// LoadTags 按扩展名加载标签文件: .yaml/.yml为YAML, .csv为CSV, 其余为GX Works导出.
+// GX Works导出中有不受支持的标签时返回melsec.ErrTagsSkipped, 其余标签已经加载.
+func LoadTags(db *melsec.TagDB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = db.LoadYAML(f)
+	case ".csv":
+		err = db.LoadCSV(f)
+	default:
+		err = db.LoadGXWorks(f)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Resolve 将相对于配置文件的路径转换为绝对路径, path为空时返回空.
+func Resolve(config, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(config), path)
+}
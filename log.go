@@ -0,0 +1,146 @@
+package melsec
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger 结构化日志接口, args为交替的键与值. *slog.Logger满足该接口, 可直接传入SetLogger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// SetLogger 设置连接的日志, 默认不输出日志.
+// 每次请求以Debug级别输出指令、软元件、收发字节数与耗时; 结束代码异常为Warn, 通信失败为Error.
+func SetLogger(l Logger) PlcOption {
+	return func(opt *plcOptions) error {
+		if l == nil {
+			l = nopLogger{}
+		}
+
+		opt.logger = l
+
+		return nil
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// LogLevel 日志级别.
+type LogLevel int8
+
+const (
+	LevelDebug LogLevel = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	}
+
+	return "ERROR"
+}
+
+// stdLogger 以key=value格式输出到*log.Logger.
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+// NewStdLogger 返回输出到l的Logger, 低于level的日志被忽略. l为nil时使用log的默认Logger.
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &stdLogger{l: l, level: level}
+}
+
+func (s *stdLogger) output(level LogLevel, msg string, args []interface{}) {
+	if level < s.level {
+		return
+	}
+
+	b := strings.Builder{}
+	b.WriteString(level.String() + " " + msg)
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+
+			break
+		}
+
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+
+	s.l.Print(b.String())
+}
+
+func (s *stdLogger) Debug(msg string, args ...interface{}) {
+	s.output(LevelDebug, msg, args)
+}
+
+func (s *stdLogger) Info(msg string, args ...interface{}) {
+	s.output(LevelInfo, msg, args)
+}
+
+func (s *stdLogger) Warn(msg string, args ...interface{}) {
+	s.output(LevelWarn, msg, args)
+}
+
+func (s *stdLogger) Error(msg string, args ...interface{}) {
+	s.output(LevelError, msg, args)
+}
+
+// exchangeAttrs 返回一次请求的日志字段.
+func (plc *PlcConn) exchangeAttrs(req, resp []byte) []interface{} {
+	attrs := []interface{}{"plc", plc.RemoteAddr().String()}
+
+	f, err := DecodeFrame(req)
+	if err != nil {
+		return append(attrs, "request", fmt.Sprintf("% x", req))
+	}
+
+	attrs = append(attrs, "command", fmt.Sprintf("%04X/%04X", f.Command, f.SubCommand), "name", f.Name())
+
+	if len(f.Devices) != 0 {
+		devices := make([]string, 0, len(f.Devices))
+
+		for i, d := range f.Devices {
+			if i == 8 {
+				devices = append(devices, fmt.Sprintf("...(%d more)", len(f.Devices)-i))
+
+				break
+			}
+
+			d.Values = nil
+			devices = append(devices, d.String())
+		}
+
+		attrs = append(attrs, "devices", strings.Join(devices, ","))
+	}
+
+	if f.Frame == Frame4E {
+		attrs = append(attrs, "serial", f.Serial)
+	}
+
+	return append(attrs, "sent", len(req), "received", len(resp))
+}
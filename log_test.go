@@ -0,0 +1,91 @@
+package melsec
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type logRecord struct {
+	level string
+	msg   string
+	attrs map[string]interface{}
+}
+
+// captureLogger 记录所有日志, 用于检查输出的字段.
+type captureLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (c *captureLogger) add(level, msg string, args []interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	attrs := make(map[string]interface{})
+	for i := 0; i+1 < len(args); i += 2 {
+		attrs[args[i].(string)] = args[i+1]
+	}
+
+	c.records = append(c.records, logRecord{level: level, msg: msg, attrs: attrs})
+}
+
+func (c *captureLogger) Debug(msg string, args ...interface{}) { c.add("debug", msg, args) }
+func (c *captureLogger) Info(msg string, args ...interface{})  { c.add("info", msg, args) }
+func (c *captureLogger) Warn(msg string, args ...interface{})  { c.add("warn", msg, args) }
+func (c *captureLogger) Error(msg string, args ...interface{}) { c.add("error", msg, args) }
+
+func TestSetLogger(t *testing.T) {
+	logger := &captureLogger{}
+	plc, conn := newFakePLC(t, SetLogger(logger))
+
+	dev, err := NewDevice("D100", 2, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	plc.failAt = 2
+
+	if err := dev.Read(); err == nil {
+		t.Fatal("want end code error")
+	}
+
+	if len(logger.records) != 2 {
+		t.Fatalf("want 2 records, got %+v", logger.records)
+	}
+
+	r := logger.records[0]
+	if r.level != "debug" || r.attrs["command"] != "0401/0000" || r.attrs["devices"] != "D100:2w" || r.attrs["latency"] == nil {
+		t.Errorf("unexpected debug record %+v", r)
+	}
+
+	if r.attrs["sent"] != 21 || r.attrs["received"] != 15 {
+		t.Errorf("unexpected byte counts %+v", r.attrs)
+	}
+
+	if r := logger.records[1]; r.level != "warn" || r.attrs["end_code"] != "C051" {
+		t.Errorf("unexpected warn record %+v", r)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	buf := bytes.Buffer{}
+	logger := NewStdLogger(log.New(&buf, "", 0), LevelWarn)
+
+	logger.Debug("hidden")
+	logger.Warn("mc end code", "end_code", "C051", "odd")
+
+	if got := buf.String(); got != "WARN mc end code end_code=C051 !BADKEY=odd\n" {
+		t.Errorf("unexpected output %q", got)
+	}
+
+	if strings.Contains(buf.String(), "hidden") {
+		t.Error("debug should be filtered")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"reflect"
+	"time"
 )
 
 var (
@@ -25,17 +27,123 @@ var (
 	TCComponent McMessage = []byte{0xC0}
 	RComponent  McMessage = []byte{0xAF}
 	CNComponent McMessage = []byte{0xC5}
+	CSComponent McMessage = []byte{0xC4}
+	CCComponent McMessage = []byte{0xC3}
+	SBComponent McMessage = []byte{0xA1}
+	SWComponent McMessage = []byte{0xB5}
+	DXComponent McMessage = []byte{0xA2}
+	DYComponent McMessage = []byte{0xA3}
+	ZComponent  McMessage = []byte{0xCC}
+	ZRComponent McMessage = []byte{0xB0}
+
+	STSComponent McMessage = []byte{0xC7}
+	STCComponent McMessage = []byte{0xC6}
+	STNComponent McMessage = []byte{0xC8}
 
 	Base10 int = 10
 	Base16 int = 16
 )
 
+const (
+	// MaxBatchPoints 批量读写(字单位)及多块批量读写一次请求的总字数上限.
+	MaxBatchPoints = 960
+	// MaxBlocks 多块批量读写一次请求的字块数与位块数之和的上限.
+	MaxBlocks = 120
+	// MaxRandomBitPoints 随机写入(位单位)一次请求最多可指定的点数.
+	MaxRandomBitPoints = 188
+	// MaxRandomReadPoints 随机读取一次请求的字访问点数与双字访问点数之和的上限.
+	MaxRandomReadPoints = 192
+)
+
 type plcOptions struct {
 	netCode               []byte
 	plcCode               []byte
 	targetModuleIoNo      []byte
 	targetModuleStationNo []byte
 	duration              []byte
+	frame                 Frame
+	ascii                 bool
+	logger                Logger
+	metrics               Metrics
+	dialTimeout           time.Duration
+	timeout               time.Duration
+}
+
+// Frame 报文格式.
+type Frame uint8
+
+const (
+	// Frame3E 3E帧, 默认格式.
+	Frame3E Frame = iota
+	// Frame4E 4E帧, 请求带有序列号, 响应按序列号核对.
+	Frame4E
+)
+
+func (f Frame) String() string {
+	if f == Frame4E {
+		return "4E"
+	}
+
+	return "3E"
+}
+
+// SetFrame 设置报文格式.
+func SetFrame(frame Frame) PlcOption {
+	return func(opt *plcOptions) error {
+		if frame > Frame4E {
+			return fmt.Errorf("unknown frame %d", frame)
+		}
+
+		opt.frame = frame
+
+		return nil
+	}
+}
+
+// SetASCII 设置通信代码, true为ASCII码, 默认为二进制码.
+// ASCII码下请求在发送前转换, 响应在接收后转换为二进制, 其余处理与二进制相同.
+func SetASCII(ascii bool) PlcOption {
+	return func(opt *plcOptions) error {
+		opt.ascii = ascii
+
+		return nil
+	}
+}
+
+// SetDialTimeout 设置建立连接(包括Reconnect)的超时时间, 默认不限制.
+func SetDialTimeout(d time.Duration) PlcOption {
+	return func(opt *plcOptions) error {
+		if d < 0 {
+			return fmt.Errorf("negative dial timeout %v", d)
+		}
+
+		opt.dialTimeout = d
+
+		return nil
+	}
+}
+
+// SetTimeout 设置每次请求的超时时间, 从请求取得连接时开始计时, 默认不限制.
+// 超时的请求返回net.Error, 之后应调用Reconnect.
+func SetTimeout(d time.Duration) PlcOption {
+	return func(opt *plcOptions) error {
+		if d < 0 {
+			return fmt.Errorf("negative timeout %v", d)
+		}
+
+		opt.timeout = d
+
+		return nil
+	}
+}
+
+// headerLength 返回响应头(至结束代码为止)的长度.
+func (plc plcOptions) headerLength() int {
+	if plc.frame == Frame4E {
+		return FirstResponseLength4E
+	}
+
+	return FirstResponseLength
 }
 
 func (plc plcOptions) makeRequest(cmd McMessage) (McMessage, error) {
@@ -128,6 +236,7 @@ func newPlcOption(ops []PlcOption) *plcOptions {
 		targetModuleIoNo:      getLocalTargetModuleIoNo(),
 		targetModuleStationNo: getLocalTargetModuleStationNo(),
 		duration:              getCPUTimer(),
+		logger:                nopLogger{},
 	}
 
 	for _, o := range ops {
@@ -140,9 +249,13 @@ func newPlcOption(ops []PlcOption) *plcOptions {
 }
 
 // getSubtitle，返回副帧头.
-// 4E: []byte{0x54, 0x00}
+// 4E: []byte{0x54, 0x00}, 其后为序列号(2字节)与固定的00 00
 // 3E: []byte{0x50, 0x00}
-func getSubtitle() McMessage {
+func getSubtitle(frame Frame) McMessage {
+	if frame == Frame4E {
+		return []byte{0x54, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+
 	return []byte{0x50, 0x00}
 }
 
@@ -153,13 +266,12 @@ func getLocalNetCode() McMessage {
 
 func SetNetCode(netCode interface{}) PlcOption {
 	return func(opt *plcOptions) error {
-		buff := bytes.Buffer{}
-
-		if err := binary.Write(&buff, binary.LittleEndian, netCode.(uint)); err != nil {
-			return err
+		b, err := encodeOption(netCode, 1)
+		if err != nil {
+			return fmt.Errorf("network number: %w", err)
 		}
 
-		copy(opt.netCode, buff.Bytes())
+		opt.netCode = b
 
 		return nil
 	}
@@ -172,12 +284,12 @@ func getPlcCode() McMessage {
 
 func SetPLCCode(plcCode interface{}) PlcOption {
 	return func(opt *plcOptions) error {
-		buff := bytes.Buffer{}
-		if err := binary.Write(&buff, binary.LittleEndian, plcCode.(uint)); err != nil {
-			return err
+		b, err := encodeOption(plcCode, 1)
+		if err != nil {
+			return fmt.Errorf("pc number: %w", err)
 		}
 
-		copy(opt.plcCode, buff.Bytes())
+		opt.plcCode = b
 
 		return nil
 	}
@@ -190,13 +302,12 @@ func getLocalTargetModuleIoNo() McMessage {
 
 func SetModuleIoNo(ioNo interface{}) PlcOption {
 	return func(opt *plcOptions) error {
-		buff := bytes.Buffer{}
-
-		if err := binary.Write(&buff, binary.LittleEndian, ioNo.(uint16)); err != nil {
-			return err
+		b, err := encodeOption(ioNo, 2)
+		if err != nil {
+			return fmt.Errorf("module io number: %w", err)
 		}
 
-		copy(opt.targetModuleIoNo, buff.Bytes())
+		opt.targetModuleIoNo = b
 
 		return nil
 	}
@@ -204,13 +315,12 @@ func SetModuleIoNo(ioNo interface{}) PlcOption {
 
 func SetCPUTimer(t interface{}) PlcOption {
 	return func(opt *plcOptions) error {
-		buff := bytes.Buffer{}
-
-		if err := binary.Write(&buff, binary.LittleEndian, t.(uint16)); err != nil {
-			return err
+		b, err := encodeOption(t, 2)
+		if err != nil {
+			return fmt.Errorf("cpu timer: %w", err)
 		}
 
-		copy(opt.duration, buff.Bytes())
+		opt.duration = b
 
 		return nil
 	}
@@ -228,23 +338,48 @@ func getLocalTargetModuleStationNo() McMessage {
 
 func SetModuleStationNo(stationNo interface{}) PlcOption {
 	return func(opt *plcOptions) error {
-		buff := bytes.Buffer{}
-
-		if err := binary.Write(&buff, binary.LittleEndian, stationNo.(uint)); err != nil {
-			return err
+		b, err := encodeOption(stationNo, 1)
+		if err != nil {
+			return fmt.Errorf("module station number: %w", err)
 		}
 
-		copy(opt.targetModuleStationNo, buff.Bytes())
+		opt.targetModuleStationNo = b
 
 		return nil
 	}
 }
 
+// encodeOption 将整数类型的选项值编码为size字节的小端序数据.
+func encodeOption(v interface{}, size int) (McMessage, error) {
+	var n uint64
+
+	rv := reflect.ValueOf(v)
+
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if rv.Int() < 0 {
+			return nil, fmt.Errorf("negative value %d", rv.Int())
+		}
+
+		n = uint64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = rv.Uint()
+	default:
+		return nil, fmt.Errorf("%T is not an integer", v)
+	}
+
+	if n>>(8*size) != 0 {
+		return nil, fmt.Errorf("value %d exceeds %d bytes", n, size)
+	}
+
+	return encodeUint(n, size)
+}
+
 type McMessage []byte
 
 func (plc plcOptions) getFixedPart() McMessage {
 	b := bytes.Buffer{}
-	b.Write(getSubtitle())
+	b.Write(getSubtitle(plc.frame))
 	b.Write(plc.getNetCode())
 	b.Write(plc.getPlcCode())
 	b.Write(plc.getTargetModuleIoNo())
@@ -291,6 +426,10 @@ func generateCmd(device string, count int, values []byte) ([]byte, error) {
 		return nil, fmt.Errorf("generateMessage error: %s", err)
 	}
 
+	if count <= 0 || count > MaxBatchPoints {
+		return nil, fmt.Errorf("generateMessage error: count %d out of range 1-%d", count, MaxBatchPoints)
+	}
+
 	b := bytes.Buffer{}
 	b.Write(sc)
 
@@ -313,7 +452,7 @@ func generateCmd(device string, count int, values []byte) ([]byte, error) {
 func generateCmdMulti(device []string, count []int, values [][]byte) ([]byte, error) {
 	re := make([]byte, 0)
 
-	var wordCount, bitCount int8
+	var wordCount, bitCount, points int
 
 	for i := 0; i < len(device); i++ {
 		_compoType, _ := splitComponentName(device[i])
@@ -322,8 +461,13 @@ func generateCmdMulti(device []string, count []int, values [][]byte) ([]byte, er
 		}
 
 		_bitSize, _wordSize := componentBitSize(_compoType)
-		wordCount += _wordSize
-		bitCount += _bitSize
+		if _bitSize == 0 && _wordSize == 0 {
+			return nil, fmt.Errorf("软元件%s不支持多块批量读写", device[i])
+		}
+
+		wordCount += int(_wordSize)
+		bitCount += int(_bitSize)
+		points += count[i]
 
 		sc, err := encodeSoftComponent(device[i])
 		if err != nil {
@@ -347,7 +491,95 @@ func generateCmdMulti(device []string, count []int, values [][]byte) ([]byte, er
 		re = append(re, b.Bytes()...)
 	}
 
+	if wordCount+bitCount > MaxBlocks {
+		return nil, fmt.Errorf("generateMessageMulti error: %d blocks, over %d", wordCount+bitCount, MaxBlocks)
+	}
+
+	if points > MaxBatchPoints {
+		return nil, fmt.Errorf("generateMessageMulti error: %d points, over %d", points, MaxBatchPoints)
+	}
+
 	re = append([]byte{byte(wordCount), byte(bitCount)}, re...)
 
 	return re, nil
 }
+
+func (plc plcOptions) generateMessageRandomBits(device []string, values []bool) (McMessage, error) {
+	request, err := generateCmdRandomBits(device, values)
+	if err != nil {
+		return nil, fmt.Errorf("get request error: %w", err)
+	}
+
+	dataBuff := bytes.Buffer{}
+	dataBuff.Write(CommandRandomWriteBitBinary)
+	dataBuff.Write(request)
+
+	return plc.makeRequest(dataBuff.Bytes())
+}
+
+// count + (softComponent + on/off) * count.
+func generateCmdRandomBits(device []string, values []bool) ([]byte, error) {
+	if len(device) != len(values) {
+		return nil, fmt.Errorf("generateMessageRandomBits error: %d devices, %d values", len(device), len(values))
+	}
+
+	if len(device) == 0 || len(device) > MaxRandomBitPoints {
+		return nil, fmt.Errorf("generateMessageRandomBits error: bit count %d out of range 1-%d", len(device), MaxRandomBitPoints)
+	}
+
+	b := bytes.Buffer{}
+	b.WriteByte(byte(len(device)))
+
+	for i := range device {
+		sc, err := encodeSoftComponent(device[i])
+		if err != nil {
+			return nil, fmt.Errorf("generateMessageRandomBits error: %w", err)
+		}
+
+		b.Write(sc)
+
+		if values[i] {
+			b.WriteByte(0x01)
+		} else {
+			b.WriteByte(0x00)
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+func (plc plcOptions) generateMessageRandomRead(words, dwords []string) (McMessage, error) {
+	request, err := generateCmdRandomRead(words, dwords)
+	if err != nil {
+		return nil, fmt.Errorf("get request error: %w", err)
+	}
+
+	dataBuff := bytes.Buffer{}
+	dataBuff.Write(CommandRandomReadWordBinary)
+	dataBuff.Write(request)
+
+	return plc.makeRequest(dataBuff.Bytes())
+}
+
+// wordCount + dwordCount + softComponent * (wordCount + dwordCount).
+func generateCmdRandomRead(words, dwords []string) ([]byte, error) {
+	total := len(words) + len(dwords)
+	if total == 0 || total > MaxRandomReadPoints {
+		return nil, fmt.Errorf("generateMessageRandomRead error: point count %d out of range 1-%d", total, MaxRandomReadPoints)
+	}
+
+	b := bytes.Buffer{}
+	b.WriteByte(byte(len(words)))
+	b.WriteByte(byte(len(dwords)))
+
+	for _, device := range append(append([]string{}, words...), dwords...) {
+		sc, err := encodeSoftComponent(device)
+		if err != nil {
+			return nil, fmt.Errorf("generateMessageRandomRead error: %w", err)
+		}
+
+		b.Write(sc)
+	}
+
+	return b.Bytes(), nil
+}
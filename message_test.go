@@ -5,6 +5,7 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func makeListener(t *testing.T) {
@@ -13,18 +14,21 @@ func makeListener(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	for {
-		_, err := listener.Accept()
-		if err != nil {
-			t.Error(err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
 		}
-	}
+	}()
 }
 
 func TestSetCPUTimer(t *testing.T) {
-	go func() {
-		makeListener(t)
-	}()
+	makeListener(t)
 
 	n := uint16(20)
 
@@ -41,3 +45,25 @@ func TestSetCPUTimer(t *testing.T) {
 		t.Fatalf("want %v, got %v", b, conn.option.getCPUTimer())
 	}
 }
+
+func TestSetRouting(t *testing.T) {
+	makeListener(t)
+
+	conn, err := NewConn("localhost", "8080", SetNetCode(uint(1)), SetPLCCode(2), SetModuleIoNo(uint16(0x03E0)), SetModuleStationNo(uint8(3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	want := McMessage{0x50, 0x00, 0x01, 0x02, 0xE0, 0x03, 0x03}
+	if got := conn.option.getFixedPart(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want % x, got % x", want, got)
+	}
+
+	for _, op := range []PlcOption{SetPLCCode(256), SetNetCode(-1), SetModuleIoNo("0x3FF"), SetDialTimeout(-time.Second)} {
+		if _, err := NewConn("localhost", "8080", op); err == nil {
+			t.Error("want option error")
+		}
+	}
+}
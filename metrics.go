@@ -0,0 +1,334 @@
+package melsec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics 接收连接的通信指标, 用于对接Prometheus、OpenTelemetry等监控系统.
+// 同一个Metrics可以由多个连接共享, 方法会被多个goroutine并发调用.
+type Metrics interface {
+	// RequestStarted 请求进入SendCmd时调用, 之后必定调用一次RequestDone. 等待发送的请求也计为进行中.
+	RequestStarted(plc string)
+	// RequestDone 请求结束时调用.
+	RequestDone(r RequestStats)
+	// Reconnected 每次调用Reconnect之后调用, 失败时err不为nil.
+	Reconnected(plc string, err error)
+}
+
+// RequestStats 一次请求的统计. PLC为NewConn时的host:port.
+type RequestStats struct {
+	PLC        string
+	Command    uint16
+	SubCommand uint16
+	Latency    time.Duration
+	Sent       int // 发送的字节数
+	Received   int // 接收的字节数
+	EndCode    uint16
+	// Err 请求返回的错误. EndCode不为0时为结束代码异常, 否则为通信失败
+	Err error
+}
+
+// SetMetrics 设置接收通信指标的Metrics, 默认不统计.
+func SetMetrics(m Metrics) PlcOption {
+	return func(opt *plcOptions) error {
+		opt.metrics = m
+
+		return nil
+	}
+}
+
+// requestCommand 返回二进制请求帧的指令与子指令.
+func requestCommand(msg McMessage, frame Frame) (uint16, uint16) {
+	// 副帧头, 访问路径, 数据长度, 监视定时器
+	offset := 11
+	if frame == Frame4E {
+		offset = 15
+	}
+
+	if len(msg) < offset+4 {
+		return 0, 0
+	}
+
+	return binary.LittleEndian.Uint16(msg[offset:]), binary.LittleEndian.Uint16(msg[offset+2:])
+}
+
+// LatencyBuckets Stats中请求耗时直方图的上限(秒).
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Stats 内置的Metrics实现, 按PLC与指令汇总, 可发布到expvar或以Prometheus文本格式输出.
+type Stats struct {
+	mu   sync.Mutex
+	plcs map[string]*plcStats
+}
+
+type plcStats struct {
+	inFlight          int64
+	sent, received    uint64
+	reconnects        uint64
+	reconnectFailures uint64
+	commands          map[uint32]*commandStats
+	endCodes          map[uint16]uint64
+}
+
+type commandStats struct {
+	requests uint64
+	failures uint64
+	buckets  []uint64
+	sum      float64
+}
+
+// NewStats 创建Stats.
+func NewStats() *Stats {
+	return &Stats{plcs: make(map[string]*plcStats)}
+}
+
+func (s *Stats) plc(name string) *plcStats {
+	p, ok := s.plcs[name]
+	if !ok {
+		p = &plcStats{commands: make(map[uint32]*commandStats), endCodes: make(map[uint16]uint64)}
+		s.plcs[name] = p
+	}
+
+	return p
+}
+
+func (s *Stats) RequestStarted(plc string) {
+	s.mu.Lock()
+	s.plc(plc).inFlight++
+	s.mu.Unlock()
+}
+
+func (s *Stats) RequestDone(r RequestStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.plc(r.PLC)
+	p.inFlight--
+	p.sent += uint64(r.Sent)
+	p.received += uint64(r.Received)
+
+	key := uint32(r.Command)<<16 | uint32(r.SubCommand)
+
+	c, ok := p.commands[key]
+	if !ok {
+		c = &commandStats{buckets: make([]uint64, len(LatencyBuckets))}
+		p.commands[key] = c
+	}
+
+	c.requests++
+
+	if r.EndCode != 0 {
+		p.endCodes[r.EndCode]++
+	} else if r.Err != nil {
+		c.failures++
+	}
+
+	seconds := r.Latency.Seconds()
+	c.sum += seconds
+
+	for i, le := range LatencyBuckets {
+		if seconds <= le {
+			c.buckets[i]++
+		}
+	}
+}
+
+func (s *Stats) Reconnected(plc string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.plc(plc)
+	p.reconnects++
+
+	if err != nil {
+		p.reconnectFailures++
+	}
+}
+
+// CommandSnapshot 一个指令的统计.
+type CommandSnapshot struct {
+	Name     string  `json:"name"`
+	Requests uint64  `json:"requests"`
+	Failures uint64  `json:"failures"`
+	Seconds  float64 `json:"seconds"` // 耗时合计
+}
+
+// PLCSnapshot 一个PLC的统计.
+type PLCSnapshot struct {
+	InFlight          int64                      `json:"in_flight"`
+	BytesSent         uint64                     `json:"bytes_sent"`
+	BytesReceived     uint64                     `json:"bytes_received"`
+	Reconnects        uint64                     `json:"reconnects"`
+	ReconnectFailures uint64                     `json:"reconnect_failures"`
+	Commands          map[string]CommandSnapshot `json:"commands"`  // 键为"0401/0000"
+	EndCodes          map[string]uint64          `json:"end_codes"` // 键为"C051"
+}
+
+// Snapshot 返回各PLC的统计, 键为PLC的host:port.
+func (s *Stats) Snapshot() map[string]PLCSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	re := make(map[string]PLCSnapshot, len(s.plcs))
+
+	for name, p := range s.plcs {
+		snap := PLCSnapshot{
+			InFlight:          p.inFlight,
+			BytesSent:         p.sent,
+			BytesReceived:     p.received,
+			Reconnects:        p.reconnects,
+			ReconnectFailures: p.reconnectFailures,
+			Commands:          make(map[string]CommandSnapshot, len(p.commands)),
+			EndCodes:          make(map[string]uint64, len(p.endCodes)),
+		}
+
+		for key, c := range p.commands {
+			cmd, sub := uint16(key>>16), uint16(key)
+			snap.Commands[fmt.Sprintf("%04X/%04X", cmd, sub)] = CommandSnapshot{
+				Name:     CommandName(cmd, sub),
+				Requests: c.requests,
+				Failures: c.failures,
+				Seconds:  c.sum,
+			}
+		}
+
+		for code, n := range p.endCodes {
+			snap.EndCodes[fmt.Sprintf("%04X", code)] = n
+		}
+
+		re[name] = snap
+	}
+
+	return re
+}
+
+// Publish 以name发布到expvar, 同一name只能发布一次.
+func (s *Stats) Publish(name string) {
+	expvar.Publish(name, s)
+}
+
+func sortedKeys(m map[string]*plcStats) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WritePrometheus 以Prometheus文本格式输出全部指标, 指标名以melsec_开头.
+func (s *Stats) WritePrometheus(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := bufio.NewWriter(w)
+	names := sortedKeys(s.plcs)
+
+	metric := func(name, typ, help string, each func(plc string, p *plcStats)) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+
+		for _, plc := range names {
+			each(strconv.Quote(plc), s.plcs[plc])
+		}
+	}
+
+	counter := func(name, help string, value func(p *plcStats) uint64) {
+		metric(name, "counter", help, func(plc string, p *plcStats) {
+			fmt.Fprintf(b, "%s{plc=%s} %d\n", name, plc, value(p))
+		})
+	}
+
+	metric("melsec_requests_in_flight", "gauge", "Requests waiting for or awaiting a response.", func(plc string, p *plcStats) {
+		fmt.Fprintf(b, "melsec_requests_in_flight{plc=%s} %d\n", plc, p.inFlight)
+	})
+
+	counter("melsec_sent_bytes_total", "Bytes sent to the PLC.", func(p *plcStats) uint64 { return p.sent })
+	counter("melsec_received_bytes_total", "Bytes received from the PLC.", func(p *plcStats) uint64 { return p.received })
+	counter("melsec_reconnects_total", "Reconnect attempts.", func(p *plcStats) uint64 { return p.reconnects })
+	counter("melsec_reconnect_failures_total", "Failed reconnect attempts.", func(p *plcStats) uint64 { return p.reconnectFailures })
+
+	commands := func(p *plcStats) []uint32 {
+		keys := make([]uint32, 0, len(p.commands))
+		for k := range p.commands {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+		return keys
+	}
+
+	labels := func(plc string, key uint32) string {
+		return fmt.Sprintf("plc=%s,command=\"%04X/%04X\"", plc, key>>16, key&0xFFFF)
+	}
+
+	metric("melsec_requests_total", "counter", "Requests by command.", func(plc string, p *plcStats) {
+		for _, k := range commands(p) {
+			fmt.Fprintf(b, "melsec_requests_total{%s} %d\n", labels(plc, k), p.commands[k].requests)
+		}
+	})
+
+	metric("melsec_request_failures_total", "counter", "Requests that failed without an end code (timeouts, closed connections, bad frames).", func(plc string, p *plcStats) {
+		for _, k := range commands(p) {
+			fmt.Fprintf(b, "melsec_request_failures_total{%s} %d\n", labels(plc, k), p.commands[k].failures)
+		}
+	})
+
+	metric("melsec_end_code_errors_total", "counter", "Responses with an abnormal end code.", func(plc string, p *plcStats) {
+		codes := make([]int, 0, len(p.endCodes))
+		for code := range p.endCodes {
+			codes = append(codes, int(code))
+		}
+
+		sort.Ints(codes)
+
+		for _, code := range codes {
+			fmt.Fprintf(b, "melsec_end_code_errors_total{plc=%s,end_code=\"%04X\"} %d\n", plc, code, p.endCodes[uint16(code)])
+		}
+	})
+
+	metric("melsec_request_duration_seconds", "histogram", "Request round trip time.", func(plc string, p *plcStats) {
+		for _, k := range commands(p) {
+			c, l := p.commands[k], labels(plc, k)
+
+			for i, le := range LatencyBuckets {
+				fmt.Fprintf(b, "melsec_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, formatFloat(le), c.buckets[i])
+			}
+
+			fmt.Fprintf(b, "melsec_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, c.requests)
+			fmt.Fprintf(b, "melsec_request_duration_seconds_sum{%s} %s\n", l, formatFloat(c.sum))
+			fmt.Fprintf(b, "melsec_request_duration_seconds_count{%s} %d\n", l, c.requests)
+		}
+	})
+
+	return b.Flush()
+}
+
+// ServeHTTP 以Prometheus文本格式输出全部指标, 可直接注册为/metrics.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	_ = s.WritePrometheus(w)
+}
+
+// String 实现expvar.Var, 返回JSON格式的Snapshot.
+func (s *Stats) String() string {
+	return expvar.Func(func() interface{} {
+		return s.Snapshot()
+	}).String()
+}
@@ -0,0 +1,82 @@
+package melsec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	stats := NewStats()
+	plc, conn := newFakePLC(t, SetMetrics(stats))
+
+	dev, err := NewDevice("D0", 2, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	plc.failAt = 2
+
+	var ee *EndCodeError
+	if err := dev.Read(); !errors.As(err, &ee) || ee.Code != 0xC051 || !strings.HasSuffix(err.Error(), "error code: 51c0") {
+		t.Fatalf("want end code error, got %v", err)
+	}
+
+	// 断开连接之后请求失败, Reconnect之后恢复
+	_ = conn.Conn.Close()
+
+	if err := dev.Read(); err == nil {
+		t.Fatal("want error on closed connection")
+	}
+
+	if err := conn.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	snap := stats.Snapshot()[conn.address]
+
+	read := snap.Commands["0401/0000"]
+	if read.Requests != 4 || read.Failures != 1 || read.Name != "batch read (word units)" {
+		t.Errorf("unexpected command stats %+v", read)
+	}
+
+	if snap.EndCodes["C051"] != 1 || snap.Reconnects != 1 || snap.InFlight != 0 {
+		t.Errorf("unexpected snapshot %+v", snap)
+	}
+
+	// 成功的请求21字节, 响应15字节; 错误响应20字节
+	if snap.BytesSent != 21*3 || snap.BytesReceived != 15*2+20 {
+		t.Errorf("unexpected byte counts %d %d", snap.BytesSent, snap.BytesReceived)
+	}
+
+	buf := bytes.Buffer{}
+	if err := stats.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`melsec_requests_total{plc="` + conn.address + `",command="0401/0000"} 4`,
+		`melsec_end_code_errors_total{plc="` + conn.address + `",end_code="C051"} 1`,
+		`melsec_request_duration_seconds_bucket{plc="` + conn.address + `",command="0401/0000",le="+Inf"} 4`,
+		"# TYPE melsec_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want %s in\n%s", want, buf.String())
+		}
+	}
+
+	var decoded map[string]PLCSnapshot
+	if err := json.Unmarshal([]byte(stats.String()), &decoded); err != nil || decoded[conn.address].Reconnects != 1 {
+		t.Errorf("unexpected expvar value %s %v", stats.String(), err)
+	}
+}
@@ -0,0 +1,159 @@
+package mock
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/server"
+	"gopkg.in/yaml.v3"
+)
+
+// Fault 一条故障规则. Command与Device为匹配条件, 为空时匹配全部请求;
+// Device可以是软元件类型(如"D")或地址(如"D100"), 地址在请求的读写范围内即匹配.
+// 跳过前After个匹配的请求后生效, 共生效Count次, Count为0时一直生效.
+// 例如{After: 10, Drop: true}使模拟PLC在10个请求之后不再响应.
+type Fault struct {
+	Command uint16 `yaml:"command"`
+	Device  string `yaml:"device"`
+	After   int    `yaml:"after"`
+	Count   int    `yaml:"count"`
+
+	// EndCode 以该结束代码响应, 不执行请求.
+	EndCode uint16 `yaml:"end_code"`
+	// Latency 响应前的延迟.
+	Latency time.Duration `yaml:"latency"`
+	// Drop 不发送响应.
+	Drop bool `yaml:"drop"`
+	// Truncate 只发送响应的前Truncate个字节.
+	Truncate int `yaml:"truncate"`
+	// Close 发送一半响应后关闭连接.
+	Close bool `yaml:"close"`
+	// WrongSerial 4E帧响应使用错误的序列号.
+	WrongSerial bool `yaml:"wrong_serial"`
+
+	hits int
+}
+
+// LoadFaults 从YAML文件读取故障规则, 格式为:
+//
+//	faults:
+//	  - command: 0x0401
+//	    device: D100
+//	    end_code: 0xC056
+//	  - after: 10
+//	    drop: true
+func LoadFaults(path string) ([]Fault, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Faults []Fault `yaml:"faults"`
+	}
+
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("load faults %s: %w", path, err)
+	}
+
+	for i := range cfg.Faults {
+		if err := cfg.Faults[i].validate(); err != nil {
+			return nil, fmt.Errorf("load faults %s: fault %d: %w", path, i, err)
+		}
+	}
+
+	return cfg.Faults, nil
+}
+
+func (f *Fault) validate() error {
+	if f.Device == "" {
+		return nil
+	}
+
+	if _, _, err := melsec.ParseAddress(f.Device); err == nil {
+		return nil
+	}
+
+	if _, ok := melsec.LookupDevice(f.Device); !ok {
+		return fmt.Errorf("unknown device %s", f.Device)
+	}
+
+	return nil
+}
+
+// AddFault 添加故障规则. 每条规则独立计数, 每个请求只应用第一条生效的规则.
+func (s *Server) AddFault(f Fault) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.faults = append(s.faults, &f)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// ClearFaults 删除全部故障规则.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	s.faults = nil
+	s.mu.Unlock()
+}
+
+// fault 返回应用于req的故障规则, 没有时返回nil.
+func (s *Server) fault(req *server.Request) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var re *Fault
+
+	// 每条规则都对匹配的请求计数
+	for _, f := range s.faults {
+		if !f.matches(req) {
+			continue
+		}
+
+		f.hits++
+
+		if re != nil || f.hits <= f.After || (f.Count > 0 && f.hits > f.After+f.Count) {
+			continue
+		}
+
+		applied := *f
+		re = &applied
+	}
+
+	return re
+}
+
+func (f *Fault) matches(req *server.Request) bool {
+	if f.Command != 0 && f.Command != req.Command {
+		return false
+	}
+
+	if f.Device == "" {
+		return true
+	}
+
+	dev, no, err := melsec.ParseAddress(f.Device)
+	whole := err != nil
+
+	if whole {
+		dev, _ = melsec.LookupDevice(f.Device)
+	}
+
+	for _, sp := range req.Spans() {
+		if sp.Device.Code != dev.Code {
+			continue
+		}
+
+		if whole || (no >= uint64(sp.No) && no < uint64(sp.No)+uint64(sp.Points)) {
+			return true
+		}
+	}
+
+	return false
+}
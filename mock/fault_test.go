@@ -0,0 +1,147 @@
+package mock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+func TestFaultEndCode(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s)
+
+	if err := s.AddFault(Fault{Device: "D100", EndCode: EndCodeDeviceRange, Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := melsec.NewDevice("D0", 10, conn)
+	if err := other.Read(); err != nil {
+		t.Fatalf("D0-D9 should not match: %v", err)
+	}
+
+	dev, _ := melsec.NewDevice("D95", 10, conn)
+	if err := dev.Read(); err == nil {
+		t.Fatal("want end code for D95-D104")
+	}
+
+	// Count用尽后恢复正常
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaultLatencyAndDrop(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s)
+	dev, _ := melsec.NewDevice("D0", 1, conn)
+
+	_ = s.AddFault(Fault{Command: 0x0401, Latency: 30 * time.Millisecond, Count: 1})
+	_ = s.AddFault(Fault{After: 2, Drop: true})
+
+	start := time.Now()
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < 30*time.Millisecond {
+		t.Error("want latency")
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	var ne interface{ Timeout() bool }
+	if err := dev.Read(); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("want timeout after 2 answered requests, got %v", err)
+	}
+}
+
+func TestFaultFrames(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	_ = s.AddFault(Fault{Command: 0x0401, WrongSerial: true, Count: 1})
+	_ = s.AddFault(Fault{Command: 0x1401, Truncate: 5, Count: 1})
+	_ = s.AddFault(Fault{Command: 0x0101, Close: true})
+
+	conn := dial(t, s, melsec.SetFrame(melsec.Frame4E))
+	dev, _ := melsec.NewDevice("D0", 1, conn)
+
+	if err := dev.Read(); !errors.Is(err, melsec.ErrSerialMismatch) {
+		t.Fatalf("want serial mismatch, got %v", err)
+	}
+
+	dev.SetValue([]byte{1, 0})
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	if err := dev.Write(); err == nil {
+		t.Fatal("want error for truncated response")
+	}
+
+	conn = dial(t, s)
+
+	if _, err := conn.GetCPUInfo(); err == nil {
+		t.Fatal("want error for connection closed mid-frame")
+	}
+}
+
+func TestLoadFaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.yaml")
+
+	err := os.WriteFile(path, []byte(`faults:
+  - command: 0x0401
+    device: M
+    end_code: 0xC05B
+  - after: 3
+    latency: 10ms
+    drop: true
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faults, err := LoadFaults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(faults) != 2 || faults[0].Command != 0x0401 || faults[0].EndCode != 0xC05B || faults[1].Latency != 10*time.Millisecond || !faults[1].Drop {
+		t.Fatalf("unexpected faults %+v", faults)
+	}
+
+	s := NewServer()
+	defer s.Close()
+
+	for _, f := range faults {
+		if err := s.AddFault(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn := dial(t, s)
+
+	bits, _ := melsec.NewDevice("M0", 1, conn)
+	if err := bits.Read(); err == nil {
+		t.Error("want end code for M")
+	}
+
+	if err := os.WriteFile(path, []byte("faults:\n  - device: K1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadFaults(path); err == nil {
+		t.Error("want error for unknown device")
+	}
+}
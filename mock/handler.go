@@ -0,0 +1,66 @@
+package mock
+
+import (
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/server"
+)
+
+// 模拟PLC返回的结束代码.
+const (
+	EndCodeOK            = uint16(server.EndCodeOK)
+	EndCodeCountRange    = uint16(server.EndCodeCountRange)    // 读写点数超出范围
+	EndCodeDeviceRange   = uint16(server.EndCodeDeviceRange)   // 软元件编号超出范围
+	EndCodeUnsupported   = uint16(server.EndCodeUnsupported)   // 指令或子指令不支持
+	EndCodeDevice        = uint16(server.EndCodeDevice)        // 指定的软元件不能访问
+	EndCodeRequestLength = uint16(server.EndCodeRequestLength) // 请求数据长度与点数不一致
+)
+
+// deviceMemory 以server.DeviceMemory访问Memory, Memory的读写不会失败.
+type deviceMemory struct {
+	m *Memory
+}
+
+func (d deviceMemory) ReadWords(dev melsec.DeviceInfo, no uint32, count int) ([]uint16, error) {
+	return d.m.ReadWords(dev, no, count), nil
+}
+
+func (d deviceMemory) WriteWords(dev melsec.DeviceInfo, no uint32, values []uint16) error {
+	d.m.WriteWords(dev, no, values)
+
+	return nil
+}
+
+func (d deviceMemory) ReadBits(dev melsec.DeviceInfo, no uint32, count int) ([]bool, error) {
+	return d.m.ReadBits(dev, no, count), nil
+}
+
+func (d deviceMemory) WriteBits(dev melsec.DeviceInfo, no uint32, values []bool) error {
+	d.m.WriteBits(dev, no, values)
+
+	return nil
+}
+
+// handler 返回处理请求的server.Server, 在第一个请求时按Memory、CPUModel与CPUCode创建.
+func (s *Server) handler() *server.Server {
+	s.once.Do(func() {
+		s.core = server.NewServer(deviceMemory{m: s.Memory})
+		s.core.CPUModel, s.core.CPUCode = s.CPUModel, s.CPUCode
+		s.core.Control = s.control
+	})
+
+	return s.core
+}
+
+// control 远程RUN/STOP改变CPU状态, 其他远程操作不支持.
+func (s *Server) control(req *server.Request) error {
+	switch req.Command {
+	case server.CommandRemoteRun, server.CommandRemoteStop:
+		s.mu.Lock()
+		s.running = req.Command == server.CommandRemoteRun
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	return server.EndCodeUnsupported
+}
@@ -0,0 +1,171 @@
+package mock
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dualm/melsec"
+)
+
+// Memory 模拟PLC的软元件存储, 未写入过的软元件为0. 可被多个连接同时访问.
+// 位软元件按点存储, 以字为单位访问时每字16点, 低位为编号较小的点.
+type Memory struct {
+	mu    sync.RWMutex
+	words map[byte]map[uint32]uint16
+	bits  map[byte]map[uint32]bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		words: make(map[byte]map[uint32]uint16),
+		bits:  make(map[byte]map[uint32]bool),
+	}
+}
+
+// ReadWords 以字为单位读取count个字.
+func (m *Memory) ReadWords(dev melsec.DeviceInfo, no uint32, count int) []uint16 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	re := make([]uint16, count)
+
+	for i := range re {
+		if !dev.Bit {
+			re[i] = m.words[dev.Code][no+uint32(i)]
+
+			continue
+		}
+
+		for j := 0; j < 16; j++ {
+			if m.bits[dev.Code][no+uint32(i*16+j)] {
+				re[i] |= 1 << j
+			}
+		}
+	}
+
+	return re
+}
+
+// WriteWords 以字为单位写入.
+func (m *Memory) WriteWords(dev melsec.DeviceInfo, no uint32, values []uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if dev.Bit {
+		bits := m.bitMap(dev.Code)
+
+		for i, v := range values {
+			for j := 0; j < 16; j++ {
+				bits[no+uint32(i*16+j)] = v&(1<<j) != 0
+			}
+		}
+
+		return
+	}
+
+	words := m.wordMap(dev.Code)
+	for i, v := range values {
+		words[no+uint32(i)] = v
+	}
+}
+
+// ReadBits 以位为单位读取位软元件.
+func (m *Memory) ReadBits(dev melsec.DeviceInfo, no uint32, count int) []bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	re := make([]bool, count)
+	for i := range re {
+		re[i] = m.bits[dev.Code][no+uint32(i)]
+	}
+
+	return re
+}
+
+// WriteBits 以位为单位写入位软元件.
+func (m *Memory) WriteBits(dev melsec.DeviceInfo, no uint32, values []bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bits := m.bitMap(dev.Code)
+	for i, v := range values {
+		bits[no+uint32(i)] = v
+	}
+}
+
+func (m *Memory) wordMap(code byte) map[uint32]uint16 {
+	if m.words[code] == nil {
+		m.words[code] = make(map[uint32]uint16)
+	}
+
+	return m.words[code]
+}
+
+func (m *Memory) bitMap(code byte) map[uint32]bool {
+	if m.bits[code] == nil {
+		m.bits[code] = make(map[uint32]bool)
+	}
+
+	return m.bits[code]
+}
+
+// SetWords 从address开始写入各字, 位软元件每字16点.
+func (m *Memory) SetWords(address string, values ...uint16) error {
+	dev, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+
+	m.WriteWords(dev, uint32(no), values)
+
+	return nil
+}
+
+// Words 从address开始读取count个字.
+func (m *Memory) Words(address string, count int) ([]uint16, error) {
+	dev, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.ReadWords(dev, uint32(no), count), nil
+}
+
+// SetBits 从address开始写入各点, address必须为位软元件.
+func (m *Memory) SetBits(address string, values ...bool) error {
+	dev, no, err := bitAddress(address)
+	if err != nil {
+		return err
+	}
+
+	m.WriteBits(dev, no, values)
+
+	return nil
+}
+
+// Bits 从address开始读取count个点, address必须为位软元件.
+func (m *Memory) Bits(address string, count int) ([]bool, error) {
+	dev, no, err := bitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.ReadBits(dev, no, count), nil
+}
+
+func errNotBit(address string) error {
+	return fmt.Errorf("%s不是位软元件", address)
+}
+
+func bitAddress(address string) (melsec.DeviceInfo, uint32, error) {
+	dev, no, err := melsec.ParseAddress(address)
+	if err != nil {
+		return dev, 0, err
+	}
+
+	if !dev.Bit {
+		return dev, 0, errNotBit(address)
+	}
+
+	return dev, uint32(no), nil
+}
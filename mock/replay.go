@@ -0,0 +1,143 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/server"
+)
+
+// ReplayMode 回放时请求与记录的匹配方式.
+type ReplayMode uint8
+
+const (
+	// ReplayStrict 请求必须按记录的顺序到达, 且除4E序列号外逐字节一致.
+	ReplayStrict ReplayMode = iota
+	// ReplayLoose 请求可按任意顺序到达并重复, 从上一次匹配的位置开始循环查找,
+	// 比较时忽略4E序列号与监视定时器.
+	ReplayLoose
+)
+
+// Unmatched 回放时没有匹配记录的请求. 严格模式下Expected为应当到达的请求.
+type Unmatched struct {
+	Time     time.Time
+	Request  []byte
+	Expected []byte
+}
+
+type replay struct {
+	mu        sync.Mutex
+	mode      ReplayMode
+	records   []melsec.FrameRecord
+	next      int
+	unmatched []Unmatched
+}
+
+// NewReplayServer 启动按记录响应的模拟PLC. 匹配的记录没有响应(记录时请求失败)时不响应,
+// 没有匹配的请求以EndCodeUnsupported响应并记入Unmatched.
+func NewReplayServer(records []melsec.FrameRecord, mode ReplayMode) *Server {
+	s := NewUnstartedServer()
+	s.replay = &replay{mode: mode, records: records}
+	s.Start()
+
+	return s
+}
+
+// Unmatched 返回回放中没有匹配记录的请求.
+func (s *Server) Unmatched() []Unmatched {
+	if s.replay == nil {
+		return nil
+	}
+
+	s.replay.mu.Lock()
+	defer s.replay.mu.Unlock()
+
+	return append([]Unmatched{}, s.replay.unmatched...)
+}
+
+// Remaining 返回严格模式下尚未回放的记录数.
+func (s *Server) Remaining() int {
+	if s.replay == nil {
+		return 0
+	}
+
+	s.replay.mu.Lock()
+	defer s.replay.mu.Unlock()
+
+	return len(s.replay.records) - s.replay.next
+}
+
+// key 返回用于比较的请求, 忽略4E序列号, 宽松模式下同时忽略监视定时器.
+func (r *replay) key(frame []byte) []byte {
+	k := append([]byte{}, frame...)
+
+	timer := 9
+	if len(k) >= 2 && k[0] == 0x54 {
+		timer = 13
+
+		if len(k) >= 4 {
+			k[2], k[3] = 0, 0
+		}
+	}
+
+	if r.mode == ReplayLoose && len(k) >= timer+2 {
+		k[timer], k[timer+1] = 0, 0
+	}
+
+	return k
+}
+
+// match 返回匹配的记录序号, 没有时返回-1.
+func (r *replay) match(key []byte) int {
+	n := len(r.records)
+
+	if r.mode == ReplayStrict {
+		if r.next < n && bytes.Equal(r.key(r.records[r.next].Request), key) {
+			return r.next
+		}
+
+		return -1
+	}
+
+	for i := 0; i < n; i++ {
+		j := (r.next + i) % n
+		if bytes.Equal(r.key(r.records[j].Request), key) {
+			return j
+		}
+	}
+
+	return -1
+}
+
+func (r *replay) respond(req *server.Request) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.match(r.key(req.Raw))
+	if i == -1 {
+		miss := Unmatched{Time: time.Now(), Request: req.Raw}
+		if r.mode == ReplayStrict && r.next < len(r.records) {
+			miss.Expected = r.records[r.next].Request
+		}
+
+		r.unmatched = append(r.unmatched, miss)
+
+		return req.Response(EndCodeUnsupported, nil)
+	}
+
+	r.next = i + 1
+
+	resp := append([]byte{}, r.records[i].Response...)
+	if len(resp) == 0 {
+		return nil, nil
+	}
+
+	if req.Frame == melsec.Frame4E && !req.ASCII && len(resp) >= 4 {
+		binary.LittleEndian.PutUint16(resp[2:], req.Serial)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,115 @@
+package mock
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/dualm/melsec"
+)
+
+// record 在模拟PLC上执行一段读写并返回记录.
+func record(t *testing.T) []melsec.FrameRecord {
+	t.Helper()
+
+	s := NewServer()
+	defer s.Close()
+
+	_ = s.Memory.SetWords("D0", 11, 22)
+
+	path := filepath.Join(t.TempDir(), "frames.jsonl")
+
+	rec, err := melsec.CreateRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := dial(t, s, melsec.SetFrame(melsec.Frame4E))
+	conn.Record(rec)
+
+	dev, _ := melsec.NewDevice("D0", 2, conn)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.SetValue([]byte{1, 0, 2, 0})
+
+	if err := dev.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := melsec.LoadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 || records[0].Time.IsZero() || records[0].Error != "" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	return records
+}
+
+func TestReplayStrict(t *testing.T) {
+	s := NewReplayServer(record(t), ReplayStrict)
+	defer s.Close()
+
+	// 新连接的序列号从1重新开始, 与记录不同时也能匹配
+	conn := dial(t, s, melsec.SetFrame(melsec.Frame4E))
+	_, _ = conn.Loopback([]byte("0"))
+
+	if len(s.Unmatched()) != 1 || s.Unmatched()[0].Expected == nil {
+		t.Fatalf("want one unmatched request with expected frame, got %+v", s.Unmatched())
+	}
+
+	dev, _ := melsec.NewDevice("D0", 2, conn)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(dev.GetValue(), []byte{11, 0, 22, 0}) {
+		t.Errorf("want recorded 11 22, got % x", dev.GetValue())
+	}
+
+	// 顺序错误: 应当先写入
+	if err := dev.Read(); err == nil {
+		t.Error("want error for out of order request")
+	}
+
+	if s.Remaining() != 2 {
+		t.Errorf("want 2 remaining records, got %d", s.Remaining())
+	}
+}
+
+func TestReplayLoose(t *testing.T) {
+	s := NewReplayServer(record(t), ReplayLoose)
+	defer s.Close()
+
+	conn := dial(t, s, melsec.SetFrame(melsec.Frame4E), melsec.SetCPUTimer(uint16(4)))
+	dev, _ := melsec.NewDevice("D0", 2, conn)
+
+	for i := 0; i < 3; i++ {
+		if err := dev.Read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 三次读取依次匹配第1、3、1条记录
+	if !bytes.Equal(dev.GetValue(), []byte{11, 0, 22, 0}) {
+		t.Errorf("unexpected value % x", dev.GetValue())
+	}
+
+	if len(s.Unmatched()) != 0 {
+		t.Errorf("want no unmatched requests, got %d", len(s.Unmatched()))
+	}
+}
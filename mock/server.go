@@ -0,0 +1,231 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dualm/melsec/server"
+)
+
+// Server 进程内的模拟PLC, 以3E/4E二进制或ASCII码帧响应批量、多块、随机读写, CPU型号读取及折返测试.
+// 请求由server包处理, 模拟PLC在其上增加故障注入与记录回放.
+// 用法与httptest.Server相同: NewServer启动后以Host、Port建立连接, 测试结束时调用Close.
+type Server struct {
+	Memory   *Memory
+	CPUModel string
+	CPUCode  uint16
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	running  bool
+	requests uint64
+	faults   []*Fault
+	replay   *replay
+	once     sync.Once
+	core     *server.Server
+}
+
+// NewServer 在本机的随机端口上启动模拟PLC.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+
+	return s
+}
+
+// NewUnstartedServer 创建未启动的模拟PLC, 可在Start之前修改其字段.
+func NewUnstartedServer() *Server {
+	return &Server{
+		Memory:   NewMemory(),
+		CPUModel: "Q03UDVCPU",
+		CPUCode:  0x0366,
+		conns:    make(map[net.Conn]struct{}),
+		running:  true,
+	}
+}
+
+// Start 在本机的随机端口上开始监听, 失败时panic.
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mock: failed to listen: %v", err))
+	}
+
+	s.listener = listener
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		_ = s.Serve(listener)
+	}()
+}
+
+// Addr 返回监听地址.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host 返回监听的IP, 可直接用于melsec.NewConn.
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+
+	return host
+}
+
+// Port 返回监听的端口, 可直接用于melsec.NewConn.
+func (s *Server) Port() string {
+	_, port, _ := net.SplitHostPort(s.Addr())
+
+	return port
+}
+
+// Requests 返回已处理的请求数.
+func (s *Server) Requests() uint64 {
+	return atomic.LoadUint64(&s.requests)
+}
+
+// Running 返回CPU是否处于RUN状态, 远程RUN/STOP指令会改变该状态.
+func (s *Server) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.running
+}
+
+// Serve 在listener上接受连接直到listener关闭, 每个连接在独立的goroutine中处理.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !s.track(conn) {
+			_ = conn.Close()
+
+			return nil
+		}
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+
+			_ = s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	_ = conn.Close()
+}
+
+// Close 停止监听, 关闭全部连接并等待处理结束.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+
+	s.wg.Wait()
+}
+
+var errFaultClose = errors.New("connection closed by fault")
+
+// respond 生成请求的响应帧, 返回nil时不响应.
+func (s *Server) respond(req *server.Request, fault *Fault) ([]byte, error) {
+	if fault.EndCode != EndCodeOK {
+		return req.Response(fault.EndCode, nil)
+	}
+
+	if s.replay != nil {
+		return s.replay.respond(req)
+	}
+
+	return s.handler().Respond(req)
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	for {
+		req, err := server.ReadRequest(conn)
+		if err != nil {
+			return err
+		}
+
+		atomic.AddUint64(&s.requests, 1)
+
+		fault := s.fault(req)
+		if fault == nil {
+			fault = &Fault{}
+		}
+
+		time.Sleep(fault.Latency)
+
+		if fault.WrongSerial {
+			req.Serial++
+		}
+
+		resp, err := s.respond(req, fault)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case resp == nil, fault.Drop:
+			continue
+		case fault.Close:
+			_, _ = conn.Write(resp[:len(resp)/2])
+
+			return errFaultClose
+		case fault.Truncate > 0 && fault.Truncate < len(resp):
+			resp = resp[:fault.Truncate]
+		}
+
+		if _, err := conn.Write(resp); err != nil {
+			return err
+		}
+	}
+}
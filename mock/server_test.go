@@ -0,0 +1,234 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dualm/melsec"
+)
+
+func dial(t *testing.T, s *Server, ops ...melsec.PlcOption) *melsec.PlcConn {
+	t.Helper()
+
+	conn, err := melsec.NewConn(s.Host(), s.Port(), ops...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	return conn
+}
+
+func TestServerBatch(t *testing.T) {
+	for _, frame := range []melsec.Frame{melsec.Frame3E, melsec.Frame4E} {
+		t.Run(fmt.Sprint(frame), func(t *testing.T) {
+			s := NewServer()
+			defer s.Close()
+
+			conn := dial(t, s, melsec.SetFrame(frame))
+
+			dev, err := melsec.NewDevice("D100", 3, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dev.SetValue([]byte{1, 0, 2, 0, 3, 0})
+
+			if err := dev.Write(); err != nil {
+				t.Fatal(err)
+			}
+
+			if words, _ := s.Memory.Words("D100", 3); !reflect.DeepEqual(words, []uint16{1, 2, 3}) {
+				t.Errorf("want D100 [1 2 3], got %v", words)
+			}
+
+			_ = s.Memory.SetWords("D101", 0x1234)
+
+			if err := dev.Read(); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(dev.GetValue(), []byte{1, 0, 0x34, 0x12, 3, 0}) {
+				t.Errorf("unexpected read % x", dev.GetValue())
+			}
+		})
+	}
+}
+
+func TestServerBits(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s)
+
+	if err := conn.WriteBits([]string{"M3", "Y1F"}, []bool{true, true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if bits, _ := s.Memory.Bits("M0", 5); !reflect.DeepEqual(bits, []bool{false, false, false, true, false}) {
+		t.Errorf("unexpected M0-M4 %v", bits)
+	}
+
+	dev, err := melsec.NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Memory.SetWords("W1A0", 0xAABB)
+
+	dev.AddBlock("M0", 1)
+	dev.AddBlock("W1A0", 1)
+	dev.AddBlock("Y10", 1)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := dev.Blocks()
+
+	if blocks[0].Words()[0] != 0x0008 || blocks[1].Words()[0] != 0xAABB || blocks[2].Words()[0] != 0x8000 {
+		t.Errorf("unexpected blocks %+v", blocks)
+	}
+
+	dev.SetValue([][]byte{{0xFF, 0}, {1, 0}, {0, 0}})
+
+	if err := dev.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bits, _ := s.Memory.Bits("M7", 2); !bits[0] || bits[1] {
+		t.Errorf("want M7 on, M8 off, got %v", bits)
+	}
+}
+
+func TestServerRandomAndInfo(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s)
+
+	_ = s.Memory.SetWords("D10", 7)
+	_ = s.Memory.SetWords("R0", 0x5678, 0x1234)
+
+	b, err := conn.ReadRandom([]string{"D10"}, []string{"R0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if binary.LittleEndian.Uint16(b) != 7 || binary.LittleEndian.Uint32(b[2:]) != 0x12345678 {
+		t.Errorf("unexpected random read % x", b)
+	}
+
+	model, err := conn.GetCPUInfo()
+	if err != nil || model[:9] != "Q03UDVCPU" {
+		t.Errorf("unexpected model %q %v", model, err)
+	}
+
+	echo, err := conn.Loopback([]byte("ABC123"))
+	if err != nil || string(echo) != "ABC123" {
+		t.Errorf("unexpected loopback %q %v", echo, err)
+	}
+}
+
+func TestServerEndCode(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s)
+
+	// 随机位写入字软元件
+	if err := conn.WriteBits([]string{"D0"}, []bool{true}); err == nil {
+		t.Fatal("want end code for bit write to word device")
+	}
+
+	// 错误响应之后连接仍可使用
+	dev, _ := melsec.NewDevice("D0", 1, conn)
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerConcurrent(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 8)
+
+	for i := 0; i < 8; i++ {
+		conn := dial(t, s, melsec.SetFrame(melsec.Frame4E))
+		name := fmt.Sprintf("D%d", i*10)
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			dev, _ := melsec.NewDevice(name, 2, conn)
+
+			for j := 0; j < 50; j++ {
+				dev.SetValue([]byte{byte(j), 0, byte(j), 1})
+
+				if err := dev.Write(); err != nil {
+					errs <- err
+
+					return
+				}
+
+				if err := dev.Read(); err != nil {
+					errs <- err
+
+					return
+				}
+
+				if v := dev.GetValue(); v[0] != byte(j) {
+					errs <- errors.New("read back mismatch")
+
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if s.Requests() != 8*100 {
+		t.Errorf("want 800 requests, got %d", s.Requests())
+	}
+}
+
+func TestServerASCII(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	conn := dial(t, s, melsec.SetFrame(melsec.Frame4E), melsec.SetASCII(true))
+
+	_ = s.Memory.SetWords("D0", 0x1234)
+
+	if err := conn.WriteBits([]string{"M5"}, []bool{true}); err != nil {
+		t.Fatal(err)
+	}
+
+	dev, _ := melsec.NewDevice("D0", 1, conn)
+	if err := dev.Read(); err != nil || !bytes.Equal(dev.GetValue(), []byte{0x34, 0x12}) {
+		t.Errorf("unexpected read % x %v", dev.GetValue(), err)
+	}
+
+	if bits, _ := s.Memory.Bits("M5", 1); !bits[0] {
+		t.Error("M5 should be on")
+	}
+}
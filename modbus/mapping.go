@@ -0,0 +1,104 @@
+package modbus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dualm/melsec"
+)
+
+// Table Modbus的数据表.
+type Table string
+
+const (
+	Coils            Table = "coils"
+	DiscreteInputs   Table = "discrete_inputs"
+	HoldingRegisters Table = "holding_registers"
+	InputRegisters   Table = "input_registers"
+)
+
+// bit 线圈与离散输入按位访问, 寄存器按字访问.
+func (t Table) bit() bool {
+	return t == Coils || t == DiscreteInputs
+}
+
+// Mapping 将一个表中Start起的Count个地址映射到Device起的MELSEC软元件, 例如HR 0-999 → D1000.
+// 线圈与离散输入只能映射到位软元件; 寄存器映射到位软元件时每个寄存器为16点.
+type Mapping struct {
+	Table  Table  `yaml:"table"`
+	Start  uint16 `yaml:"start"`
+	Count  int    `yaml:"count"`
+	Device string `yaml:"device"`
+}
+
+// mapping 已检查的映射.
+type mapping struct {
+	Mapping
+	info melsec.DeviceInfo
+	no   uint64
+}
+
+// address 返回表中第offset个地址对应的软元件.
+func (m *mapping) address(offset int) string {
+	if m.info.Bit && !m.Table.bit() {
+		return melsec.FormatAddress(m.info, m.no+uint64(offset)*16)
+	}
+
+	return melsec.FormatAddress(m.info, m.no+uint64(offset))
+}
+
+func (m *mapping) end() int {
+	return int(m.Start) + m.Count
+}
+
+// newMappings 检查映射, 按表分组并按起始地址排序. 同一表内的映射不能重叠.
+func newMappings(list []Mapping) (map[Table][]*mapping, error) {
+	tables := make(map[Table][]*mapping)
+
+	for _, m := range list {
+		switch m.Table {
+		case Coils, DiscreteInputs, HoldingRegisters, InputRegisters:
+		default:
+			return nil, fmt.Errorf("modbus: unknown table %q", m.Table)
+		}
+
+		if m.Count <= 0 || int(m.Start)+m.Count > 0x10000 {
+			return nil, fmt.Errorf("modbus: %s %d: count %d out of range", m.Table, m.Start, m.Count)
+		}
+
+		info, no, err := melsec.ParseAddress(strings.ToUpper(m.Device))
+		if err != nil {
+			return nil, fmt.Errorf("modbus: %s %d: %w", m.Table, m.Start, err)
+		}
+
+		if m.Table.bit() && !info.Bit {
+			return nil, fmt.Errorf("modbus: %s %d: %s is not a bit device", m.Table, m.Start, m.Device)
+		}
+
+		tables[m.Table] = append(tables[m.Table], &mapping{Mapping: m, info: info, no: no})
+	}
+
+	for table, list := range tables {
+		sort.Slice(list, func(i, j int) bool { return list[i].Start < list[j].Start })
+
+		for i := 1; i < len(list); i++ {
+			if int(list[i].Start) < list[i-1].end() {
+				return nil, fmt.Errorf("modbus: %s %d overlaps %d", table, list[i].Start, list[i-1].Start)
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+// lookup 返回包含[start, start+count)的映射与start在其中的偏移, 不能跨越映射.
+func lookup(list []*mapping, start, count int) (*mapping, int, error) {
+	for _, m := range list {
+		if start >= int(m.Start) && start+count <= m.end() {
+			return m, start - int(m.Start), nil
+		}
+	}
+
+	return nil, 0, IllegalDataAddress
+}
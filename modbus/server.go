@@ -0,0 +1,548 @@
+// Package modbus 以Modbus TCP服务器的形式提供PLC访问, 供只支持Modbus的SCADA使用.
+//
+// 线圈、离散输入、保持寄存器与输入寄存器按Mapping映射到MELSEC软元件, 功能码转换为MC请求:
+//
+//	1, 2   读线圈/离散输入   按字批量读取位软元件
+//	3, 4   读寄存器          批量读取
+//	5, 15  写线圈            随机写入位
+//	6, 16  写寄存器          批量写入
+//
+// 全部客户端共用一个PlcConn, PLC的结束代码转换为对应的Modbus异常码.
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// 功能码
+const (
+	FuncReadCoils              byte = 0x01
+	FuncReadDiscreteInputs     byte = 0x02
+	FuncReadHoldingRegisters   byte = 0x03
+	FuncReadInputRegisters     byte = 0x04
+	FuncWriteSingleCoil        byte = 0x05
+	FuncWriteSingleRegister    byte = 0x06
+	FuncWriteMultipleCoils     byte = 0x0F
+	FuncWriteMultipleRegisters byte = 0x10
+)
+
+// Exception Modbus异常码.
+type Exception byte
+
+const (
+	IllegalFunction        Exception = 0x01
+	IllegalDataAddress     Exception = 0x02
+	IllegalDataValue       Exception = 0x03
+	ServerDeviceFailure    Exception = 0x04
+	GatewayPathUnavailable Exception = 0x0A
+	GatewayTargetFailed    Exception = 0x0B
+)
+
+func (e Exception) Error() string {
+	switch e {
+	case IllegalFunction:
+		return "modbus: illegal function"
+	case IllegalDataAddress:
+		return "modbus: illegal data address"
+	case IllegalDataValue:
+		return "modbus: illegal data value"
+	case ServerDeviceFailure:
+		return "modbus: server device failure"
+	case GatewayPathUnavailable:
+		return "modbus: gateway path unavailable"
+	case GatewayTargetFailed:
+		return "modbus: gateway target device failed to respond"
+	}
+
+	return fmt.Sprintf("modbus: exception %02X", byte(e))
+}
+
+// exception 返回err对应的异常码. 通信失败时为GatewayTargetFailed, 结束代码按其含义转换.
+func exception(err error) Exception {
+	var e Exception
+	if errors.As(err, &e) {
+		return e
+	}
+
+	var ee *melsec.EndCodeError
+	if errors.As(err, &ee) {
+		switch ee.Code {
+		case 0xC056, 0xC05B, 0xC070:
+			return IllegalDataAddress
+		case 0xC051, 0xC052, 0xC053, 0xC054, 0xC058, 0xC060, 0xC061:
+			return IllegalDataValue
+		case 0xC059:
+			return IllegalFunction
+		case 0xC05E:
+			return GatewayTargetFailed
+		}
+
+		return ServerDeviceFailure
+	}
+
+	if isNetError(err) {
+		return GatewayTargetFailed
+	}
+
+	return ServerDeviceFailure
+}
+
+func isNetError(err error) bool {
+	var ne net.Error
+
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Config 服务器的配置.
+type Config struct {
+	Mappings []Mapping `yaml:"mappings"`
+	// UnitID 响应的单元标识符, 0表示响应全部
+	UnitID uint8 `yaml:"unit_id"`
+	// Timeout 非0时设置为conn每次请求的超时时间, 为0时使用conn已有的设置
+	Timeout time.Duration `yaml:"timeout"`
+	Logger  melsec.Logger `yaml:"-"`
+}
+
+// Server Modbus TCP服务器.
+type Server struct {
+	conn   *melsec.PlcConn
+	config Config
+	tables map[Table][]*mapping
+	logger melsec.Logger
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New 创建以conn访问PLC的服务器.
+func New(conn *melsec.PlcConn, c Config) (*Server, error) {
+	if conn == nil {
+		return nil, errors.New("modbus: nil plc connection")
+	}
+
+	tables, err := newMappings(c.Mappings)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tables) == 0 {
+		return nil, errors.New("modbus: no mappings")
+	}
+
+	if c.Timeout > 0 {
+		if err := conn.SetTimeout(c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		conn:      conn,
+		config:    c,
+		tables:    tables,
+		logger:    c.Logger,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	if s.logger == nil {
+		s.logger = nopLogger{}
+	}
+
+	return s, nil
+}
+
+// ListenAndServe 在addr上监听并处理请求, Close之后返回nil.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve 在l上接受连接直到l或服务器关闭, 每个连接在独立的goroutine中处理.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		_ = l.Close()
+
+		return nil
+	}
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !s.track(nil, conn) {
+			_ = conn.Close()
+
+			return nil
+		}
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+
+			err := s.serveConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				s.logger.Debug("modbus connection closed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (s *Server) track(l net.Listener, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	if l != nil {
+		s.listeners[l] = struct{}{}
+	}
+
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+
+	return true
+}
+
+// Close 停止监听, 关闭全部客户端连接并等待处理结束. PlcConn由调用者关闭.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
+
+// serveConn 按顺序处理一个连接上的请求. MBAP头为事务标识、协议标识(0)、长度与单元标识.
+func (s *Server) serveConn(conn net.Conn) error {
+	header := make([]byte, 7)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return err
+		}
+
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+			return fmt.Errorf("invalid mbap header % x", header)
+		}
+
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			return err
+		}
+
+		resp := s.handle(header[6], pdu)
+
+		out := make([]byte, 7, 7+len(resp))
+		copy(out, header[:4])
+		binary.BigEndian.PutUint16(out[4:], uint16(len(resp)+1))
+		out[6] = header[6]
+		out = append(out, resp...)
+
+		if _, err := conn.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// handle 处理一个请求PDU, 返回响应PDU.
+func (s *Server) handle(unit byte, pdu []byte) []byte {
+	fc := pdu[0]
+
+	if s.config.UnitID != 0 && unit != s.config.UnitID {
+		return []byte{fc | 0x80, byte(GatewayPathUnavailable)}
+	}
+
+	resp, err := s.dispatch(fc, pdu[1:])
+	if err != nil {
+		e := exception(err)
+
+		if e >= ServerDeviceFailure {
+			s.logger.Warn("modbus request failed", "function", fc, "exception", byte(e), "err", err)
+		} else {
+			s.logger.Debug("modbus request rejected", "function", fc, "exception", byte(e), "err", err)
+		}
+
+		return []byte{fc | 0x80, byte(e)}
+	}
+
+	return append([]byte{fc}, resp...)
+}
+
+func (s *Server) dispatch(fc byte, data []byte) ([]byte, error) {
+	switch fc {
+	case FuncReadCoils, FuncReadDiscreteInputs, FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if len(data) != 4 {
+			return nil, IllegalDataValue
+		}
+
+		start, count := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+
+		switch fc {
+		case FuncReadCoils:
+			return s.readBits(Coils, start, count)
+		case FuncReadDiscreteInputs:
+			return s.readBits(DiscreteInputs, start, count)
+		case FuncReadHoldingRegisters:
+			return s.readRegisters(HoldingRegisters, start, count)
+		default:
+			return s.readRegisters(InputRegisters, start, count)
+		}
+	case FuncWriteSingleCoil:
+		if len(data) != 4 {
+			return nil, IllegalDataValue
+		}
+
+		var on bool
+
+		switch binary.BigEndian.Uint16(data[2:]) {
+		case 0xFF00:
+			on = true
+		case 0x0000:
+		default:
+			return nil, IllegalDataValue
+		}
+
+		if err := s.writeBits(int(binary.BigEndian.Uint16(data)), []bool{on}); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	case FuncWriteSingleRegister:
+		if len(data) != 4 {
+			return nil, IllegalDataValue
+		}
+
+		if err := s.writeRegisters(int(binary.BigEndian.Uint16(data)), data[2:]); err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	case FuncWriteMultipleCoils:
+		if len(data) < 5 {
+			return nil, IllegalDataValue
+		}
+
+		count := int(binary.BigEndian.Uint16(data[2:]))
+		if count < 1 || count > 0x7B0 || int(data[4]) != (count+7)/8 || len(data) != 5+int(data[4]) {
+			return nil, IllegalDataValue
+		}
+
+		bits := make([]bool, count)
+		for i := range bits {
+			bits[i] = data[5+i/8]>>(i%8)&1 == 1
+		}
+
+		if err := s.writeBits(int(binary.BigEndian.Uint16(data)), bits); err != nil {
+			return nil, err
+		}
+
+		return data[:4], nil
+	case FuncWriteMultipleRegisters:
+		if len(data) < 5 {
+			return nil, IllegalDataValue
+		}
+
+		count := int(binary.BigEndian.Uint16(data[2:]))
+		if count < 1 || count > 0x7B || int(data[4]) != count*2 || len(data) != 5+count*2 {
+			return nil, IllegalDataValue
+		}
+
+		if err := s.writeRegisters(int(binary.BigEndian.Uint16(data)), data[5:]); err != nil {
+			return nil, err
+		}
+
+		return data[:4], nil
+	}
+
+	return nil, IllegalFunction
+}
+
+// check 通信失败时重新连接, 下一个请求使用新的连接.
+func (s *Server) check(err error) error {
+	if err == nil || !isNetError(err) {
+		return err
+	}
+
+	if rerr := s.conn.Reconnect(); rerr != nil {
+		s.logger.Error("plc reconnect failed", "err", rerr)
+	}
+
+	return err
+}
+
+// readWords 批量读取m中offset起的count个字.
+func (s *Server) readWords(m *mapping, offset, count int) ([]byte, error) {
+	dev, err := melsec.NewDevice(m.address(offset), count, s.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.check(dev.Read()); err != nil {
+		return nil, err
+	}
+
+	return dev.GetValue(), nil
+}
+
+// readBits 以字为单位读取位软元件, 字内的位为小端序, 与Modbus的位顺序相同.
+// 读取按16点取整, 可能多读映射之后的至多15点.
+func (s *Server) readBits(table Table, start, count int) ([]byte, error) {
+	if count < 1 || count > 0x7D0 {
+		return nil, IllegalDataValue
+	}
+
+	m, offset, err := lookup(s.tables[table], start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.readWords(m, offset, (count+15)/16)
+	if err != nil {
+		return nil, err
+	}
+
+	n := (count + 7) / 8
+	resp := append([]byte{byte(n)}, b[:n]...)
+
+	if rest := count % 8; rest != 0 {
+		resp[n] &= 1<<rest - 1
+	}
+
+	return resp, nil
+}
+
+func (s *Server) readRegisters(table Table, start, count int) ([]byte, error) {
+	if count < 1 || count > 0x7D {
+		return nil, IllegalDataValue
+	}
+
+	m, offset, err := lookup(s.tables[table], start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.readWords(m, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 1+count*2)
+	resp[0] = byte(count * 2)
+
+	for i := 0; i < count; i++ {
+		binary.BigEndian.PutUint16(resp[1+i*2:], binary.LittleEndian.Uint16(b[i*2:]))
+	}
+
+	return resp, nil
+}
+
+// writeBits 随机写入线圈, 超过随机写入上限时拆分为多个请求.
+func (s *Server) writeBits(start int, bits []bool) error {
+	m, offset, err := lookup(s.tables[Coils], start, len(bits))
+	if err != nil {
+		return err
+	}
+
+	addresses := make([]string, len(bits))
+	for i := range addresses {
+		addresses[i] = m.address(offset + i)
+	}
+
+	for len(addresses) > 0 {
+		n := len(addresses)
+		if n > melsec.MaxRandomBitPoints {
+			n = melsec.MaxRandomBitPoints
+		}
+
+		if err := s.check(s.conn.WriteBits(addresses[:n], bits[:n])); err != nil {
+			return err
+		}
+
+		addresses, bits = addresses[n:], bits[n:]
+	}
+
+	return nil
+}
+
+// writeRegisters 批量写入保持寄存器, data为大端序的寄存器值.
+func (s *Server) writeRegisters(start int, data []byte) error {
+	count := len(data) / 2
+
+	m, offset, err := lookup(s.tables[HoldingRegisters], start, count)
+	if err != nil {
+		return err
+	}
+
+	dev, err := melsec.NewDevice(m.address(offset), count, s.conn)
+	if err != nil {
+		return err
+	}
+
+	b := make([]byte, count*2)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint16(b[i*2:], binary.BigEndian.Uint16(data[i*2:]))
+	}
+
+	dev.SetValue(b)
+	return s.check(dev.Write())
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,203 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+)
+
+// client 最小的Modbus TCP客户端, 返回响应PDU.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	tid  uint16
+}
+
+func (c *client) call(unit byte, pdu ...byte) []byte {
+	c.t.Helper()
+
+	c.tid++
+
+	req := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(req, c.tid)
+	binary.BigEndian.PutUint16(req[4:], uint16(len(pdu)+1))
+	req[6] = unit
+	req = append(req, pdu...)
+
+	_ = c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.conn.Write(req); err != nil {
+		c.t.Fatal(err)
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if binary.BigEndian.Uint16(header) != c.tid || header[6] != unit {
+		c.t.Fatalf("unexpected header % x", header)
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+	if _, err := io.ReadFull(c.conn, resp); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return resp
+}
+
+func newServer(t *testing.T) (*mock.Server, *client) {
+	t.Helper()
+
+	plc := mock.NewServer()
+	t.Cleanup(plc.Close)
+
+	conn, err := melsec.NewConn(plc.Host(), plc.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	s, err := New(conn, Config{
+		UnitID: 1,
+		Mappings: []Mapping{
+			{Table: HoldingRegisters, Start: 0, Count: 1000, Device: "D1000"},
+			{Table: HoldingRegisters, Start: 1000, Count: 4, Device: "M100"},
+			{Table: InputRegisters, Start: 100, Count: 10, Device: "W1F"},
+			{Table: Coils, Start: 0, Count: 100, Device: "M0"},
+			{Table: DiscreteInputs, Start: 200, Count: 64, Device: "x10"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() { _ = s.Serve(l) }()
+
+	t.Cleanup(func() { s.Close() })
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { c.Close() })
+
+	return plc, &client{t: t, conn: c}
+}
+
+func TestServer(t *testing.T) {
+	plc, c := newServer(t)
+
+	_ = plc.Memory.SetWords("D1000", 1, 0xFFFF, 0x1234)
+	_ = plc.Memory.SetWords("W1F", 7)
+	_ = plc.Memory.SetBits("X10", true, false, true, true, false, false, false, false, true)
+	_ = plc.Memory.SetBits("M116", true)
+
+	tests := []struct {
+		name string
+		req  []byte
+		want []byte
+	}{
+		{"read holding", []byte{0x03, 0, 0, 0, 3}, []byte{0x03, 6, 0, 1, 0xFF, 0xFF, 0x12, 0x34}},
+		{"read input", []byte{0x04, 0, 100, 0, 1}, []byte{0x04, 2, 0, 7}},
+		{"read inputs", []byte{0x02, 0, 200, 0, 9}, []byte{0x02, 2, 0x0D, 0x01}},
+		{"read bit device words", []byte{0x03, 0x03, 0xE9, 0, 1}, []byte{0x03, 2, 0, 1}},
+		{"write register", []byte{0x06, 0, 5, 0xAB, 0xCD}, []byte{0x06, 0, 5, 0xAB, 0xCD}},
+		{"write registers", []byte{0x10, 0, 10, 0, 2, 4, 0, 1, 0x80, 0}, []byte{0x10, 0, 10, 0, 2}},
+		{"write coil", []byte{0x05, 0, 3, 0xFF, 0}, []byte{0x05, 0, 3, 0xFF, 0}},
+		{"write coils", []byte{0x0F, 0, 10, 0, 10, 2, 0x05, 0x02}, []byte{0x0F, 0, 10, 0, 10}},
+		{"read coils", []byte{0x01, 0, 0, 0, 20}, []byte{0x01, 3, 0x08, 0x14, 0x08}},
+
+		{"unmapped", []byte{0x03, 0x07, 0xD0, 0, 1}, []byte{0x83, 0x02}},
+		{"across mapping", []byte{0x03, 0x03, 0xE7, 0, 2}, []byte{0x83, 0x02}},
+		{"read-only table", []byte{0x05, 0, 200, 0xFF, 0}, []byte{0x85, 0x02}},
+		{"zero count", []byte{0x03, 0, 0, 0, 0}, []byte{0x83, 0x03}},
+		{"too many", []byte{0x03, 0, 0, 0, 126}, []byte{0x83, 0x03}},
+		{"coil value", []byte{0x05, 0, 3, 0x12, 0x34}, []byte{0x85, 0x03}},
+		{"byte count", []byte{0x10, 0, 10, 0, 2, 3, 0, 1, 0}, []byte{0x90, 0x03}},
+		{"short pdu", []byte{0x03, 0}, []byte{0x83, 0x03}},
+		{"function", []byte{0x2B, 0x0E, 1, 0}, []byte{0xAB, 0x01}},
+	}
+
+	for _, tt := range tests {
+		if got := c.call(1, tt.req...); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: want % x, got % x", tt.name, tt.want, got)
+		}
+	}
+
+	if words, _ := plc.Memory.Words("D1005", 8); !reflect.DeepEqual(words, []uint16{0xABCD, 0, 0, 0, 0, 1, 0x8000, 0}) {
+		t.Errorf("unexpected registers % x", words)
+	}
+
+	if bits, _ := plc.Memory.Bits("M0", 20); !reflect.DeepEqual(bits, []bool{
+		false, false, false, true, false, false, false, false, false, false,
+		true, false, true, false, false, false, false, false, false, true,
+	}) {
+		t.Errorf("unexpected coils %v", bits)
+	}
+
+	if got := c.call(2, 0x03, 0, 0, 0, 1); !bytes.Equal(got, []byte{0x83, 0x0A}) {
+		t.Errorf("unit id: got % x", got)
+	}
+
+	// PLC的结束代码转换为异常码
+	_ = plc.AddFault(mock.Fault{Device: "D1500", EndCode: mock.EndCodeDeviceRange})
+	_ = plc.AddFault(mock.Fault{Device: "D1600", EndCode: mock.EndCodeUnsupported})
+	_ = plc.AddFault(mock.Fault{Device: "D1700", EndCode: 0xC0B5})
+
+	for _, tt := range []struct {
+		register uint16
+		want     byte
+	}{{500, 0x02}, {600, 0x01}, {700, 0x04}} {
+		if got := c.call(1, 0x03, byte(tt.register>>8), byte(tt.register), 0, 1); !bytes.Equal(got, []byte{0x83, tt.want}) {
+			t.Errorf("register %d: want exception %02X, got % x", tt.register, tt.want, got)
+		}
+	}
+
+	// 与PLC的通信失败
+	plc.Close()
+
+	if got := c.call(1, 0x03, 0, 0, 0, 1); !bytes.Equal(got, []byte{0x83, 0x0B}) {
+		t.Errorf("plc down: got % x", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	conn := &melsec.PlcConn{}
+
+	for _, list := range [][]Mapping{
+		nil,
+		{{Table: "registers", Count: 1, Device: "D0"}},
+		{{Table: HoldingRegisters, Count: 0, Device: "D0"}},
+		{{Table: HoldingRegisters, Start: 0xFFFF, Count: 2, Device: "D0"}},
+		{{Table: HoldingRegisters, Count: 1, Device: "Q0"}},
+		{{Table: Coils, Count: 1, Device: "D0"}},
+		{{Table: HoldingRegisters, Count: 10, Device: "D0"}, {Table: HoldingRegisters, Start: 9, Count: 1, Device: "D100"}},
+	} {
+		if _, err := New(conn, Config{Mappings: list}); err == nil {
+			t.Errorf("want error for %+v", list)
+		}
+	}
+
+	if _, err := New(conn, Config{Mappings: []Mapping{
+		{Table: HoldingRegisters, Count: 10, Device: "D0"},
+		{Table: InputRegisters, Count: 10, Device: "D0"},
+	}}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,483 @@
+// Package mqttbridge 在PLC与MQTT broker之间转发数据.
+//
+// 标签按周期以MultiDevice读取, 值变化时以JSON发布到<Topic>/<标签名>, 例如plant/line1/D100:
+//
+//	{"value":12.5,"time":"2024-01-02T15:04:05.000Z"}
+//
+// 向<Topic>/<标签名>/set发布的值在检查允许列表与数据类型后写入PLC, 结果发布到.../set/result.
+// 写入的消息可以是JSON值(42, [1,2], true), {"value":42}或不加引号的文本(on).
+// <Topic>/status为保留消息online, 连接异常断开时broker以遗嘱发布offline.
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// Config 桥接的配置.
+type Config struct {
+	// Broker broker地址, 例如tcp://127.0.0.1:1883
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Topic 主题前缀, 例如plant/line1
+	Topic string `yaml:"topic"`
+	// QoS 发布与订阅的QoS, 0~2
+	QoS byte `yaml:"qos"`
+	// Retain 值以保留消息发布, 新的订阅者立即收到最近的值
+	Retain bool `yaml:"retain"`
+	// Interval 读取周期, 默认1s
+	Interval time.Duration `yaml:"interval"`
+	// Timeout 非0时设置为conn每次请求的超时时间, 为0时使用conn已有的设置
+	Timeout time.Duration `yaml:"timeout"`
+	// Tags 发布的标签, 名称为空时以地址为名称
+	Tags []melsec.Tag `yaml:"tags"`
+	// Writable 允许写入的标签名或地址范围, 例如Speed、D100、D5000-D5999, 为空时不允许写入
+	Writable []string      `yaml:"writable"`
+	Logger   melsec.Logger `yaml:"-"`
+}
+
+// allowRule 允许写入的标签名或地址范围.
+type allowRule struct {
+	name       string
+	device     string
+	start, end uint64
+}
+
+// Bridge PLC与MQTT的桥接.
+type Bridge struct {
+	conn   *melsec.PlcConn
+	config Config
+	db     *melsec.TagDB
+	tags   []*melsec.Tag
+	dev    *melsec.MultiDevice
+	rules  []allowRule
+	client mqtt.Client
+	logger melsec.Logger
+
+	mu   sync.Mutex
+	last map[string]string // 最近一次发布的值, 用于检测变化
+}
+
+// New 创建桥接, 标签与允许列表在此检查.
+func New(conn *melsec.PlcConn, c Config) (*Bridge, error) {
+	if c.Broker == "" || c.Topic == "" {
+		return nil, errors.New("mqttbridge: broker and topic are required")
+	}
+
+	if c.QoS > 2 {
+		return nil, fmt.Errorf("mqttbridge: invalid qos %d", c.QoS)
+	}
+
+	if strings.ContainsAny(c.Topic, "+#") {
+		return nil, fmt.Errorf("mqttbridge: invalid topic %q", c.Topic)
+	}
+
+	c.Topic = strings.TrimSuffix(c.Topic, "/")
+
+	if c.Interval <= 0 {
+		c.Interval = time.Second
+	}
+
+	if c.Timeout > 0 {
+		if err := conn.SetTimeout(c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ClientID == "" {
+		c.ClientID = "melsec-" + strings.ReplaceAll(c.Topic, "/", "-")
+	}
+
+	b := &Bridge{
+		conn:   conn,
+		config: c,
+		db:     melsec.NewTagDB(conn),
+		logger: c.Logger,
+		last:   make(map[string]string),
+	}
+
+	if b.logger == nil {
+		b.logger = nopLogger{}
+	}
+
+	for _, tag := range c.Tags {
+		if tag.Name == "" {
+			tag.Name = tag.Address
+		}
+
+		if tag.Name == "status" || strings.ContainsAny(tag.Name, "+#") || strings.HasSuffix(tag.Name, "/set") {
+			return nil, fmt.Errorf("mqttbridge: invalid tag name %q", tag.Name)
+		}
+
+		if tag.Type == melsec.TypeString {
+			return nil, fmt.Errorf("mqttbridge: tag %s: string tags are not supported", tag.Name)
+		}
+
+		if _, ok := b.db.Lookup(tag.Name); ok {
+			return nil, fmt.Errorf("mqttbridge: duplicate tag %s", tag.Name)
+		}
+
+		if err := b.db.Add(tag); err != nil {
+			return nil, fmt.Errorf("mqttbridge: %w", err)
+		}
+	}
+
+	b.tags = b.db.Tags()
+	if len(b.tags) == 0 {
+		return nil, errors.New("mqttbridge: no tags")
+	}
+
+	dev, err := melsec.NewMultiDevice(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tag := range b.tags {
+		dev.AddBlock(tag.Address, tag.Words())
+	}
+
+	b.dev = dev
+
+	for _, w := range c.Writable {
+		rule, err := parseAllowRule(w)
+		if err != nil {
+			return nil, err
+		}
+
+		b.rules = append(b.rules, rule)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Second).
+		SetMaxReconnectInterval(10*time.Second).
+		SetOrderMatters(false).
+		SetWill(b.topic("status"), StatusOffline, c.QoS, true).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			b.logger.Warn("mqtt connection lost", "broker", c.Broker, "err", err)
+		})
+
+	b.client = mqtt.NewClient(opts)
+
+	return b, nil
+}
+
+// parseAllowRule 解析标签名、地址或地址范围(D5000-D5999).
+func parseAllowRule(s string) (allowRule, error) {
+	s = strings.TrimSpace(s)
+
+	first, last := s, s
+	if i := strings.Index(s, "-"); i > 0 {
+		first, last = s[:i], s[i+1:]
+	}
+
+	info, start, err := melsec.ParseAddress(strings.ToUpper(first))
+	if err != nil {
+		// 不是地址时按标签名匹配
+		if first == s {
+			return allowRule{name: s}, nil
+		}
+
+		return allowRule{}, fmt.Errorf("mqttbridge: writable %q: %w", s, err)
+	}
+
+	end := start
+
+	if last != first {
+		endInfo, no, err := melsec.ParseAddress(strings.ToUpper(last))
+		if err != nil {
+			return allowRule{}, fmt.Errorf("mqttbridge: writable %q: %w", s, err)
+		}
+
+		if endInfo.Name != info.Name || no < start {
+			return allowRule{}, fmt.Errorf("mqttbridge: writable %q: invalid range", s)
+		}
+
+		end = no
+	}
+
+	return allowRule{name: s, device: info.Name, start: start, end: end}, nil
+}
+
+// writable 标签名在允许列表中, 或标签占用的全部软元件在允许的范围内.
+func (b *Bridge) writable(tag *melsec.Tag) bool {
+	info, start, err := melsec.ParseAddress(tag.Address)
+	if err != nil {
+		return false
+	}
+
+	// 位软元件上的bool占1点, 其余按字每字16点
+	points := uint64(tag.Words())
+	if info.Bit {
+		points *= 16
+		if tag.IsBit() {
+			points = 1
+		}
+	}
+
+	for _, r := range b.rules {
+		if r.name == tag.Name {
+			return true
+		}
+
+		if r.device == info.Name && start >= r.start && start+points-1 <= r.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Bridge) topic(name string) string {
+	return b.config.Topic + "/" + name
+}
+
+// onConnect 连接或重新连接后发布在线状态, 订阅写入主题并重新发布全部值.
+func (b *Bridge) onConnect(client mqtt.Client) {
+	b.mu.Lock()
+	b.last = make(map[string]string)
+	b.mu.Unlock()
+
+	client.Publish(b.topic("status"), b.config.QoS, true, StatusOnline)
+
+	filters := make(map[string]byte, len(b.tags))
+	for _, tag := range b.tags {
+		filters[b.topic(tag.Name+"/set")] = b.config.QoS
+	}
+
+	client.SubscribeMultiple(filters, b.onSet)
+
+	b.logger.Info("mqtt connected", "broker", b.config.Broker, "topic", b.config.Topic)
+}
+
+// Run 连接broker并周期读取, 直到ctx结束. 结束时发布离线状态并断开连接.
+func (b *Bridge) Run(ctx context.Context) error {
+	token := b.client.Connect()
+
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return err
+		}
+	case <-ctx.Done():
+	}
+
+	defer func() {
+		// 正常退出时遗嘱不会发布, 需要主动发布离线状态
+		if b.client.IsConnectionOpen() {
+			b.client.Publish(b.topic("status"), b.config.QoS, true, StatusOffline).WaitTimeout(time.Second)
+		}
+
+		b.client.Disconnect(250)
+	}()
+
+	poller := melsec.NewPoller()
+
+	err := poller.Add(melsec.PollGroup{
+		Name:     b.config.Topic,
+		Interval: b.config.Interval,
+		Devices:  []melsec.Reader{b.dev},
+		OnCycle:  b.publish,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := poller.Run(ctx); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// publish 每次读取后发布变化的值, 通信失败时重新连接PLC.
+func (b *Bridge) publish(err error) {
+	if err != nil {
+		b.logger.Warn("plc read failed", "topic", b.config.Topic, "err", err)
+
+		if brokenConn(err) {
+			if err := b.conn.Reconnect(); err != nil {
+				b.logger.Error("plc reconnect failed", "err", err)
+			}
+		}
+	}
+
+	if !b.client.IsConnectionOpen() {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	for i, tag := range b.tags {
+		block := b.dev.Block(i)
+		if block.Err != nil || len(block.Value) < tag.Words()*2 {
+			continue
+		}
+
+		v, err := tag.Decode(block.Value)
+		if err != nil {
+			continue
+		}
+
+		value, err := json.Marshal(v)
+		if err != nil {
+			// NaN等无法以JSON表示的值
+			b.logger.Warn("encode value", "tag", tag.Name, "err", err)
+
+			continue
+		}
+
+		b.mu.Lock()
+		changed := b.last[tag.Name] != string(value)
+		b.last[tag.Name] = string(value)
+		b.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		payload := fmt.Sprintf(`{"value":%s,"time":%q}`, value, now)
+		b.client.Publish(b.topic(tag.Name), b.config.QoS, b.config.Retain, payload)
+	}
+}
+
+func brokenConn(err error) bool {
+	var ne net.Error
+
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// onSet 处理写入请求.
+func (b *Bridge) onSet(_ mqtt.Client, msg mqtt.Message) {
+	name := strings.TrimSuffix(strings.TrimPrefix(msg.Topic(), b.config.Topic+"/"), "/set")
+
+	result := `{"ok":true}`
+
+	if err := b.write(name, msg.Payload()); err != nil {
+		b.logger.Warn("mqtt write rejected", "tag", name, "err", err)
+
+		e, _ := json.Marshal(map[string]string{"error": err.Error()})
+		result = string(e)
+	} else {
+		b.logger.Info("mqtt write", "tag", name, "value", string(msg.Payload()))
+	}
+
+	b.client.Publish(msg.Topic()+"/result", b.config.QoS, false, result)
+}
+
+func (b *Bridge) write(name string, payload []byte) error {
+	tag, ok := b.db.Lookup(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", melsec.ErrTagNotFound, name)
+	}
+
+	if !b.writable(tag) {
+		return fmt.Errorf("tag %s is not writable", name)
+	}
+
+	v, err := parsePayload(payload)
+	if err != nil {
+		return err
+	}
+
+	if err := checkValue(tag, v); err != nil {
+		return err
+	}
+
+	// bool标签另外接受on/off
+	if text, ok := v.(string); ok && tag.Type == melsec.TypeBool {
+		switch strings.ToLower(text) {
+		case "on":
+			v = true
+		case "off":
+			v = false
+		}
+	}
+
+	return b.db.Write(name, v)
+}
+
+// parsePayload 解析JSON值或{"value":...}, 不是JSON时作为文本.
+func parsePayload(payload []byte) (interface{}, error) {
+	text := strings.TrimSpace(string(payload))
+	if text == "" {
+		return nil, errors.New("empty payload")
+	}
+
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return text, nil
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		value, ok := m["value"]
+		if !ok {
+			return nil, errors.New(`payload object needs "value"`)
+		}
+
+		v = value
+	}
+
+	if v == nil {
+		return nil, errors.New("null value")
+	}
+
+	return v, nil
+}
+
+// checkValue 检查值的个数与类型.
+func checkValue(tag *melsec.Tag, v interface{}) error {
+	values := []interface{}{v}
+	if s, ok := v.([]interface{}); ok {
+		values = s
+	}
+
+	length := tag.Length
+	if length <= 0 {
+		length = 1
+	}
+
+	if len(values) != length {
+		return fmt.Errorf("tag %s: want %d value(s), got %d", tag.Name, length, len(values))
+	}
+
+	for _, value := range values {
+		if k := reflect.ValueOf(value).Kind(); k == reflect.Map || k == reflect.Slice {
+			return fmt.Errorf("tag %s: unsupported value %v", tag.Name, value)
+		}
+	}
+
+	return nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,199 @@
+package mqttbridge
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+	"github.com/dualm/melsec/mqttbridge/mqtttest"
+)
+
+// waitMessage 等待主题上满足条件的消息.
+func waitMessage(t *testing.T, ch <-chan mqtttest.Message, topic string, ok func(payload string) bool) string {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case m := <-ch:
+			if m.Topic == topic && ok(string(m.Payload)) {
+				return string(m.Payload)
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %s", topic)
+		}
+	}
+}
+
+func contains(s string) func(string) bool {
+	return func(payload string) bool {
+		return strings.Contains(payload, s)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	s := mock.NewServer()
+	defer s.Close()
+
+	broker := mqtttest.NewBroker()
+	defer broker.Close()
+
+	_ = s.Memory.SetWords("D100", 125)
+	_ = s.Memory.SetBits("M0", true)
+
+	conn, err := melsec.NewConn(s.Host(), s.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b, err := New(conn, Config{
+		Broker:   broker.URL(),
+		ClientID: "bridge",
+		Topic:    "plant/line1/",
+		QoS:      1,
+		Retain:   true,
+		Interval: 20 * time.Millisecond,
+		Tags: []melsec.Tag{
+			{Address: "D100", Type: melsec.TypeInt16, Scale: 0.1},
+			{Name: "run", Address: "M0"},
+			{Address: "D5000", Type: melsec.TypeInt16, Length: 2},
+		},
+		Writable: []string{"D5000-D5999", "run"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := broker.Watch("plant/line1/#")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	payload := waitMessage(t, ch, "plant/line1/D100", contains("12.5"))
+
+	var value struct {
+		Value float64   `json:"value"`
+		Time  time.Time `json:"time"`
+	}
+
+	if err := json.Unmarshal([]byte(payload), &value); err != nil || value.Value != 12.5 || value.Time.IsZero() {
+		t.Errorf("unexpected payload %s %v", payload, err)
+	}
+
+	waitMessage(t, ch, "plant/line1/run", contains("true"))
+
+	if m, ok := broker.Retained("plant/line1/status"); !ok || string(m.Payload) != StatusOnline {
+		t.Errorf("want retained online status, got %q", m.Payload)
+	}
+
+	if m, ok := broker.Retained("plant/line1/D100"); !ok || !strings.Contains(string(m.Payload), "12.5") {
+		t.Errorf("want retained value, got %q", m.Payload)
+	}
+
+	// 写入
+	tests := []struct {
+		topic   string
+		payload string
+		result  string
+	}{
+		{"plant/line1/D5000/set", "[1, -2]", `{"ok":true}`},
+		{"plant/line1/run/set", `{"value": "off"}`, `{"ok":true}`},
+		{"plant/line1/D100/set", "5", "not writable"},
+		{"plant/line1/D5000/set", "[1.5, 2]", "not an integer"},
+		{"plant/line1/D5000/set", "7", "want 2 value(s)"},
+		{"plant/line1/D5000/set", "[70000, 0]", "out of range"},
+	}
+
+	for _, tt := range tests {
+		broker.Publish(tt.topic, []byte(tt.payload), 1, false)
+		waitMessage(t, ch, tt.topic+"/result", contains(tt.result))
+	}
+
+	if words, _ := s.Memory.Words("D5000", 2); !reflect.DeepEqual(words, []uint16{1, 0xFFFE}) {
+		t.Errorf("unexpected D5000 %v", words)
+	}
+
+	if words, _ := s.Memory.Words("D100", 1); words[0] != 125 {
+		t.Errorf("D100 must not be written, got %v", words)
+	}
+
+	// 变化的值被发布
+	waitMessage(t, ch, "plant/line1/run", contains("false"))
+
+	_ = s.Memory.SetWords("D100", 130)
+	waitMessage(t, ch, "plant/line1/D100", contains(`"value":13,`))
+
+	// 异常断开时broker发布遗嘱, 重新连接后恢复在线
+	broker.Kick("bridge")
+	waitMessage(t, ch, "plant/line1/status", contains(StatusOffline))
+	waitMessage(t, ch, "plant/line1/status", contains(StatusOnline))
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if m, _ := broker.Retained("plant/line1/status"); string(m.Payload) != StatusOffline {
+		t.Errorf("want offline status after Run, got %q", m.Payload)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	tag := []melsec.Tag{{Address: "D0"}}
+
+	for _, c := range []Config{
+		{Topic: "a", Tags: tag},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a/+", Tags: tag},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a", QoS: 3, Tags: tag},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a"},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a", Tags: []melsec.Tag{{Name: "status", Address: "D0"}}},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a", Tags: []melsec.Tag{{Address: "D0"}, {Address: "D0"}}},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a", Tags: tag, Writable: []string{"D10-M20"}},
+		{Broker: "tcp://127.0.0.1:1", Topic: "a", Tags: tag, Writable: []string{"D10-D5"}},
+	} {
+		if _, err := New(&melsec.PlcConn{}, c); err == nil {
+			t.Errorf("want error for %+v", c)
+		}
+	}
+
+	b, err := New(&melsec.PlcConn{}, Config{
+		Broker:   "tcp://127.0.0.1:1",
+		Topic:    "a",
+		Tags:     tag,
+		Writable: []string{"Speed", "D10-D19", "M0-M15", "X0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		tag  melsec.Tag
+		want bool
+	}{
+		{melsec.Tag{Name: "Speed", Address: "D0", Type: melsec.TypeInt16}, true},
+		{melsec.Tag{Name: "a", Address: "D18", Type: melsec.TypeInt32}, true},
+		{melsec.Tag{Name: "b", Address: "D19", Type: melsec.TypeInt32}, false},
+		{melsec.Tag{Name: "c", Address: "M15", Type: melsec.TypeBool}, true},
+		{melsec.Tag{Name: "d", Address: "M0", Type: melsec.TypeUint16}, true},
+		{melsec.Tag{Name: "e", Address: "M1", Type: melsec.TypeUint16}, false},
+		{melsec.Tag{Name: "f", Address: "X0", Type: melsec.TypeBool}, true},
+		{melsec.Tag{Name: "g", Address: "Y0", Type: melsec.TypeBool}, false},
+	} {
+		tag := tt.tag
+		if got := b.writable(&tag); got != tt.want {
+			t.Errorf("%s %s: want %v, got %v", tag.Name, tag.Address, tt.want, got)
+		}
+	}
+}
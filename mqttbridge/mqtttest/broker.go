@@ -0,0 +1,502 @@
+// Package mqtttest 提供进程内的MQTT 3.1.1 broker, 用于在测试中运行MQTT客户端.
+//
+// 支持QoS 0/1/2的发布(向订阅者转发时最高为QoS 1)、保留消息、遗嘱消息与通配符订阅,
+// 不支持会话保持与认证.
+package mqtttest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Message 一条经过broker的消息.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Broker 进程内的MQTT broker, 用法与httptest.Server相同: NewBroker启动后以URL连接, 测试结束时调用Close.
+type Broker struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	clients  map[string]*client
+	conns    map[net.Conn]struct{}
+	retained map[string]Message
+	watchers []*watcher
+	closed   bool
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+type client struct {
+	id     string
+	conn   net.Conn
+	wmu    sync.Mutex
+	subs   []subscription
+	will   *Message
+	nextID uint16
+}
+
+type watcher struct {
+	filter string
+	ch     chan Message
+}
+
+// NewBroker 在本机的随机端口上启动broker, 失败时panic.
+func NewBroker() *Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mqtttest: failed to listen: %v", err))
+	}
+
+	b := &Broker{
+		listener: listener,
+		clients:  make(map[string]*client),
+		conns:    make(map[net.Conn]struct{}),
+		retained: make(map[string]Message),
+	}
+
+	b.wg.Add(1)
+
+	go func() {
+		defer b.wg.Done()
+
+		b.serve()
+	}()
+
+	return b
+}
+
+// Addr 返回监听地址.
+func (b *Broker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// URL 返回客户端使用的地址, 形如tcp://127.0.0.1:1883.
+func (b *Broker) URL() string {
+	return "tcp://" + b.Addr()
+}
+
+// Close 停止监听, 关闭全部连接并等待处理结束. 关闭的连接不发布遗嘱.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	b.closed = true
+
+	for conn := range b.conns {
+		_ = conn.Close()
+	}
+
+	for _, w := range b.watchers {
+		close(w.ch)
+	}
+
+	b.watchers = nil
+	b.mu.Unlock()
+
+	_ = b.listener.Close()
+
+	b.wg.Wait()
+}
+
+// Retained 返回主题的保留消息.
+func (b *Broker) Retained(topic string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.retained[topic]
+
+	return m, ok
+}
+
+// Clients 返回已连接的客户端数.
+func (b *Broker) Clients() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.clients)
+}
+
+// Publish 以broker自身的身份发布消息.
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) {
+	b.route(Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+}
+
+// Watch 返回此后发布到filter的消息(不含已有的保留消息), 通道在Close时关闭.
+// 通道有缓冲, 未及时读取的消息被丢弃.
+func (b *Broker) Watch(filter string) <-chan Message {
+	w := &watcher{filter: filter, ch: make(chan Message, 256)}
+
+	b.mu.Lock()
+	b.watchers = append(b.watchers, w)
+	b.mu.Unlock()
+
+	return w.ch
+}
+
+// Kick 不经DISCONNECT断开客户端, 模拟网络故障, 客户端的遗嘱被发布.
+func (b *Broker) Kick(clientID string) bool {
+	b.mu.Lock()
+	c, ok := b.clients[clientID]
+	b.mu.Unlock()
+
+	if ok {
+		_ = c.conn.Close()
+	}
+
+	return ok
+}
+
+func (b *Broker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			_ = conn.Close()
+
+			return
+		}
+
+		b.conns[conn] = struct{}{}
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+
+		go func() {
+			defer b.wg.Done()
+
+			b.serveConn(conn)
+
+			b.mu.Lock()
+			delete(b.conns, conn)
+			b.mu.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (c *client) send(p packets.ControlPacket) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	return p.Write(c.conn)
+}
+
+// deliver 按订阅的QoS向客户端转发消息.
+func (c *client) deliver(m Message, qos byte, retain bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = m.Topic
+	p.Payload = m.Payload
+	p.Qos = qos
+	p.Retain = retain
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if qos > 0 {
+		c.nextID++
+		if c.nextID == 0 {
+			c.nextID = 1
+		}
+
+		p.MessageID = c.nextID
+	}
+
+	_ = p.Write(c.conn)
+}
+
+var errProtocol = errors.New("mqtttest: protocol violation")
+
+func (b *Broker) serveConn(conn net.Conn) {
+	first, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+
+	connect, ok := first.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if ack.ReturnCode = connect.Validate(); ack.ReturnCode != packets.Accepted {
+		_ = ack.Write(conn)
+
+		return
+	}
+
+	c := &client{id: connect.ClientIdentifier, conn: conn}
+	if c.id == "" {
+		c.id = conn.RemoteAddr().String()
+	}
+
+	if connect.WillFlag {
+		c.will = &Message{Topic: connect.WillTopic, Payload: connect.WillMessage, QoS: connect.WillQos, Retain: connect.WillRetain}
+	}
+
+	b.mu.Lock()
+	old := b.clients[c.id]
+	b.clients[c.id] = c
+	b.mu.Unlock()
+
+	// 相同ID的客户端被新连接取代
+	if old != nil {
+		_ = old.conn.Close()
+	}
+
+	if err := c.send(ack); err != nil {
+		b.disconnect(c, true)
+
+		return
+	}
+
+	b.disconnect(c, b.loop(c) != nil)
+}
+
+// loop 处理CONNECT之后的报文, 收到DISCONNECT时返回nil.
+func (b *Broker) loop(c *client) error {
+	for {
+		p, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return err
+		}
+
+		switch p := p.(type) {
+		case *packets.PublishPacket:
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = c.send(ack)
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = c.send(rec)
+			}
+
+			b.route(Message{Topic: p.TopicName, Payload: p.Payload, QoS: p.Qos, Retain: p.Retain})
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = c.send(comp)
+		case *packets.SubscribePacket:
+			err = b.subscribe(c, p)
+		case *packets.UnsubscribePacket:
+			b.unsubscribe(c, p.Topics)
+
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			err = c.send(ack)
+		case *packets.PingreqPacket:
+			err = c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return nil
+		case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+			// 转发时最高为QoS 1, 不重发, 忽略确认
+		default:
+			return errProtocol
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Broker) subscribe(c *client, p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+
+	var retained []Message
+
+	b.mu.Lock()
+
+	for i, filter := range p.Topics {
+		qos := p.Qoss[i]
+		if qos > 1 {
+			qos = 1
+		}
+
+		if !validFilter(filter) {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+
+			continue
+		}
+
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+		c.subs = append(removeSub(c.subs, filter), subscription{filter: filter, qos: qos})
+
+		for _, m := range b.retained {
+			if Match(filter, m.Topic) {
+				m.QoS = minQoS(m.QoS, qos)
+				retained = append(retained, m)
+			}
+		}
+	}
+
+	b.mu.Unlock()
+
+	if err := c.send(ack); err != nil {
+		return err
+	}
+
+	for _, m := range retained {
+		c.deliver(m, m.QoS, true)
+	}
+
+	return nil
+}
+
+func (b *Broker) unsubscribe(c *client, filters []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, filter := range filters {
+		c.subs = removeSub(c.subs, filter)
+	}
+}
+
+func removeSub(subs []subscription, filter string) []subscription {
+	re := subs[:0]
+
+	for _, s := range subs {
+		if s.filter != filter {
+			re = append(re, s)
+		}
+	}
+
+	return re
+}
+
+// disconnect 移除客户端, 异常断开时发布遗嘱.
+func (b *Broker) disconnect(c *client, abnormal bool) {
+	b.mu.Lock()
+	if b.clients[c.id] == c {
+		delete(b.clients, c.id)
+	}
+
+	closed := b.closed
+	b.mu.Unlock()
+
+	if abnormal && !closed && c.will != nil {
+		b.route(*c.will)
+	}
+}
+
+// route 保存保留消息并转发给匹配的订阅者.
+func (b *Broker) route(m Message) {
+	type target struct {
+		c   *client
+		qos byte
+	}
+
+	var targets []target
+
+	b.mu.Lock()
+
+	if m.Retain {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+
+	for _, c := range b.clients {
+		matched, qos := false, byte(0)
+
+		for _, s := range c.subs {
+			if Match(s.filter, m.Topic) {
+				if !matched || s.qos > qos {
+					qos = s.qos
+				}
+
+				matched = true
+			}
+		}
+
+		if matched {
+			targets = append(targets, target{c, minQoS(m.QoS, qos)})
+		}
+	}
+
+	for _, w := range b.watchers {
+		if Match(w.filter, m.Topic) {
+			select {
+			case w.ch <- m:
+			default:
+			}
+		}
+	}
+
+	b.mu.Unlock()
+
+	// 转发给订阅者时清除保留标志
+	for _, t := range targets {
+		t.c.deliver(m, t.qos, false)
+	}
+}
+
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match 返回主题是否匹配订阅的主题过滤器. 以$开头的主题不匹配以通配符开头的过滤器.
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(ts) || f != "+" && f != ts[i] {
+			return false
+		}
+	}
+
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,110 @@
+package mqtttest
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/+/c", "a/b/c", true},
+		{"#", "$SYS/x", false},
+		{"a/b", "a/c", false},
+	}
+
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v", tt.filter, tt.topic, got)
+		}
+	}
+}
+
+func connect(t *testing.T, b *Broker, id string, opts *mqtt.ClientOptions) mqtt.Client {
+	t.Helper()
+
+	if opts == nil {
+		opts = mqtt.NewClientOptions()
+	}
+
+	c := mqtt.NewClient(opts.AddBroker(b.URL()).SetClientID(id).SetAutoReconnect(false))
+	if token := c.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("connect %s: %v", id, token.Error())
+	}
+
+	return c
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	will := mqtt.NewClientOptions().SetWill("dev/status", "offline", 1, true)
+	pub := connect(t, b, "pub", will)
+	sub := connect(t, b, "sub", nil)
+
+	defer sub.Disconnect(0)
+
+	pub.Publish("dev/a", 1, true, "retained").Wait()
+
+	got := make(chan mqtt.Message, 10)
+	sub.Subscribe("dev/#", 1, func(_ mqtt.Client, m mqtt.Message) {
+		got <- m
+	}).Wait()
+
+	recv := func() mqtt.Message {
+		select {
+		case m := <-got:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+
+		return nil
+	}
+
+	if m := recv(); m.Topic() != "dev/a" || string(m.Payload()) != "retained" || !m.Retained() {
+		t.Errorf("want retained message, got %s %q %v", m.Topic(), m.Payload(), m.Retained())
+	}
+
+	pub.Publish("dev/b", 2, false, "live").Wait()
+
+	if m := recv(); m.Topic() != "dev/b" || m.Retained() || m.Qos() != 1 {
+		t.Errorf("unexpected message %s %v %d", m.Topic(), m.Retained(), m.Qos())
+	}
+
+	// 空消息删除保留消息
+	pub.Publish("dev/a", 0, true, "").Wait()
+	recv()
+
+	if _, ok := b.Retained("dev/a"); ok {
+		t.Error("retained message should be cleared")
+	}
+
+	if !b.Kick("pub") {
+		t.Fatal("pub not connected")
+	}
+
+	if m := recv(); m.Topic() != "dev/status" || string(m.Payload()) != "offline" {
+		t.Errorf("want will message, got %s %q", m.Topic(), m.Payload())
+	}
+
+	// 正常断开不发布遗嘱
+	pub = connect(t, b, "pub", will)
+	pub.Disconnect(100)
+
+	select {
+	case m := <-got:
+		t.Errorf("unexpected message %s", m.Topic())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
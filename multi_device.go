@@ -1,7 +1,9 @@
 package melsec
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"reflect"
 )
 
@@ -10,10 +12,52 @@ type MultiDevice struct {
 	count       []int
 	value       [][]byte
 	mValue      [][]byte
-	readMessage McMessage
+	errs        []error
+	requests    [][]deviceChunk
+	blockErrs   []error
+	readMessage []McMessage
 	Error       error
 	conn        *PlcConn
 	changed     bool
+	hub         changeHub
+}
+
+// BlockResult 一个区块最近一次读取的结果. 位软元件的Count以字(16点)计.
+type BlockResult struct {
+	Name  string
+	Count int
+	Bit   bool
+	Value []byte
+	Err   error
+}
+
+// Words 按字返回区块的值.
+func (r BlockResult) Words() []uint16 {
+	re := make([]uint16, len(r.Value)/2)
+	for i := range re {
+		re[i] = binary.LittleEndian.Uint16(r.Value[i*2:])
+	}
+
+	return re
+}
+
+// Bits 按点返回区块的值, 自区块起始软元件起每字16点, 低位在前.
+func (r BlockResult) Bits() []bool {
+	re := make([]bool, len(r.Value)*8)
+	for i := range re {
+		re[i] = bitOf(r.Value, i)
+	}
+
+	return re
+}
+
+// Decode 将区块的值按数据类型解码.
+func (r BlockResult) Decode(t DataType, length int) (interface{}, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+
+	return DecodeValue(t, r.Value, length)
 }
 
 func (dev *MultiDevice) Count() []int {
@@ -24,63 +68,192 @@ func (dev *MultiDevice) Changed() bool {
 	return dev.changed
 }
 
-func (dev *MultiDevice) Write(debug bool) error {
+// Block 返回第i个区块最近一次读取的结果.
+func (dev *MultiDevice) Block(i int) BlockResult {
+	name, _ := splitComponentName(dev.name[i])
+
+	re := BlockResult{
+		Name:  dev.name[i],
+		Count: dev.count[i],
+		Bit:   isBitComponent(name),
+		Value: dev.value[i],
+	}
+
+	if i < len(dev.errs) {
+		re.Err = dev.errs[i]
+	}
+
+	return re
+}
+
+// Blocks 返回全部区块最近一次读取的结果.
+func (dev *MultiDevice) Blocks() []BlockResult {
+	re := make([]BlockResult, len(dev.name))
+	for i := range re {
+		re[i] = dev.Block(i)
+	}
+
+	return re
+}
+
+// Atomic 返回写入是否能在一个请求内完成.
+// 区块数超过MaxBlocks或总字数超过MaxBatchPoints时拆分为多个请求, 写入不是原子的.
+func (dev *MultiDevice) Atomic() bool {
+	requests, err := dev.getRequests()
+
+	return err == nil && len(requests) <= 1
+}
+
+// getRequests 返回拆分后的请求, 存在无效区块时同时返回第一个区块错误.
+func (dev *MultiDevice) getRequests() ([][]deviceChunk, error) {
+	if dev.requests == nil {
+		dev.requests, dev.blockErrs = packChunks(dev.name, dev.count)
+	}
+
+	for _, err := range dev.blockErrs {
+		if err != nil {
+			return dev.requests, err
+		}
+	}
+
+	return dev.requests, nil
+}
+
+// Write 执行写入操作, 写入内容为最近一次SetValue时传入的值.
+// 拆分为多个请求的写入中途失败时返回*PartialWriteError.
+func (dev *MultiDevice) Write() error {
 	if dev.mValue == nil {
 		return nil
 	}
 
-	message, err := dev.conn.option.generateMessageMulti(dev.name, dev.count, dev.mValue)
+	requests, err := dev.getRequests()
 	if err != nil {
 		return err
 	}
 
-	_, err = dev.conn.SendCmd(message, 0, debug)
-	if err != nil {
-		return err
+	for i, chunks := range requests {
+		names := make([]string, len(chunks))
+		counts := make([]int, len(chunks))
+		values := make([][]byte, len(chunks))
+
+		for j, c := range chunks {
+			if len(dev.mValue[c.block]) < (c.offset+c.count)*2 {
+				return fmt.Errorf("block %s: need %d bytes, got %d", dev.name[c.block], dev.count[c.block]*2, len(dev.mValue[c.block]))
+			}
+
+			names[j], counts[j] = c.name, c.count
+			values[j] = dev.mValue[c.block][c.offset*2 : (c.offset+c.count)*2]
+		}
+
+		message, err := dev.conn.option.generateMessageMulti(names, counts, values)
+		if err != nil {
+			return err
+		}
+
+		_, err = dev.conn.SendCmd(message, 0)
+		if err != nil {
+			if i > 0 {
+				return &PartialWriteError{Written: i, Total: len(requests), Err: err}
+			}
+
+			return err
+		}
 	}
 
 	// 更新数据
 	copy(dev.value, dev.mValue)
 	dev.changed = true
 	dev.mValue = nil
+	dev.publish()
 
 	return nil
 }
 
-func (dev *MultiDevice) getReadMessage() (McMessage, error) {
+func (dev *MultiDevice) getReadMessage() ([]McMessage, error) {
 	if len(dev.readMessage) == 0 {
-		message, err := dev.conn.option.generateMessageMulti(dev.name, dev.count, nil)
-		if err != nil {
-			return nil, err
+		requests, _ := dev.getRequests()
+
+		messages := make([]McMessage, len(requests))
+
+		for i, chunks := range requests {
+			names := make([]string, len(chunks))
+			counts := make([]int, len(chunks))
+
+			for j, c := range chunks {
+				names[j], counts[j] = c.name, c.count
+			}
+
+			message, err := dev.conn.option.generateMessageMulti(names, counts, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			messages[i] = message
 		}
 
-		dev.readMessage = message
+		dev.readMessage = messages
 	}
 
 	return dev.readMessage, nil
 }
 
-func (dev *MultiDevice) Read(debug bool) error {
-	msg, err := dev.getReadMessage()
+// Read 读取全部区块, 超过单次请求上限时拆分为多个请求并按区块合并结果.
+// 部分区块无效或所在请求失败时, 其余区块照常更新, 各区块的错误通过Block返回.
+func (dev *MultiDevice) Read() error {
+	messages, err := dev.getReadMessage()
 	if err != nil {
 		return err
 	}
 
-	buff, err := dev.conn.SendCmd(msg, dev.totalCount()*2, debug)
-	if err != nil {
-		return err
+	errs := make([]error, len(dev.name))
+	copy(errs, dev.blockErrs)
+
+	values := make([][]byte, len(dev.name))
+	for i := range values {
+		values[i] = make([]byte, 0, dev.count[i]*2)
 	}
 
-	if reflect.DeepEqual(dev.value, buff) {
-		return nil
+	for i, message := range messages {
+		buff, err := dev.conn.SendCmd(message, chunksCount(dev.requests[i])*2)
+		if err != nil {
+			for _, c := range dev.requests[i] {
+				errs[c.block] = err
+			}
+
+			continue
+		}
+
+		for _, c := range dev.requests[i] {
+			values[c.block] = append(values[c.block], buff[:c.count*2]...)
+			buff = buff[c.count*2:]
+		}
+	}
+
+	failed, first := 0, error(nil)
+
+	for i := range values {
+		if errs[i] != nil {
+			// 保留上一次的值
+			values[i] = dev.value[i]
+			failed++
+
+			if first == nil {
+				first = errs[i]
+			}
+		}
 	}
 
-	for i := 0; i < len(dev.count); i++ {
-		dev.value[i] = buff[:dev.count[i]*2]
-		buff = buff[dev.count[i]*2:]
+	dev.errs = errs
+
+	if !reflect.DeepEqual(dev.value, values) {
+		dev.value = values
+		dev.changed = true
+		dev.publish()
 	}
 
-	dev.changed = true
+	if failed != 0 {
+		return fmt.Errorf("%d of %d blocks failed: %w", failed, len(values), first)
+	}
 
 	return nil
 }
@@ -91,15 +264,6 @@ func (dev *MultiDevice) GetValue() [][]byte {
 	return dev.value
 }
 
-func (dev *MultiDevice) totalCount() int {
-	totalCount := 0
-	for i := range dev.count {
-		totalCount += dev.count[i]
-	}
-
-	return totalCount
-}
-
 func (dev *MultiDevice) SetValue(val [][]byte) {
 	dev.mValue = val
 	dev.changed = false
@@ -109,11 +273,14 @@ func (dev *MultiDevice) Name() []string {
 	return dev.name
 }
 
+// AddBlock 添加数据区块, 字软元件与位软元件可以混合添加, 位软元件的count以字(16点)计.
 func (dev *MultiDevice) AddBlock(name string, count int) {
 	dev.name = append(dev.name, name)
 	dev.count = append(dev.count, count)
 	dev.value = append(dev.value, make([]byte, 0))
 	dev.mValue = append(dev.mValue, make([]byte, 0))
+	dev.requests = nil
+	dev.readMessage = dev.readMessage[:0]
 }
 
 func NewMultiDevice(conn *PlcConn) (*MultiDevice, error) {
@@ -126,7 +293,7 @@ func NewMultiDevice(conn *PlcConn) (*MultiDevice, error) {
 		count:       make([]int, 0),
 		value:       make([][]byte, 0),
 		mValue:      make([][]byte, 0),
-		readMessage: make([]byte, 0),
+		readMessage: make([]McMessage, 0),
 		Error:       nil,
 		conn:        conn,
 		changed:     false,
@@ -0,0 +1,148 @@
+package melsec
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func mixedMultiDevice(t *testing.T, conn *PlcConn) *MultiDevice {
+	t.Helper()
+
+	dev, err := NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.AddBlock("M0", 2)
+	dev.AddBlock("D100", 3)
+	dev.AddBlock("X20", 1)
+	dev.AddBlock("W1A0", 2)
+
+	return dev
+}
+
+func TestMultiDeviceMixedReadFrame(t *testing.T) {
+	dev := mixedMultiDevice(t, &PlcConn{option: newPlcOption(nil)})
+
+	messages, err := dev.getReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x50, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, // 副帧头, 访问路径
+		0x20, 0x00, // 数据长度
+		0x01, 0x00, // 监视定时器
+		0x06, 0x04, 0x00, 0x00, // 多块批量读取
+		0x02, 0x02, // 字块数, 位块数
+		0x64, 0x00, 0x00, 0xA8, 0x03, 0x00, // D100 x3
+		0xA0, 0x01, 0x00, 0xB4, 0x02, 0x00, // W1A0 x2
+		0x00, 0x00, 0x00, 0x90, 0x02, 0x00, // M0 x2
+		0x20, 0x00, 0x00, 0x9C, 0x01, 0x00, // X20 x1
+	}
+
+	if len(messages) != 1 || !bytes.Equal(messages[0], want) {
+		t.Fatalf("want % x, got % x", want, messages)
+	}
+}
+
+func TestMultiDeviceMixedWriteFrame(t *testing.T) {
+	dev := mixedMultiDevice(t, &PlcConn{option: newPlcOption(nil)})
+
+	requests, err := dev.getRequests()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, counts, values := make([]string, 0), make([]int, 0), make([][]byte, 0)
+	blockValues := [][]byte{{0x01, 0x80, 0xFF, 0x00}, {1, 0, 2, 0, 3, 0}, {0x0F, 0x00}, {0xAA, 0xBB, 0xCC, 0xDD}}
+
+	for _, c := range requests[0] {
+		names, counts = append(names, c.name), append(counts, c.count)
+		values = append(values, blockValues[c.block])
+	}
+
+	message, err := dev.conn.option.generateMessageMulti(names, counts, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x50, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00,
+		0x30, 0x00,
+		0x01, 0x00,
+		0x06, 0x14, 0x00, 0x00, // 多块批量写入
+		0x02, 0x02,
+		0x64, 0x00, 0x00, 0xA8, 0x03, 0x00, 1, 0, 2, 0, 3, 0,
+		0xA0, 0x01, 0x00, 0xB4, 0x02, 0x00, 0xAA, 0xBB, 0xCC, 0xDD,
+		0x00, 0x00, 0x00, 0x90, 0x02, 0x00, 0x01, 0x80, 0xFF, 0x00,
+		0x20, 0x00, 0x00, 0x9C, 0x01, 0x00, 0x0F, 0x00,
+	}
+
+	if !bytes.Equal(message, want) {
+		t.Fatalf("want % x, got % x", want, message)
+	}
+}
+
+func TestMultiDeviceMixedRead(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	copy(plc.words(0x90, 0, 2), []byte{0x01, 0x80, 0xFF, 0x00})
+	copy(plc.words(0xA8, 100, 3), []byte{1, 0, 2, 0, 3, 0})
+	copy(plc.words(0x9C, 0x20, 1), []byte{0x0F, 0x00})
+	copy(plc.words(0xB4, 0x1A0, 2), []byte{0xAA, 0xBB, 0xCC, 0xDD})
+
+	dev := mixedMultiDevice(t, conn)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := dev.Blocks()
+
+	if !blocks[0].Bit || blocks[1].Bit {
+		t.Errorf("want M0 bit block and D100 word block, got %+v", blocks[:2])
+	}
+
+	if bits := blocks[0].Bits(); !bits[0] || bits[1] || !bits[15] || !bits[16] || bits[24] {
+		t.Errorf("unexpected M0 bits %v", bits)
+	}
+
+	if words := blocks[1].Words(); !reflect.DeepEqual(words, []uint16{1, 2, 3}) {
+		t.Errorf("want D100 [1 2 3], got %v", words)
+	}
+
+	if v, err := blocks[3].Decode(TypeUint32, 1); err != nil || v != uint32(0xDDCCBBAA) {
+		t.Errorf("want W1A0 0xddccbbaa, got %v %v", v, err)
+	}
+
+	if !bytes.Equal(blocks[2].Value, []byte{0x0F, 0x00}) {
+		t.Errorf("want X20 0f 00, got % x", blocks[2].Value)
+	}
+}
+
+func TestMultiDeviceBlockError(t *testing.T) {
+	plc, conn := newFakePLC(t)
+	copy(plc.words(0xA8, 0, 1), []byte{7, 0})
+
+	dev, err := NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.AddBlock("K10", 1)
+	dev.AddBlock("D0", 1)
+
+	if err := dev.Read(); err == nil {
+		t.Fatal("want error for invalid block")
+	}
+
+	if dev.Block(0).Err == nil {
+		t.Error("want error on block 0")
+	}
+
+	if b := dev.Block(1); b.Err != nil || !bytes.Equal(b.Value, []byte{7, 0}) {
+		t.Errorf("want D0 = 07 00, got %+v", b)
+	}
+}
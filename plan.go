@@ -0,0 +1,603 @@
+package melsec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RequestKind 读取请求的种类.
+type RequestKind uint8
+
+const (
+	RequestBatch  RequestKind = iota + 1 // 批量读取(0401)
+	RequestBlock                         // 多块批量读取(0406)
+	RequestRandom                        // 随机读取(0403)
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case RequestBatch:
+		return "batch"
+	case RequestBlock:
+		return "block"
+	case RequestRandom:
+		return "random"
+	}
+
+	return fmt.Sprintf("RequestKind(%d)", uint8(k))
+}
+
+// PlanItem 需要读取的地址. 字软元件读取Words个字;
+// 位软元件读取自Address起的16*Words个点, Words为0时只读取该点.
+type PlanItem struct {
+	Address string
+	Words   int
+}
+
+// PlanCost 读取计划的成本模型, 单位为字节当量.
+type PlanCost struct {
+	Request int // 每个请求的固定开销, 包括帧头及一次往返的延迟
+	Block   int // 每个区块的描述, 软元件4字节+点数2字节
+	Point   int // 随机读取中每个访问点的描述
+	Word    int // 响应中的每个字
+}
+
+// DefaultPlanCost 默认成本模型, 一次往返按200字节计.
+var DefaultPlanCost = PlanCost{Request: 200, Block: 6, Point: 4, Word: 2}
+
+// Planner 将任意地址集合规划为尽量少的批量、多块或随机读取请求.
+type Planner struct {
+	Cost PlanCost
+	// MaxPoints 每个请求读取的总字数上限.
+	MaxPoints int
+	// MaxBlocks 多块读取每个请求的区块数上限.
+	MaxBlocks int
+	// MaxRandomPoints 随机读取每个请求的访问点数上限.
+	MaxRandomPoints int
+	// Random 是否允许使用随机读取. 部分CPU或模块不支持随机读取时应关闭.
+	Random bool
+}
+
+func NewPlanner() *Planner {
+	return &Planner{
+		Cost:            DefaultPlanCost,
+		MaxPoints:       MaxBatchPoints,
+		MaxBlocks:       MaxBlocks,
+		MaxRandomPoints: MaxRandomReadPoints,
+		Random:          true,
+	}
+}
+
+// PlanBlock 一段连续读取的软元件. 位软元件的Device按16点对齐, Count以字计.
+type PlanBlock struct {
+	Device string
+	Count  int
+	comp   string
+	bit    bool
+	lo     uint64
+}
+
+// PlanRequest 一个MC协议请求.
+type PlanRequest struct {
+	Kind   RequestKind
+	Blocks []PlanBlock
+}
+
+// PlanReport 读取计划的成本报告.
+type PlanReport struct {
+	Requests      int
+	Batch         int
+	Block         int
+	Random        int
+	Blocks        int // 批量与多块读取的区块数
+	RandomPoints  int // 随机读取的访问点数
+	Words         int // 实际读取的字数
+	UsefulWords   int // 请求地址覆盖的字数
+	RequestBytes  int
+	ResponseBytes int
+	Cost          int
+}
+
+func (r PlanReport) String() string {
+	return fmt.Sprintf("requests=%d (batch=%d block=%d random=%d) blocks=%d random_points=%d words=%d useful=%d wasted=%d request_bytes=%d response_bytes=%d cost=%d",
+		r.Requests, r.Batch, r.Block, r.Random, r.Blocks, r.RandomPoints, r.Words, r.UsefulWords, r.Words-r.UsefulWords,
+		r.RequestBytes, r.ResponseBytes, r.Cost)
+}
+
+// ReadPlan 读取计划, 可通过Read在PlcConn上执行.
+type ReadPlan struct {
+	Requests []PlanRequest
+	Report   PlanReport
+}
+
+// planRange 一段连续的字, 位软元件以16点为一个字.
+type planRange struct {
+	comp   string
+	bit    bool
+	lo, hi uint64
+}
+
+func (r planRange) words() int {
+	return int(r.hi - r.lo)
+}
+
+func (r planRange) block() PlanBlock {
+	no := r.lo
+	if r.bit {
+		no *= 16
+	}
+
+	name, _ := formatComponent(r.comp, no)
+
+	return PlanBlock{Device: name, Count: r.words(), comp: r.comp, bit: r.bit, lo: r.lo}
+}
+
+func toPlanRange(item PlanItem) (planRange, error) {
+	comp, no, err := parseComponent(item.Address)
+	if err != nil {
+		return planRange{}, err
+	}
+
+	if item.Words < 0 {
+		return planRange{}, fmt.Errorf("%s: negative word count", item.Address)
+	}
+
+	r := planRange{comp: comp, bit: isBitComponent(comp)}
+
+	switch {
+	case !r.bit:
+		r.lo, r.hi = no, no+uint64(item.Words)
+		if item.Words == 0 {
+			r.hi++
+		}
+	case item.Words == 0:
+		r.lo, r.hi = no/16, no/16+1
+	default:
+		r.lo, r.hi = no/16, (no+uint64(item.Words)*16+15)/16
+	}
+
+	return r, nil
+}
+
+// PlanAddresses 规划单个地址的读取, 每个地址为一个字或一个点.
+func (p *Planner) PlanAddresses(addrs ...string) (*ReadPlan, error) {
+	items := make([]PlanItem, len(addrs))
+	for i := range addrs {
+		items[i] = PlanItem{Address: addrs[i]}
+	}
+
+	return p.Plan(items...)
+}
+
+// Plan 规划读取: 合并重叠与相邻地址, 间隔小于一个区块开销时桥接,
+// 超过单次请求上限时拆分, 然后在多块读取与随机读取之间选择成本较低的组合.
+func (p *Planner) Plan(items ...PlanItem) (*ReadPlan, error) {
+	if len(items) == 0 {
+		return nil, errors.New("empty plan")
+	}
+
+	ranges := make([]planRange, 0, len(items))
+
+	for _, item := range items {
+		r, err := toPlanRange(item)
+		if err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	ranges = mergeRanges(ranges, 0)
+
+	useful := 0
+	for _, r := range ranges {
+		useful += r.words()
+	}
+
+	gap := 0
+	if p.Cost.Word > 0 {
+		gap = p.Cost.Block / p.Cost.Word
+	}
+
+	ranges = p.splitRanges(mergeRanges(ranges, gap))
+
+	plan := p.blockPlan(ranges)
+
+	if p.Random {
+		small := make([]planRange, 0)
+		large := make([]planRange, 0)
+
+		for _, r := range ranges {
+			if r.words() <= 2 {
+				small = append(small, r)
+			} else {
+				large = append(large, r)
+			}
+		}
+
+		if len(small) != 0 {
+			mixed := p.blockPlan(large)
+			mixed.Requests = append(mixed.Requests, p.randomRequests(small)...)
+			p.report(mixed)
+
+			if mixed.Report.Cost < plan.Report.Cost {
+				plan = mixed
+			}
+		}
+	}
+
+	plan.Report.UsefulWords = useful
+
+	return plan, nil
+}
+
+// mergeRanges 合并同一软元件中间隔不超过gap个字的地址段.
+func mergeRanges(ranges []planRange, gap int) []planRange {
+	sorted := make([]planRange, len(ranges))
+	copy(sorted, ranges)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].comp != sorted[j].comp {
+			return sorted[i].comp < sorted[j].comp
+		}
+
+		return sorted[i].lo < sorted[j].lo
+	})
+
+	re := make([]planRange, 0, len(sorted))
+
+	for _, r := range sorted {
+		last := len(re) - 1
+		if last >= 0 && re[last].comp == r.comp && r.lo <= re[last].hi+uint64(gap) {
+			if r.hi > re[last].hi {
+				re[last].hi = r.hi
+			}
+
+			continue
+		}
+
+		re = append(re, r)
+	}
+
+	return re
+}
+
+// splitRanges 拆分超过单次请求字数上限的地址段.
+func (p *Planner) splitRanges(ranges []planRange) []planRange {
+	re := make([]planRange, 0, len(ranges))
+
+	for _, r := range ranges {
+		for r.words() > p.MaxPoints {
+			head := r
+			head.hi = r.lo + uint64(p.MaxPoints)
+			re = append(re, head)
+			r.lo = head.hi
+		}
+
+		re = append(re, r)
+	}
+
+	return re
+}
+
+// blockPlan 将地址段按首次适应递减装箱为多块读取请求, 只有一个区块的请求改为批量读取.
+func (p *Planner) blockPlan(ranges []planRange) *ReadPlan {
+	type bin struct {
+		ranges []planRange
+		words  int
+	}
+
+	sorted := make([]planRange, len(ranges))
+	copy(sorted, ranges)
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].words() > sorted[j].words()
+	})
+
+	bins := make([]*bin, 0)
+
+	for _, r := range sorted {
+		var target *bin
+
+		for _, b := range bins {
+			if len(b.ranges) < p.MaxBlocks && b.words+r.words() <= p.MaxPoints {
+				target = b
+
+				break
+			}
+		}
+
+		if target == nil {
+			target = &bin{}
+			bins = append(bins, target)
+		}
+
+		target.ranges = append(target.ranges, r)
+		target.words += r.words()
+	}
+
+	plan := &ReadPlan{Requests: make([]PlanRequest, 0, len(bins))}
+
+	for _, b := range bins {
+		// 多块读取要求字块在前, 位块在后
+		sort.Slice(b.ranges, func(i, j int) bool {
+			ri, rj := b.ranges[i], b.ranges[j]
+			if ri.bit != rj.bit {
+				return !ri.bit
+			}
+
+			if ri.comp != rj.comp {
+				return ri.comp < rj.comp
+			}
+
+			return ri.lo < rj.lo
+		})
+
+		req := PlanRequest{Kind: RequestBlock}
+		if len(b.ranges) == 1 {
+			req.Kind = RequestBatch
+		}
+
+		for _, r := range b.ranges {
+			req.Blocks = append(req.Blocks, r.block())
+		}
+
+		plan.Requests = append(plan.Requests, req)
+	}
+
+	p.report(plan)
+
+	return plan
+}
+
+// randomRequests 将1~2个字的地址段作为随机读取的字或双字访问点.
+func (p *Planner) randomRequests(ranges []planRange) []PlanRequest {
+	sorted := make([]planRange, len(ranges))
+	copy(sorted, ranges)
+
+	// 随机读取的响应中字访问点在前, 双字访问点在后
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].words() < sorted[j].words()
+	})
+
+	re := make([]PlanRequest, 0)
+
+	for len(sorted) != 0 {
+		n := len(sorted)
+		if n > p.MaxRandomPoints {
+			n = p.MaxRandomPoints
+		}
+
+		req := PlanRequest{Kind: RequestRandom}
+		for _, r := range sorted[:n] {
+			req.Blocks = append(req.Blocks, r.block())
+		}
+
+		re = append(re, req)
+		sorted = sorted[n:]
+	}
+
+	return re
+}
+
+// report 按成本模型计算计划的报告, 字节数按3E帧估算.
+func (p *Planner) report(plan *ReadPlan) {
+	const (
+		requestHeader  = 15 // 副帧头~数据长度9字节, 监视定时器2字节, 指令4字节
+		responseHeader = 11
+	)
+
+	r := PlanReport{}
+
+	for _, req := range plan.Requests {
+		r.Requests++
+		r.RequestBytes += requestHeader
+		r.ResponseBytes += responseHeader
+		r.Cost += p.Cost.Request
+
+		words := 0
+		for _, b := range req.Blocks {
+			words += b.Count
+		}
+
+		r.Words += words
+		r.ResponseBytes += words * 2
+		r.Cost += words * p.Cost.Word
+
+		switch req.Kind {
+		case RequestBatch:
+			r.Batch++
+			r.Blocks++
+			r.RequestBytes += 6
+			r.Cost += p.Cost.Block
+		case RequestBlock:
+			r.Block++
+			r.Blocks += len(req.Blocks)
+			r.RequestBytes += 2 + 6*len(req.Blocks)
+			r.Cost += p.Cost.Block * len(req.Blocks)
+		case RequestRandom:
+			r.Random++
+			r.RandomPoints += len(req.Blocks)
+			r.RequestBytes += 2 + 4*len(req.Blocks)
+			r.Cost += p.Cost.Point * len(req.Blocks)
+		}
+	}
+
+	plan.Report = r
+}
+
+// String 以可读形式列出计划中的请求.
+func (plan *ReadPlan) String() string {
+	b := strings.Builder{}
+
+	for i, req := range plan.Requests {
+		devices := make([]string, len(req.Blocks))
+		for j, block := range req.Blocks {
+			devices[j] = fmt.Sprintf("%s:%d", block.Device, block.Count)
+		}
+
+		fmt.Fprintf(&b, "#%d %s %s\n", i, req.Kind, strings.Join(devices, " "))
+	}
+
+	b.WriteString(plan.Report.String())
+
+	return b.String()
+}
+
+// Read 在conn上依次执行计划中的请求.
+func (plan *ReadPlan) Read(conn *PlcConn) (*PlanResult, error) {
+	result := &PlanResult{}
+
+	for _, req := range plan.Requests {
+		data, err := plan.read(conn, req)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, block := range req.Blocks {
+			start := block.lo
+			if block.bit {
+				start *= 16
+			}
+
+			result.add(block.comp, block.bit, start, data[i])
+		}
+	}
+
+	return result, nil
+}
+
+func (plan *ReadPlan) read(conn *PlcConn, req PlanRequest) ([][]byte, error) {
+	switch req.Kind {
+	case RequestBatch:
+		dev, err := NewDevice(req.Blocks[0].Device, req.Blocks[0].Count, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := dev.Read(); err != nil {
+			return nil, err
+		}
+
+		return [][]byte{dev.GetValue()}, nil
+	case RequestBlock:
+		dev, err := NewMultiDevice(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, block := range req.Blocks {
+			dev.AddBlock(block.Device, block.Count)
+		}
+
+		if err := dev.Read(); err != nil {
+			return nil, err
+		}
+
+		return dev.GetValue(), nil
+	case RequestRandom:
+		words := make([]string, 0)
+		dwords := make([]string, 0)
+
+		for _, block := range req.Blocks {
+			if block.Count == 1 {
+				words = append(words, block.Device)
+			} else {
+				dwords = append(dwords, block.Device)
+			}
+		}
+
+		buff, err := conn.ReadRandom(words, dwords)
+		if err != nil {
+			return nil, err
+		}
+
+		re := make([][]byte, len(req.Blocks))
+		for i, block := range req.Blocks {
+			re[i], buff = buff[:block.Count*2], buff[block.Count*2:]
+		}
+
+		return re, nil
+	}
+
+	return nil, fmt.Errorf("unknown request kind %s", req.Kind)
+}
+
+// planSegment 一段读取结果, start为起始软元件编号, 位软元件以点计.
+type planSegment struct {
+	bit   bool
+	start uint64
+	data  []byte
+}
+
+// end 返回段后第一个软元件的编号.
+func (seg planSegment) end() uint64 {
+	if seg.bit {
+		return seg.start + uint64(len(seg.data))*8
+	}
+
+	return seg.start + uint64(len(seg.data)/2)
+}
+
+// PlanResult 读取计划的结果, 按地址取值.
+type PlanResult struct {
+	segments map[string][]planSegment
+}
+
+func (r *PlanResult) add(comp string, bit bool, start uint64, data []byte) {
+	if r.segments == nil {
+		r.segments = make(map[string][]planSegment)
+	}
+
+	r.segments[comp] = append(r.segments[comp], planSegment{bit: bit, start: start, data: data})
+}
+
+// Words 返回自address起words个字的数据. 位软元件返回自该点起的16*words个点, 按小端打包.
+func (r *PlanResult) Words(address string, words int) ([]byte, error) {
+	comp, no, err := parseComponent(address)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range r.segments[comp] {
+		if !seg.bit {
+			if no < seg.start || no+uint64(words) > seg.end() {
+				continue
+			}
+
+			offset := int(no-seg.start) * 2
+
+			return seg.data[offset : offset+words*2], nil
+		}
+
+		if no < seg.start || no+uint64(words)*16 > seg.end() {
+			continue
+		}
+
+		return packBits(seg.data, int(no-seg.start), words*16), nil
+	}
+
+	return nil, fmt.Errorf("%s:%d not in read plan", address, words)
+}
+
+// Bit 返回位软元件一个点的值.
+func (r *PlanResult) Bit(address string) (bool, error) {
+	comp, no, err := parseComponent(address)
+	if err != nil {
+		return false, err
+	}
+
+	if !isBitComponent(comp) {
+		return false, fmt.Errorf("%s is not a bit device", address)
+	}
+
+	for _, seg := range r.segments[comp] {
+		if no >= seg.start && no < seg.end() {
+			return bitOf(seg.data, int(no-seg.start)), nil
+		}
+	}
+
+	return false, fmt.Errorf("%s not in read plan", address)
+}
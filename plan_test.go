@@ -0,0 +1,106 @@
+package melsec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPlannerMerge(t *testing.T) {
+	plan, err := NewPlanner().PlanAddresses("D100", "D101", "D105", "D103", "M20", "M21", "R3000", "D100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "#0 block D100:6 R3000:1 M16:1"
+	if got := strings.Split(plan.String(), "\n")[0]; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	if plan.Report.UsefulWords != 6 || plan.Report.Words != 8 {
+		t.Errorf("want useful 6 words 8, got %s", plan.Report)
+	}
+}
+
+func TestPlannerRandom(t *testing.T) {
+	addrs := make([]string, 150)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("D%d", i*10)
+	}
+
+	plan, err := NewPlanner().PlanAddresses(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Requests) != 1 || plan.Requests[0].Kind != RequestRandom || len(plan.Requests[0].Blocks) != 150 {
+		t.Fatalf("want one random request with 150 points, got %s", plan.Report)
+	}
+}
+
+func TestPlannerMergeWithoutRandom(t *testing.T) {
+	p := NewPlanner()
+	p.Random = false
+
+	plan, err := p.PlanAddresses("D100", "D105", "M20", "R3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Requests) != 1 || plan.Requests[0].Kind != RequestBlock {
+		t.Fatalf("want one block request, got %s", plan)
+	}
+
+	want := "#0 block D100:1 D105:1 R3000:1 M16:1"
+	if got := strings.Split(plan.String(), "\n")[0]; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestPlannerSplit(t *testing.T) {
+	plan, err := NewPlanner().Plan(PlanItem{Address: "D0", Words: 2000}, PlanItem{Address: "W100", Words: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+
+	for _, req := range plan.Requests {
+		words := 0
+		for _, b := range req.Blocks {
+			words += b.Count
+		}
+
+		if words > MaxBatchPoints || len(req.Blocks) > MaxBlocks {
+			t.Errorf("request over limit: %+v", req)
+		}
+
+		total += words
+	}
+
+	if total != 2010 || len(plan.Requests) != 3 {
+		t.Errorf("want 2010 words in 3 requests, got %s", plan)
+	}
+}
+
+func TestPlanResult(t *testing.T) {
+	result := &PlanResult{segments: map[string][]planSegment{
+		"D": {{start: 100, data: []byte{1, 0, 2, 0, 3, 0}}},
+		"M": {{bit: true, start: 16, data: []byte{0x10, 0x80}}},
+	}}
+
+	b, err := result.Words("D101", 2)
+	if err != nil || string(b) != string([]byte{2, 0, 3, 0}) {
+		t.Errorf("want [2 0 3 0], got %v %v", b, err)
+	}
+
+	if _, err := result.Words("D102", 2); err == nil {
+		t.Error("want error for words outside the plan")
+	}
+
+	for addr, want := range map[string]bool{"M20": true, "M21": false, "M31": true} {
+		if got, err := result.Bit(addr); err != nil || got != want {
+			t.Errorf("%s: want %v, got %v %v", addr, want, got, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package melsec
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Reader 可被轮询读取的软元件, *Device与*MultiDevice均实现该接口.
+type Reader interface {
+	Read() error
+}
+
+// PollGroup 一组以相同周期扫描的软元件.
+type PollGroup struct {
+	Name     string
+	Interval time.Duration
+	Devices  []Reader
+	// OnCycle 每次扫描结束后调用, err为本次扫描中的第一个读取错误.
+	OnCycle func(err error)
+}
+
+// GroupStats 扫描组的运行统计. Jitter为实际开始时间与计划时间之差,
+// Overruns为因上一次扫描超时而跳过的周期数.
+type GroupStats struct {
+	Name      string
+	Interval  time.Duration
+	Cycles    uint64
+	Errors    uint64
+	Overruns  uint64
+	LastCycle time.Duration
+	MaxCycle  time.Duration
+	AvgCycle  time.Duration
+	Jitter    time.Duration
+	MaxJitter time.Duration
+	LastError error
+	LastRun   time.Time
+}
+
+type pollGroup struct {
+	PollGroup
+	next  time.Time
+	total time.Duration
+	stats GroupStats
+}
+
+// Poller 在一个共享的PlcConn上按各组的周期调度读取.
+// 同一时刻只执行一组读取, 到期最早的组优先, 同时到期时最久未执行的组优先;
+// 落后超过一个周期的组只补读一次, 跳过的周期计入Overruns, 不会堆积.
+type Poller struct {
+	mu     sync.Mutex
+	groups []*pollGroup
+	wake   chan struct{}
+}
+
+func NewPoller() *Poller {
+	return &Poller{
+		groups: make([]*pollGroup, 0),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Add 添加扫描组, 可在Run运行期间调用.
+func (p *Poller) Add(group PollGroup) error {
+	if group.Interval <= 0 {
+		return errors.New("poll interval must be positive")
+	}
+
+	if len(group.Devices) == 0 {
+		return errors.New("empty poll group")
+	}
+
+	p.mu.Lock()
+	p.groups = append(p.groups, &pollGroup{
+		PollGroup: group,
+		stats:     GroupStats{Name: group.Name, Interval: group.Interval},
+	})
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Stats 返回各组的运行统计.
+func (p *Poller) Stats() []GroupStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	re := make([]GroupStats, len(p.groups))
+	for i, g := range p.groups {
+		re[i] = g.stats
+	}
+
+	return re
+}
+
+// nextGroup 返回下一个到期的组.
+func (p *Poller) nextGroup() *pollGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var next *pollGroup
+
+	for _, g := range p.groups {
+		if g.next.IsZero() {
+			g.next = time.Now()
+		}
+
+		switch {
+		case next == nil, g.next.Before(next.next):
+			next = g
+		case g.next.Equal(next.next) && g.stats.LastRun.Before(next.stats.LastRun):
+			next = g
+		}
+	}
+
+	return next
+}
+
+// Run 运行调度直到ctx结束.
+func (p *Poller) Run(ctx context.Context) error {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		g := p.nextGroup()
+
+		wait := time.Hour
+		if g != nil {
+			wait = time.Until(g.next)
+		}
+
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			timer.Reset(wait)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-p.wake:
+				continue
+			case <-timer.C:
+				continue
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		p.runGroup(g)
+	}
+}
+
+func (p *Poller) runGroup(g *pollGroup) {
+	start := time.Now()
+
+	var first error
+
+	for _, dev := range g.Devices {
+		if err := dev.Read(); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	end := time.Now()
+
+	p.mu.Lock()
+
+	s := &g.stats
+	s.Cycles++
+	s.LastRun = start
+	s.LastCycle = end.Sub(start)
+	s.Jitter = start.Sub(g.next)
+	g.total += s.LastCycle
+	s.AvgCycle = g.total / time.Duration(s.Cycles)
+
+	if s.LastCycle > s.MaxCycle {
+		s.MaxCycle = s.LastCycle
+	}
+
+	if s.Jitter > s.MaxJitter {
+		s.MaxJitter = s.Jitter
+	}
+
+	if first != nil {
+		s.Errors++
+		s.LastError = first
+	}
+
+	// 跳过已经错过的周期, 保持原有的相位
+	g.next = g.next.Add(g.Interval)
+	if !g.next.After(end) {
+		missed := end.Sub(g.next)/g.Interval + 1
+		s.Overruns += uint64(missed)
+		g.next = g.next.Add(missed * g.Interval)
+	}
+
+	p.mu.Unlock()
+
+	if g.OnCycle != nil {
+		g.OnCycle(first)
+	}
+}
@@ -0,0 +1,85 @@
+package melsec
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testReader struct {
+	reads int32
+	delay time.Duration
+	err   error
+}
+
+func (r *testReader) Read() error {
+	atomic.AddInt32(&r.reads, 1)
+	time.Sleep(r.delay)
+
+	return r.err
+}
+
+func TestPoller(t *testing.T) {
+	fast := &testReader{}
+	slow := &testReader{delay: 35 * time.Millisecond, err: errors.New("boom")}
+
+	p := NewPoller()
+
+	if err := p.Add(PollGroup{Name: "fast", Interval: 10 * time.Millisecond, Devices: []Reader{fast}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cycles := int32(0)
+	if err := p.Add(PollGroup{
+		Name:     "slow",
+		Interval: 10 * time.Millisecond,
+		Devices:  []Reader{slow},
+		OnCycle: func(err error) {
+			if err != nil {
+				atomic.AddInt32(&cycles, 1)
+			}
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if err := p.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal(err)
+	}
+
+	stats := p.Stats()
+
+	if stats[0].Cycles == 0 || stats[1].Cycles == 0 {
+		t.Fatalf("both groups should run, got %+v", stats)
+	}
+
+	// 慢组每次扫描35ms, 周期10ms, 最多约6次扫描, 其余周期被跳过而不是堆积
+	if stats[1].Cycles > 7 || stats[1].Overruns == 0 {
+		t.Errorf("want slow group coalesced, got cycles=%d overruns=%d", stats[1].Cycles, stats[1].Overruns)
+	}
+
+	if stats[1].Errors != stats[1].Cycles || uint64(atomic.LoadInt32(&cycles)) != stats[1].Cycles || stats[1].LastError == nil {
+		t.Errorf("want every slow cycle reported as error, got %+v", stats[1])
+	}
+
+	if stats[1].MaxCycle < 35*time.Millisecond {
+		t.Errorf("want max cycle >= 35ms, got %s", stats[1].MaxCycle)
+	}
+}
+
+func TestPollerAddValidation(t *testing.T) {
+	p := NewPoller()
+
+	if err := p.Add(PollGroup{Name: "zero", Devices: []Reader{&testReader{}}}); err == nil {
+		t.Error("want error for zero interval")
+	}
+
+	if err := p.Add(PollGroup{Name: "empty", Interval: time.Second}); err == nil {
+		t.Error("want error for empty group")
+	}
+}
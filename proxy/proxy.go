@@ -0,0 +1,320 @@
+// Package proxy 透明转发HMI、上位机等客户端与PLC之间的MC协议请求, 记录每个请求并按规则限制访问.
+//
+// 全部客户端共用一个PlcConn, 请求按到达顺序依次转发; 客户端与PLC的帧格式(3E/4E、二进制/ASCII码)
+// 可以不同, 响应按客户端请求的格式与4E序列号返回. 转发时使用PlcConn的访问路径与监视定时器.
+// 被规则拒绝或无法解析的请求不转发, 直接以结束代码响应.
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/server"
+)
+
+// Config 代理的配置.
+type Config struct {
+	Rules []Rule `yaml:"rules"`
+	// DenyByDefault 没有规则匹配时拒绝请求, 默认转发
+	DenyByDefault bool `yaml:"deny_by_default"`
+	// DenyEndCode 拒绝请求时响应的结束代码, 默认0xC05B(指定的软元件不能访问)
+	DenyEndCode uint16 `yaml:"deny_end_code"`
+	// Timeout 非0时设置为conn每次请求的超时时间, 为0时使用conn已有的设置
+	Timeout time.Duration `yaml:"timeout"`
+	Logger  melsec.Logger `yaml:"-"`
+}
+
+// Proxy MC协议代理.
+type Proxy struct {
+	conn   *melsec.PlcConn
+	config Config
+	rules  []*rule
+	logger melsec.Logger
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New 创建转发到conn的代理.
+func New(conn *melsec.PlcConn, c Config) (*Proxy, error) {
+	if conn == nil {
+		return nil, errors.New("proxy: nil plc connection")
+	}
+
+	rules, err := newRules(c.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.DenyEndCode == 0 {
+		c.DenyEndCode = uint16(server.EndCodeDevice)
+	}
+
+	if c.Timeout > 0 {
+		if err := conn.SetTimeout(c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Proxy{
+		conn:      conn,
+		config:    c,
+		rules:     rules,
+		logger:    c.Logger,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	if p.logger == nil {
+		p.logger = nopLogger{}
+	}
+
+	return p, nil
+}
+
+// ListenAndServe 在addr上监听并转发请求, Close之后返回nil.
+func (p *Proxy) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return p.Serve(l)
+}
+
+// Serve 在l上接受连接直到l或代理关闭, 每个连接在独立的goroutine中处理.
+func (p *Proxy) Serve(l net.Listener) error {
+	if !p.track(l, nil) {
+		_ = l.Close()
+
+		return nil
+	}
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.listeners, l)
+		p.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mu.Lock()
+			closed := p.closed
+			p.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !p.track(nil, conn) {
+			_ = conn.Close()
+
+			return nil
+		}
+
+		p.wg.Add(1)
+
+		go func() {
+			defer p.wg.Done()
+
+			err := p.serveConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				p.logger.Debug("proxy connection closed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+
+			p.mu.Lock()
+			delete(p.conns, conn)
+			p.mu.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (p *Proxy) track(l net.Listener, conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	if l != nil {
+		p.listeners[l] = struct{}{}
+	}
+
+	if conn != nil {
+		p.conns[conn] = struct{}{}
+	}
+
+	return true
+}
+
+// Close 停止监听, 关闭全部客户端连接并等待处理结束. PlcConn由调用者关闭.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+
+	for l := range p.listeners {
+		_ = l.Close()
+	}
+
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return nil
+}
+
+// serveConn 按顺序转发一个连接上的请求. 与PLC通信失败时关闭客户端连接.
+func (p *Proxy) serveConn(conn net.Conn) error {
+	var client net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = addr.IP
+	}
+
+	for {
+		req, err := server.ReadRequest(conn)
+		if err != nil {
+			return err
+		}
+
+		resp, err := p.handle(client, req)
+		if err != nil {
+			return err
+		}
+
+		if _, err := conn.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handle 检查并转发一个请求, 返回客户端格式的响应帧.
+func (p *Proxy) handle(client net.IP, req *server.Request) ([]byte, error) {
+	start := time.Now()
+	attrs := []interface{}{"client", client.String(), "request", describe(req)}
+
+	// 不能解析软元件的请求只在客户端适用按软元件限制的规则时拒绝, 否则照常检查指令并转发
+	spans, err := req.ParseSpans()
+	if err != nil && !p.scoped(client) {
+		spans, err = nil, nil
+	}
+
+	if rerr := req.Err(); rerr != nil {
+		err = rerr
+	}
+
+	var code server.EndCode
+	if errors.As(err, &code) {
+		p.logger.Warn("mc request rejected", append(attrs, "end_code", fmt.Sprintf("%04X", uint16(code)))...)
+
+		return req.Response(uint16(code), nil)
+	}
+
+	if name, ok := p.check(client, req, spans); !ok {
+		p.logger.Warn("mc request denied", append(attrs, "rule", name)...)
+
+		return req.Response(p.config.DenyEndCode, nil)
+	}
+
+	cmd := make([]byte, 4, 4+len(req.Data))
+	binary.LittleEndian.PutUint16(cmd, req.Command)
+	binary.LittleEndian.PutUint16(cmd[2:], req.SubCommand)
+	cmd = append(cmd, req.Data...)
+
+	data, err := p.conn.Forward(cmd)
+
+	var endCode uint16
+
+	var ee *melsec.EndCodeError
+	if errors.As(err, &ee) {
+		endCode, err = ee.Code, nil
+	}
+
+	if err != nil {
+		p.logger.Error("mc forward failed", append(attrs, "err", err)...)
+
+		if isNetError(err) || errors.Is(err, melsec.ErrSerialMismatch) {
+			if rerr := p.conn.Reconnect(); rerr != nil {
+				p.logger.Error("plc reconnect failed", "err", rerr)
+			}
+		}
+
+		return nil, err
+	}
+
+	p.logger.Info("mc request", append(attrs, "end_code", fmt.Sprintf("%04X", endCode), "latency", time.Since(start))...)
+
+	return req.Response(endCode, data)
+}
+
+// check 按顺序检查规则, 返回决定结果的规则名称与是否允许转发.
+// 没有匹配的规则时, 客户端适用按软元件限制的规则则拒绝不含软元件的请求, 否则按默认处理.
+func (p *Proxy) check(client net.IP, req *server.Request, spans []server.Span) (string, bool) {
+	for i, r := range p.rules {
+		if r.match(client, req, spans) {
+			return r.name(i), r.Action == Allow
+		}
+	}
+
+	if len(spans) == 0 {
+		for i, r := range p.rules {
+			if r.scoped(client) {
+				return r.name(i) + " (no devices)", false
+			}
+		}
+	}
+
+	return "default", !p.config.DenyByDefault
+}
+
+// scoped 返回客户端是否适用按软元件限制的规则.
+func (p *Proxy) scoped(client net.IP) bool {
+	for _, r := range p.rules {
+		if r.scoped(client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describe 返回请求的解码文本, 无法解码时只包含指令.
+func describe(req *server.Request) string {
+	if f, err := melsec.DecodeFrame(req.Raw); err == nil {
+		return f.String()
+	}
+
+	return fmt.Sprintf("%04X/%04X %s", req.Command, req.SubCommand, melsec.CommandName(req.Command, req.SubCommand))
+}
+
+func isNetError(err error) bool {
+	var ne net.Error
+
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
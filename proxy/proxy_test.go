@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/mock"
+	"github.com/dualm/melsec/server"
+)
+
+func newProxy(t *testing.T, c Config) (*mock.Server, string) {
+	t.Helper()
+
+	plc := mock.NewServer()
+	t.Cleanup(plc.Close)
+
+	conn, err := melsec.NewConn(plc.Host(), plc.Port(), melsec.SetFrame(melsec.Frame4E))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	p, err := New(conn, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- p.Serve(l) }()
+
+	t.Cleanup(func() {
+		_ = p.Close()
+
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+
+	return plc, l.Addr().String()
+}
+
+func dial(t *testing.T, addr string, ops ...melsec.PlcOption) *melsec.PlcConn {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(addr)
+
+	conn, err := melsec.NewConn(host, port, ops...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func endCode(err error) uint16 {
+	var ee *melsec.EndCodeError
+	if errors.As(err, &ee) {
+		return ee.Code
+	}
+
+	return 0
+}
+
+func TestProxy(t *testing.T) {
+	logs := bytes.Buffer{}
+
+	plc, addr := newProxy(t, Config{
+		Rules: []Rule{
+			{Name: "recipe", Action: Allow, Clients: []string{"127.0.0.1"}, Commands: []string{"write"}, Devices: []string{"D5000-D5999"}},
+			{Name: "read only", Action: Deny, Clients: []string{"127.0.0.0/8"}, Commands: []string{"write"}},
+			{Name: "no stop", Action: Deny, Commands: []string{"remote_stop"}},
+			{Name: "run", Action: Allow, Commands: []string{"remote_run"}},
+		},
+		Logger: melsec.NewStdLogger(log.New(&logs, "", 0), melsec.LevelInfo),
+	})
+
+	_ = plc.Memory.SetWords("D100", 1, 2, 3)
+
+	for _, ops := range [][]melsec.PlcOption{
+		nil,
+		{melsec.SetFrame(melsec.Frame4E), melsec.SetASCII(true)},
+	} {
+		conn := dial(t, addr, ops...)
+
+		dev, _ := melsec.NewDevice("D100", 3, conn)
+		if err := dev.Read(); err != nil || !bytes.Equal(dev.GetValue(), []byte{1, 0, 2, 0, 3, 0}) {
+			t.Errorf("unexpected D100 % x %v", dev.GetValue(), err)
+		}
+
+		dev, _ = melsec.NewDevice("D5998", 2, conn)
+		dev.SetValue([]byte{0x34, 0x12, 0x78, 0x56})
+
+		if err := dev.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		if words, _ := plc.Memory.Words("D5998", 2); words[0] != 0x1234 || words[1] != 0x5678 {
+			t.Errorf("unexpected D5998 %v", words)
+		}
+
+		// 超出允许范围的写入不转发
+		dev, _ = melsec.NewDevice("D5999", 2, conn)
+		dev.SetValue([]byte{1, 0, 1, 0})
+
+		if err := dev.Write(); endCode(err) != 0xC05B {
+			t.Errorf("want end code C05B, got %v", err)
+		}
+
+		if err := conn.WriteBits([]string{"M0"}, []bool{true}); endCode(err) != 0xC05B {
+			t.Errorf("want end code C05B, got %v", err)
+		}
+
+		// PLC的结束代码原样返回: 批量读取D0起0字
+		if _, err := conn.Forward([]byte{0x01, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xA8, 0x00, 0x00}); endCode(err) != 0xC051 {
+			t.Errorf("want end code C051, got %v", err)
+		}
+	}
+
+	if words, _ := plc.Memory.Words("D6000", 1); words[0] != 0 {
+		t.Errorf("denied write reached plc: %v", words)
+	}
+
+	conn := dial(t, addr)
+
+	if _, err := conn.Forward([]byte{0x02, 0x10, 0x00, 0x00, 0x01, 0x00}); endCode(err) != 0xC05B || !plc.Running() {
+		t.Errorf("remote stop: want end code C05B, got %v", err)
+	}
+
+	if _, err := conn.Forward([]byte{0x01, 0x10, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}); err != nil {
+		t.Errorf("remote run: %v", err)
+	}
+
+	// 客户端适用按软元件限制的规则时, 不能解析软元件的指令不转发
+	if _, err := conn.Forward([]byte{0x13, 0x16, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}); endCode(err) != 0xC05B {
+		t.Errorf("unknown command: want end code C05B, got %v", err)
+	}
+
+	// iQ-R子指令写入D6000按软元件检查
+	if _, err := conn.Forward([]byte{0x01, 0x14, 0x02, 0x00, 0x70, 0x17, 0x00, 0x00, 0xA8, 0x00, 0x01, 0x00, 0x01, 0x00}); endCode(err) != 0xC05B {
+		t.Errorf("iQ-R write: want end code C05B, got %v", err)
+	}
+
+	// 适用按软元件限制的规则时, 不支持的子指令与多余的数据不转发
+	if _, err := conn.Forward([]byte{0x01, 0x14, 0x80, 0x00, 0x70, 0x17, 0x00, 0xA8, 0x01, 0x00, 0x01, 0x00}); endCode(err) != 0xC059 {
+		t.Errorf("extended subcommand: want end code C059, got %v", err)
+	}
+
+	if _, err := conn.Forward([]byte{0x01, 0x14, 0x00, 0x00, 0x88, 0x13, 0x00, 0xA8, 0x01, 0x00, 0x01, 0x00, 0x02, 0x00}); endCode(err) != 0xC061 {
+		t.Errorf("trailing data: want end code C061, got %v", err)
+	}
+
+	// 多个客户端共用一个PLC连接
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 4; i++ {
+		conn := dial(t, addr, melsec.SetFrame(melsec.Frame4E))
+		address := fmt.Sprintf("D%d", 5000+i)
+
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for n := 0; n < 20; n++ {
+				dev, _ := melsec.NewDevice(address, 1, conn)
+				dev.SetValue([]byte{byte(n), byte(i)})
+
+				if err := dev.Write(); err != nil {
+					t.Error(err)
+
+					return
+				}
+
+				if err := dev.Read(); err != nil || !bytes.Equal(dev.GetValue(), []byte{byte(n), byte(i)}) {
+					t.Errorf("%s: unexpected value % x %v", address, dev.GetValue(), err)
+
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, want := range []string{
+		"INFO mc request client=127.0.0.1 request=3E binary request",
+		"WARN mc request denied client=127.0.0.1 request=4E ASCII request",
+		"rule=read only",
+		"rule=no stop",
+		"rule=recipe (no devices)",
+		"end_code=C051",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log missing %q:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestDenyByDefault(t *testing.T) {
+	plc, addr := newProxy(t, Config{
+		Rules:         []Rule{{Action: Allow, Commands: []string{"read", "cpu_model"}}},
+		DenyByDefault: true,
+		DenyEndCode:   0xC201,
+	})
+
+	conn := dial(t, addr)
+
+	if _, err := conn.GetCPUInfo(); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := conn.Loopback([]byte("AB")); endCode(err) != 0xC201 {
+		t.Errorf("want end code C201, got %v", err)
+	}
+
+	if plc.Requests() != 1 {
+		t.Errorf("want 1 request forwarded, got %d", plc.Requests())
+	}
+}
+
+func TestTransparent(t *testing.T) {
+	plc, addr := newProxy(t, Config{})
+
+	conn := dial(t, addr)
+
+	// 没有规则时, 不能解析软元件的请求也转发给PLC, 由PLC返回结束代码
+	if _, err := conn.Forward([]byte{0x01, 0x04, 0x80, 0x00, 0x64, 0x00, 0x00, 0xA8, 0x00, 0x00, 0x01, 0x00}); endCode(err) != 0xC059 {
+		t.Errorf("extended subcommand: want end code C059, got %v", err)
+	}
+
+	if plc.Requests() != 1 {
+		t.Errorf("want 1 request forwarded, got %d", plc.Requests())
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rules, err := newRules([]Rule{
+		{Action: Allow, Devices: []string{"D100-D199", "m"}},
+		{Action: Deny, Clients: []string{"10.0.0.0/24"}, Devices: []string{"D100-D199"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, _ := melsec.LookupDevice("D")
+	m, _ := melsec.LookupDevice("M")
+	read := &server.Request{Command: server.CommandBlockRead}
+
+	tests := []struct {
+		spans []server.Span
+		allow bool
+		deny  bool
+	}{
+		{[]server.Span{{Device: d, No: 100, Points: 100}}, true, true},
+		{[]server.Span{{Device: d, No: 100, Points: 101}}, false, true},
+		{[]server.Span{{Device: d, No: 90, Points: 11}}, false, true},
+		{[]server.Span{{Device: d, No: 90, Points: 10}}, false, false},
+		{[]server.Span{{Device: d, No: 150, Points: 1}, {Device: m, No: 8000, Points: 16}}, true, true},
+		{nil, false, false},
+	}
+
+	for i, tt := range tests {
+		if got := rules[0].match(net.ParseIP("10.0.0.1"), read, tt.spans); got != tt.allow {
+			t.Errorf("%d: allow rule matched %v", i, got)
+		}
+
+		if got := rules[1].match(net.ParseIP("10.0.0.1"), read, tt.spans); got != tt.deny {
+			t.Errorf("%d: deny rule matched %v", i, got)
+		}
+	}
+
+	if rules[1].match(net.ParseIP("10.0.1.1"), read, tests[0].spans) {
+		t.Error("deny rule matched other client")
+	}
+
+	if !rules[1].scoped(net.ParseIP("10.0.0.1")) || rules[1].scoped(net.ParseIP("10.0.1.1")) {
+		t.Error("unexpected device scope")
+	}
+
+	for _, r := range []Rule{
+		{Action: "block"},
+		{Action: Deny, Clients: []string{"10.0.0"}},
+		{Action: Deny, Commands: []string{"format"}},
+		{Action: Deny, Devices: []string{"D10-M20"}},
+		{Action: Deny, Devices: []string{"D20-D10"}},
+		{Action: Deny, Devices: []string{"Q1"}},
+	} {
+		if _, err := newRules([]Rule{r}); err == nil {
+			t.Errorf("want error for %+v", r)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/dualm/melsec"
+	"github.com/dualm/melsec/server"
+)
+
+// Action 规则匹配时的处理.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Rule 访问规则, 按顺序检查, 第一个匹配的规则决定请求是否转发.
+//
+// Clients为客户端IP或CIDR, Commands为指令名称或4位十六进制的指令代码, Devices为软元件范围,
+// 如"D5000-D5999"、"D100"或"M"(全部M). 字段为空时匹配全部.
+// Allow规则要求请求访问的软元件全部在Devices内; Deny规则只要有一个软元件与Devices重叠即匹配.
+// 不访问软元件的请求(如远程操作)及代理不能解析软元件的指令不匹配设置了Devices的规则;
+// 客户端适用设置了Devices的规则时, 这些请求只有被未设置Devices的Allow规则匹配才转发, 不使用默认处理.
+// 软元件格式无法解析的请求(如扩展指定的子指令)在客户端适用设置了Devices的规则时直接拒绝, 否则只按指令检查.
+//
+// 指令名称:
+//
+//	read                 批量、随机、多块读取
+//	write                批量、随机、多块写入
+//	remote               全部远程操作
+//	remote_run, remote_stop, remote_pause, remote_latch_clear, remote_reset
+//	cpu_model, loopback
+type Rule struct {
+	Name     string   `yaml:"name"`
+	Action   Action   `yaml:"action"`
+	Clients  []string `yaml:"clients"`
+	Commands []string `yaml:"commands"`
+	Devices  []string `yaml:"devices"`
+}
+
+var commandNames = map[string][]uint16{
+	"read":               {server.CommandBatchRead, server.CommandRandomRead, server.CommandBlockRead},
+	"write":              {server.CommandBatchWrite, server.CommandRandomWrite, server.CommandBlockWrite},
+	"remote":             {server.CommandRemoteRun, server.CommandRemoteStop, server.CommandRemotePause, server.CommandRemoteLatchClear, server.CommandRemoteReset},
+	"remote_run":         {server.CommandRemoteRun},
+	"remote_stop":        {server.CommandRemoteStop},
+	"remote_pause":       {server.CommandRemotePause},
+	"remote_latch_clear": {server.CommandRemoteLatchClear},
+	"remote_reset":       {server.CommandRemoteReset},
+	"cpu_model":          {server.CommandCPUModel},
+	"loopback":           {server.CommandLoopback},
+}
+
+// deviceRange 一种软元件编号从lo至hi(含)的范围.
+type deviceRange struct {
+	code   byte
+	lo, hi uint32
+}
+
+// rule 已检查的规则.
+type rule struct {
+	Rule
+	nets     []*net.IPNet
+	commands map[uint16]bool
+	ranges   []deviceRange
+}
+
+// name 返回规则名称, 未命名时为序号.
+func (r *rule) name(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+
+	return "#" + strconv.Itoa(i+1)
+}
+
+func newRules(list []Rule) ([]*rule, error) {
+	rules := make([]*rule, 0, len(list))
+
+	for i, r := range list {
+		re := &rule{Rule: r}
+
+		switch r.Action {
+		case Allow, Deny:
+		default:
+			return nil, fmt.Errorf("proxy: rule %s: unknown action %q", re.name(i), r.Action)
+		}
+
+		for _, c := range r.Clients {
+			n, err := parseClient(c)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: rule %s: %w", re.name(i), err)
+			}
+
+			re.nets = append(re.nets, n)
+		}
+
+		if len(r.Commands) != 0 {
+			re.commands = make(map[uint16]bool)
+		}
+
+		for _, c := range r.Commands {
+			codes, err := parseCommand(c)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: rule %s: %w", re.name(i), err)
+			}
+
+			for _, code := range codes {
+				re.commands[code] = true
+			}
+		}
+
+		for _, d := range r.Devices {
+			dr, err := parseRange(d)
+			if err != nil {
+				return nil, fmt.Errorf("proxy: rule %s: %w", re.name(i), err)
+			}
+
+			re.ranges = append(re.ranges, dr)
+		}
+
+		rules = append(rules, re)
+	}
+
+	return rules, nil
+}
+
+// parseClient 解析IP或CIDR, 单个IP视为只包含该地址的网络.
+func parseClient(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %q", s)
+	}
+
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func parseCommand(s string) ([]uint16, error) {
+	if codes, ok := commandNames[strings.ToLower(s)]; ok {
+		return codes, nil
+	}
+
+	if len(s) == 4 {
+		if v, err := strconv.ParseUint(s, 16, 16); err == nil {
+			return []uint16{uint16(v)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown command %q", s)
+}
+
+// parseRange 解析"D5000-D5999"、"D100"或"D".
+func parseRange(s string) (deviceRange, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+
+	if info, ok := melsec.LookupDevice(s); ok {
+		return deviceRange{code: info.Code, lo: 0, hi: 1<<24 - 1}, nil
+	}
+
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	info, lo, err := melsec.ParseAddress(from)
+	if err != nil {
+		return deviceRange{}, fmt.Errorf("device range %q: %w", s, err)
+	}
+
+	end, hi, err := melsec.ParseAddress(to)
+	if err != nil {
+		return deviceRange{}, fmt.Errorf("device range %q: %w", s, err)
+	}
+
+	if end.Code != info.Code || hi < lo {
+		return deviceRange{}, fmt.Errorf("invalid device range %q", s)
+	}
+
+	return deviceRange{code: info.Code, lo: uint32(lo), hi: uint32(hi)}, nil
+}
+
+// contains 判断s是否在范围内.
+func (d deviceRange) contains(s server.Span) bool {
+	return s.Device.Code == d.code && s.No >= d.lo && uint64(s.No)+uint64(s.Points)-1 <= uint64(d.hi)
+}
+
+// overlaps 判断s与范围是否重叠.
+func (d deviceRange) overlaps(s server.Span) bool {
+	return s.Device.Code == d.code && s.No <= d.hi && uint64(s.No)+uint64(s.Points)-1 >= uint64(d.lo)
+}
+
+// client 判断规则是否适用于client.
+func (r *rule) client(client net.IP) bool {
+	if len(r.nets) == 0 {
+		return true
+	}
+
+	for _, n := range r.nets {
+		if client != nil && n.Contains(client) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scoped 判断规则是否按软元件限制client的访问.
+func (r *rule) scoped(client net.IP) bool {
+	return len(r.ranges) != 0 && r.client(client)
+}
+
+// match 判断规则是否适用于client的请求, spans为请求访问的软元件.
+func (r *rule) match(client net.IP, req *server.Request, spans []server.Span) bool {
+	if !r.client(client) {
+		return false
+	}
+
+	if r.commands != nil && !r.commands[req.Command] {
+		return false
+	}
+
+	if len(r.ranges) == 0 {
+		return true
+	}
+
+	if len(spans) == 0 {
+		return false
+	}
+
+	if r.Action == Deny {
+		for _, s := range spans {
+			for _, d := range r.ranges {
+				if d.overlaps(s) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	for _, s := range spans {
+		inside := false
+
+		for _, d := range r.ranges {
+			if d.contains(s) {
+				inside = true
+
+				break
+			}
+		}
+
+		if !inside {
+			return false
+		}
+	}
+
+	return true
+}
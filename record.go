@@ -0,0 +1,156 @@
+package melsec
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FrameRecord 一次请求/响应的记录. 请求失败时Error不为空, Response为已收到的部分.
+type FrameRecord struct {
+	Time     time.Time     `json:"time"`
+	Latency  time.Duration `json:"latency"`
+	Request  HexBytes      `json:"request"`
+	Response HexBytes      `json:"response"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// HexBytes 以十六进制字符串序列化的字节.
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	v, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	*b = v
+
+	return nil
+}
+
+// Recorder 将PlcConn收发的每一帧以JSON行的形式写入w.
+type Recorder struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// CreateRecording 创建记录文件.
+func CreateRecording(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewRecorder(f)
+	r.closer = f
+
+	return r, nil
+}
+
+// Err 返回第一次写入失败的错误. 写入失败不影响PLC通信.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Close 关闭由CreateRecording创建的文件.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closer == nil {
+		return nil
+	}
+
+	return r.closer.Close()
+}
+
+// Write 写入一条记录.
+func (r *Recorder) Write(rec FrameRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.enc.Encode(rec)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+
+	return err
+}
+
+func (r *Recorder) record(start time.Time, req, resp []byte, err error) {
+	rec := FrameRecord{
+		Time:     start,
+		Latency:  time.Since(start),
+		Request:  append(HexBytes{}, req...),
+		Response: append(HexBytes{}, resp...),
+	}
+
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	_ = r.Write(rec)
+}
+
+// Record 开始将收发的每一帧记录到r, r为nil时停止记录.
+func (plc *PlcConn) Record(r *Recorder) {
+	plc.mu.Lock()
+	plc.recorder = r
+	plc.mu.Unlock()
+}
+
+// ReadRecording 读取Recorder写入的全部记录.
+func ReadRecording(r io.Reader) ([]FrameRecord, error) {
+	re := make([]FrameRecord, 0)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec FrameRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("recording line %d: %w", line, err)
+		}
+
+		re = append(re, rec)
+	}
+
+	return re, scanner.Err()
+}
+
+// LoadRecording 读取记录文件.
+func LoadRecording(path string) ([]FrameRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ReadRecording(f)
+}
@@ -0,0 +1,444 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/dualm/melsec"
+)
+
+// 指令
+const (
+	CommandBatchRead        uint16 = 0x0401
+	CommandBatchWrite       uint16 = 0x1401
+	CommandRandomRead       uint16 = 0x0403
+	CommandRandomWrite      uint16 = 0x1402
+	CommandBlockRead        uint16 = 0x0406
+	CommandBlockWrite       uint16 = 0x1406
+	CommandCPUModel         uint16 = 0x0101
+	CommandLoopback         uint16 = 0x0619
+	CommandRemoteRun        uint16 = 0x1001
+	CommandRemoteStop       uint16 = 0x1002
+	CommandRemotePause      uint16 = 0x1003
+	CommandRemoteLatchClear uint16 = 0x1005
+	CommandRemoteReset      uint16 = 0x1006
+
+	SubCommandWord uint16 = 0x0000
+	SubCommandBit  uint16 = 0x0001
+	// iQ-R系列的子指令, 软元件编号为4字节, 代码为2字节
+	SubCommandWordIQR uint16 = 0x0002
+	SubCommandBitIQR  uint16 = 0x0003
+)
+
+// ErrSubheader 帧不以3E/4E请求的副帧头开始.
+var ErrSubheader = errors.New("unknown subheader")
+
+// Request 一个已解析的请求帧. ASCII码请求的Data已转换为二进制格式.
+type Request struct {
+	Frame    melsec.Frame
+	ASCII    bool
+	Serial   uint16
+	Network  uint8
+	PC       uint8
+	ModuleIO uint16
+	Station  uint8
+
+	Timer      uint16
+	Command    uint16
+	SubCommand uint16
+	// Data 子指令之后的请求数据
+	Data []byte
+	// Raw 收到的完整请求帧
+	Raw []byte
+
+	binary  []byte  // 二进制格式的完整请求帧
+	invalid EndCode // 请求数据不足或无法转换时的结束代码
+}
+
+// ReadRequest 从r读取一个3E/4E二进制或ASCII码请求帧. 只有读取失败或副帧头错误时返回错误;
+// 数据不完整的请求仍然返回, Server.Handle以结束代码响应.
+func ReadRequest(r io.Reader) (*Request, error) {
+	sub := make([]byte, 2)
+	if _, err := io.ReadFull(r, sub); err != nil {
+		return nil, err
+	}
+
+	req := &Request{}
+
+	switch {
+	case sub[0] == 0x50 && sub[1] == 0x00:
+	case sub[0] == 0x54 && sub[1] == 0x00:
+		req.Frame = melsec.Frame4E
+	case string(sub) == "50" || string(sub) == "54":
+		req.ASCII = true
+
+		if sub[1] == '4' {
+			req.Frame = melsec.Frame4E
+		}
+	default:
+		return nil, fmt.Errorf("%w % x", ErrSubheader, sub)
+	}
+
+	// 副帧头之后至请求数据长度为止的字段
+	width := 7
+	if req.Frame == melsec.Frame4E {
+		width += 4
+	}
+
+	if req.ASCII {
+		width = width*2 + 2
+	}
+
+	header := make([]byte, width)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if req.ASCII && string(header[:2]) != "00" {
+		return nil, fmt.Errorf("%w %q", ErrSubheader, string(sub)+string(header[:2]))
+	}
+
+	// 4E帧: 序列号, 预留, 网络号, PLC号, 模块IO编号, 模块站号, 请求数据长度
+	fields := []int{2, 2, 1, 1, 2, 1, 2}
+	if req.Frame == melsec.Frame3E {
+		fields = fields[2:]
+	}
+
+	values, err := parseFields(header, fields, req.ASCII)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Frame == melsec.Frame4E {
+		req.Serial = uint16(values[0])
+		values = values[2:]
+	}
+
+	req.Network, req.PC, req.ModuleIO, req.Station = uint8(values[0]), uint8(values[1]), uint16(values[2]), uint8(values[3])
+
+	data := make([]byte, values[4])
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	req.Raw = append(append(sub, header...), data...)
+	req.binary = req.Raw
+
+	if req.ASCII {
+		if req.binary, err = melsec.TranscodeRequest(req.Raw, false); err != nil {
+			req.invalid = EndCodeRequestLength
+
+			return req, nil
+		}
+
+		// 二进制帧的头部为副帧头(2字节)、4E的序列号与预留(4字节)及其后的7字节
+		data = req.binary[len(sub)+width/2-1:]
+	}
+
+	// 监视定时器(2字节) + 指令(2字节) + 子指令(2字节)
+	if len(data) < 6 {
+		req.invalid = EndCodeRequestLength
+
+		return req, nil
+	}
+
+	req.Timer = binary.LittleEndian.Uint16(data)
+	req.Command = binary.LittleEndian.Uint16(data[2:])
+	req.SubCommand = binary.LittleEndian.Uint16(data[4:])
+	req.Data = data[6:]
+
+	return req, nil
+}
+
+// Err 返回请求数据不足或无法转换时应响应的结束代码, 请求完整时返回nil.
+func (req *Request) Err() error {
+	if req.invalid != EndCodeOK {
+		return req.invalid
+	}
+
+	return nil
+}
+
+// parseFields 解析帧头部的数值字段, widths为各字段的字节数. ASCII码的数值为大端十六进制字符.
+func parseFields(b []byte, widths []int, ascii bool) ([]int, error) {
+	values := make([]int, 0, len(widths))
+
+	if ascii {
+		// 副帧头的后2字符已经检查
+		b = b[2:]
+	}
+
+	for _, n := range widths {
+		if !ascii {
+			v := 0
+			for i := n - 1; i >= 0; i-- {
+				v = v<<8 | int(b[i])
+			}
+
+			values = append(values, v)
+			b = b[n:]
+
+			continue
+		}
+
+		v, err := strconv.ParseUint(string(b[:n*2]), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ascii header field %q", b[:n*2])
+		}
+
+		values = append(values, int(v))
+		b = b[n*2:]
+	}
+
+	return values, nil
+}
+
+// Response 生成请求的响应帧, 格式与请求相同. data为二进制格式的响应数据, 结束代码不为0时被忽略.
+func (req *Request) Response(code uint16, data []byte) ([]byte, error) {
+	if code != 0 {
+		// 错误信息: 访问路径 + 指令 + 子指令
+		data = []byte{
+			req.Network, req.PC, byte(req.ModuleIO), byte(req.ModuleIO >> 8), req.Station,
+			byte(req.Command), byte(req.Command >> 8), byte(req.SubCommand), byte(req.SubCommand >> 8),
+		}
+	}
+
+	b := make([]byte, 0, 15+len(data))
+
+	if req.Frame == melsec.Frame4E {
+		b = append(b, 0xD4, 0x00, byte(req.Serial), byte(req.Serial>>8), 0x00, 0x00)
+	} else {
+		b = append(b, 0xD0, 0x00)
+	}
+
+	b = append(b, req.Network, req.PC, byte(req.ModuleIO), byte(req.ModuleIO>>8), req.Station)
+	b = append(b, byte(len(data)+2), byte((len(data)+2)>>8), byte(code), byte(code>>8))
+	b = append(b, data...)
+
+	if !req.ASCII {
+		return b, nil
+	}
+
+	return melsec.TranscodeResponse(b, req.binary, true)
+}
+
+// Span 请求访问的一段软元件, 位软元件以点计.
+type Span struct {
+	Device melsec.DeviceInfo
+	No     uint32
+	Points int
+}
+
+// Spans 返回请求访问的全部软元件, 请求格式错误时返回已解析的部分.
+// 字单位访问位软元件时每字为16点. 不访问软元件的指令返回空.
+func (req *Request) Spans() []Span {
+	re, _ := req.ParseSpans()
+
+	return re
+}
+
+// ParseSpans 同Spans, 请求数据与指令的格式不一致、软元件代码未知或子指令不支持时同时返回对应的EndCode.
+// 支持Q/L系列(0000/0001)与iQ-R系列(0002/0003, 仅二进制码)的子指令.
+func (req *Request) ParseSpans() ([]Span, error) {
+	r := &reader{b: req.Data}
+	re := make([]Span, 0)
+
+	switch req.Command {
+	case CommandBatchRead, CommandBatchWrite, CommandRandomRead, CommandRandomWrite, CommandBlockRead, CommandBlockWrite:
+	default:
+		return re, nil
+	}
+
+	var bit bool
+
+	switch req.SubCommand {
+	case SubCommandWord:
+	case SubCommandBit:
+		bit = true
+	case SubCommandWordIQR:
+		r.wide = true
+	case SubCommandBitIQR:
+		r.wide, bit = true, true
+	default:
+		return re, EndCodeUnsupported
+	}
+
+	// ASCII码的iQ-R软元件格式不能转换
+	if r.wide && req.ASCII {
+		return re, EndCodeUnsupported
+	}
+
+	add := func(dev melsec.DeviceInfo, no uint32, words int) {
+		if r.err != nil {
+			return
+		}
+
+		points := words
+		if dev.Bit {
+			points *= 16
+		}
+
+		re = append(re, Span{Device: dev, No: no, Points: points})
+	}
+
+	switch req.Command {
+	case CommandBatchRead, CommandBatchWrite:
+		dev, no := r.device()
+		count := r.uint16()
+
+		if !bit {
+			if req.Command == CommandBatchWrite {
+				r.next(count * 2)
+			}
+
+			add(dev, no, count)
+
+			break
+		}
+
+		// 每字节2点
+		if req.Command == CommandBatchWrite {
+			r.next((count + 1) / 2)
+		}
+
+		if r.err == nil {
+			re = append(re, Span{Device: dev, No: no, Points: count})
+		}
+	case CommandRandomRead:
+		if bit {
+			return re, EndCodeUnsupported
+		}
+
+		words, dwords := r.uint8(), r.uint8()
+
+		for i := 0; i < words+dwords; i++ {
+			n := 1
+			if i >= words {
+				n = 2
+			}
+
+			dev, no := r.device()
+			add(dev, no, n)
+		}
+	case CommandRandomWrite:
+		if bit {
+			// 置位/复位: 0001为1字节, 0003为2字节
+			width := 1
+			if r.wide {
+				width = 2
+			}
+
+			for i, n := 0, r.uint8(); i < n; i++ {
+				dev, no := r.device()
+				r.next(width)
+
+				if r.err == nil {
+					re = append(re, Span{Device: dev, No: no, Points: 1})
+				}
+			}
+
+			break
+		}
+
+		words, dwords := r.uint8(), r.uint8()
+
+		for i := 0; i < words+dwords; i++ {
+			n := 1
+			if i >= words {
+				n = 2
+			}
+
+			dev, no := r.device()
+			r.next(n * 2)
+			add(dev, no, n)
+		}
+	case CommandBlockRead, CommandBlockWrite:
+		if bit {
+			return re, EndCodeUnsupported
+		}
+
+		blocks := r.uint8() + r.uint8()
+
+		for i := 0; i < blocks; i++ {
+			dev, no := r.device()
+			count := r.uint16()
+
+			if req.Command == CommandBlockWrite {
+				r.next(count * 2)
+			}
+
+			add(dev, no, count)
+		}
+	}
+
+	return re, r.done()
+}
+
+// reader 按顺序读取请求数据, 数据不足时返回EndCodeRequestLength.
+type reader struct {
+	b    []byte
+	err  error
+	wide bool // iQ-R格式的软元件
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+
+	if len(r.b) < n {
+		r.err = EndCodeRequestLength
+
+		return make([]byte, n)
+	}
+
+	b := r.b[:n]
+	r.b = r.b[n:]
+
+	return b
+}
+
+func (r *reader) uint8() int {
+	return int(r.next(1)[0])
+}
+
+func (r *reader) uint16() int {
+	return int(binary.LittleEndian.Uint16(r.next(2)))
+}
+
+// device 读取软元件编号(3字节)与代码(1字节), iQ-R格式为编号(4字节)与代码(2字节).
+func (r *reader) device() (melsec.DeviceInfo, uint32) {
+	if r.wide {
+		b := r.next(6)
+		no := binary.LittleEndian.Uint32(b)
+
+		dev, ok := melsec.LookupDeviceCode(b[4])
+		if (!ok || b[5] != 0) && r.err == nil {
+			r.err = EndCodeDevice
+		}
+
+		return dev, no
+	}
+
+	b := r.next(4)
+	no := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+
+	dev, ok := melsec.LookupDeviceCode(b[3])
+	if !ok && r.err == nil {
+		r.err = EndCodeDevice
+	}
+
+	return dev, no
+}
+
+// done 检查请求数据是否恰好读完.
+func (r *reader) done() error {
+	if r.err == nil && len(r.b) != 0 {
+		return EndCodeRequestLength
+	}
+
+	return r.err
+}
@@ -0,0 +1,641 @@
+// Package server 以MC协议服务器的形式运行, Go程序可以作为PLC被GOT、其他PLC的SLMP客户端指令
+// 或视觉系统等访问.
+//
+// 服务器接受3E/4E二进制及ASCII码请求, 批量、随机、多块读写由用户提供的DeviceMemory处理,
+// 另外响应CPU型号读取与折返测试, 远程RUN/STOP等由Control处理.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/dualm/melsec"
+)
+
+// EndCode 结束代码, 作为错误返回时以该代码响应.
+type EndCode uint16
+
+const (
+	EndCodeOK            EndCode = 0x0000
+	EndCodeCountRange    EndCode = 0xC051 // 读写点数超出范围
+	EndCodeDeviceRange   EndCode = 0xC056 // 软元件编号超出范围
+	EndCodeUnsupported   EndCode = 0xC059 // 指令或子指令不支持
+	EndCodeDevice        EndCode = 0xC05B // 指定的软元件不能访问
+	EndCodeRequestLength EndCode = 0xC061 // 请求数据长度与点数不一致
+)
+
+func (e EndCode) Error() string {
+	return fmt.Sprintf("end code 0x%04x", uint16(e))
+}
+
+const (
+	maxBitPoints = 7168
+	maxDeviceNo  = 1 << 24
+)
+
+// DeviceMemory 服务器读写的软元件存储, 会被多个连接同时调用.
+// 位软元件以字为单位访问时每字16点, 低位为编号较小的点.
+// 返回EndCode时以该结束代码响应, 其他错误以EndCodeDevice响应.
+type DeviceMemory interface {
+	ReadWords(dev melsec.DeviceInfo, no uint32, count int) ([]uint16, error)
+	WriteWords(dev melsec.DeviceInfo, no uint32, values []uint16) error
+	ReadBits(dev melsec.DeviceInfo, no uint32, count int) ([]bool, error)
+	WriteBits(dev melsec.DeviceInfo, no uint32, values []bool) error
+}
+
+// Server MC协议服务器. 字段应在Serve之前设置.
+type Server struct {
+	Memory DeviceMemory
+	// CPUModel CPU型号读取(0101)响应的型号与代码
+	CPUModel string
+	CPUCode  uint16
+	// Control 处理远程RUN/STOP/PAUSE/LATCH CLEAR/RESET, 为nil时以EndCodeUnsupported响应
+	Control func(req *Request) error
+	Logger  melsec.Logger
+
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewServer 创建读写mem的服务器.
+func NewServer(mem DeviceMemory) *Server {
+	return &Server{
+		Memory:   mem,
+		CPUModel: "Q03UDVCPU",
+		CPUCode:  0x0366,
+	}
+}
+
+func (s *Server) logger() melsec.Logger {
+	if s.Logger == nil {
+		return nopLogger{}
+	}
+
+	return s.Logger
+}
+
+// ListenAndServe 在addr上监听并处理请求, Close之后返回nil.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve 在l上接受连接直到l或服务器关闭, 每个连接在独立的goroutine中处理.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l, nil) {
+		_ = l.Close()
+
+		return nil
+	}
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		if !s.track(nil, conn) {
+			_ = conn.Close()
+
+			return nil
+		}
+
+		s.wg.Add(1)
+
+		go func() {
+			defer s.wg.Done()
+
+			err := s.ServeConn(conn)
+			if err != nil && !errors.Is(err, io.EOF) {
+				s.logger().Debug("mc connection closed", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+}
+
+func (s *Server) track(l net.Listener, conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+
+	if l != nil {
+		s.listeners[l] = struct{}{}
+	}
+
+	if conn != nil {
+		s.conns[conn] = struct{}{}
+	}
+
+	return true
+}
+
+// Close 停止监听, 关闭全部连接并等待处理结束.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return nil
+}
+
+// ServeConn 按顺序处理rw上的请求, 直到读写失败.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	for {
+		req, err := ReadRequest(rw)
+		if err != nil {
+			return err
+		}
+
+		resp, err := s.Respond(req)
+		if err != nil {
+			return err
+		}
+
+		if _, err := rw.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// Respond 处理请求并生成响应帧.
+func (s *Server) Respond(req *Request) ([]byte, error) {
+	data, err := s.Handle(req)
+
+	code := uint16(EndCodeOK)
+	if err != nil {
+		code = uint16(endCode(err))
+
+		log := s.logger().Debug
+
+		var e EndCode
+		if !errors.As(err, &e) {
+			// DeviceMemory的内部错误
+			log = s.logger().Warn
+		}
+
+		log("mc request failed", "command", fmt.Sprintf("%04X/%04X", req.Command, req.SubCommand),
+			"end_code", fmt.Sprintf("%04X", code), "err", err)
+	}
+
+	return req.Response(code, data)
+}
+
+// endCode 返回错误对应的结束代码.
+func endCode(err error) EndCode {
+	var e EndCode
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return EndCodeDevice
+}
+
+func checkRange(no uint32, points int) error {
+	if uint64(no)+uint64(points) > maxDeviceNo {
+		return EndCodeDeviceRange
+	}
+
+	return nil
+}
+
+func putWords(b []byte, values []uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v), byte(v>>8))
+	}
+
+	return b
+}
+
+func getWords(b []byte) []uint16 {
+	re := make([]uint16, len(b)/2)
+	for i := range re {
+		re[i] = uint16(b[i*2]) | uint16(b[i*2+1])<<8
+	}
+
+	return re
+}
+
+// Handle 处理一个请求, 返回二进制格式的响应数据. 错误为EndCode时以该结束代码响应.
+func (s *Server) Handle(req *Request) ([]byte, error) {
+	if err := req.Err(); err != nil {
+		return nil, err
+	}
+
+	r := &reader{b: req.Data}
+
+	switch req.Command {
+	case CommandBatchRead, CommandBatchWrite:
+		return s.batch(req, r)
+	case CommandRandomRead:
+		return s.randomRead(req, r)
+	case CommandRandomWrite:
+		return s.randomWrite(req, r)
+	case CommandBlockRead, CommandBlockWrite:
+		return s.block(req, r)
+	case CommandCPUModel:
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		model := make([]byte, 16)
+		for i := range model {
+			model[i] = ' '
+		}
+
+		copy(model, s.CPUModel)
+
+		return append(model, byte(s.CPUCode), byte(s.CPUCode>>8)), nil
+	case CommandLoopback:
+		n := r.uint16()
+		data := r.next(n)
+
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		if n == 0 || n > 960 {
+			return nil, EndCodeCountRange
+		}
+
+		return append([]byte{byte(n), byte(n >> 8)}, data...), nil
+	case CommandRemoteRun, CommandRemoteStop, CommandRemotePause, CommandRemoteLatchClear, CommandRemoteReset:
+		if s.Control == nil {
+			return nil, EndCodeUnsupported
+		}
+
+		return nil, s.Control(req)
+	}
+
+	return nil, EndCodeUnsupported
+}
+
+func (s *Server) batch(req *Request, r *reader) ([]byte, error) {
+	dev, no := r.device()
+	count := r.uint16()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	write := req.Command == CommandBatchWrite
+
+	switch req.SubCommand {
+	case SubCommandWord:
+		if count == 0 || count > melsec.MaxBatchPoints {
+			return nil, EndCodeCountRange
+		}
+
+		points := count
+		if dev.Bit {
+			points *= 16
+		}
+
+		if err := checkRange(no, points); err != nil {
+			return nil, err
+		}
+
+		if !write {
+			if err := r.done(); err != nil {
+				return nil, err
+			}
+
+			words, err := s.Memory.ReadWords(dev, no, count)
+			if err != nil {
+				return nil, err
+			}
+
+			return putWords(nil, words), nil
+		}
+
+		data := r.next(count * 2)
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		return nil, s.Memory.WriteWords(dev, no, getWords(data))
+	case SubCommandBit:
+		if !dev.Bit {
+			return nil, EndCodeDevice
+		}
+
+		if count == 0 || count > maxBitPoints {
+			return nil, EndCodeCountRange
+		}
+
+		if err := checkRange(no, count); err != nil {
+			return nil, err
+		}
+
+		// 每字节2点, 高4位为前一点
+		if !write {
+			if err := r.done(); err != nil {
+				return nil, err
+			}
+
+			bits, err := s.Memory.ReadBits(dev, no, count)
+			if err != nil {
+				return nil, err
+			}
+
+			re := make([]byte, (count+1)/2)
+
+			for i, b := range bits {
+				if !b {
+					continue
+				}
+
+				if i%2 == 0 {
+					re[i/2] |= 0x10
+				} else {
+					re[i/2] |= 0x01
+				}
+			}
+
+			return re, nil
+		}
+
+		data := r.next((count + 1) / 2)
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		bits := make([]bool, count)
+		for i := range bits {
+			if i%2 == 0 {
+				bits[i] = data[i/2]&0xF0 != 0
+			} else {
+				bits[i] = data[i/2]&0x0F != 0
+			}
+		}
+
+		return nil, s.Memory.WriteBits(dev, no, bits)
+	}
+
+	return nil, EndCodeUnsupported
+}
+
+func (s *Server) randomRead(req *Request, r *reader) ([]byte, error) {
+	if req.SubCommand != SubCommandWord {
+		return nil, EndCodeUnsupported
+	}
+
+	words, dwords := r.uint8(), r.uint8()
+	if words+dwords == 0 || words+dwords > melsec.MaxRandomReadPoints {
+		return nil, EndCodeCountRange
+	}
+
+	type point struct {
+		dev melsec.DeviceInfo
+		no  uint32
+	}
+
+	points := make([]point, words+dwords)
+	for i := range points {
+		points[i].dev, points[i].no = r.device()
+	}
+
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+
+	re := make([]byte, 0, words*2+dwords*4)
+
+	for i, p := range points {
+		n := 1
+		if i >= words {
+			n = 2
+		}
+
+		if err := checkRange(p.no, n); err != nil {
+			return nil, err
+		}
+
+		values, err := s.Memory.ReadWords(p.dev, p.no, n)
+		if err != nil {
+			return nil, err
+		}
+
+		re = putWords(re, values)
+	}
+
+	return re, nil
+}
+
+func (s *Server) randomWrite(req *Request, r *reader) ([]byte, error) {
+	switch req.SubCommand {
+	case SubCommandWord:
+		words, dwords := r.uint8(), r.uint8()
+		if words+dwords == 0 || words+dwords > melsec.MaxRandomReadPoints {
+			return nil, EndCodeCountRange
+		}
+
+		type point struct {
+			dev    melsec.DeviceInfo
+			no     uint32
+			values []uint16
+		}
+
+		points := make([]point, words+dwords)
+
+		for i := range points {
+			n := 1
+			if i >= words {
+				n = 2
+			}
+
+			points[i].dev, points[i].no = r.device()
+			points[i].values = getWords(r.next(n * 2))
+		}
+
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		for _, p := range points {
+			if err := checkRange(p.no, len(p.values)); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, p := range points {
+			if err := s.Memory.WriteWords(p.dev, p.no, p.values); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	case SubCommandBit:
+		count := r.uint8()
+		if count == 0 || count > melsec.MaxRandomBitPoints {
+			return nil, EndCodeCountRange
+		}
+
+		devs := make([]melsec.DeviceInfo, count)
+		nos := make([]uint32, count)
+		values := make([]bool, count)
+
+		for i := range devs {
+			devs[i], nos[i] = r.device()
+			values[i] = r.uint8() == 0x01
+		}
+
+		if err := r.done(); err != nil {
+			return nil, err
+		}
+
+		for i := range devs {
+			if !devs[i].Bit {
+				return nil, EndCodeDevice
+			}
+
+			if err := checkRange(nos[i], 1); err != nil {
+				return nil, err
+			}
+		}
+
+		for i := range devs {
+			if err := s.Memory.WriteBits(devs[i], nos[i], values[i:i+1]); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	}
+
+	return nil, EndCodeUnsupported
+}
+
+func (s *Server) block(req *Request, r *reader) ([]byte, error) {
+	if req.SubCommand != SubCommandWord {
+		return nil, EndCodeUnsupported
+	}
+
+	wordBlocks, bitBlocks := r.uint8(), r.uint8()
+	if wordBlocks+bitBlocks == 0 || wordBlocks+bitBlocks > melsec.MaxBlocks {
+		return nil, EndCodeCountRange
+	}
+
+	type block struct {
+		dev   melsec.DeviceInfo
+		no    uint32
+		count int
+		data  []byte
+	}
+
+	write := req.Command == CommandBlockWrite
+	blocks := make([]block, wordBlocks+bitBlocks)
+	total := 0
+
+	for i := range blocks {
+		b := &blocks[i]
+		b.dev, b.no = r.device()
+		b.count = r.uint16()
+
+		if write {
+			b.data = r.next(b.count * 2)
+		}
+
+		total += b.count
+	}
+
+	if err := r.done(); err != nil {
+		return nil, err
+	}
+
+	if total > melsec.MaxBatchPoints {
+		return nil, EndCodeCountRange
+	}
+
+	for i, b := range blocks {
+		// 字块在前, 位块在后
+		if b.dev.Bit != (i >= wordBlocks) {
+			return nil, EndCodeDevice
+		}
+
+		points := b.count
+		if b.dev.Bit {
+			points *= 16
+		}
+
+		if err := checkRange(b.no, points); err != nil {
+			return nil, err
+		}
+	}
+
+	re := make([]byte, 0)
+
+	for _, b := range blocks {
+		if write {
+			if err := s.Memory.WriteWords(b.dev, b.no, getWords(b.data)); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		words, err := s.Memory.ReadWords(b.dev, b.no, b.count)
+		if err != nil {
+			return nil, err
+		}
+
+		re = putWords(re, words)
+	}
+
+	return re, nil
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dualm/melsec"
+)
+
+// memory 每种软元件4096点的测试存储, 位软元件按点存储.
+type memory struct {
+	mu    sync.Mutex
+	words map[byte][]uint16
+	bits  map[byte][]bool
+}
+
+const memorySize = 4096
+
+func newMemory() *memory {
+	return &memory{words: make(map[byte][]uint16), bits: make(map[byte][]bool)}
+}
+
+func (m *memory) check(dev melsec.DeviceInfo, no uint32, points int) error {
+	if dev.Name == "R" {
+		return errors.New("file register not mounted")
+	}
+
+	if int(no)+points > memorySize {
+		return EndCodeDeviceRange
+	}
+
+	if m.words[dev.Code] == nil {
+		m.words[dev.Code] = make([]uint16, memorySize)
+		m.bits[dev.Code] = make([]bool, memorySize)
+	}
+
+	return nil
+}
+
+func (m *memory) ReadWords(dev melsec.DeviceInfo, no uint32, count int) ([]uint16, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	points := count
+	if dev.Bit {
+		points *= 16
+	}
+
+	if err := m.check(dev, no, points); err != nil {
+		return nil, err
+	}
+
+	if !dev.Bit {
+		return append([]uint16{}, m.words[dev.Code][no:int(no)+count]...), nil
+	}
+
+	re := make([]uint16, count)
+	for i := 0; i < points; i++ {
+		if m.bits[dev.Code][int(no)+i] {
+			re[i/16] |= 1 << (i % 16)
+		}
+	}
+
+	return re, nil
+}
+
+func (m *memory) WriteWords(dev melsec.DeviceInfo, no uint32, values []uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	points := len(values)
+	if dev.Bit {
+		points *= 16
+	}
+
+	if err := m.check(dev, no, points); err != nil {
+		return err
+	}
+
+	if !dev.Bit {
+		copy(m.words[dev.Code][no:], values)
+
+		return nil
+	}
+
+	for i := 0; i < points; i++ {
+		m.bits[dev.Code][int(no)+i] = values[i/16]>>(i%16)&1 == 1
+	}
+
+	return nil
+}
+
+func (m *memory) ReadBits(dev melsec.DeviceInfo, no uint32, count int) ([]bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(dev, no, count); err != nil {
+		return nil, err
+	}
+
+	return append([]bool{}, m.bits[dev.Code][no:int(no)+count]...), nil
+}
+
+func (m *memory) WriteBits(dev melsec.DeviceInfo, no uint32, values []bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.check(dev, no, len(values)); err != nil {
+		return err
+	}
+
+	copy(m.bits[dev.Code][no:], values)
+
+	return nil
+}
+
+func start(t *testing.T, s *Server) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() { done <- s.Serve(l) }()
+
+	t.Cleanup(func() {
+		_ = s.Close()
+
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+
+	return l.Addr().String()
+}
+
+func TestServer(t *testing.T) {
+	for _, tt := range []struct {
+		frame melsec.Frame
+		ascii bool
+	}{{melsec.Frame3E, false}, {melsec.Frame4E, false}, {melsec.Frame3E, true}, {melsec.Frame4E, true}} {
+		t.Run(fmt.Sprintf("%v/ascii=%v", tt.frame, tt.ascii), func(t *testing.T) {
+			mem := newMemory()
+			s := NewServer(mem)
+			host, port, _ := net.SplitHostPort(start(t, s))
+
+			conn, err := melsec.NewConn(host, port, melsec.SetFrame(tt.frame), melsec.SetASCII(tt.ascii))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			dev, _ := melsec.NewDevice("D100", 3, conn)
+			dev.SetValue([]byte{1, 0, 2, 0, 3, 0})
+
+			if err := dev.Write(); err != nil {
+				t.Fatal(err)
+			}
+
+			if words, _ := mem.ReadWords(melsec.DeviceInfo{Name: "D", Code: 0xA8}, 100, 3); !reflect.DeepEqual(words, []uint16{1, 2, 3}) {
+				t.Errorf("unexpected D100 %v", words)
+			}
+
+			if err := conn.WriteBits([]string{"M3", "Y1F"}, []bool{true, true}); err != nil {
+				t.Fatal(err)
+			}
+
+			multi, _ := melsec.NewMultiDevice(conn)
+			multi.AddBlock("D101", 2)
+			multi.AddBlock("M0", 1)
+
+			if err := multi.Read(); err != nil {
+				t.Fatal(err)
+			}
+
+			if b := multi.Blocks(); !reflect.DeepEqual(b[0].Words(), []uint16{2, 3}) || b[1].Words()[0] != 0x0008 {
+				t.Errorf("unexpected blocks %v %v", b[0].Words(), b[1].Words())
+			}
+
+			b, err := conn.ReadRandom([]string{"D102", "Y10"}, []string{"D100"})
+			if err != nil || !bytes.Equal(b, []byte{3, 0, 0, 0x80, 1, 0, 2, 0}) {
+				t.Errorf("unexpected random read % x %v", b, err)
+			}
+
+			if model, err := conn.GetCPUInfo(); err != nil || model[:9] != "Q03UDVCPU" {
+				t.Errorf("unexpected model %q %v", model, err)
+			}
+
+			if echo, err := conn.Loopback([]byte("ABC123")); err != nil || string(echo) != "ABC123" {
+				t.Errorf("unexpected loopback %q %v", echo, err)
+			}
+
+			// 存储返回的错误转换为结束代码, 之后连接仍可使用
+			for address, want := range map[string]uint16{"D4095": 0xC056, "R0": 0xC05B} {
+				dev, _ := melsec.NewDevice(address, 2, conn)
+
+				var ee *melsec.EndCodeError
+				if err := dev.Read(); !errors.As(err, &ee) || ee.Code != want {
+					t.Errorf("%s: want end code %04X, got %v", address, want, err)
+				}
+			}
+
+			if err := dev.Read(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// frame 生成3E二进制请求帧.
+func frame(cmd, sub uint16, body ...byte) []byte {
+	data := append([]byte{0x10, 0x00, byte(cmd), byte(cmd >> 8), byte(sub), byte(sub >> 8)}, body...)
+
+	return append([]byte{0x50, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, byte(len(data)), byte(len(data) >> 8)}, data...)
+}
+
+func TestHandle(t *testing.T) {
+	mem := newMemory()
+	_ = mem.WriteBits(melsec.DeviceInfo{Name: "M", Code: 0x90, Bit: true}, 0, []bool{true, false, false, true, true})
+
+	var controls []uint16
+
+	s := NewServer(mem)
+	s.Control = func(req *Request) error {
+		if req.Command == CommandRemoteReset {
+			return EndCodeUnsupported
+		}
+
+		controls = append(controls, req.Command)
+
+		return nil
+	}
+
+	c, sc := net.Pipe()
+	defer c.Close()
+
+	go func() { _ = s.ServeConn(sc) }()
+
+	call := func(req []byte) (uint16, []byte) {
+		t.Helper()
+
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := make([]byte, 11)
+		if _, err := io.ReadFull(c, resp); err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, int(binary.LittleEndian.Uint16(resp[7:]))-2)
+		if _, err := io.ReadFull(c, data); err != nil {
+			t.Fatal(err)
+		}
+
+		return binary.LittleEndian.Uint16(resp[9:]), data
+	}
+
+	tests := []struct {
+		name string
+		req  []byte
+		code uint16
+		data []byte
+	}{
+		{"bit read", frame(0x0401, 0x0001, 0, 0, 0, 0x90, 5, 0), 0, []byte{0x10, 0x01, 0x10}},
+		{"bit write", frame(0x1401, 0x0001, 10, 0, 0, 0x90, 3, 0, 0x11, 0x10), 0, nil},
+		{"bit read back", frame(0x0401, 0x0001, 10, 0, 0, 0x90, 3, 0), 0, []byte{0x11, 0x10}},
+		{"bit read word device", frame(0x0401, 0x0001, 0, 0, 0, 0xA8, 1, 0), 0xC05B, nil},
+		{"zero count", frame(0x0401, 0x0000, 0, 0, 0, 0xA8, 0, 0), 0xC051, nil},
+		{"unknown device", frame(0x0401, 0x0000, 0, 0, 0, 0x01, 1, 0), 0xC05B, nil},
+		{"trailing data", frame(0x0401, 0x0000, 0, 0, 0, 0xA8, 1, 0, 0), 0xC061, nil},
+		{"random write range", frame(0x1402, 0x0000, 1, 1, 0, 0, 0, 0xA8, 0x34, 0x12, 0xFF, 0xFF, 0xFF, 0xA8, 1, 0, 2, 0), 0xC056, nil},
+		{"random write not applied", frame(0x0401, 0x0000, 0, 0, 0, 0xA8, 1, 0), 0, []byte{0, 0}},
+		{"short", frame(0x0401, 0x0000, 0, 0), 0xC061, nil},
+		{"unsupported", frame(0x0613, 0x0000), 0xC059, nil},
+		{"remote stop", frame(0x1002, 0x0000, 1, 0), 0, nil},
+		{"remote run", frame(0x1001, 0x0000, 1, 0, 0, 0), 0, nil},
+		{"remote reset", frame(0x1006, 0x0000, 1, 0), 0xC059, nil},
+	}
+
+	for _, tt := range tests {
+		code, data := call(tt.req)
+		if code != tt.code || (code == 0 && !bytes.Equal(data, tt.data)) {
+			t.Errorf("%s: want %04X % x, got %04X % x", tt.name, tt.code, tt.data, code, data)
+		}
+
+		// 错误信息为访问路径与指令
+		if code != 0 && !bytes.Equal(data, append([]byte{0x00, 0xFF, 0xFF, 0x03, 0x00}, tt.req[11:15]...)) {
+			t.Errorf("%s: unexpected error information % x", tt.name, data)
+		}
+	}
+
+	if !reflect.DeepEqual(controls, []uint16{CommandRemoteStop, CommandRemoteRun}) {
+		t.Errorf("unexpected controls %v", controls)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	// 4E批量位写入M10起3点
+	bin := []byte{0x54, 0x00, 0x34, 0x12, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x0E, 0x00, 0x10, 0x00, 0x01, 0x14, 0x01, 0x00, 0x0A, 0x00, 0x00, 0x90, 0x03, 0x00, 0x10, 0x10}
+
+	ascii, err := melsec.TranscodeRequest(bin, true)
+	if err != nil || string(ascii) != "54001234000000FF03FF00001B001014010001M*0000100003101" {
+		t.Fatalf("unexpected ascii request %q %v", ascii, err)
+	}
+
+	for _, b := range [][]byte{ascii, bin} {
+		req, err := ReadRequest(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req.ASCII != (b[0] == '5') || req.Frame != melsec.Frame4E || req.Serial != 0x1234 || req.ModuleIO != 0x03FF ||
+			req.Command != CommandBatchWrite || req.SubCommand != SubCommandBit || !bytes.Equal(req.Raw, b) {
+			t.Errorf("unexpected request %+v", req)
+		}
+
+		spans := req.Spans()
+		if len(spans) != 1 || spans[0].Device.Name != "M" || spans[0].No != 10 || spans[0].Points != 3 {
+			t.Errorf("unexpected spans %+v", spans)
+		}
+
+		resp, err := req.Response(0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []byte{0xD4, 0x00, 0x34, 0x12, 0x00, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x02, 0x00, 0x00, 0x00}
+		if req.ASCII {
+			want = []byte("D4001234000000FF03FF0000040000")
+		}
+
+		if !bytes.Equal(resp, want) {
+			t.Errorf("unexpected response %q", resp)
+		}
+	}
+
+	// 多块读取D0与未知代码的软元件, 只解析出第一块
+	unknown := frame(0x0406, 0x0000, 2, 0, 0, 0, 0, 0xA8, 1, 0, 0, 0, 0, 0x01, 1, 0)
+
+	req, err := ReadRequest(bytes.NewReader(unknown))
+	if err != nil || req.Err() != nil {
+		t.Fatal(err, req.Err())
+	}
+
+	if spans, err := req.ParseSpans(); len(spans) != 1 || err != EndCodeDevice {
+		t.Errorf("unexpected spans %+v %v", spans, err)
+	}
+
+	short := []byte{0x50, 0x00, 0x00, 0xFF, 0xFF, 0x03, 0x00, 0x04, 0x00, 0x10, 0x00, 0x01, 0x04}
+	if req, err := ReadRequest(bytes.NewReader(short)); err != nil || req.Err() != EndCodeRequestLength {
+		t.Fatalf("want EndCodeRequestLength, got %v", err)
+	}
+
+	if _, err := ReadRequest(bytes.NewReader([]byte{0xD0, 0x00})); !errors.Is(err, ErrSubheader) {
+		t.Errorf("want ErrSubheader, got %v", err)
+	}
+
+	if _, err := ReadRequest(bytes.NewReader(bin[:20])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("want io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestParseSpans(t *testing.T) {
+	d, _ := melsec.LookupDevice("D")
+	m, _ := melsec.LookupDevice("M")
+
+	tests := []struct {
+		name  string
+		req   Request
+		spans []Span
+		err   error
+	}{
+		{"batch write words", Request{Command: CommandBatchWrite, SubCommand: SubCommandWord, Data: []byte{0x88, 0x13, 0x00, 0xA8, 2, 0, 1, 0, 2, 0}},
+			[]Span{{d, 5000, 2}}, nil},
+		{"batch write bits", Request{Command: CommandBatchWrite, SubCommand: SubCommandBit, Data: []byte{10, 0, 0, 0x90, 3, 0, 0x10, 0x10}},
+			[]Span{{m, 10, 3}}, nil},
+		{"iQ-R batch write words", Request{Command: CommandBatchWrite, SubCommand: SubCommandWordIQR, Data: []byte{0xA0, 0x86, 0x01, 0x00, 0xA8, 0x00, 1, 0, 1, 0}},
+			[]Span{{d, 100000, 1}}, nil},
+		{"iQ-R random bit write", Request{Command: CommandRandomWrite, SubCommand: SubCommandBitIQR, Data: []byte{2, 1, 0, 0, 0, 0x90, 0x00, 1, 0, 2, 0, 0, 0, 0x90, 0x00, 0, 0}},
+			[]Span{{m, 1, 1}, {m, 2, 1}}, nil},
+		{"iQ-R unknown device", Request{Command: CommandBatchRead, SubCommand: SubCommandWordIQR, Data: []byte{0, 0, 0, 0, 0xA8, 0x01, 1, 0}},
+			[]Span{}, EndCodeDevice},
+		{"iQ-R ascii", Request{ASCII: true, Command: CommandBatchRead, SubCommand: SubCommandWordIQR, Data: []byte{0, 0, 0, 0, 0xA8, 0x00, 1, 0}},
+			[]Span{}, EndCodeUnsupported},
+		{"extended subcommand", Request{Command: CommandBatchWrite, SubCommand: 0x0080, Data: []byte{0, 0, 0, 0xA8, 1, 0, 1, 0}},
+			[]Span{}, EndCodeUnsupported},
+		{"trailing data", Request{Command: CommandBatchWrite, SubCommand: SubCommandWord, Data: []byte{0, 0, 0, 0xA8, 1, 0, 1, 0, 0, 0}},
+			[]Span{{d, 0, 1}}, EndCodeRequestLength},
+		{"random read bits", Request{Command: CommandRandomRead, SubCommand: SubCommandBit, Data: []byte{1, 0, 0, 0, 0, 0x90}},
+			[]Span{}, EndCodeUnsupported},
+		{"no devices", Request{Command: 0x0801, SubCommand: 0x0000, Data: []byte{1, 0, 0, 0, 0, 0xA8}},
+			[]Span{}, nil},
+	}
+
+	for _, tt := range tests {
+		spans, err := tt.req.ParseSpans()
+		if err != tt.err || !reflect.DeepEqual(spans, tt.spans) {
+			t.Errorf("%s: got %+v %v, want %+v %v", tt.name, spans, err, tt.spans, tt.err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package melsec
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNonAtomicWrite 写入被拆分为多个请求, 其中部分请求已经生效.
+var ErrNonAtomicWrite = errors.New("non-atomic write")
+
+// PartialWriteError 拆分写入的中途失败, Written个请求(共Total个)已经写入PLC.
+type PartialWriteError struct {
+	Written int
+	Total   int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%s: %d of %d requests written, %s", ErrNonAtomicWrite, e.Written, e.Total, e.Err)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PartialWriteError) Is(target error) bool {
+	return target == ErrNonAtomicWrite
+}
+
+// deviceChunk 一个请求中的一段软元件, 超过上限的区块被拆分为多段.
+type deviceChunk struct {
+	block  int    // 所属区块
+	name   string // 起始软元件
+	offset int    // 在区块中的字偏移
+	count  int    // 字数
+}
+
+// splitDevice 将count个字拆分为不超过limit字的多段, 位软元件每个字为16点.
+func splitDevice(block int, name string, count, limit int) ([]deviceChunk, error) {
+	if count <= limit {
+		return []deviceChunk{{block: block, name: name, count: count}}, nil
+	}
+
+	comp, no, err := parseComponent(name)
+	if err != nil {
+		return nil, err
+	}
+
+	unit := uint64(1)
+	if isBitComponent(comp) {
+		unit = 16
+	}
+
+	chunks := make([]deviceChunk, 0, count/limit+1)
+
+	for offset := 0; offset < count; offset += limit {
+		n := count - offset
+		if n > limit {
+			n = limit
+		}
+
+		chunkName, err := formatComponent(comp, no+uint64(offset)*unit)
+		if err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, deviceChunk{block: block, name: chunkName, offset: offset, count: n})
+	}
+
+	return chunks, nil
+}
+
+// validateBlock 检查区块能否用于多块批量读写.
+func validateBlock(name string, count int) error {
+	comp, _, err := parseComponent(name)
+	if err != nil {
+		return err
+	}
+
+	if bit, word := componentBitSize(comp); bit == 0 && word == 0 {
+		return fmt.Errorf("软元件%s不支持多块批量读写", name)
+	}
+
+	if count <= 0 {
+		return fmt.Errorf("block %s: count %d", name, count)
+	}
+
+	return nil
+}
+
+// packChunks 将多个区块依次装入请求, 每个请求不超过MaxBlocks个区块及MaxBatchPoints个字,
+// 请求内字块在前、位块在后. 无效的区块不参与请求, 其错误按区块返回.
+func packChunks(names []string, counts []int) ([][]deviceChunk, []error) {
+	errs := make([]error, len(names))
+	requests := make([][]deviceChunk, 0, 1)
+	current := make([]deviceChunk, 0)
+	points := 0
+
+	for i := range names {
+		if errs[i] = validateBlock(names[i], counts[i]); errs[i] != nil {
+			continue
+		}
+
+		chunks, err := splitDevice(i, names[i], counts[i], MaxBatchPoints)
+		if err != nil {
+			errs[i] = err
+
+			continue
+		}
+
+		for _, c := range chunks {
+			if len(current) == MaxBlocks || points+c.count > MaxBatchPoints {
+				requests = append(requests, current)
+				current, points = make([]deviceChunk, 0), 0
+			}
+
+			current = append(current, c)
+			points += c.count
+		}
+	}
+
+	if len(current) != 0 {
+		requests = append(requests, current)
+	}
+
+	for _, chunks := range requests {
+		sort.SliceStable(chunks, func(i, j int) bool {
+			return !chunks[i].bit() && chunks[j].bit()
+		})
+	}
+
+	return requests, errs
+}
+
+func (c deviceChunk) bit() bool {
+	name, _ := splitComponentName(c.name)
+
+	return isBitComponent(name)
+}
+
+func chunksCount(chunks []deviceChunk) int {
+	total := 0
+	for _, c := range chunks {
+		total += c.count
+	}
+
+	return total
+}
@@ -0,0 +1,457 @@
+package melsec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var structPlans sync.Map // reflect.Type -> *structPlan
+
+// structField 结构体字段与PLC软元件的映射, 来自字段标签 `melsec:"D200,len=10,type=int16"`.
+type structField struct {
+	index  int
+	name   string
+	comp   string
+	no     uint64
+	typ    DataType
+	length int
+	array  bool
+}
+
+// bitDevice 字段是否位于位软元件上.
+func (f *structField) bitDevice() bool {
+	return isBitComponent(f.comp)
+}
+
+// item 字段对应的读取地址.
+func (f *structField) item() PlanItem {
+	name, _ := formatComponent(f.comp, f.no)
+
+	if f.bitDevice() && f.typ == TypeBool {
+		return PlanItem{Address: name, Words: (f.length + 15) / 16}
+	}
+
+	return PlanItem{Address: name, Words: f.typ.Words(f.length)}
+}
+
+// span 字段占用的范围, 字软元件以字为单位, 位软元件以点为单位.
+func (f *structField) span() (uint64, uint64) {
+	if !f.bitDevice() {
+		return f.no, f.no + uint64(f.typ.Words(f.length))
+	}
+
+	if f.typ == TypeBool {
+		return f.no, f.no + uint64(f.length)
+	}
+
+	return f.no, f.no + uint64(f.typ.Words(f.length))*16
+}
+
+type structPlan struct {
+	// fields 按软元件类型及编号排序
+	fields []*structField
+	read   *ReadPlan
+}
+
+func parseStructTag(sf reflect.StructField, index int) (*structField, error) {
+	tag, ok := sf.Tag.Lookup("melsec")
+	if !ok || tag == "" || tag == "-" {
+		return nil, nil
+	}
+
+	parts := strings.Split(tag, ",")
+
+	comp, no, err := parseComponent(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+	}
+
+	field := &structField{
+		index:  index,
+		name:   sf.Name,
+		comp:   comp,
+		no:     no,
+		length: 1,
+	}
+
+	ft := sf.Type
+	if ft.Kind() == reflect.Array {
+		field.array = true
+		field.length = ft.Len()
+		ft = ft.Elem()
+	}
+
+	hasLen := false
+
+	for _, opt := range parts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+
+		switch key {
+		case "len":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("field %s: invalid len %q", sf.Name, value)
+			}
+
+			if field.array && n != field.length {
+				return nil, fmt.Errorf("field %s: len %d does not match array length %d", sf.Name, n, field.length)
+			}
+
+			field.length = n
+			hasLen = true
+		case "type":
+			t, err := ParseDataType(value)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+			}
+
+			field.typ = t
+		default:
+			return nil, fmt.Errorf("field %s: unknown option %q", sf.Name, opt)
+		}
+	}
+
+	if field.typ == 0 {
+		field.typ = kindDataType(ft.Kind())
+	}
+
+	switch {
+	case field.typ == 0:
+		return nil, fmt.Errorf("field %s: unsupported type %s", sf.Name, sf.Type)
+	case field.typ == TypeString && (ft.Kind() != reflect.String || field.array):
+		return nil, fmt.Errorf("field %s: string tag needs a string field", sf.Name)
+	case ft.Kind() == reflect.String && field.typ != TypeString:
+		return nil, fmt.Errorf("field %s: string field needs a string tag", sf.Name)
+	case (field.typ == TypeBool) != (ft.Kind() == reflect.Bool):
+		return nil, fmt.Errorf("field %s: bool tag needs a bool field", sf.Name)
+	case field.typ == TypeString && !field.array && !hasLen:
+		return nil, fmt.Errorf("field %s: string tag needs len", sf.Name)
+	}
+
+	return field, nil
+}
+
+func kindDataType(kind reflect.Kind) DataType {
+	switch kind {
+	case reflect.Bool:
+		return TypeBool
+	case reflect.Int16:
+		return TypeInt16
+	case reflect.Uint16:
+		return TypeUint16
+	case reflect.Int32:
+		return TypeInt32
+	case reflect.Uint32:
+		return TypeUint32
+	case reflect.Float32:
+		return TypeFloat32
+	case reflect.Float64:
+		return TypeFloat64
+	case reflect.String:
+		return TypeString
+	}
+
+	return 0
+}
+
+func getStructPlan(t reflect.Type) (*structPlan, error) {
+	if p, ok := structPlans.Load(t); ok {
+		return p.(*structPlan), nil
+	}
+
+	plan := &structPlan{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field, err := parseStructTag(t.Field(i), i)
+		if err != nil {
+			return nil, err
+		}
+
+		if field != nil {
+			plan.fields = append(plan.fields, field)
+		}
+	}
+
+	if len(plan.fields) == 0 {
+		return nil, fmt.Errorf("%s has no melsec tags", t)
+	}
+
+	sort.SliceStable(plan.fields, func(i, j int) bool {
+		if plan.fields[i].comp != plan.fields[j].comp {
+			return plan.fields[i].comp < plan.fields[j].comp
+		}
+
+		return plan.fields[i].no < plan.fields[j].no
+	})
+
+	items := make([]PlanItem, len(plan.fields))
+	for i, f := range plan.fields {
+		items[i] = f.item()
+	}
+
+	read, err := NewPlanner().Plan(items...)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.read = read
+
+	structPlans.Store(t, plan)
+
+	return plan, nil
+}
+
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, errors.New("melsec: need a non-nil pointer to struct")
+	}
+
+	return rv.Elem(), nil
+}
+
+// decodeField 从读取结果中解码一个字段的值.
+func decodeField(f *structField, result *PlanResult, t reflect.Type) (reflect.Value, error) {
+	item := f.item()
+
+	buff, err := result.Words(item.Address, item.Words)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("field %s: %w", f.name, err)
+	}
+
+	if f.bitDevice() && f.typ == TypeBool {
+		bits := make([]bool, f.length)
+		for i := range bits {
+			bits[i] = bitOf(buff, i)
+		}
+
+		if f.array {
+			return assignValue(bits, t)
+		}
+
+		return assignValue(bits[0], t)
+	}
+
+	value, err := DecodeValue(f.typ, buff, f.length)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("field %s: %w", f.name, err)
+	}
+
+	return assignValue(value, t)
+}
+
+// assignValue 将解码结果转换为字段类型, 切片转换为数组.
+func assignValue(value interface{}, t reflect.Type) (reflect.Value, error) {
+	rv := reflect.ValueOf(value)
+	re := reflect.New(t).Elem()
+
+	if t.Kind() != reflect.Array {
+		if rv.Kind() == reflect.Slice {
+			rv = rv.Index(0)
+		}
+
+		re.Set(rv.Convert(t))
+
+		return re, nil
+	}
+
+	if rv.Kind() != reflect.Slice {
+		rv = reflect.Append(reflect.MakeSlice(reflect.SliceOf(rv.Type()), 0, 1), rv)
+	}
+
+	for i := 0; i < t.Len() && i < rv.Len(); i++ {
+		re.Index(i).Set(rv.Index(i).Convert(t.Elem()))
+	}
+
+	return re, nil
+}
+
+func bitOf(b []byte, i int) bool {
+	return b[i/8]>>(uint(i)%8)&1 == 1
+}
+
+// packBits 从offset开始取n个位, 重新打包为小端字节.
+func packBits(b []byte, offset, n int) []byte {
+	re := make([]byte, (n+7)/8)
+
+	for i := 0; i < n; i++ {
+		if bitOf(b, offset+i) {
+			re[i/8] |= 1 << (uint(i) % 8)
+		}
+	}
+
+	return re
+}
+
+// ReadStruct 按结构体字段上的melsec标签读取PLC数据, v必须为结构体指针.
+// 读取按Planner规划为尽量少的请求, 返回值发生变化的字段名.
+func (plc *PlcConn) ReadStruct(v interface{}) ([]string, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := getStructPlan(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := plan.read.Read(plc)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+
+	for _, f := range plan.fields {
+		fv := rv.Field(f.index)
+
+		value, err := decodeField(f, result, fv.Type())
+		if err != nil {
+			return changed, err
+		}
+
+		if reflect.DeepEqual(fv.Interface(), value.Interface()) {
+			continue
+		}
+
+		fv.Set(value)
+		changed = append(changed, f.name)
+	}
+
+	return changed, nil
+}
+
+// WriteStruct 将结构体中带melsec标签的字段写入PLC.
+// 字软元件合并为一次多块批量写入; 位软元件按位随机写入, 不影响相邻的位.
+func (plc *PlcConn) WriteStruct(v interface{}) error {
+	rv, err := structValue(v)
+	if err != nil {
+		return err
+	}
+
+	plan, err := getStructPlan(rv.Type())
+	if err != nil {
+		return err
+	}
+
+	dev, err := NewMultiDevice(plc)
+	if err != nil {
+		return err
+	}
+
+	values := make([][]byte, 0)
+	bitNames := make([]string, 0)
+	bitValues := make([]bool, 0)
+
+	var (
+		lastComp string
+		end      uint64
+	)
+
+	for _, f := range plan.fields {
+		fv := rv.Field(f.index)
+
+		if f.bitDevice() {
+			names, bits, err := fieldBits(f, fv)
+			if err != nil {
+				return err
+			}
+
+			bitNames = append(bitNames, names...)
+			bitValues = append(bitValues, bits...)
+
+			continue
+		}
+
+		b, err := EncodeValue(f.typ, fv.Interface(), f.length)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", f.name, err)
+		}
+
+		start, stop := f.span()
+
+		// 只合并首尾相接的字段, 不能覆盖字段间隙中的数据
+		if last := len(values) - 1; last >= 0 && lastComp == f.comp && start == end {
+			values[last] = append(values[last], b...)
+			dev.count[last] += int(stop - start)
+			end = stop
+
+			continue
+		}
+
+		name, err := formatComponent(f.comp, start)
+		if err != nil {
+			return err
+		}
+
+		dev.AddBlock(name, int(stop-start))
+		values = append(values, b)
+		lastComp, end = f.comp, stop
+	}
+
+	if len(values) != 0 {
+		dev.SetValue(values)
+
+		if err := dev.Write(); err != nil {
+			return err
+		}
+	}
+
+	for len(bitNames) != 0 {
+		n := len(bitNames)
+		if n > MaxRandomBitPoints {
+			n = MaxRandomBitPoints
+		}
+
+		if err := plc.WriteBits(bitNames[:n], bitValues[:n]); err != nil {
+			return err
+		}
+
+		bitNames, bitValues = bitNames[n:], bitValues[n:]
+	}
+
+	return nil
+}
+
+// fieldBits 展开位软元件上的字段为逐点的名称和值.
+func fieldBits(f *structField, fv reflect.Value) ([]string, []bool, error) {
+	bits := make([]bool, 0)
+
+	if f.typ == TypeBool {
+		if f.array {
+			for i := 0; i < fv.Len(); i++ {
+				bits = append(bits, fv.Index(i).Bool())
+			}
+		} else {
+			bits = append(bits, fv.Bool())
+		}
+	} else {
+		b, err := EncodeValue(f.typ, fv.Interface(), f.length)
+		if err != nil {
+			return nil, nil, fmt.Errorf("field %s: %w", f.name, err)
+		}
+
+		for i := 0; i < len(b)*8; i++ {
+			bits = append(bits, bitOf(b, i))
+		}
+	}
+
+	names := make([]string, len(bits))
+
+	for i := range bits {
+		name, err := formatComponent(f.comp, f.no+uint64(i))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names[i] = name
+	}
+
+	return names, bits, nil
+}
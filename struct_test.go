@@ -0,0 +1,175 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testStation struct {
+	Speed   float32 `melsec:"D100"`
+	Count   int16   `melsec:"D102"`
+	Running bool    `melsec:"M20"`
+	Alarm   [3]bool `melsec:"M40"`
+	Lot     string  `melsec:"D200,len=10"`
+	Temp    [2]int  `melsec:"D104,type=int16"`
+	Ignored int     `melsec:"-"`
+	Flags   uint16  `melsec:"M64"`
+	Energy  float64 `melsec:"R10"`
+	Plain   uint32
+}
+
+func TestStructPlan(t *testing.T) {
+	plan, err := getStructPlan(reflect.TypeOf(testStation{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "#0 block D100:6 D200:5 R10:4 M16:4"
+	if got := plan.read.String(); !strings.HasPrefix(got, want+"\n") {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestStructDecode(t *testing.T) {
+	plan, err := getStructPlan(reflect.TypeOf(testStation{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]byte{
+		make([]byte, 12), make([]byte, 10), make([]byte, 8), make([]byte, 8),
+	}
+
+	binary.LittleEndian.PutUint32(values[0][0:], math.Float32bits(12.5))
+	binary.LittleEndian.PutUint16(values[0][4:], uint16(0xFFFF))
+	binary.LittleEndian.PutUint16(values[0][8:], 7)
+	binary.LittleEndian.PutUint16(values[0][10:], 8)
+	copy(values[1], "LOT01")
+	binary.LittleEndian.PutUint64(values[2], math.Float64bits(3.25))
+	// M16起: M20, M41, M64 + M65
+	binary.LittleEndian.PutUint16(values[3][0:], 1<<4)
+	binary.LittleEndian.PutUint16(values[3][2:], 1<<9)
+	binary.LittleEndian.PutUint16(values[3][6:], 0x0003)
+
+	result := &PlanResult{}
+	for i, block := range plan.read.Requests[0].Blocks {
+		start := block.lo
+		if block.bit {
+			start *= 16
+		}
+
+		result.add(block.comp, block.bit, start, values[i])
+	}
+
+	var s testStation
+
+	rv := reflect.ValueOf(&s).Elem()
+
+	for _, f := range plan.fields {
+		v, err := decodeField(f, result, rv.Field(f.index).Type())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rv.Field(f.index).Set(v)
+	}
+
+	want := testStation{
+		Speed:   12.5,
+		Count:   -1,
+		Running: true,
+		Alarm:   [3]bool{false, true, false},
+		Lot:     "LOT01",
+		Temp:    [2]int{7, 8},
+		Flags:   3,
+		Energy:  3.25,
+	}
+
+	if s != want {
+		t.Fatalf("want %+v, got %+v", want, s)
+	}
+}
+
+func TestStructTagErrors(t *testing.T) {
+	tests := []interface{}{
+		struct {
+			A int `melsec:"D0"`
+		}{},
+		struct {
+			A string `melsec:"D0"`
+		}{},
+		struct {
+			A bool `melsec:"D0,type=int16"`
+		}{},
+		struct {
+			A int16 `melsec:"K0"`
+		}{},
+		struct {
+			A [2]int16 `melsec:"D0,len=3"`
+		}{},
+	}
+
+	for _, tt := range tests {
+		if _, err := getStructPlan(reflect.TypeOf(tt)); err == nil {
+			t.Errorf("%T: want error", tt)
+		}
+	}
+}
+
+func TestEncodeDecodeValue(t *testing.T) {
+	tests := []struct {
+		typ    DataType
+		value  interface{}
+		length int
+		want   interface{}
+	}{
+		{TypeInt16, -2, 1, int16(-2)},
+		{TypeUint32, uint32(70000), 1, uint32(70000)},
+		{TypeFloat32, 1.5, 1, float32(1.5)},
+		{TypeInt32, []int{1, -1}, 2, []int32{1, -1}},
+		{TypeString, "AB", 3, "AB"},
+		{TypeBool, "true", 1, true},
+		{TypeUint16, []interface{}{1, "2", uint8(3)}, 3, []uint16{1, 2, 3}},
+		{TypeInt16, []interface{}{3.0, "-4", "5.0"}, 3, []int16{3, -4, 5}},
+		{TypeBool, []interface{}{1.0, 0, "1"}, 3, []bool{true, false, true}},
+	}
+
+	for _, tt := range tests {
+		b, err := EncodeValue(tt.typ, tt.value, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b) != tt.typ.Words(tt.length)*2 {
+			t.Errorf("%s: want %d bytes, got %d", tt.typ, tt.typ.Words(tt.length)*2, len(b))
+		}
+
+		got, err := DecodeValue(tt.typ, b, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: want %v, got %v", tt.typ, tt.want, got)
+		}
+	}
+
+	for _, v := range []interface{}{40000, 1.7, "2.5", uint64(math.MaxUint64), math.Inf(1), math.NaN()} {
+		if _, err := EncodeValue(TypeInt16, v, 1); err == nil {
+			t.Errorf("%v: want error", v)
+		}
+	}
+
+	for _, v := range []interface{}{0.5, 2, -1, "2"} {
+		if _, err := EncodeValue(TypeBool, v, 1); err == nil {
+			t.Errorf("%v: want error for bool", v)
+		}
+	}
+
+	if _, err := EncodeValue(TypeUint32, []float64{1, 1e19}, 2); err == nil {
+		t.Error("want out of range error")
+	}
+}
@@ -0,0 +1,409 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ChangeEvent 一个字或一个标签的值变化. 首次读取时Old为nil.
+// 按字订阅时Address为字地址, Old/New为uint16; 按标签订阅时Tag为标签名, Old/New为标签的工程值.
+type ChangeEvent struct {
+	Address string
+	Tag     string
+	Old     interface{}
+	New     interface{}
+	Time    time.Time
+}
+
+// OverflowPolicy 订阅者的缓冲区已满时的处理方式.
+type OverflowPolicy uint8
+
+const (
+	// DropOldest 丢弃缓冲区中最旧的事件.
+	DropOldest OverflowPolicy = iota
+	// DropNewest 丢弃新事件.
+	DropNewest
+	// Block 阻塞读取, 直到订阅者取走事件. 慢速订阅者会拖慢所有读取.
+	Block
+)
+
+type SubscribeOption func(*Subscription)
+
+// WithTags 只订阅指定的标签, 标签必须位于软元件的读取范围内.
+func WithTags(tags ...Tag) SubscribeOption {
+	return func(s *Subscription) {
+		s.tags = append(s.tags, tags...)
+	}
+}
+
+// WithDeadband 数值变化的绝对值不超过d时不产生事件.
+func WithDeadband(d float64) SubscribeOption {
+	return func(s *Subscription) {
+		s.deadband = d
+	}
+}
+
+// WithBuffer 设置事件缓冲区的大小, 默认64. n为0时只在订阅者正在等待时送达事件,
+// 此时DropOldest与DropNewest相同.
+func WithBuffer(n int) SubscribeOption {
+	return func(s *Subscription) {
+		if n >= 0 {
+			s.buffer = n
+		}
+	}
+}
+
+// WithOverflow 设置缓冲区已满时的处理方式, 默认DropOldest.
+func WithOverflow(p OverflowPolicy) SubscribeOption {
+	return func(s *Subscription) {
+		s.overflow = p
+	}
+}
+
+// Subscription 一个变化订阅, 事件从C中读取. 不再使用时必须调用Close.
+type Subscription struct {
+	C <-chan ChangeEvent
+
+	ch       chan ChangeEvent
+	done     chan struct{}
+	once     sync.Once
+	hub      *changeHub
+	tags     []Tag
+	deadband float64
+	buffer   int
+	overflow OverflowPolicy
+	last     map[string]interface{}
+
+	mu      sync.Mutex
+	dropped uint64
+}
+
+// Dropped 返回因缓冲区已满而丢弃的事件数.
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Close 取消订阅并关闭C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.hub.remove(s)
+		close(s.ch)
+	})
+}
+
+func (s *Subscription) drop() {
+	s.mu.Lock()
+	s.dropped++
+	s.mu.Unlock()
+}
+
+func (s *Subscription) send(ev ChangeEvent) {
+	switch s.overflow {
+	case Block:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		}
+	case DropNewest:
+		select {
+		case s.ch <- ev:
+		default:
+			s.drop()
+		}
+	default:
+		if cap(s.ch) == 0 {
+			// 没有缓冲区时无法丢弃旧事件
+			select {
+			case s.ch <- ev:
+			default:
+				s.drop()
+			}
+
+			return
+		}
+
+		for {
+			select {
+			case s.ch <- ev:
+				return
+			default:
+			}
+
+			select {
+			case <-s.ch:
+				s.drop()
+			default:
+			}
+		}
+	}
+}
+
+// changed 判断是否需要产生事件, 数值类型按死区比较.
+func (s *Subscription) changed(old, cur interface{}) bool {
+	if s.deadband > 0 {
+		if o, c, ok := numbers(old, cur); ok {
+			return math.Abs(c-o) > s.deadband
+		}
+	}
+
+	return !reflect.DeepEqual(old, cur)
+}
+
+func numbers(old, cur interface{}) (float64, float64, bool) {
+	o, c := toFloat(reflect.ValueOf(old)), toFloat(reflect.ValueOf(cur))
+
+	return o, c, !math.IsNaN(o) && !math.IsNaN(c)
+}
+
+// wordValue 一个字的地址与值.
+type wordValue struct {
+	address string
+	value   uint16
+}
+
+// segmentWords 将一段数据展开为逐字的地址与值, 位软元件每字16点.
+func segmentWords(comp string, start uint64, data []byte) []wordValue {
+	unit := uint64(1)
+	if isBitComponent(comp) {
+		unit = 16
+	}
+
+	re := make([]wordValue, len(data)/2)
+	for i := range re {
+		name, _ := formatComponent(comp, start+uint64(i)*unit)
+		re[i] = wordValue{address: name, value: binary.LittleEndian.Uint16(data[i*2:])}
+	}
+
+	return re
+}
+
+// changeHub 管理一个软元件的全部订阅.
+type changeHub struct {
+	mu   sync.Mutex
+	subs []*Subscription
+}
+
+func (h *changeHub) subscribe(layout *PlanResult, opts []SubscribeOption) (*Subscription, error) {
+	s := &Subscription{
+		done:   make(chan struct{}),
+		hub:    h,
+		buffer: 64,
+		last:   make(map[string]interface{}),
+	}
+
+	for _, o := range opts {
+		if o != nil {
+			o(s)
+		}
+	}
+
+	for i := range s.tags {
+		if err := s.tags[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.tags) != 0 {
+		tags := make([]*Tag, len(s.tags))
+		for i := range s.tags {
+			tags[i] = &s.tags[i]
+		}
+
+		if _, err := DecodeTags(tags, layout); err != nil {
+			return nil, err
+		}
+	}
+
+	s.ch = make(chan ChangeEvent, s.buffer)
+	s.C = s.ch
+
+	h.mu.Lock()
+	h.subs = append(h.subs, s)
+	h.mu.Unlock()
+
+	return s, nil
+}
+
+func (h *changeHub) subscribeFunc(layout *PlanResult, fn func(ChangeEvent), opts []SubscribeOption) (*Subscription, error) {
+	if fn == nil {
+		return nil, errors.New("nil subscription callback")
+	}
+
+	s, err := h.subscribe(layout, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for ev := range s.C {
+			fn(ev)
+		}
+	}()
+
+	return s, nil
+}
+
+func (h *changeHub) remove(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range h.subs {
+		if h.subs[i] == s {
+			h.subs = append(h.subs[:i], h.subs[i+1:]...)
+
+			return
+		}
+	}
+}
+
+// publish 向各订阅者发送相对其上一次事件的变化.
+func (h *changeHub) publish(result *PlanResult, words func() []wordValue) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subs) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	var all []wordValue
+
+	for _, s := range h.subs {
+		select {
+		case <-s.done:
+			continue
+		default:
+		}
+
+		if len(s.tags) == 0 {
+			if all == nil {
+				all = words()
+			}
+
+			for _, w := range all {
+				old, ok := s.last[w.address]
+				if ok && !s.changed(old, w.value) {
+					continue
+				}
+
+				s.last[w.address] = w.value
+				s.send(ChangeEvent{Address: w.address, Old: old, New: w.value, Time: now})
+			}
+
+			continue
+		}
+
+		for i := range s.tags {
+			tag := &s.tags[i]
+
+			values, err := DecodeTags([]*Tag{tag}, result)
+			if err != nil {
+				continue
+			}
+
+			cur := values[tag.Name]
+
+			old, ok := s.last[tag.Name]
+			if ok && !s.changed(old, cur) {
+				continue
+			}
+
+			s.last[tag.Name] = cur
+			s.send(ChangeEvent{Address: tag.Address, Tag: tag.Name, Old: old, New: cur, Time: now})
+		}
+	}
+}
+
+func (dev *Device) layout(value []byte) *PlanResult {
+	re := &PlanResult{}
+
+	if comp, no, err := parseComponent(dev.name); err == nil {
+		re.add(comp, isBitComponent(comp), no, value)
+	}
+
+	return re
+}
+
+func (dev *Device) publish() {
+	dev.hub.publish(dev.layout(dev.value), func() []wordValue {
+		comp, no, err := parseComponent(dev.name)
+		if err != nil {
+			return nil
+		}
+
+		return segmentWords(comp, no, dev.value)
+	})
+}
+
+// Subscribe 订阅软元件的变化, 每次Read或Write后按字(或WithTags指定的标签)发送事件.
+// 多个订阅者相互独立, 不受GetValue清除变化标志的影响.
+func (dev *Device) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	return dev.hub.subscribe(dev.layout(make([]byte, dev.count*2)), opts)
+}
+
+// SubscribeFunc 订阅软元件的变化, 在独立的goroutine中依次调用fn.
+func (dev *Device) SubscribeFunc(fn func(ChangeEvent), opts ...SubscribeOption) (*Subscription, error) {
+	return dev.hub.subscribeFunc(dev.layout(make([]byte, dev.count*2)), fn, opts)
+}
+
+func (dev *MultiDevice) layout(values [][]byte) *PlanResult {
+	re := &PlanResult{}
+
+	for i := range dev.name {
+		if i < len(dev.errs) && dev.errs[i] != nil {
+			continue
+		}
+
+		if comp, no, err := parseComponent(dev.name[i]); err == nil {
+			re.add(comp, isBitComponent(comp), no, values[i])
+		}
+	}
+
+	return re
+}
+
+func (dev *MultiDevice) publish() {
+	dev.hub.publish(dev.layout(dev.value), func() []wordValue {
+		re := make([]wordValue, 0)
+
+		for i := range dev.name {
+			if i < len(dev.errs) && dev.errs[i] != nil {
+				continue
+			}
+
+			if comp, no, err := parseComponent(dev.name[i]); err == nil {
+				re = append(re, segmentWords(comp, no, dev.value[i])...)
+			}
+		}
+
+		return re
+	})
+}
+
+func (dev *MultiDevice) emptyLayout() *PlanResult {
+	values := make([][]byte, len(dev.count))
+	for i := range values {
+		values[i] = make([]byte, dev.count[i]*2)
+	}
+
+	return dev.layout(values)
+}
+
+// Subscribe 订阅全部区块的变化, 每次Read或Write后按字(或WithTags指定的标签)发送事件.
+func (dev *MultiDevice) Subscribe(opts ...SubscribeOption) (*Subscription, error) {
+	return dev.hub.subscribe(dev.emptyLayout(), opts)
+}
+
+// SubscribeFunc 订阅全部区块的变化, 在独立的goroutine中依次调用fn.
+func (dev *MultiDevice) SubscribeFunc(fn func(ChangeEvent), opts ...SubscribeOption) (*Subscription, error) {
+	return dev.hub.subscribeFunc(dev.emptyLayout(), fn, opts)
+}
@@ -0,0 +1,201 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription) ChangeEvent {
+	t.Helper()
+
+	select {
+	case ev := <-s.C:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	return ChangeEvent{}
+}
+
+func noEvent(t *testing.T, s *Subscription) {
+	t.Helper()
+
+	select {
+	case ev := <-s.C:
+		t.Fatalf("unexpected event %+v", ev)
+	default:
+	}
+}
+
+func TestSubscribeWords(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	dev, err := NewDevice("D100", 3, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := dev.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	b, err := dev.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Subscription{a, b} {
+		for _, addr := range []string{"D100", "D101", "D102"} {
+			if ev := receive(t, s); ev.Address != addr || ev.Old != nil || ev.New != uint16(0) {
+				t.Fatalf("want initial %s, got %+v", addr, ev)
+			}
+		}
+	}
+
+	_ = dev.GetValue()
+	binary.LittleEndian.PutUint16(plc.words(0xA8, 101, 1), 42)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Subscription{a, b} {
+		if ev := receive(t, s); ev.Address != "D101" || ev.Old != uint16(0) || ev.New != uint16(42) {
+			t.Fatalf("want D101 0 -> 42, got %+v", ev)
+		}
+
+		noEvent(t, s)
+	}
+}
+
+func TestSubscribeTagDeadband(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	dev, err := NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.AddBlock("M0", 1)
+	dev.AddBlock("D100", 3)
+
+	events := make(chan ChangeEvent, 10)
+
+	s, err := dev.SubscribeFunc(func(ev ChangeEvent) {
+		events <- ev
+	}, WithTags(Tag{Name: "Temp", Address: "D101", Type: TypeInt16}, Tag{Name: "Run", Address: "M3"}), WithDeadband(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	next := func() ChangeEvent {
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+
+		return ChangeEvent{}
+	}
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = next(), next()
+
+	binary.LittleEndian.PutUint16(plc.words(0xA8, 101, 1), 3)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	binary.LittleEndian.PutUint16(plc.words(0xA8, 101, 1), 10)
+	binary.LittleEndian.PutUint16(plc.words(0x90, 0, 1), 1<<3)
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]ChangeEvent{}
+	for i := 0; i < 2; i++ {
+		ev := next()
+		got[ev.Tag] = ev
+	}
+
+	if ev := got["Temp"]; ev.Old != int16(0) || ev.New != int16(10) {
+		t.Errorf("want Temp 0 -> 10 with the change to 3 suppressed, got %+v", ev)
+	}
+
+	if ev := got["Run"]; ev.Old != false || ev.New != true || ev.Address != "M3" {
+		t.Errorf("want Run false -> true, got %+v", ev)
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	dev, err := NewDevice("D0", 4, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := dev.Subscribe(WithBuffer(1), WithOverflow(DropNewest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := dev.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ev := receive(t, s); ev.Address != "D0" {
+		t.Errorf("want D0 kept, got %+v", ev)
+	}
+
+	if s.Dropped() != 3 {
+		t.Errorf("want 3 dropped, got %d", s.Dropped())
+	}
+
+	// 没有缓冲区且没有订阅者等待时丢弃事件, 读取不阻塞
+	u, err := dev.Subscribe(WithBuffer(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	copy(plc.words(0xA8, 0, 4), []byte{1, 0, 2, 0, 3, 0, 4, 0})
+
+	done := make(chan error, 1)
+
+	go func() { done <- dev.Read() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read blocked by unbuffered subscription")
+	}
+
+	if u.Dropped() != 4 {
+		t.Errorf("want 4 dropped, got %d", u.Dropped())
+	}
+
+	if _, err := dev.Subscribe(WithTags(Tag{Name: "Out", Address: "D10"})); err == nil {
+		t.Error("want error for tag outside the device")
+	}
+}
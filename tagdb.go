@@ -0,0 +1,684 @@
+package melsec
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrTagsSkipped 部分标签的数据类型不受支持, 未被加载.
+var ErrTagsSkipped = errors.New("tags skipped")
+
+// SkippedTag 未被加载的标签, Line为所在行.
+type SkippedTag struct {
+	Line int
+	Name string
+	Type string
+}
+
+// SkippedTagsError LoadGXWorks跳过的标签, 其余标签已经加载.
+type SkippedTagsError struct {
+	Tags []SkippedTag
+}
+
+func (e *SkippedTagsError) Error() string {
+	names := make([]string, len(e.Tags))
+	for i, tag := range e.Tags {
+		names[i] = fmt.Sprintf("%s (line %d, %s)", tag.Name, tag.Line, tag.Type)
+	}
+
+	return fmt.Sprintf("%s: %d unsupported data types: %s", ErrTagsSkipped, len(e.Tags), strings.Join(names, ", "))
+}
+
+func (e *SkippedTagsError) Is(target error) bool {
+	return target == ErrTagsSkipped
+}
+
+// Tag 标签定义, 将名称映射到软元件地址、数据类型、长度与缩放.
+// 工程值 = 原始值 * Scale + Offset, Scale为0时不缩放.
+type Tag struct {
+	Name    string   `yaml:"name" json:"name"`
+	Address string   `yaml:"address" json:"address"`
+	Type    DataType `yaml:"type" json:"type"`
+	Length  int      `yaml:"length,omitempty" json:"length,omitempty"`
+	Scale   float64  `yaml:"scale,omitempty" json:"scale,omitempty"`
+	Offset  float64  `yaml:"offset,omitempty" json:"offset,omitempty"`
+	Comment string   `yaml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// Words 标签占用的字数, 位软元件上的bool按1个字计.
+func (tag *Tag) Words() int {
+	return tag.Type.Words(tag.Length)
+}
+
+// IsBit 标签是否为位软元件上的bool.
+func (tag *Tag) IsBit() bool {
+	name, _ := splitComponentName(tag.Address)
+
+	return tag.Type == TypeBool && isBitComponent(name)
+}
+
+func (tag *Tag) scaled() bool {
+	return tag.Scale != 0 && tag.Type != TypeBool && tag.Type != TypeString
+}
+
+// validate 补全默认值并检查地址能否被编码.
+func (tag *Tag) validate() error {
+	tag.Name = strings.TrimSpace(tag.Name)
+	tag.Address = strings.ToUpper(strings.TrimSpace(tag.Address))
+
+	if tag.Name == "" {
+		return errors.New("empty tag name")
+	}
+
+	if _, err := encodeSoftComponent(tag.Address); err != nil {
+		return fmt.Errorf("tag %s: %w", tag.Name, err)
+	}
+
+	if tag.Type == 0 {
+		tag.Type = TypeInt16
+
+		if name, _ := splitComponentName(tag.Address); isBitComponent(name) {
+			tag.Type = TypeBool
+		}
+	}
+
+	if tag.Length <= 0 {
+		tag.Length = 1
+	}
+
+	if tag.Type == TypeBool && tag.Length != 1 {
+		return fmt.Errorf("tag %s: bool tags must have length 1", tag.Name)
+	}
+
+	return nil
+}
+
+// Decode 将字数据解码为工程值.
+func (tag *Tag) Decode(b []byte) (interface{}, error) {
+	if tag.IsBit() {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("tag %s: need 2 bytes, got %d", tag.Name, len(b))
+		}
+
+		return b[0]&1 == 1, nil
+	}
+
+	value, err := DecodeValue(tag.Type, b, tag.Length)
+	if err != nil || !tag.scaled() {
+		return value, err
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice {
+		return toFloat(rv)*tag.Scale + tag.Offset, nil
+	}
+
+	re := make([]float64, rv.Len())
+	for i := range re {
+		re[i] = toFloat(rv.Index(i))*tag.Scale + tag.Offset
+	}
+
+	return re, nil
+}
+
+// Encode 将工程值编码为字数据.
+func (tag *Tag) Encode(v interface{}) ([]byte, error) {
+	if !tag.scaled() {
+		return EncodeValue(tag.Type, v, tag.Length)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		f, err := strconv.ParseFloat(rv.String(), 64)
+		if err != nil {
+			return nil, fmt.Errorf("tag %s: %w", tag.Name, err)
+		}
+
+		rv = reflect.ValueOf(f)
+	}
+
+	unscale := func(f float64) float64 {
+		raw := (f - tag.Offset) / tag.Scale
+		if tag.Type != TypeFloat32 && tag.Type != TypeFloat64 {
+			raw = math.Round(raw)
+		}
+
+		return raw
+	}
+
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return EncodeValue(tag.Type, unscale(toFloat(rv)), tag.Length)
+	}
+
+	raw := make([]float64, rv.Len())
+	for i := range raw {
+		raw[i] = unscale(toFloat(rv.Index(i)))
+	}
+
+	return EncodeValue(tag.Type, raw, tag.Length)
+}
+
+func toFloat(rv reflect.Value) float64 {
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Interface:
+		return toFloat(rv.Elem())
+	}
+
+	return math.NaN()
+}
+
+// MarshalText 实现encoding.TextMarshaler, 便于在YAML/JSON中以名称表示类型.
+func (t DataType) MarshalText() ([]byte, error) {
+	if _, ok := dataTypeNames[t]; !ok {
+		return nil, fmt.Errorf("unknown data type %d", uint8(t))
+	}
+
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText 实现encoding.TextUnmarshaler.
+func (t *DataType) UnmarshalText(b []byte) error {
+	v, err := ParseDataType(string(b))
+	if err != nil {
+		return err
+	}
+
+	*t = v
+
+	return nil
+}
+
+// TagDB 标签数据库, 通过名称读写PLC, 不必在业务代码中硬编码地址.
+type TagDB struct {
+	mu    sync.RWMutex
+	tags  map[string]*Tag
+	order []string
+	conn  *PlcConn
+}
+
+// NewTagDB 创建标签数据库. conn为nil时只能用于查询标签定义.
+func NewTagDB(conn *PlcConn) *TagDB {
+	return &TagDB{
+		tags:  make(map[string]*Tag),
+		order: make([]string, 0),
+		conn:  conn,
+	}
+}
+
+// Add 添加或覆盖标签.
+func (db *TagDB) Add(tags ...Tag) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := range tags {
+		tag := tags[i]
+		if err := tag.validate(); err != nil {
+			return err
+		}
+
+		if _, ok := db.tags[tag.Name]; !ok {
+			db.order = append(db.order, tag.Name)
+		}
+
+		db.tags[tag.Name] = &tag
+	}
+
+	return nil
+}
+
+// Lookup 按名称查找标签.
+func (db *TagDB) Lookup(name string) (*Tag, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	tag, ok := db.tags[name]
+
+	return tag, ok
+}
+
+// Tags 按添加顺序返回全部标签.
+func (db *TagDB) Tags() []*Tag {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	re := make([]*Tag, 0, len(db.order))
+	for _, name := range db.order {
+		re = append(re, db.tags[name])
+	}
+
+	return re
+}
+
+func (db *TagDB) lookup(name string) (*Tag, error) {
+	if db.conn == nil {
+		return nil, errors.New("nil plc connection")
+	}
+
+	tag, ok := db.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTagNotFound, name)
+	}
+
+	return tag, nil
+}
+
+// Read 按名称读取标签的工程值.
+func (db *TagDB) Read(name string) (interface{}, error) {
+	tag, err := db.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := NewDevice(tag.Address, tag.Words(), db.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dev.Read(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+
+	return tag.Decode(dev.GetValue())
+}
+
+// Item 标签对应的读取地址.
+func (tag *Tag) Item() PlanItem {
+	if tag.IsBit() {
+		return PlanItem{Address: tag.Address}
+	}
+
+	return PlanItem{Address: tag.Address, Words: tag.Words()}
+}
+
+// Plan 为多个标签生成读取计划, names为空时包含全部标签.
+func (db *TagDB) Plan(names ...string) (*ReadPlan, error) {
+	tags, err := db.resolve(names)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]PlanItem, len(tags))
+	for i, tag := range tags {
+		items[i] = tag.Item()
+	}
+
+	return NewPlanner().Plan(items...)
+}
+
+// ReadTags 批量读取多个标签的工程值, 读取按Planner合并为尽量少的请求. names为空时读取全部标签.
+func (db *TagDB) ReadTags(names ...string) (map[string]interface{}, error) {
+	if db.conn == nil {
+		return nil, errors.New("nil plc connection")
+	}
+
+	tags, err := db.resolve(names)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := db.Plan(names...)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := plan.Read(db.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeTags(tags, result)
+}
+
+// DecodeTags 从读取结果中解码多个标签的工程值.
+func DecodeTags(tags []*Tag, result *PlanResult) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(tags))
+
+	for _, tag := range tags {
+		if tag.IsBit() {
+			v, err := result.Bit(tag.Address)
+			if err != nil {
+				return nil, err
+			}
+
+			values[tag.Name] = v
+
+			continue
+		}
+
+		b, err := result.Words(tag.Address, tag.Words())
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := tag.Decode(b)
+		if err != nil {
+			return nil, err
+		}
+
+		values[tag.Name] = v
+	}
+
+	return values, nil
+}
+
+func (db *TagDB) resolve(names []string) ([]*Tag, error) {
+	if len(names) == 0 {
+		return db.Tags(), nil
+	}
+
+	tags := make([]*Tag, len(names))
+
+	for i, name := range names {
+		tag, ok := db.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrTagNotFound, name)
+		}
+
+		tags[i] = tag
+	}
+
+	return tags, nil
+}
+
+// Write 按名称写入标签, 位软元件上的bool按位写入.
+func (db *TagDB) Write(name string, v interface{}) error {
+	tag, err := db.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if tag.IsBit() {
+		b, err := EncodeValue(TypeBool, v, 1)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", name, err)
+		}
+
+		return db.conn.WriteBits([]string{tag.Address}, []bool{b[0] == 1})
+	}
+
+	b, err := tag.Encode(v)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+
+	dev, err := NewDevice(tag.Address, tag.Words(), db.conn)
+	if err != nil {
+		return err
+	}
+
+	dev.SetValue(b)
+
+	if err := dev.Write(); err != nil {
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// LoadYAML 加载YAML格式的标签文件:
+//
+//	tags:
+//	  - name: Line1.Speed
+//	    address: D100
+//	    type: float32
+//	    scale: 0.1
+func (db *TagDB) LoadYAML(r io.Reader) error {
+	var file struct {
+		Tags []Tag `yaml:"tags"`
+	}
+
+	if err := yaml.NewDecoder(r).Decode(&file); err != nil && err != io.EOF {
+		return fmt.Errorf("load yaml tags: %w", err)
+	}
+
+	return db.Add(file.Tags...)
+}
+
+// LoadCSV 加载CSV格式的标签文件, 首行为表头, 可包含name,address,type,length,scale,offset,comment列.
+func (db *TagDB) LoadCSV(r io.Reader) error {
+	rows, err := readTagRecords(r)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	col := headerIndex(rows[0])
+	if col["name"] < 0 || col["address"] < 0 {
+		return errors.New("load csv tags: need name and address columns")
+	}
+
+	tags := make([]Tag, 0, len(rows)-1)
+
+	for i, row := range rows[1:] {
+		get := func(key string) string {
+			if c := col[key]; c >= 0 && c < len(row) {
+				return strings.TrimSpace(row[c])
+			}
+
+			return ""
+		}
+
+		if get("name") == "" && get("address") == "" {
+			continue
+		}
+
+		tag := Tag{
+			Name:    get("name"),
+			Address: get("address"),
+			Comment: get("comment"),
+		}
+
+		if err := parseTagColumns(&tag, get("type"), get("length"), get("scale"), get("offset")); err != nil {
+			return fmt.Errorf("load csv tags, line %d: %w", i+2, err)
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return db.Add(tags...)
+}
+
+func parseTagColumns(tag *Tag, typ, length, scale, offset string) error {
+	var err error
+
+	if typ != "" {
+		if tag.Type, err = ParseDataType(typ); err != nil {
+			return err
+		}
+	}
+
+	if length != "" {
+		if tag.Length, err = strconv.Atoi(length); err != nil {
+			return fmt.Errorf("invalid length %q", length)
+		}
+	}
+
+	if scale != "" {
+		if tag.Scale, err = strconv.ParseFloat(scale, 64); err != nil {
+			return fmt.Errorf("invalid scale %q", scale)
+		}
+	}
+
+	if offset != "" {
+		if tag.Offset, err = strconv.ParseFloat(offset, 64); err != nil {
+			return fmt.Errorf("invalid offset %q", offset)
+		}
+	}
+
+	return nil
+}
+
+// gxArrayType 匹配GX Works中的数组与字符串类型, 如 "Word [Signed](0..9)", "String(32)".
+var gxArrayType = regexp.MustCompile(`^(.*?)\s*\((\d+)(?:\.\.(\d+))?\)$`)
+
+// LoadGXWorks 加载GX Works2/3导出的全局标签或软元件注释(CSV或制表符分隔).
+// 全局标签使用标签名作为名称; 软元件注释使用注释作为名称.
+// 未分配软元件的标签被忽略; 数据类型不受支持(定时器、结构体等)的标签被跳过,
+// 其余标签加载后以*SkippedTagsError返回跳过的标签.
+func (db *TagDB) LoadGXWorks(r io.Reader) error {
+	rows, err := readTagRecords(r)
+	if err != nil {
+		return err
+	}
+
+	var (
+		col     map[string]int
+		labels  bool
+		tags    = make([]Tag, 0)
+		skipped []SkippedTag
+	)
+
+	for i, row := range rows {
+		if col == nil {
+			h := headerIndex(row)
+
+			switch {
+			case h["label name"] >= 0 && (h["assign (device/label)"] >= 0 || h["device"] >= 0):
+				col, labels = h, true
+			case (h["device name"] >= 0 || h["device"] >= 0) && h["comment"] >= 0:
+				col = h
+			}
+
+			continue
+		}
+
+		get := func(keys ...string) string {
+			for _, key := range keys {
+				if c, ok := col[key]; ok && c >= 0 && c < len(row) {
+					return strings.TrimSpace(row[c])
+				}
+			}
+
+			return ""
+		}
+
+		tag := Tag{}
+
+		if labels {
+			tag.Name = get("label name")
+			tag.Address = get("assign (device/label)", "device")
+			tag.Comment = get("comment")
+
+			if tag.Name == "" || tag.Address == "" {
+				continue
+			}
+
+			// 定时器、计数器、结构体等类型无法按字读写, 跳过
+			if err := parseGXType(&tag, get("data type")); err != nil {
+				skipped = append(skipped, SkippedTag{Line: i + 1, Name: tag.Name, Type: get("data type")})
+
+				continue
+			}
+		} else {
+			tag.Address = get("device name", "device")
+			tag.Name = get("comment")
+
+			if tag.Name == "" || tag.Address == "" {
+				continue
+			}
+		}
+
+		tags = append(tags, tag)
+	}
+
+	if col == nil {
+		return errors.New("load gx works: no label or device comment header found")
+	}
+
+	if err := db.Add(tags...); err != nil {
+		return err
+	}
+
+	if len(skipped) > 0 {
+		return &SkippedTagsError{Tags: skipped}
+	}
+
+	return nil
+}
+
+func parseGXType(tag *Tag, typ string) error {
+	if typ == "" {
+		return nil
+	}
+
+	if m := gxArrayType.FindStringSubmatch(typ); m != nil {
+		lo, _ := strconv.Atoi(m[2])
+		tag.Length = lo
+
+		if m[3] != "" {
+			hi, _ := strconv.Atoi(m[3])
+			tag.Length = hi - lo + 1
+		}
+
+		typ = m[1]
+	}
+
+	t, err := ParseDataType(typ)
+	if err != nil {
+		return err
+	}
+
+	tag.Type = t
+
+	return nil
+}
+
+// readTagRecords 读取CSV, 自动识别逗号或制表符分隔, 忽略UTF-8 BOM.
+func readTagRecords(r io.Reader) ([][]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimPrefix(string(data), "\ufeff")
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	if line, _, _ := strings.Cut(text, "\n"); strings.Count(line, "\t") > strings.Count(line, ",") {
+		reader.Comma = '\t'
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read tag records: %w", err)
+	}
+
+	return rows, nil
+}
+
+// headerIndex 返回表头各列(小写)的位置, 常用列缺失时为-1.
+func headerIndex(row []string) map[string]int {
+	col := map[string]int{
+		"name": -1, "address": -1, "type": -1, "length": -1, "scale": -1, "offset": -1, "comment": -1,
+		"label name": -1, "assign (device/label)": -1, "device": -1, "device name": -1, "data type": -1,
+	}
+
+	for i, h := range row {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+
+	return col
+}
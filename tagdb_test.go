@@ -0,0 +1,94 @@
+package melsec
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTagDBLoad(t *testing.T) {
+	db := NewTagDB(nil)
+
+	csvTags := "name,address,type,length,scale,offset,comment\n" +
+		"Line1.Speed,D100,int16,,0.1,,speed\n" +
+		"Line1.Start,M20,,,,,\n" +
+		"Line1.Lot,D200,string,10,,,\n"
+	if err := db.LoadCSV(strings.NewReader(csvTags)); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := "\"Global Label Setting\"\t\"Global\"\n" +
+		"\"Label Name\"\t\"Data Type\"\t\"Class\"\t\"Assign (Device/Label)\"\t\"Comment\"\n" +
+		"\"Temp\"\t\"FLOAT (Single Precision)\"\t\"VAR_GLOBAL\"\t\"D300\"\t\"\"\n" +
+		"\"Counts\"\t\"Word [Signed](0..9)\"\t\"VAR_GLOBAL\"\t\"D400\"\t\"\"\n" +
+		"\"Timer1\"\t\"Timer\"\t\"VAR_GLOBAL\"\t\"T0\"\t\"\"\n" +
+		"\"Auto\"\t\"Bit\"\t\"VAR_GLOBAL\"\t\"\"\t\"\"\n"
+	// 不支持的数据类型跳过并报告, 其余标签照常加载
+	var skipped *SkippedTagsError
+	if err := db.LoadGXWorks(strings.NewReader(labels)); !errors.As(err, &skipped) || !errors.Is(err, ErrTagsSkipped) {
+		t.Fatalf("want skipped tags, got %v", err)
+	}
+
+	if want := []SkippedTag{{Line: 5, Name: "Timer1", Type: "Timer"}}; !reflect.DeepEqual(skipped.Tags, want) {
+		t.Errorf("want skipped %v, got %v", want, skipped.Tags)
+	}
+
+	comments := "\"Device Name\",\"Comment\"\n\"X10\",\"Door.Closed\"\n\"D10\",\"\"\n"
+	if err := db.LoadGXWorks(strings.NewReader(comments)); err != nil {
+		t.Fatal(err)
+	}
+
+	yamlTags := "tags:\n  - name: Line2.Total\n    address: r100\n    type: uint32\n"
+	if err := db.LoadYAML(strings.NewReader(yamlTags)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Tag{
+		{Name: "Line1.Speed", Address: "D100", Type: TypeInt16, Length: 1, Scale: 0.1, Comment: "speed"},
+		{Name: "Line1.Start", Address: "M20", Type: TypeBool, Length: 1},
+		{Name: "Line1.Lot", Address: "D200", Type: TypeString, Length: 10},
+		{Name: "Temp", Address: "D300", Type: TypeFloat32, Length: 1},
+		{Name: "Counts", Address: "D400", Type: TypeInt16, Length: 10},
+		{Name: "Door.Closed", Address: "X10", Type: TypeBool, Length: 1},
+		{Name: "Line2.Total", Address: "R100", Type: TypeUint32, Length: 1},
+	}
+
+	got := make([]Tag, 0)
+	for _, tag := range db.Tags() {
+		got = append(got, *tag)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	if err := db.Add(Tag{Name: "Bad", Address: "K10"}); err == nil {
+		t.Error("want error for invalid address")
+	}
+}
+
+func TestTagScale(t *testing.T) {
+	tag := Tag{Name: "Speed", Address: "D100", Type: TypeInt16, Scale: 0.1, Offset: -10}
+	if err := tag.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := tag.Encode(12.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(b, []byte{225, 0}) {
+		t.Fatalf("want [225 0], got %v", b)
+	}
+
+	v, err := tag.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f, ok := v.(float64); !ok || f < 12.49 || f > 12.51 {
+		t.Fatalf("want 12.5, got %v", v)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"reflect"
 	"strconv"
 	"strings"
 	"unicode"
@@ -44,6 +46,11 @@ func splitComponentName(component string) (string, string) {
 		return unicode.IsDigit(r)
 	})
 
+	// 没有数字时(如"M"、十六进制编号"XA")从整个名称开始查找
+	if index == -1 {
+		index = len(component)
+	}
+
 LOOP:
 	for {
 		switch index {
@@ -120,6 +127,28 @@ func encodeComponentName(componentName string) (McMessage, int) {
 		return TCComponent, Base10
 	case "cn":
 		return CNComponent, Base10
+	case "cs":
+		return CSComponent, Base10
+	case "cc":
+		return CCComponent, Base10
+	case "sb":
+		return SBComponent, Base16
+	case "sw":
+		return SWComponent, Base16
+	case "dx":
+		return DXComponent, Base16
+	case "dy":
+		return DYComponent, Base16
+	case "z":
+		return ZComponent, Base10
+	case "zr":
+		return ZRComponent, Base10
+	case "sts":
+		return STSComponent, Base10
+	case "stc":
+		return STCComponent, Base10
+	case "stn":
+		return STNComponent, Base10
 	default:
 		return nil, -1
 	}
@@ -130,9 +159,9 @@ func encodeComponentName(componentName string) (McMessage, int) {
 // word: 0, 1
 func componentBitSize(componentName string) (int8, int8) {
 	switch strings.ToLower(componentName) {
-	case "m", "x", "y", "b":
+	case "m", "x", "y", "l", "f", "v", "b", "sm", "sb", "dx", "dy", "ts", "tc", "cs", "cc", "sts", "stc":
 		return 1, 0
-	case "d", "w", "r":
+	case "d", "w", "r", "zr", "sd", "sw", "z", "tn", "cn", "stn":
 		return 0, 1
 	}
 
@@ -151,3 +180,454 @@ func encodeUint(num uint64, count int) (McMessage, error) {
 
 	return buf.Bytes()[:count], nil
 }
+
+// formatComponent 由软元件类型与编号还原软元件名称, 编号按该类型的进制输出.
+func formatComponent(name string, no uint64) (string, error) {
+	_, base := encodeComponentName(name)
+	if base == -1 {
+		return "", fmt.Errorf("错误的melsec点位类型, %s", name)
+	}
+
+	return strings.ToUpper(name) + strings.ToUpper(strconv.FormatUint(no, base)), nil
+}
+
+// parseComponent 拆分软元件名称, 返回类型与编号.
+func parseComponent(component string) (string, uint64, error) {
+	name, no := splitComponentName(component)
+	if name == "" {
+		return "", 0, fmt.Errorf("错误的melsec点位类型, %s", component)
+	}
+
+	_, base := encodeComponentName(name)
+	if base == -1 {
+		return "", 0, fmt.Errorf("wrong component name, %s", component)
+	}
+
+	n, err := strconv.ParseUint(no, base, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("错误的软元件编号, %s: %w", component, err)
+	}
+
+	return name, n, nil
+}
+
+// isBitComponent 判断软元件是否为位软元件.
+func isBitComponent(name string) bool {
+	bit, _ := componentBitSize(name)
+
+	return bit == 1
+}
+
+// DeviceInfo 软元件类型的名称、二进制代码、编号进制以及是否为位软元件.
+type DeviceInfo struct {
+	Name string
+	Code byte
+	Base int
+	Bit  bool
+}
+
+var deviceNames = []string{
+	"X", "Y", "M", "L", "F", "V", "B", "SM", "SB", "DX", "DY", "TS", "TC", "CS", "CC", "STS", "STC",
+	"D", "W", "R", "ZR", "SD", "SW", "Z", "TN", "CN", "STN",
+}
+
+// Devices 返回支持的全部软元件类型.
+func Devices() []DeviceInfo {
+	re := make([]DeviceInfo, len(deviceNames))
+	for i, name := range deviceNames {
+		re[i], _ = LookupDevice(name)
+	}
+
+	return re
+}
+
+// LookupDevice 按名称(不区分大小写)查找软元件类型.
+func LookupDevice(name string) (DeviceInfo, bool) {
+	code, base := encodeComponentName(name)
+	if base == -1 {
+		return DeviceInfo{}, false
+	}
+
+	return DeviceInfo{Name: strings.ToUpper(name), Code: code[0], Base: base, Bit: isBitComponent(name)}, true
+}
+
+// LookupDeviceCode 按二进制代码查找软元件类型.
+func LookupDeviceCode(code byte) (DeviceInfo, bool) {
+	for _, name := range deviceNames {
+		if c, _ := encodeComponentName(name); c[0] == code {
+			return LookupDevice(name)
+		}
+	}
+
+	return DeviceInfo{}, false
+}
+
+// ParseAddress 解析软元件地址, 如"D100"、"X1F", 返回软元件类型与编号.
+func ParseAddress(address string) (DeviceInfo, uint64, error) {
+	name, no, err := parseComponent(address)
+	if err != nil {
+		return DeviceInfo{}, 0, err
+	}
+
+	info, _ := LookupDevice(name)
+
+	return info, no, nil
+}
+
+// FormatAddress 由软元件类型与编号生成地址, 编号按该类型的进制输出.
+func FormatAddress(info DeviceInfo, no uint64) string {
+	name, _ := formatComponent(info.Name, no)
+
+	return name
+}
+
+// DataType 标签的数据类型, 决定其在PLC中占用的字数及编解码方式.
+type DataType uint8
+
+const (
+	TypeBool DataType = iota + 1
+	TypeInt16
+	TypeUint16
+	TypeInt32
+	TypeUint32
+	TypeFloat32
+	TypeFloat64
+	TypeString
+)
+
+var dataTypeNames = map[DataType]string{
+	TypeBool:    "bool",
+	TypeInt16:   "int16",
+	TypeUint16:  "uint16",
+	TypeInt32:   "int32",
+	TypeUint32:  "uint32",
+	TypeFloat32: "float32",
+	TypeFloat64: "float64",
+	TypeString:  "string",
+}
+
+func (t DataType) String() string {
+	if s, ok := dataTypeNames[t]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("DataType(%d)", uint8(t))
+}
+
+// ParseDataType 解析数据类型名称, 同时接受GX Works中的常用写法(Bit, Word, Double Word, FLOAT等).
+func ParseDataType(s string) (DataType, error) {
+	switch strings.ToLower(strings.Join(strings.Fields(s), " ")) {
+	case "bool", "bit":
+		return TypeBool, nil
+	case "int16", "int", "word [signed]", "word":
+		return TypeInt16, nil
+	case "uint16", "uint", "word [unsigned]/bit string [16-bit]", "word [unsigned]":
+		return TypeUint16, nil
+	case "int32", "dint", "double word [signed]", "double word", "dword":
+		return TypeInt32, nil
+	case "uint32", "udint", "double word [unsigned]/bit string [32-bit]", "double word [unsigned]":
+		return TypeUint32, nil
+	case "float32", "float", "real", "float (single precision)":
+		return TypeFloat32, nil
+	case "float64", "double", "lreal", "float (double precision)":
+		return TypeFloat64, nil
+	case "string":
+		return TypeString, nil
+	}
+
+	return 0, fmt.Errorf("unknown data type %q", s)
+}
+
+// Words 返回该类型的length个元素占用的字数, 字符串的length为字符数.
+func (t DataType) Words(length int) int {
+	if length <= 0 {
+		length = 1
+	}
+
+	switch t {
+	case TypeBool, TypeInt16, TypeUint16:
+		return length
+	case TypeInt32, TypeUint32, TypeFloat32:
+		return length * 2
+	case TypeFloat64:
+		return length * 4
+	case TypeString:
+		return (length + 1) / 2
+	}
+
+	return 0
+}
+
+// DecodeValue 将PLC中的字数据解码为Go值. 字符串返回string, 其余类型length大于1时返回对应类型的切片.
+// 位类型按字解码, 字不为0时为true.
+func DecodeValue(t DataType, b []byte, length int) (interface{}, error) {
+	if length <= 0 {
+		length = 1
+	}
+
+	if len(b) < t.Words(length)*2 {
+		return nil, fmt.Errorf("decode %s: need %d bytes, got %d", t, t.Words(length)*2, len(b))
+	}
+
+	if t == TypeString {
+		b = b[:length]
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+
+		return string(b), nil
+	}
+
+	size := t.Words(1) * 2
+	values := make([]interface{}, length)
+
+	for i := range values {
+		v, err := decodeScalar(t, b[i*size:(i+1)*size])
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = v
+	}
+
+	if length == 1 {
+		return values[0], nil
+	}
+
+	return sliceOf(t, values), nil
+}
+
+func decodeScalar(t DataType, b []byte) (interface{}, error) {
+	switch t {
+	case TypeBool:
+		return binary.LittleEndian.Uint16(b) != 0, nil
+	case TypeInt16:
+		return int16(binary.LittleEndian.Uint16(b)), nil
+	case TypeUint16:
+		return binary.LittleEndian.Uint16(b), nil
+	case TypeInt32:
+		return int32(binary.LittleEndian.Uint32(b)), nil
+	case TypeUint32:
+		return binary.LittleEndian.Uint32(b), nil
+	case TypeFloat32:
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
+	case TypeFloat64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	}
+
+	return nil, fmt.Errorf("unknown data type %s", t)
+}
+
+func sliceOf(t DataType, values []interface{}) interface{} {
+	switch t {
+	case TypeBool:
+		re := make([]bool, len(values))
+		for i := range values {
+			re[i] = values[i].(bool)
+		}
+
+		return re
+	case TypeInt16:
+		re := make([]int16, len(values))
+		for i := range values {
+			re[i] = values[i].(int16)
+		}
+
+		return re
+	case TypeUint16:
+		re := make([]uint16, len(values))
+		for i := range values {
+			re[i] = values[i].(uint16)
+		}
+
+		return re
+	case TypeInt32:
+		re := make([]int32, len(values))
+		for i := range values {
+			re[i] = values[i].(int32)
+		}
+
+		return re
+	case TypeUint32:
+		re := make([]uint32, len(values))
+		for i := range values {
+			re[i] = values[i].(uint32)
+		}
+
+		return re
+	case TypeFloat32:
+		re := make([]float32, len(values))
+		for i := range values {
+			re[i] = values[i].(float32)
+		}
+
+		return re
+	case TypeFloat64:
+		re := make([]float64, len(values))
+		for i := range values {
+			re[i] = values[i].(float64)
+		}
+
+		return re
+	}
+
+	return values
+}
+
+// EncodeValue 将Go值编码为PLC中的字数据, 接受任意数值类型、bool、string及其切片.
+func EncodeValue(t DataType, v interface{}, length int) ([]byte, error) {
+	if length <= 0 {
+		length = 1
+	}
+
+	buff := make([]byte, t.Words(length)*2)
+
+	if t == TypeString {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("encode %s: unsupported value %T", t, v)
+		}
+
+		if len(s) > length {
+			return nil, fmt.Errorf("encode %s: %q longer than %d", t, s, length)
+		}
+
+		copy(buff, s)
+
+		return buff, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		if length != 1 {
+			return nil, fmt.Errorf("encode %s: need %d values, got 1", t, length)
+		}
+
+		return buff, encodeScalar(t, rv, buff)
+	}
+
+	if rv.Len() != length {
+		return nil, fmt.Errorf("encode %s: need %d values, got %d", t, length, rv.Len())
+	}
+
+	size := t.Words(1) * 2
+	for i := 0; i < length; i++ {
+		if err := encodeScalar(t, rv.Index(i), buff[i*size:(i+1)*size]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buff, nil
+}
+
+func encodeScalar(t DataType, rv reflect.Value, b []byte) error {
+	var (
+		i     int64
+		f     float64
+		exact bool // i是否为原值
+		err   error
+	)
+
+	if rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		if rv.Bool() {
+			i, f = 1, 1
+		}
+
+		exact = true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i = rv.Int()
+		f = float64(i)
+		exact = true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f = float64(rv.Uint())
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			i, exact = int64(u), true
+		}
+	case reflect.Float32, reflect.Float64:
+		f = rv.Float()
+	case reflect.String:
+		if t == TypeBool {
+			if on, e := strconv.ParseBool(rv.String()); e == nil {
+				return encodeScalar(t, reflect.ValueOf(on), b)
+			}
+		}
+
+		if n, e := strconv.ParseInt(rv.String(), 10, 64); e == nil {
+			return encodeScalar(t, reflect.ValueOf(n), b)
+		}
+
+		f, err = strconv.ParseFloat(rv.String(), 64)
+		if err != nil {
+			return fmt.Errorf("encode %s: %w", t, err)
+		}
+	default:
+		return fmt.Errorf("encode %s: unsupported value %s", t, rv.Type())
+	}
+
+	if !exact && t != TypeBool && t != TypeFloat32 && t != TypeFloat64 {
+		if i, err = integer(t, f); err != nil {
+			return err
+		}
+	}
+
+	switch t {
+	case TypeBool:
+		if f != 0 && f != 1 {
+			return fmt.Errorf("encode %s: %v is not 0 or 1", t, f)
+		}
+
+		if f == 1 {
+			binary.LittleEndian.PutUint16(b, 1)
+		}
+	case TypeInt16:
+		if i < math.MinInt16 || i > math.MaxInt16 {
+			return fmt.Errorf("encode %s: %d out of range", t, i)
+		}
+
+		binary.LittleEndian.PutUint16(b, uint16(i))
+	case TypeUint16:
+		if i < 0 || i > math.MaxUint16 {
+			return fmt.Errorf("encode %s: %d out of range", t, i)
+		}
+
+		binary.LittleEndian.PutUint16(b, uint16(i))
+	case TypeInt32:
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return fmt.Errorf("encode %s: %d out of range", t, i)
+		}
+
+		binary.LittleEndian.PutUint32(b, uint32(i))
+	case TypeUint32:
+		if i < 0 || i > math.MaxUint32 {
+			return fmt.Errorf("encode %s: %d out of range", t, i)
+		}
+
+		binary.LittleEndian.PutUint32(b, uint32(i))
+	case TypeFloat32:
+		binary.LittleEndian.PutUint32(b, math.Float32bits(float32(f)))
+	case TypeFloat64:
+		binary.LittleEndian.PutUint64(b, math.Float64bits(f))
+	default:
+		return fmt.Errorf("encode: unknown data type %s", t)
+	}
+
+	return nil
+}
+
+// integer 返回f对应的整数, f不是整数或超出int64范围时返回错误.
+func integer(t DataType, f float64) (int64, error) {
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("encode %s: %v is not an integer", t, f)
+	}
+
+	if f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, fmt.Errorf("encode %s: %v out of range", t, f)
+	}
+
+	return int64(f), nil
+}
@@ -129,3 +129,32 @@ func Test_splitComponentName1(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAddress(t *testing.T) {
+	info, no, err := ParseAddress("x1f")
+	if err != nil || info.Name != "X" || info.Code != 0x9C || !info.Bit || no != 0x1F {
+		t.Fatalf("unexpected %+v %d %v", info, no, err)
+	}
+
+	if FormatAddress(info, no) != "X1F" {
+		t.Errorf("want X1F, got %s", FormatAddress(info, no))
+	}
+
+	if _, _, err := ParseAddress("K10"); err == nil {
+		t.Error("want error for K10")
+	}
+
+	if _, _, err := ParseAddress("M"); err == nil {
+		t.Error("want error for M without number")
+	}
+
+	if _, no, err := ParseAddress("XA"); err != nil || no != 0xA {
+		t.Errorf("want XA = X 0xa, got %d %v", no, err)
+	}
+
+	for _, d := range Devices() {
+		if got, ok := LookupDeviceCode(d.Code); !ok || got != d {
+			t.Errorf("code %#x: want %+v, got %+v", d.Code, d, got)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package melsec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrVerify = errors.New("write verify failed")
+
+// WordMismatch 回读时一个字的期望值与实际值.
+type WordMismatch struct {
+	Address  string
+	Expected uint16
+	Actual   uint16
+}
+
+// VerifyError 写入后回读的值与写入的值不一致.
+type VerifyError struct {
+	Attempts   int
+	Mismatches []WordMismatch
+}
+
+func (e *VerifyError) Error() string {
+	const limit = 8
+
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "%s after %d attempts:", ErrVerify, e.Attempts)
+
+	for i, m := range e.Mismatches {
+		if i == limit {
+			fmt.Fprintf(&b, " ... (%d more)", len(e.Mismatches)-limit)
+
+			break
+		}
+
+		fmt.Fprintf(&b, " %s expected 0x%04x actual 0x%04x;", m.Address, m.Expected, m.Actual)
+	}
+
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+func (e *VerifyError) Is(target error) bool {
+	return target == ErrVerify
+}
+
+// compareWords 逐字比较, 返回不一致的字.
+func compareWords(name string, expected, actual []byte) []WordMismatch {
+	if bytes.Equal(expected, actual) {
+		return nil
+	}
+
+	comp, no, err := parseComponent(name)
+	if err != nil {
+		return []WordMismatch{{Address: name}}
+	}
+
+	unit := uint64(1)
+	if isBitComponent(comp) {
+		unit = 16
+	}
+
+	re := make([]WordMismatch, 0)
+
+	for i := 0; i*2+1 < len(expected); i++ {
+		var want, got uint16
+
+		want = binary.LittleEndian.Uint16(expected[i*2:])
+		if i*2+1 < len(actual) {
+			got = binary.LittleEndian.Uint16(actual[i*2:])
+		}
+
+		if want != got || i*2+1 >= len(actual) {
+			address, _ := formatComponent(comp, no+uint64(i)*unit)
+			re = append(re, WordMismatch{Address: address, Expected: want, Actual: got})
+		}
+	}
+
+	return re
+}
+
+// WriteVerified 写入后回读同一范围并比较, 不一致时最多重新写入retries次.
+// 仍不一致时返回*VerifyError, 其中列出每个不一致字的期望值与实际值. 写入本身失败时直接返回该错误.
+func (dev *Device) WriteVerified(retries int) error {
+	if dev.mValue == nil {
+		return nil
+	}
+
+	expected := append([]byte{}, dev.mValue...)
+
+	var mismatches []WordMismatch
+
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		dev.mValue = append([]byte{}, expected...)
+
+		if err := dev.Write(); err != nil {
+			return err
+		}
+
+		if err := dev.Read(); err != nil {
+			return fmt.Errorf("verify read back: %w", err)
+		}
+
+		if mismatches = compareWords(dev.name, expected, dev.value); len(mismatches) == 0 {
+			return nil
+		}
+	}
+
+	return &VerifyError{Attempts: retries + 1, Mismatches: mismatches}
+}
+
+// WriteVerified 写入后回读全部区块并比较, 不一致时最多重新写入retries次.
+// 仍不一致时返回*VerifyError. 写入本身失败时直接返回该错误.
+func (dev *MultiDevice) WriteVerified(retries int) error {
+	if dev.mValue == nil {
+		return nil
+	}
+
+	expected := make([][]byte, len(dev.mValue))
+	for i := range dev.mValue {
+		expected[i] = append([]byte{}, dev.mValue[i]...)
+	}
+
+	var mismatches []WordMismatch
+
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		values := make([][]byte, len(expected))
+		for i := range expected {
+			values[i] = append([]byte{}, expected[i]...)
+		}
+
+		dev.SetValue(values)
+
+		if err := dev.Write(); err != nil {
+			return err
+		}
+
+		if err := dev.Read(); err != nil {
+			return fmt.Errorf("verify read back: %w", err)
+		}
+
+		mismatches = mismatches[:0]
+		for i := range expected {
+			mismatches = append(mismatches, compareWords(dev.name[i], expected[i], dev.value[i])...)
+		}
+
+		if len(mismatches) == 0 {
+			return nil
+		}
+	}
+
+	return &VerifyError{Attempts: retries + 1, Mismatches: mismatches}
+}
@@ -0,0 +1,78 @@
+package melsec
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWriteVerified(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	// PLC程序在前两次写入后把D101改回0
+	overwrites := 2
+	plc.after = func(cmd uint16) {
+		if cmd == 0x1401 && overwrites > 0 {
+			overwrites--
+			binary.LittleEndian.PutUint16(plc.words(0xA8, 101, 1), 0)
+		}
+	}
+
+	dev, err := NewDevice("D100", 2, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.SetValue([]byte{1, 0, 2, 0})
+
+	err = dev.WriteVerified(1)
+
+	var verr *VerifyError
+	if !errors.As(err, &verr) || !errors.Is(err, ErrVerify) {
+		t.Fatalf("want verify error, got %v", err)
+	}
+
+	if verr.Attempts != 2 || len(verr.Mismatches) != 1 || verr.Mismatches[0] != (WordMismatch{Address: "D101", Expected: 2, Actual: 0}) {
+		t.Fatalf("unexpected mismatch %+v", verr)
+	}
+
+	if !strings.Contains(err.Error(), "D101 expected 0x0002 actual 0x0000") {
+		t.Errorf("unexpected message %s", err)
+	}
+
+	dev.SetValue([]byte{1, 0, 2, 0})
+
+	if err := dev.WriteVerified(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiDeviceWriteVerified(t *testing.T) {
+	plc, conn := newFakePLC(t)
+
+	overwrites := 1
+	plc.after = func(cmd uint16) {
+		if cmd == 0x1406 && overwrites > 0 {
+			overwrites--
+			binary.LittleEndian.PutUint16(plc.words(0xAF, 5, 1), 0xFFFF)
+		}
+	}
+
+	dev, err := NewMultiDevice(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.AddBlock("D0", 1)
+	dev.AddBlock("R4", 2)
+	dev.SetValue([][]byte{{9, 0}, {1, 0, 2, 0}})
+
+	if err := dev.WriteVerified(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if overwrites != 0 || len(plc.requests) != 4 {
+		t.Errorf("want one retry (4 requests), got %d", len(plc.requests))
+	}
+}